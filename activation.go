@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const listenFDsStart = 3
+
+// activatedListener returns the control listener systemd passed in with
+// socket activation, or nil when the daemon wasn't started that way. With
+// several sockets, the one named "control" with FileDescriptorName= is
+// used. The variables are cleared so that programs the daemon runs don't
+// take the sockets for their own.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	index := 0
+	if count > 1 {
+		index = -1
+		for i, name := range names {
+			if name == "control" && i < count {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("systemd passed %d sockets and none is named \"control\"", count)
+		}
+	}
+
+	name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+index)
+	if index < len(names) && names[index] != "" {
+		name = names[index]
+	}
+	file := os.NewFile(uintptr(listenFDsStart+index), name)
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("error using socket %s from systemd: %w", name, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,113 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestActivationHelper stands in for a socket-activated daemon when run by
+// runActivated: it takes its listener from systemd's variables and answers
+// one connection with "accepted", or prints why it has none.
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv("ACTIVATION_HELPER") == "" {
+		t.Skip("only run by the socket activation tests")
+	}
+	// systemd sets LISTEN_PID after forking, which exec.Cmd can't do.
+	if os.Getenv("LISTEN_PID") == "self" {
+		os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	}
+	listener, err := activatedListener()
+	switch {
+	case err != nil:
+		fmt.Print("error: ", err)
+	case listener == nil:
+		fmt.Print("no listener")
+	default:
+		if os.Getenv("LISTEN_FDS") != "" {
+			fmt.Print("variables left set")
+			return
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Print("error: ", err)
+			return
+		}
+		conn.Write([]byte("accepted"))
+		conn.Close()
+		fmt.Print("served")
+	}
+}
+
+// runActivated runs the helper with the listeners passed in as file
+// descriptors 3 and on, dials the one at index answer, if any, and returns
+// what the helper printed and what it replied.
+func runActivated(t *testing.T, env []string, count, answer int) (string, string) {
+	t.Helper()
+	var listeners []*net.TCPListener
+	var files []*os.File
+	for i := 0; i < count; i++ {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		listeners, files = append(listeners, l), append(files, f)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(os.Environ(), append(env, "ACTIVATION_HELPER=1", fmt.Sprintf("LISTEN_FDS=%d", count))...)
+	cmd.ExtraFiles = files
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	reply := ""
+	if answer >= 0 {
+		conn, err := net.Dial("tcp", listeners[answer].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(conn)
+		conn.Close()
+		reply = string(data)
+	}
+	cmd.Wait()
+	printed, _, _ := strings.Cut(out.String(), "\n")
+	return strings.TrimSuffix(printed, "PASS"), reply
+}
+
+func TestSocketActivation(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		env           []string
+		count, answer int
+		printed       string
+	}{
+		{"one socket", []string{"LISTEN_PID=self"}, 1, 0, "served"},
+		{"named control socket", []string{"LISTEN_PID=self", "LISTEN_FDNAMES=metrics:control"}, 2, 1, "served"},
+		{"no control socket", []string{"LISTEN_PID=self", "LISTEN_FDNAMES=metrics:admin"}, 2, -1, `error: systemd passed 2 sockets and none is named "control"`},
+		{"another process's sockets", []string{"LISTEN_PID=1"}, 1, -1, "no listener"},
+	} {
+		printed, reply := runActivated(t, test.env, test.count, test.answer)
+		if printed != test.printed {
+			t.Errorf("%s: helper printed %q, want %q", test.name, printed, test.printed)
+		}
+		if test.answer >= 0 && reply != "accepted" {
+			t.Errorf("%s: the socket answered %q", test.name, reply)
+		}
+	}
+}
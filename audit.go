@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// auditRecord is one entry of the audit log. Hash is the sha256 of the
+// record's JSON encoding with Hash left empty, and Prev is the hash of the
+// record before it, so editing, removing or reordering entries breaks the
+// chain from that point on.
+type auditRecord struct {
+	Seq         int64     `json:"seq"`
+	Time        time.Time `json:"time"`
+	TransferID  string    `json:"transfer_id"`
+	User        string    `json:"user"`
+	Host        string    `json:"host"`
+	PID         int       `json:"pid"`
+	Action      string    `json:"action"`
+	Status      string    `json:"status"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination,omitempty"`
+	Bytes       int64     `json:"bytes"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Prev        string    `json:"prev"`
+	Hash        string    `json:"hash"`
+}
+
+func (r auditRecord) digest() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog appends hash-chained records to a JSON lines file. Unlike the
+// seen database it is never rewritten or compacted.
+type auditLog struct {
+	path string
+	user string
+	host string
+
+	mu   sync.Mutex
+	seq  int64
+	last string
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path, user: "unknown", host: "unknown"}
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		a.host = host
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+	if last != nil {
+		var record auditRecord
+		if err := json.Unmarshal(last, &record); err != nil || record.Hash == "" {
+			return nil, fmt.Errorf("audit log %s ends with a damaged record", path)
+		}
+		a.seq, a.last = record.Seq, record.Hash
+	}
+	return a, nil
+}
+
+func (a *auditLog) add(r *transferResult) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record := auditRecord{
+		Seq:         a.seq + 1,
+		Time:        time.Now().UTC(),
+		TransferID:  r.ID,
+		User:        a.user,
+		Host:        a.host,
+		PID:         os.Getpid(),
+		Action:      r.verb(),
+		Status:      r.Status,
+		Source:      r.Source,
+		Destination: r.Destination,
+		Bytes:       r.Bytes,
+		SHA256:      r.SHA256,
+		Error:       r.Error,
+		Prev:        a.last,
+	}
+	hash, err := record.digest()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	a.seq, a.last = record.Seq, record.Hash
+	return nil
+}
+
+// runAudit implements the audit subcommand: audit [file]. It checks that
+// every record's hash matches its contents and that the chain is unbroken.
+func runAudit(opts *options, args []string) error {
+	path := opts.auditLog
+	switch len(args) {
+	case 0:
+	case 1:
+		path = args[0]
+	default:
+		return errors.New("usage: audit [file]")
+	}
+	if path == "" {
+		return errors.New("no audit log given")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer file.Close()
+
+	var prev string
+	var seq int64
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: invalid record: %w", line, err)
+		}
+		hash, err := record.digest()
+		if err != nil {
+			return err
+		}
+		switch {
+		case hash != record.Hash:
+			return fmt.Errorf("line %d: record was modified", line)
+		case record.Prev != prev:
+			return fmt.Errorf("line %d: chain is broken; a record before it was removed or changed", line)
+		case record.Seq != seq+1:
+			return fmt.Errorf("line %d: expected sequence number %d, found %d", line, seq+1, record.Seq)
+		}
+		prev, seq = record.Hash, record.Seq
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+	fmt.Printf("%s: %d records, chain intact\n", path, seq)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLogRecordsTransfers(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// A second run continues the chain the first one left.
+	for _, name := range []string{"a.txt", "b.txt"} {
+		opts := newTestOptions(t, "-audit-log", path, "-retry-on", "none")
+		if opts.audit, err = openAuditLog(path); err != nil {
+			t.Fatal(err)
+		}
+		runBatch(opts, []string{"tcp://" + server.addr() + "/" + name, "tcp://" + refused.Addr().String() + "/gone.txt"}, nil, opts.log)
+	}
+
+	records := readAuditRecords(t, path)
+	var got []string
+	for i, r := range records {
+		got = append(got, r.Action+" "+r.Status+" "+filepath.Base(r.Source))
+		if r.Seq != int64(i+1) || r.TransferID == "" || r.PID != os.Getpid() {
+			t.Errorf("record %d has seq %d, transfer %q and pid %d", i, r.Seq, r.TransferID, r.PID)
+		}
+	}
+	if want := "download downloaded a.txt, download failed gone.txt, download downloaded b.txt, download failed gone.txt"; strings.Join(got, ", ") != want {
+		t.Errorf("audit log has %s, want %s", strings.Join(got, ", "), want)
+	}
+	if records[0].Bytes != int64(len("contents of a.txt")) || records[1].Error == "" {
+		t.Errorf("records %+v and %+v lack bytes or error", records[0], records[1])
+	}
+	if err := runAudit(newTestOptions(t, "-audit-log", path), nil); err != nil {
+		t.Errorf("audit of an untouched log: %v", err)
+	}
+}
+
+func TestAuditDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := a.add(&transferResult{ID: name, Status: statusDownloaded, Source: "tcp://host/" + name, Bytes: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	for _, test := range []struct {
+		name, log, want string
+	}{
+		{"edited", lines[0] + strings.Replace(lines[1], `"bytes":10`, `"bytes":11`, 1) + lines[2], "line 2: record was modified"},
+		{"removed", lines[0] + lines[2], "line 2: chain is broken"},
+		{"reordered", lines[1] + lines[0] + lines[2], "line 1: chain is broken"},
+		{"garbled", lines[0] + "{\n", "line 2: invalid record"},
+	} {
+		tampered := filepath.Join(dir, test.name+".log")
+		if err := os.WriteFile(tampered, []byte(test.log), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := runAudit(newTestOptions(t), []string{tampered}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s log: got %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(string(data)+"{\"seq\":"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openAuditLog(path); err == nil {
+		t.Error("opened an audit log ending in a damaged record")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backend reads remote files for one URL scheme. open returns the file's
+// contents starting at offset, and its total size, or -1 if the backend
+// cannot tell before the transfer. ctx carries the transfer's ID.
+type backend interface {
+	open(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, int64, error)
+}
+
+var backends = map[string]func(*options) backend{
+	"tcp":   newTCPBackend,
+	"sftp":  newSFTPBackend,
+	"http":  newHTTPBackend,
+	"https": newHTTPBackend,
+	"ftp":   newFTPBackend,
+	"ftps":  newFTPBackend,
+}
+
+func (o *options) backend(scheme string) (backend, error) {
+	o.backendsMu.Lock()
+	defer o.backendsMu.Unlock()
+
+	if b, ok := o.openBackends[scheme]; ok {
+		return b, nil
+	}
+	newBackend, ok := backends[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	if o.openBackends == nil {
+		o.openBackends = make(map[string]backend)
+	}
+	b := newBackend(o)
+	o.openBackends[scheme] = b
+	return b, nil
+}
+
+// openSource opens the source at offset. With -retry-on dial, failing to
+// connect is retried too. Unless -reconnect is 0 or transfers aren't
+// retried, the reader redials and resumes by itself when the connection
+// breaks.
+func (o *options) openSource(ctx context.Context, source *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	reader, size, err := o.openSourceOnce(ctx, source, offset)
+	for n := 0; err != nil && o.retry.dial && n < o.reconnects && retryable(err); n++ {
+		o.transferLog(ctx).Warnf("connecting to %s failed: %v; retrying", source.Host, err)
+		if err := o.retry.wait(ctx, n, err); err != nil {
+			return nil, 0, err
+		}
+		reader, size, err = o.openSourceOnce(ctx, source, offset)
+	}
+	if err != nil || o.reconnects <= 0 || !o.retry.transfer {
+		return reader, size, err
+	}
+	return &reconnectingReader{
+		ctx:       ctx,
+		opts:      o,
+		source:    source,
+		offset:    offset,
+		size:      size,
+		reader:    reader,
+		remaining: o.reconnects,
+	}, size, nil
+}
+
+func (o *options) openSourceOnce(ctx context.Context, source *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	b, err := o.backend(source.Scheme)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, size, err := b.open(ctx, source, offset)
+	if err == nil && o.minSpeed > 0 {
+		reader = newStallReader(reader, int64(o.minSpeed), o.minSpeedTime)
+	}
+	return reader, size, err
+}
+
+// parseSource turns a command line argument into a source URL and the local
+// filename it is saved as. Plain names are fetched from the default server.
+func parseSource(arg string) (*url.URL, string, error) {
+	source := &url.URL{Scheme: "tcp", Host: ServerAddress, Path: "/" + arg}
+	if strings.Contains(arg, "://") {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid url %s: %w", arg, err)
+		}
+		source = u
+	}
+
+	filename := path.Base(source.Path)
+	if err := validateFilename(filename); err != nil {
+		return nil, "", err
+	}
+	return source, filename, nil
+}
+
+func hostWithDefaultPort(u *url.URL, port int) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+}
+
+type tcpBackend struct {
+	opts *options
+
+	mu          sync.Mutex
+	pipelines   map[string]*pipeline
+	unpipelined map[string]bool
+}
+
+func newTCPBackend(opts *options) backend {
+	return &tcpBackend{opts: opts}
+}
+
+// open fetches a file with GET. The protocol has no way to start partway
+// through, so resuming reads and discards the bytes before offset.
+func (b *tcpBackend) open(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	filename := strings.TrimPrefix(u.Path, "/")
+	if err := validateFilename(filename); err != nil {
+		return nil, 0, err
+	}
+
+	if b.opts.pipelineDepth > 0 && offset == 0 {
+		p, err := b.pipeline(u.Host)
+		if err != nil {
+			return nil, 0, err
+		}
+		if p != nil {
+			return p.get(filename, b.opts.upcoming(u.Host), b.opts.pipelineDepth)
+		}
+	}
+
+	id := ""
+	if b.opts.sendTransferID {
+		id = transferID(ctx)
+	}
+	if b.opts.wire == wireProtobuf {
+		body, size, err := b.openWire(ctx, u.Host, filename, id)
+		if err != nil || offset == 0 {
+			return body, size, err
+		}
+		b.opts.transferLog(ctx).Debugf("discarding %d bytes to resume %s", offset, filename)
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			body.Close()
+			return nil, 0, fmt.Errorf("error skipping to resume offset: %w", err)
+		}
+		return body, size, nil
+	}
+
+	conn, r, _, err := b.opts.dialRequest(ctx, u.Host, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := b.opts.requestFile(conn, u.Host, filename, id); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	b.opts.transferLog(ctx).Debugf("sent GET %s to %s", filename, u.Host)
+	if offset > 0 {
+		b.opts.transferLog(ctx).Debugf("discarding %d bytes to resume %s", offset, filename)
+		if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+			conn.Close()
+			return nil, 0, fmt.Errorf("error skipping to resume offset: %w", err)
+		}
+	}
+	return &connBody{Reader: r, Closer: conn}, -1, nil
+}
+
+// requestFile sends GET filename to the server at address, with the
+// transfer ID if id isn't empty.
+func (o *options) requestFile(conn net.Conn, address, filename, id string) error {
+	request := "GET " + filename
+	if id != "" {
+		request += " id=" + id
+	}
+	request, err := o.signRequest(address, request)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(request + "\n")); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	return nil
+}
+
+// deadlineReader re-arms the read deadline before every read, so a stalled
+// server is noticed without capping how long a whole transfer may take.
+type deadlineReader struct {
+	net.Conn
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if err := r.Conn.SetReadDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
+		return 0, fmt.Errorf("error setting read deadline: %w", err)
+	}
+	return r.Conn.Read(p)
+}
+
+// deadlineWriter is the write-side counterpart of deadlineReader.
+type deadlineWriter struct {
+	net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	if err := w.Conn.SetWriteDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
+		return 0, fmt.Errorf("error setting write deadline: %w", err)
+	}
+	return w.Conn.Write(p)
+}
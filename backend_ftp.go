@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpBackend serves ftp:// and ftps:// URLs in passive mode. ftps upgrades
+// the control connection with AUTH TLS (explicit FTPS) and protects the data
+// connection as well; TLS settings are shared with the other backends.
+type ftpBackend struct {
+	opts *options
+}
+
+func newFTPBackend(opts *options) backend {
+	return &ftpBackend{opts: opts}
+}
+
+func (b *ftpBackend) open(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, ConnectionTimeout)
+	defer cancel()
+
+	session, err := b.login(ctx, u)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stop := closeOnDone(ctx, session.conn)
+	reader, size, err := session.retrieve(ctx, u.Path, offset)
+	if stopErr := stop(); stopErr != nil {
+		err = stopErr
+	}
+	if err != nil {
+		session.close()
+		return nil, 0, err
+	}
+	return reader, size, nil
+}
+
+type ftpSession struct {
+	opts    *options
+	address string
+	secure  bool
+	conn    net.Conn
+	text    *textproto.Conn
+}
+
+func (b *ftpBackend) login(ctx context.Context, u *url.URL) (*ftpSession, error) {
+	address := hostWithDefaultPort(u, 21)
+	conn, err := b.opts.dialTransport(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ftp server: %w", err)
+	}
+
+	s := &ftpSession{opts: b.opts, address: address, secure: u.Scheme == "ftps", conn: conn, text: textproto.NewConn(conn)}
+	stop := closeOnDone(ctx, conn)
+	err = s.handshake(ctx, u.User)
+	if stopErr := stop(); stopErr != nil {
+		err = stopErr
+	}
+	if err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// closeOnDone closes conn if ctx is done before the returned stop is
+// called, as the control connection's replies are read without ctx. stop
+// returns ctx's error if conn was closed.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() error) {
+	done := make(chan struct{})
+	closed := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- ctx.Err()
+		case <-done:
+			closed <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-closed
+	}
+}
+
+func (s *ftpSession) handshake(ctx context.Context, user *url.Userinfo) error {
+	if _, _, err := s.text.ReadResponse(220); err != nil {
+		return fmt.Errorf("error reading ftp greeting: %w", err)
+	}
+
+	if s.secure {
+		if _, err := s.command(234, "AUTH TLS"); err != nil {
+			return err
+		}
+		conn, err := s.opts.tls.client(ctx, s.conn, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		s.text = textproto.NewConn(conn)
+
+		if _, err := s.command(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, err := s.command(200, "PROT P"); err != nil {
+			return err
+		}
+	}
+
+	username, password := "anonymous", "anonymous@"
+	if e := s.opts.netrc(s.address); user == nil && e != nil && e.login != "" {
+		username, password = e.login, e.password
+	}
+	if user != nil {
+		username = user.Username()
+		if p, ok := user.Password(); ok {
+			password = p
+		}
+	}
+
+	code, err := s.command(0, "USER %s", username)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, err := s.command(230, "PASS %s", password); err != nil {
+			return err
+		}
+	} else if code != 230 {
+		return fmt.Errorf("ftp login rejected with code %d", code)
+	}
+
+	_, err = s.command(200, "TYPE I")
+	return err
+}
+
+// command sends a command and checks the reply code. An expected code of 0
+// accepts any non-error reply and returns it to the caller.
+func (s *ftpSession) command(expect int, format string, args ...interface{}) (int, error) {
+	return s.commandMessage(expect, nil, format, args...)
+}
+
+func (s *ftpSession) commandMessage(expect int, message *string, format string, args ...interface{}) (int, error) {
+	id, err := s.text.Cmd(format, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error sending ftp command: %w", err)
+	}
+	s.text.StartResponse(id)
+	defer s.text.EndResponse(id)
+
+	code, msg, err := s.text.ReadResponse(expect)
+	if message != nil {
+		*message = msg
+	}
+	if err != nil {
+		name, _, _ := strings.Cut(format, " ")
+		return code, fmt.Errorf("ftp %s failed: %w", name, err)
+	}
+	return code, nil
+}
+
+func (s *ftpSession) retrieve(ctx context.Context, path string, offset int64) (io.ReadCloser, int64, error) {
+	size := int64(-1)
+	var message string
+	if _, err := s.commandMessage(213, &message, "SIZE %s", path); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(message), 10, 64); err == nil {
+			size = n
+		}
+	}
+
+	if offset > 0 {
+		if size == offset {
+			return &ftpReader{session: s, data: nopConn{}}, size, nil
+		}
+		if _, err := s.command(350, "REST %d", offset); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	data, err := s.passive(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := s.command(1, "RETR %s", path); err != nil {
+		data.Close()
+		return nil, 0, err
+	}
+
+	if s.secure {
+		if data, err = s.opts.tls.client(ctx, data, s.address); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &ftpReader{session: s, data: data}, size, nil
+}
+
+// passive opens the data connection, preferring EPSV. The address the server
+// advertises in a PASV reply is ignored in favour of the control connection's
+// host, which keeps working behind NAT and through tunnels.
+func (s *ftpSession) passive(ctx context.Context) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(s.address)
+
+	var message string
+	port := 0
+	if _, err := s.commandMessage(229, &message, "EPSV"); err == nil {
+		port = parseEPSV(message)
+	} else {
+		if _, err := s.commandMessage(227, &message, "PASV"); err != nil {
+			return nil, err
+		}
+		port = parsePASV(message)
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("invalid passive reply %q", message)
+	}
+
+	conn, err := s.opts.dialTransport(ctx, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("error opening ftp data connection: %w", err)
+	}
+	return conn, nil
+}
+
+func (s *ftpSession) close() {
+	s.text.Cmd("QUIT")
+	s.conn.Close()
+}
+
+// parseEPSV reads the port from "Entering Extended Passive Mode (|||port|)".
+func parseEPSV(message string) int {
+	start := strings.Index(message, "(")
+	end := strings.LastIndex(message, ")")
+	if start < 0 || end <= start {
+		return 0
+	}
+	fields := strings.Split(message[start+1:end], "|")
+	if len(fields) != 5 {
+		return 0
+	}
+	port, _ := strconv.Atoi(fields[3])
+	return port
+}
+
+// parsePASV reads the port from "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func parsePASV(message string) int {
+	start := strings.Index(message, "(")
+	end := strings.LastIndex(message, ")")
+	if start < 0 || end <= start {
+		return 0
+	}
+	fields := strings.Split(message[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0
+	}
+	high, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	low, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return high<<8 | low
+}
+
+// ftpReader reads the data connection and, once it is closed, collects the
+// transfer's final reply and ends the session.
+type ftpReader struct {
+	session *ftpSession
+	data    net.Conn
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	return deadlineReader{r.data}.Read(p)
+}
+
+func (r *ftpReader) Close() error {
+	r.data.Close()
+	defer r.session.close()
+
+	if _, ok := r.data.(nopConn); ok {
+		return nil
+	}
+	if _, _, err := r.session.text.ReadResponse(2); err != nil {
+		return fmt.Errorf("ftp transfer failed: %w", err)
+	}
+	return nil
+}
+
+// nopConn stands in for a data connection when there is nothing to transfer.
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Read([]byte) (int, error)        { return 0, io.EOF }
+func (nopConn) Close() error                    { return nil }
+func (nopConn) SetReadDeadline(time.Time) error { return nil }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFTPOpenStopsWithContext(t *testing.T) {
+	// The server accepts the connection but never greets.
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		io.Copy(io.Discard, r)
+	})
+	u, err := url.Parse("ftp://" + server.addr() + "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = newFTPBackend(newTestOptions(t)).open(ctx, u, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("open returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("open took %s after its context ended", elapsed)
+	}
+}
+
+func TestFTPOpen(t *testing.T) {
+	data, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		conn.Write([]byte("220 ready\r\n"))
+		for {
+			line, ok := readRequest(r)
+			if !ok {
+				return
+			}
+			command, _, _ := strings.Cut(line, " ")
+			switch command {
+			case "USER":
+				conn.Write([]byte("230 logged in\r\n"))
+			case "TYPE":
+				conn.Write([]byte("200 binary\r\n"))
+			case "SIZE":
+				conn.Write([]byte("213 5\r\n"))
+			case "EPSV":
+				conn.Write([]byte("229 Entering Extended Passive Mode (|||" + strconv.Itoa(data.Addr().(*net.TCPAddr).Port) + "|)\r\n"))
+			case "RETR":
+				conn.Write([]byte("150 sending\r\n"))
+				if d, err := data.Accept(); err == nil {
+					d.Write([]byte("hello"))
+					d.Close()
+				}
+				conn.Write([]byte("226 done\r\n"))
+			default:
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			}
+		}
+	})
+	u, err := url.Parse("ftp://" + server.addr() + "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, size, err := newFTPBackend(newTestOptions(t)).open(context.Background(), u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil || string(got) != "hello" || size != 5 {
+		t.Errorf("read %q of %d bytes, %v", got, size, err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Error(err)
+	}
+}
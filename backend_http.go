@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// httpBackend serves http:// and https:// URLs. Connections go through the
+// same proxy, SSH and TLS settings as the tcp backend, and resuming uses
+// Range requests.
+type httpBackend struct {
+	opts   *options
+	client *http.Client
+}
+
+func newHTTPBackend(opts *options) backend {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return opts.dialTransport(ctx, address)
+		},
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := opts.dialTransport(ctx, address)
+			if err != nil {
+				return nil, err
+			}
+			return opts.tls.client(ctx, conn, address)
+		},
+		ResponseHeaderTimeout: ConnectionTimeout,
+	}
+	return &httpBackend{opts: opts, client: &http.Client{Transport: transport}}
+}
+
+func (b *httpBackend) open(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %w", err)
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if e := b.opts.netrc(hostWithDefaultPort(u, port)); u.User == nil && e != nil && e.login != "" {
+		request.SetBasicAuth(e.login, e.password)
+	}
+	if id := transferID(ctx); b.opts.sendTransferID && id != "" {
+		request.Header.Set("X-Transfer-ID", id)
+	}
+
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error sending request: %w", err)
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		// The server ignored the range, so skip what we already have.
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+				response.Body.Close()
+				return nil, 0, fmt.Errorf("error skipping to resume offset: %w", err)
+			}
+		}
+		return response.Body, response.ContentLength, nil
+
+	case http.StatusPartialContent:
+		start, total := parseContentRange(response.Header.Get("Content-Range"))
+		if start != offset {
+			response.Body.Close()
+			return nil, 0, fmt.Errorf("server resumed at byte %d, expected %d", start, offset)
+		}
+		return response.Body, total, nil
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Asking for bytes past the end means the file is already complete.
+		response.Body.Close()
+		if _, total := parseContentRange(response.Header.Get("Content-Range")); total == offset {
+			return io.NopCloser(strings.NewReader("")), total, nil
+		}
+		return nil, 0, fmt.Errorf("server returned %s", response.Status)
+
+	default:
+		response.Body.Close()
+		return nil, 0, fmt.Errorf("server returned %s", response.Status)
+	}
+}
+
+// parseContentRange extracts the first byte and the complete length from a
+// "bytes start-end/total" or "bytes */total" header. Missing parts are -1.
+func parseContentRange(header string) (int64, int64) {
+	start, total := int64(-1), int64(-1)
+
+	spec := strings.TrimPrefix(strings.TrimSpace(header), "bytes ")
+	byteRange, length, found := strings.Cut(spec, "/")
+	if !found {
+		return start, total
+	}
+	if n, err := strconv.ParseInt(length, 10, 64); err == nil {
+		total = n
+	}
+	if first, _, found := strings.Cut(byteRange, "-"); found {
+		if n, err := strconv.ParseInt(first, 10, 64); err == nil {
+			start = n
+		}
+	}
+	return start, total
+}
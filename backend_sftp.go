@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpBackend serves sftp://[user@]host[:port]/path URLs. It authenticates
+// with the same agent, keys and known_hosts as -ssh, and keeps one session
+// per host open for the rest of the run.
+type sftpBackend struct {
+	opts *options
+
+	mu      sync.Mutex
+	clients map[string]*sftp.Client
+}
+
+func newSFTPBackend(opts *options) backend {
+	return &sftpBackend{opts: opts, clients: make(map[string]*sftp.Client)}
+}
+
+func (b *sftpBackend) open(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	client, err := b.client(u)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := client.Open(sftpPath(u))
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) {
+		// The session died before its connection was seen to close.
+		b.forget(client)
+		client.Close()
+		if client, err = b.client(u); err != nil {
+			return nil, 0, err
+		}
+		file, err = client.Open(sftpPath(u))
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening remote file: %w", err)
+	}
+
+	size := int64(-1)
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("error seeking remote file: %w", err)
+		}
+	}
+	return file, size, nil
+}
+
+func (b *sftpBackend) client(u *url.URL) (*sftp.Client, error) {
+	username := u.User.Username()
+	if username == "" {
+		var err error
+		if username, err = defaultSSHUser(); err != nil {
+			return nil, err
+		}
+	}
+	address := hostWithDefaultPort(u, 22)
+	key := username + "@" + address
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if client, ok := b.clients[key]; ok {
+		return client, nil
+	}
+
+	config, err := b.opts.ssh.clientConfig(username)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+
+	conn, err := b.opts.dialTransport(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to sftp server: %w", err)
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error establishing ssh connection: %w", err)
+	}
+
+	sshClient := ssh.NewClient(sshConn, channels, requests)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("error starting sftp session: %w", err)
+	}
+
+	b.clients[key] = client
+	go func() {
+		// Once the connection drops, the next open makes a new one.
+		sshClient.Wait()
+		b.forget(client)
+	}()
+	return client, nil
+}
+
+func (b *sftpBackend) forget(client *sftp.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, c := range b.clients {
+		if c == client {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// sftpPath follows the curl convention: paths are absolute, and a leading
+// "/~/" makes them relative to the login directory.
+func sftpPath(u *url.URL) string {
+	if strings.HasPrefix(u.Path, "/~/") {
+		return strings.TrimPrefix(u.Path, "/~/")
+	}
+	return u.Path
+}
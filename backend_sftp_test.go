@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSFTPOpen(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, hostKey := newSFTPServer(t, root)
+	keyFile, knownHosts := writeSSHClientFiles(t, server, hostKey)
+	opts := newTestOptions(t, "-ssh-key", keyFile, "-ssh-known-hosts", knownHosts)
+	backend := newSFTPBackend(opts)
+	u, err := url.Parse("sftp://tester@" + server.ln.Addr().String() + "/~/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		offset int64
+		want   string
+	}{
+		{0, "hello, world"},
+		{7, "world"},
+	} {
+		reader, size, err := backend.open(context.Background(), u, test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != test.want || size != 12 {
+			t.Errorf("at %d read %q of %d bytes, %v; want %q of 12", test.offset, data, size, err, test.want)
+		}
+		// The next open has to notice the session is gone and start another.
+		server.drop()
+	}
+	if _, _, err := backend.open(context.Background(), &url.URL{Scheme: "sftp", User: u.User, Host: u.Host, Path: "/~/missing.txt"}, 0); err == nil {
+		t.Error("opened a missing file")
+	}
+}
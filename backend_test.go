@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	"tcpFileClient/wirepb"
+)
+
+// serveWireFile serves one protobuf GET of data, cutting the connection
+// after the first cut bytes if cut is positive.
+func serveWireFile(t *testing.T, conn net.Conn, r *bufio.Reader, data []byte, cut int) {
+	if _, ok := serveHello(r, conn, "proto"); !ok {
+		return
+	}
+	var request wirepb.Request
+	if err := protodelim.UnmarshalFrom(r, &request); err != nil {
+		t.Errorf("reading request: %v", err)
+		return
+	}
+	if request.GetGet().GetName() != "a.bin" {
+		t.Errorf("request for %q, want a.bin", request.GetGet().GetName())
+	}
+	protodelim.MarshalTo(conn, &wirepb.Reply{Kind: &wirepb.Reply_File{File: &wirepb.FileHeader{Size: int64(len(data))}}})
+	if cut > 0 {
+		data = data[:cut]
+	}
+	conn.Write(data)
+}
+
+func TestWireResumeAfterReconnect(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		cut := 0
+		if n == 0 {
+			cut = len(data) / 3
+		}
+		serveWireFile(t, conn, r, data, cut)
+	})
+
+	opts := newTestOptions(t, "-wire", "protobuf", "-retry-backoff", "1ms", "-retry-jitter", "0")
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.bin"}
+	reader, size, err := opts.openSource(context.Background(), source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if size != int64(len(data)) {
+		t.Errorf("size %d, want %d", size, len(data))
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading after reconnect: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes that differ from the %d sent", len(got), len(data))
+	}
+	if n := server.connections(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+func TestWireOpenAtOffsetReportsTotalSize(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		serveWireFile(t, conn, r, data, 0)
+	})
+
+	opts := newTestOptions(t, "-wire", "protobuf")
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.bin"}
+	reader, size, err := opts.openSourceOnce(context.Background(), source, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if size != int64(len(data)) {
+		t.Errorf("size %d, want the file's total size %d", size, len(data))
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data)-400 {
+		t.Errorf("read %d bytes from offset 400, want %d", len(got), len(data)-400)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// backupMode is the -backup flag. Given alone it makes numbered backups
+// like cp --backup=numbered, renaming the file a download replaces to
+// file.~1~, file.~2~ and so on; -backup=SUFFIX keeps a single backup named
+// file+SUFFIX instead, replacing the previous one.
+type backupMode struct {
+	enabled bool
+	suffix  string
+}
+
+func (b *backupMode) String() string {
+	switch {
+	case b == nil || !b.enabled:
+		return "false"
+	case b.suffix != "":
+		return b.suffix
+	}
+	return "true"
+}
+
+func (b *backupMode) Set(value string) error {
+	switch value {
+	case "false":
+		*b = backupMode{}
+	case "true", "numbered":
+		*b = backupMode{enabled: true}
+	case "":
+		return errors.New("empty backup suffix")
+	default:
+		if strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("backup suffix %q contains a path separator", value)
+		}
+		*b = backupMode{enabled: true, suffix: value}
+	}
+	return nil
+}
+
+func (b *backupMode) IsBoolFlag() bool {
+	return true
+}
+
+// backup moves an existing regular file at path out of the way of the
+// download about to replace it.
+func (b backupMode) backup(path string) error {
+	if !b.enabled {
+		return nil
+	}
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	name := path + b.suffix
+	if b.suffix == "" {
+		for n := 1; ; n++ {
+			name = fmt.Sprintf("%s.~%d~", path, n)
+			if _, err := os.Lstat(name); errors.Is(err, os.ErrNotExist) {
+				break
+			}
+		}
+	}
+	if err := os.Rename(path, name); err != nil {
+		return fmt.Errorf("error backing up existing file: %w", err)
+	}
+	return nil
+}
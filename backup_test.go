@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBackupKeepsReplacedFiles(t *testing.T) {
+	server := newFileServer(t)
+	for _, test := range []struct {
+		flag string
+		want map[string]string
+	}{
+		{"-backup", map[string]string{"a.txt.~1~": "old", "a.txt.~2~": "contents of a.txt"}},
+		{"-backup=.bak", map[string]string{"a.txt.bak": "contents of a.txt"}},
+		{"-backup=false", map[string]string{"a.txt.~1~": ""}},
+	} {
+		chdir(t, t.TempDir())
+		if err := os.WriteFile("a.txt", []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Download twice, so the second replaces the first.
+		for i := 0; i < 2; i++ {
+			opts := newTestOptions(t, test.flag)
+			if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if data, _ := os.ReadFile("a.txt"); string(data) != "contents of a.txt" {
+			t.Errorf("%s: a.txt has %q", test.flag, data)
+		}
+		for name, want := range test.want {
+			if data, _ := os.ReadFile(name); string(data) != want {
+				t.Errorf("%s: %s has %q, want %q", test.flag, name, data, want)
+			}
+		}
+	}
+}
+
+func TestBackupSuffixes(t *testing.T) {
+	var b backupMode
+	for _, bad := range []string{"", "/bak", `..\bak`} {
+		if err := b.Set(bad); err == nil {
+			t.Errorf("-backup=%q accepted", bad)
+		}
+	}
+	if err := b.Set("numbered"); err != nil || !b.enabled || b.suffix != "" {
+		t.Errorf("-backup=numbered gives %+v, %v", b, err)
+	}
+}
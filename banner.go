@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxBannerLines bounds a server's banner.
+const maxBannerLines = 32
+
+// A server can send everyone who connects a message, such as notice of a
+// maintenance window, as lines of the form
+//
+//	MOTD text
+//
+// ahead of its reply to HELLO, whether it sends them as soon as the client
+// connects or once it has the HELLO. Only connections that handshake see
+// it: pipelines, ping and diagnose, and -wire protobuf downloads.
+//
+// bannerPrinter shows each server's banner on stderr once per run, unless
+// -q is set. Banner lines have been through readLine, so they can't carry
+// terminal escapes.
+type bannerPrinter struct {
+	quiet bool
+
+	mu    sync.Mutex
+	shown map[string]bool
+}
+
+// readBanner reads the banner lines ahead of the HELLO reply and returns
+// them with the first line that isn't one.
+func readBanner(r *bufio.Reader) ([]string, string, error) {
+	var banner []string
+	for {
+		line, err := readLine(r, maxReplyLength)
+		if err != nil {
+			return nil, "", err
+		}
+		text, ok := bannerLine(line)
+		if !ok {
+			return banner, line, nil
+		}
+		if len(banner) == maxBannerLines {
+			return nil, "", &protocolError{fmt.Sprintf("banner longer than %d lines", maxBannerLines), line}
+		}
+		banner = append(banner, text)
+	}
+}
+
+func bannerLine(line string) (string, bool) {
+	if line == "MOTD" {
+		return "", true
+	}
+	if strings.HasPrefix(line, "MOTD ") {
+		return line[len("MOTD "):], true
+	}
+	return "", false
+}
+
+func (p *bannerPrinter) show(address string, banner []string) {
+	if p.quiet || len(banner) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown[address] {
+		return
+	}
+	if p.shown == nil {
+		p.shown = make(map[string]bool)
+	}
+	p.shown[address] = true
+	for _, line := range banner {
+		fmt.Fprintln(os.Stderr, strings.TrimRight(address+": "+line, " "))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newBannerServer sends before lines as the client connects and after
+// lines once it has the HELLO, ahead of its reply.
+func newBannerServer(t *testing.T, before, after []string) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		for _, line := range before {
+			conn.Write([]byte(line + "\n"))
+		}
+		if line, ok := readRequest(r); !ok || !strings.HasPrefix(line, "HELLO ") {
+			return
+		}
+		for _, line := range after {
+			conn.Write([]byte(line + "\n"))
+		}
+		conn.Write([]byte("OK tcp-file-server/1 list\n"))
+		readRequest(r)
+	})
+}
+
+func TestServerBanner(t *testing.T) {
+	server := newBannerServer(t, []string{"MOTD maintenance at 02:00 UTC"}, []string{"MOTD", "MOTD  see status.example.com"})
+	stderr := captureStderr(t)
+	opts := newTestOptions(t)
+
+	for i := 0; i < 2; i++ {
+		result, err := opts.ping(server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Join(result.Hello.Banner, "|"), "maintenance at 02:00 UTC|| see status.example.com"; got != want {
+			t.Errorf("banner %q, want %q", got, want)
+		}
+		if strings.Join(result.Hello.Capabilities, " ") != "list" {
+			t.Errorf("the banner hid the hello: %+v", result.Hello)
+		}
+	}
+	address := server.addr()
+	if got, want := stderr(), address+": maintenance at 02:00 UTC\n"+address+":\n"+address+":  see status.example.com\n"; got != want {
+		t.Errorf("showed %q, want it once: %q", got, want)
+	}
+
+	quiet := newTestOptions(t, "-q")
+	if result, err := quiet.ping(newBannerServer(t, []string{"MOTD hello"}, nil).addr()); err != nil || len(result.Hello.Banner) != 1 {
+		t.Errorf("ping with -q: %+v, %v", result, err)
+	}
+	if got := stderr(); strings.Contains(got, "hello") {
+		t.Errorf("-q showed the banner: %q", got)
+	}
+}
+
+func TestServerBannerLimits(t *testing.T) {
+	long := make([]string, maxBannerLines+1)
+	for i := range long {
+		long[i] = "MOTD line"
+	}
+	for _, test := range []struct {
+		name   string
+		banner []string
+		want   string
+	}{
+		{"too long", long, "banner longer than 32 lines"},
+		{"escape", []string{"MOTD \x1b[2Jgotcha"}, "control character 0x1b"},
+	} {
+		_, err := newTestOptions(t, "-q").ping(newBannerServer(t, test.banner, nil).addr())
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: %v, want %s", test.name, err, test.want)
+		}
+	}
+}
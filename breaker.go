@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+// breaker is a per-server circuit breaker for batch downloads. After
+// -breaker-failures consecutive connection failures a server's circuit
+// opens: its remaining sources wait at the back of the queue while other
+// servers are served, and once -breaker-cooldown has passed a single source
+// is let through as a probe. A successful probe closes the circuit again;
+// a failed one reopens it for another cooldown.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	consecutive int
+	openUntil   time.Time
+}
+
+func (b *breaker) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&b.failures, "breaker-failures", 5, "stop contacting a server for -breaker-cooldown after this many consecutive connection `failures`; 0 disables it")
+	fs.DurationVar(&b.cooldown, "breaker-cooldown", 30*time.Second, "how long a failing server is left alone before it is probed again")
+}
+
+// next picks the first queued source whose server may be contacted now,
+// passing over those blocked reports must wait for other reasons. If none
+// can start it returns -1 and how long to wait for the first cooldown to
+// end, or 0 if no source is waiting for one.
+func (b *breaker) next(queue []string, blocked func(string) bool) (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for i, arg := range queue {
+		if blocked(arg) {
+			continue
+		}
+		c := b.hosts[sourceHost(arg)]
+		if c == nil || !now.Before(c.openUntil) {
+			return i, 0
+		}
+		if d := c.openUntil.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return -1, wait
+}
+
+// record updates the server's circuit with the outcome of a transfer. Only
+// failures to reach or stay connected to the server count; a file that was
+// missing or rejected says nothing about the server's health.
+func (b *breaker) record(host string, err error, logger *leveledLogger) {
+	if b.failures <= 0 || host == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.hosts[host]
+	if err == nil {
+		if c != nil && c.consecutive >= b.failures {
+			logger.Infof("server %s is responding again", host)
+		}
+		delete(b.hosts, host)
+		return
+	}
+	if !retryable(err) {
+		return
+	}
+
+	if c == nil {
+		if b.hosts == nil {
+			b.hosts = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.consecutive++
+	if c.consecutive >= b.failures {
+		c.openUntil = time.Now().Add(b.cooldown)
+		logger.Warnf("server %s failed %d times in a row; pausing it for %s", host, c.consecutive, b.cooldown)
+	}
+}
+
+// sourceHost returns the server a command line source is fetched from, or
+// "" if it doesn't parse.
+func sourceHost(arg string) string {
+	source, _, err := parseSource(arg)
+	if err != nil {
+		return ""
+	}
+	return source.Host
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := &breaker{failures: 2, cooldown: 50 * time.Millisecond}
+	logger := newTestOptions(t).log
+	broken := &classifiedError{classNetwork, errors.New("connection refused")}
+	queue := []string{"tcp://a:1/x", "tcp://a:1/y", "tcp://b:1/z"}
+	none := func(string) bool { return false }
+
+	b.record("a:1", broken, logger)
+	if i, _ := b.next(queue, none); i != 0 {
+		t.Errorf("one failure: next %d, want 0", i)
+	}
+	// A missing file says nothing about the server.
+	b.record("a:1", &serverError{"no such file"}, logger)
+	if i, _ := b.next(queue, none); i != 0 {
+		t.Errorf("a missing file opened the circuit: next %d, want 0", i)
+	}
+	b.record("a:1", broken, logger)
+	if i, _ := b.next(queue, none); i != 2 {
+		t.Errorf("open circuit: next %d, want 2, the other server", i)
+	}
+	i, wait := b.next(queue[:2], none)
+	if i != -1 || wait <= 0 || wait > b.cooldown {
+		t.Errorf("only the open server queued: next %d after %s, want -1 after up to %s", i, wait, b.cooldown)
+	}
+
+	time.Sleep(wait)
+	if i, _ := b.next(queue, none); i != 0 {
+		t.Errorf("after the cooldown: next %d, want a probe of 0", i)
+	}
+	b.record("a:1", nil, logger)
+	b.record("a:1", broken, logger)
+	if i, _ := b.next(queue, none); i != 0 {
+		t.Errorf("a successful probe didn't reset the failure count: next %d", i)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := &breaker{failures: 0, cooldown: time.Hour}
+	logger := newTestOptions(t).log
+	for i := 0; i < 10; i++ {
+		b.record("a:1", &classifiedError{classNetwork, errors.New("timeout")}, logger)
+	}
+	if i, _ := b.next([]string{"tcp://a:1/x"}, func(string) bool { return false }); i != 0 {
+		t.Errorf("disabled breaker: next %d, want 0", i)
+	}
+}
+
+func TestBreakerSkipsBlockedSources(t *testing.T) {
+	b := &breaker{failures: 1, cooldown: time.Hour}
+	queue := []string{"tcp://a:1/x", "tcp://b:1/y"}
+	if i, wait := b.next(queue, func(arg string) bool { return true }); i != -1 || wait != 0 {
+		t.Errorf("all blocked: next %d after %s, want -1 after 0", i, wait)
+	}
+	if i, _ := b.next(queue, func(arg string) bool { return arg == queue[0] }); i != 1 {
+		t.Errorf("first blocked: next %d, want 1", i)
+	}
+}
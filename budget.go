@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// budget caps how much one batch or sync run downloads, for metered links
+// and small disks: once -max-total-size bytes or -max-files files have been
+// downloaded, the run starts no more transfers, and the sources left over
+// are reported as deferred rather than failed, for a later run to pick up.
+//
+// Sync knows each file's size from the listing and defers a file that
+// would take the run past -max-total-size. A batch only learns sizes as
+// files arrive, so the transfers already under way when the budget runs
+// out are finished, and may take it past the limit.
+type budget struct {
+	maxBytes byteSize
+	maxFiles int
+
+	mu       sync.Mutex
+	bytes    int64
+	files    int
+	deferred []string
+}
+
+func (b *budget) registerFlags(fs *flag.FlagSet) {
+	fs.Var(&b.maxBytes, "max-total-size", "stop a batch or sync once it has downloaded this `size` in all, such as 50G, deferring the rest to a later run")
+	fs.IntVar(&b.maxFiles, "max-files", 0, "stop a batch or sync once it has downloaded this many `files`, deferring the rest to a later run; 0 means no limit")
+}
+
+func (b *budget) enabled() bool {
+	return b.maxBytes > 0 || b.maxFiles > 0
+}
+
+// spend records a downloaded file.
+func (b *budget) spend(bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bytes += bytes
+	b.files++
+}
+
+// exhausted reports whether the budget is used up, counting files and bytes
+// that are still being downloaded as well as those already recorded.
+func (b *budget) exhausted(files int, bytes int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxFiles > 0 && b.files+files >= b.maxFiles ||
+		b.maxBytes > 0 && b.bytes+bytes >= int64(b.maxBytes)
+}
+
+// admit reports whether a sync may download source, which the listing says
+// is size bytes, and defers it if not.
+func (b *budget) admit(source string, size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	if b.maxFiles > 0 && b.files >= b.maxFiles || b.maxBytes > 0 && b.bytes+size > int64(b.maxBytes) {
+		b.deferred = append(b.deferred, source)
+		return false
+	}
+	return true
+}
+
+// deferSources records sources the run leaves for later.
+func (b *budget) deferSources(sources ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deferred = append(b.deferred, sources...)
+}
+
+// deferredResults returns a result for each source the run deferred.
+func (b *budget) deferredResults() []*transferResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	results := make([]*transferResult, len(b.deferred))
+	for i, source := range b.deferred {
+		results[i] = &transferResult{Source: source, Status: statusDeferred}
+	}
+	return results
+}
+
+// report logs what the budget deferred, if anything.
+func (b *budget) report(logger *leveledLogger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.deferred) == 0 {
+		return
+	}
+	var limits []string
+	if b.maxBytes > 0 {
+		limits = append(limits, "-max-total-size "+formatBytes(int64(b.maxBytes)))
+	}
+	if b.maxFiles > 0 {
+		limits = append(limits, "-max-files "+strconv.Itoa(b.maxFiles))
+	}
+	logger.Warnf("download budget (%s) reached after %d files, %s; deferred %d more to a later run", strings.Join(limits, ", "), b.files, formatBytes(b.bytes), len(b.deferred))
+	for _, source := range b.deferred {
+		logger.Infof("deferred file %s", source)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkedSink applies the run's content checks to the data passing through
+// to a sink: the size limit, the content policy and the virus scan. It also
+// hashes the file for the result. Rejected and infected files are moved into
+// the quarantine directory instead of being deleted when one is configured.
+type checkedSink struct {
+	sink
+	opts    *options
+	result  *transferResult
+	w       io.Writer
+	hash    hash.Hash
+	sniffer *contentSniffer
+	scanner *clamdScanner
+	failure error
+}
+
+func (o *options) checkSink(out sink, offset int64, result *transferResult) (sink, error) {
+	c := &checkedSink{sink: out, opts: o, result: result, hash: sha256.New()}
+	checks := []io.Writer{c.hash}
+	if o.content.enabled() {
+		c.sniffer = &contentSniffer{policy: &o.content}
+		checks = append(checks, c.sniffer)
+	}
+	if o.clamd != "" {
+		scanner, err := dialClamd(o.clamd)
+		if err != nil {
+			out.abort()
+			return nil, err
+		}
+		c.scanner = scanner
+		checks = append(checks, scanner)
+	}
+
+	if offset > 0 {
+		// The start of a resumed file is already on disk.
+		if err := c.replayPartial(io.MultiWriter(checks...)); err != nil {
+			c.failure = err
+			c.abort()
+			return nil, err
+		}
+	}
+	c.w = o.limitWriter(io.MultiWriter(append(checks, out)...), offset)
+	return c, nil
+}
+
+// replayPartial feeds what an earlier attempt wrote through the checks.
+func (c *checkedSink) replayPartial(w io.Writer) error {
+	f, ok := c.sink.(*fileSink)
+	if !ok {
+		return nil
+	}
+	partial, err := os.Open(f.Name())
+	if err != nil {
+		return fmt.Errorf("error reading partial file: %w", err)
+	}
+	defer partial.Close()
+	if _, err := io.Copy(w, partial); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *checkedSink) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil && c.failure == nil {
+		c.failure = err
+	}
+	return n, err
+}
+
+func (c *checkedSink) commit() error {
+	if c.sniffer != nil {
+		if err := c.sniffer.finish(); err != nil {
+			c.failure = err
+			c.abort()
+			return err
+		}
+	}
+	c.result.SHA256 = hex.EncodeToString(c.hash.Sum(nil))
+	if c.result.expectSHA256 != "" && !strings.EqualFold(c.result.expectSHA256, c.result.SHA256) {
+		c.failure = fmt.Errorf("file hash: %w", errChecksumMismatch)
+		c.abort()
+		return c.failure
+	}
+	if c.scanner != nil {
+		verdict, err := c.scanner.verdict()
+		c.scanner = nil
+		c.result.Scan = verdict
+		if err != nil {
+			c.failure = err
+			c.abort()
+			return err
+		}
+	}
+	if f, ok := c.sink.(*fileSink); ok && c.opts.verifyReadback {
+		return f.commitVerified(c.result.SHA256)
+	}
+	return c.sink.commit()
+}
+
+func (c *checkedSink) abort() error {
+	if c.scanner != nil {
+		c.scanner.close()
+	}
+	rejected := errors.Is(c.failure, errContentRejected) || errors.Is(c.failure, errInfected)
+	if rejected && c.opts.quarantine != "" {
+		if q, ok := c.sink.(quarantiner); ok {
+			return q.quarantine(c.opts.quarantine)
+		}
+	}
+	return c.sink.abort()
+}
+
+// A quarantiner can set a rejected download aside instead of deleting it.
+type quarantiner interface {
+	quarantine(dir string) error
+}
+
+// quarantine moves the partial file into dir, stamped with the time so
+// repeated rejections of the same name are all kept.
+func (s *fileSink) quarantine(dir string) error {
+	s.File.Close()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	target := filepath.Join(dir, filepath.Base(s.path)+"."+time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(s.File.Name(), target); err != nil {
+		return fmt.Errorf("error quarantining file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	clamdChunkSize   = 64 << 10
+	clamdScanTimeout = 5 * time.Minute
+)
+
+var errInfected = errors.New("malware detected")
+
+// clamdScanner streams a transfer to clamd with the INSTREAM command as it is
+// written, so the verdict is ready as soon as the download completes. A
+// failure to feed clamd doesn't interrupt the download; it surfaces as a
+// failed scan instead.
+type clamdScanner struct {
+	conn net.Conn
+	w    *bufio.Writer
+	err  error
+}
+
+// dialClamd connects to clamd at a host:port or, with a unix: prefix or an
+// absolute path, its local socket.
+func dialClamd(address string) (*clamdScanner, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, ConnectionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to clamd: %w", err)
+	}
+	s := &clamdScanner{conn: conn, w: bufio.NewWriterSize(conn, clamdChunkSize+4)}
+	if _, err := s.w.WriteString("zINSTREAM\x00"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting clamd scan: %w", err)
+	}
+	return s, nil
+}
+
+func (s *clamdScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && s.err == nil {
+		chunk := p
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		s.err = s.writeChunk(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (s *clamdScanner) writeChunk(chunk []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(ConnectionTimeout))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+	if _, err := s.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(chunk)
+	return err
+}
+
+// verdict ends the stream and returns clamd's answer, such as "OK" or
+// "Eicar-Signature FOUND". Detections wrap errInfected; anything else that
+// isn't a clean result is a scan failure.
+func (s *clamdScanner) verdict() (string, error) {
+	defer s.conn.Close()
+
+	if s.err == nil {
+		s.err = s.writeChunk(nil)
+	}
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+
+	// clamd answers before hanging up even when it stops reading early,
+	// for example because the stream exceeded StreamMaxLength.
+	s.conn.SetReadDeadline(time.Now().Add(clamdScanTimeout))
+	reply, err := bufio.NewReader(s.conn).ReadString(0)
+	if err != nil {
+		if s.err != nil {
+			err = s.err
+		}
+		return "", fmt.Errorf("error reading clamd verdict: %w", err)
+	}
+
+	result := strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream:"))
+	switch {
+	case result == "OK":
+		return result, nil
+	case strings.HasSuffix(result, "FOUND"):
+		return result, fmt.Errorf("clamd: %s: %w", result, errInfected)
+	default:
+		return result, fmt.Errorf("clamd scan failed: %s", result)
+	}
+}
+
+func (s *clamdScanner) close() {
+	s.conn.Close()
+}
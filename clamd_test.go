@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newFakeClamd answers INSTREAM scans, finding anything that mentions EICAR.
+func newFakeClamd(t *testing.T) string {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		command, err := r.ReadString(0)
+		if err != nil || command != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var stream bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+				return
+			}
+		}
+		if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+			conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	}).addr()
+}
+
+func TestClamdScansDownloads(t *testing.T) {
+	server := newFileServer(t)
+	clamd := newFakeClamd(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-clamd", clamd, "-retry-on", "none")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/clean.txt", "tcp://" + server.addr() + "/EICAR.txt"}, nil, opts.log)
+	if err == nil {
+		t.Error("an infected file did not fail the batch")
+	}
+	if got, want := statuses(results), "downloaded failed"; got != want {
+		t.Fatalf("statuses %q, want %q", got, want)
+	}
+	if results[0].Scan != "OK" || results[1].Scan != "Eicar-Signature FOUND" {
+		t.Errorf("scans %q and %q", results[0].Scan, results[1].Scan)
+	}
+	if !strings.Contains(results[1].Error, errInfected.Error()) {
+		t.Errorf("error %q, want %v", results[1].Error, errInfected)
+	}
+	if _, err := os.Stat("clean.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat("EICAR.txt"); err == nil {
+		t.Error("the infected file was kept")
+	}
+}
+
+func TestClamdFailureFailsTransfer(t *testing.T) {
+	server := newFileServer(t)
+	clamd := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		r.ReadString(0)
+		conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+	})
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-clamd", clamd.addr(), "-retry-on", "none")
+
+	results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if statuses(results) != statusFailed || !strings.Contains(results[0].Error, "clamd scan failed") {
+		t.Errorf("status %s with %q, want a failed scan", statuses(results), results[0].Error)
+	}
+	if _, err := os.Stat("a.txt"); err == nil {
+		t.Error("an unscanned file was kept")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// The daemon coalesces jobs for the same file: a job submitted while
+// another for the same source and destination is queued or running is not
+// queued itself but follows that one, its leader, taking on its state,
+// progress and result, so the file is downloaded once however many times
+// it is asked for. Cancelling a follower detaches it; cancelling a leader
+// that still has followers hands the transfer on to the first of them.
+
+// coalesceKey is what coalesced transfers share: the source, with the
+// default server filled in, and where it is saved.
+func (o *options) coalesceKey(source, destination string) string {
+	if destination == "" {
+		destination = o.destination(source)
+	}
+	if u, _, err := parseSource(source); err == nil {
+		source = u.String()
+	}
+	return source + "\n" + destination
+}
+
+// coalesceSources drops the command line sources that repeat an earlier one,
+// for the batch, so that each file is downloaded once.
+func (o *options) coalesceSources(args []string, logger *leveledLogger) []string {
+	seen := make(map[string]bool, len(args))
+	var unique []string
+	for _, arg := range args {
+		key := o.coalesceKey(arg, "")
+		if seen[key] {
+			logger.Infof("%s is requested more than once; downloading it once", arg)
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, arg)
+	}
+	return unique
+}
+
+// coalesceLocked makes j follow the queued or running job for the same
+// file, if there is one, and returns whether it did. Otherwise j becomes
+// the job others follow. d.mu must be held.
+func (d *daemon) coalesceLocked(j *job) bool {
+	j.key = d.opts.coalesceKey(j.Source, j.Destination)
+	leader := d.active[j.key]
+	if leader == nil {
+		d.active[j.key] = j
+		return false
+	}
+	j.State, j.CoalescedWith = leader.State, leader.ID
+	leader.followers = append(leader.followers, j)
+	daemonStats.Add("jobs_coalesced", 1)
+	d.logger.Infof("job %s is for the same file as job %s; coalescing them", j.ID, leader.ID)
+	return true
+}
+
+// cancelCoalescedLocked handles cancelling a queued job that is part of a
+// coalesced group; d.mu must be held.
+func (d *daemon) cancelCoalescedLocked(j *job) {
+	if j.CoalescedWith != "" {
+		if leader := d.jobs[j.CoalescedWith]; leader != nil {
+			for i, f := range leader.followers {
+				if f == j {
+					leader.followers = append(leader.followers[:i], leader.followers[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if d.active[j.key] == j {
+		delete(d.active, j.key)
+	}
+	if len(j.followers) == 0 {
+		return
+	}
+	next := j.followers[0]
+	next.CoalescedWith, next.followers = "", j.followers[1:]
+	for _, f := range next.followers {
+		f.CoalescedWith = next.ID
+	}
+	j.followers, j.handoff = nil, next
+	d.active[j.key] = next
+}
+
+// followLocked copies j's state onto its followers; d.mu must be held.
+func (j *job) followLocked() {
+	for _, f := range j.followers {
+		f.State, f.Result, f.progress = j.State, j.Result, j.progress
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jobStates returns the state of each of d's jobs, in submission order.
+func jobStates(d *daemon) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var states []string
+	for _, j := range d.order {
+		states = append(states, j.State)
+	}
+	return states
+}
+
+// startWorker runs one of d's workers until the test ends.
+func startWorker(t *testing.T, d *daemon) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.work()
+	}()
+	t.Cleanup(func() {
+		close(d.queue)
+		<-done
+	})
+}
+
+func TestDaemonCoalescesDuplicateJobs(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	d := newTestDaemon(t, 0)
+	source := "tcp://" + server.addr() + "/a.txt"
+	destination := filepath.Join(d.root, "a.txt")
+
+	var ids []string
+	for _, dest := range []string{destination, destination, filepath.Join(d.root, "b.txt")} {
+		j, err := d.submit(source, dest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID+":"+j.CoalescedWith)
+	}
+	if got, want := strings.Join(ids, " "), "1: 2:1 3:"; got != want {
+		t.Errorf("jobs %s, want %s", got, want)
+	}
+	if n := len(d.queue); n != 2 {
+		t.Errorf("%d jobs queued, want the follower left out", n)
+	}
+
+	startWorker(t, d)
+	waitFor(t, "the jobs to finish", func() bool { return strings.Join(jobStates(d), " ") == "done done done" })
+
+	d.mu.Lock()
+	leader, follower := d.jobs["1"], d.jobs["2"]
+	if follower.Result != leader.Result || leader.Result.Status != statusDownloaded {
+		t.Errorf("follower finished with %+v, leader with %+v", follower.Result, leader.Result)
+	}
+	if len(d.active) != 0 {
+		t.Errorf("%d transfers still active", len(d.active))
+	}
+	d.mu.Unlock()
+	if got, want := log.String(), "server GET a.txt, server GET a.txt"; got != want {
+		t.Errorf("server saw %s, want one GET per destination", got)
+	}
+	if data, err := os.ReadFile(destination); err != nil || string(data) != "contents of a.txt" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+
+	// Once the leader is done, the same file is fetched again.
+	if j, err := d.submit(source, destination, nil); err != nil || j.CoalescedWith != "" {
+		t.Errorf("resubmitted job follows %q, %v", j.CoalescedWith, err)
+	}
+}
+
+func TestDaemonCancelsCoalescedJobs(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	d := newTestDaemon(t, 0)
+	source, destination := "tcp://"+server.addr()+"/a.txt", filepath.Join(d.root, "a.txt")
+	for i := 0; i < 3; i++ {
+		if _, err := d.submit(source, destination, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cancelling a follower leaves the others alone; cancelling the leader
+	// hands the transfer to the follower left.
+	for _, id := range []string{"2", "1"} {
+		if _, err := d.cancel(id); err != nil {
+			t.Fatalf("cancel %s: %v", id, err)
+		}
+	}
+	d.mu.Lock()
+	if next := d.jobs["3"]; next.CoalescedWith != "" || d.active[next.key] != next {
+		t.Errorf("job 3 follows %q after its leader was cancelled", next.CoalescedWith)
+	}
+	d.mu.Unlock()
+
+	startWorker(t, d)
+	waitFor(t, "job 3 to finish", func() bool { return strings.Join(jobStates(d), " ") == "cancelled cancelled done" })
+	if got, want := log.String(), "server GET a.txt"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+}
+
+func TestBatchCoalescesSources(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t)
+	useDefaultServer(t, server.addr())
+
+	sources := []string{"a.txt", "tcp://" + server.addr() + "/a.txt", "b.txt", "b.txt"}
+	results, err := runBatch(opts, sources, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if got, want := log.String(), "server GET a.txt, server GET b.txt"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+var errCaseCollision = errors.New("name differs only in case from another file in the batch")
+
+// Policies for sources whose destinations collide on a case-insensitive
+// filesystem, such as Readme.txt and README.TXT.
+const (
+	collisionRename = "rename"
+	collisionSkip   = "skip"
+	collisionFail   = "fail"
+)
+
+// resolveCollisions finds command line sources that would be saved under
+// names differing only in case, in directories where the filesystem doesn't
+// tell such names apart, before anything is downloaded. The first source
+// keeps its name; later ones are renamed, reported as skipped or make the
+// whole batch fail, depending on -case-collision. It returns the sources
+// still to be fetched.
+func (o *options) resolveCollisions(args []string, logger *leveledLogger) ([]string, error) {
+	if o.output != "" || len(args) < 2 {
+		return args, nil
+	}
+	switch o.caseCollision {
+	case collisionRename, collisionSkip, collisionFail:
+	default:
+		return nil, fmt.Errorf("unknown case collision policy %q", o.caseCollision)
+	}
+
+	insensitive := map[string]bool{}
+	// taken maps folded destinations to the name the first file saved
+	// there has, renamed files included.
+	taken := map[string]string{}
+	var kept []string
+	for _, arg := range args {
+		dest := o.destination(arg)
+		dir := filepath.Dir(dest)
+		ignoresCase, ok := insensitive[dir]
+		if !ok {
+			ignoresCase = caseInsensitive(dir)
+			insensitive[dir] = ignoresCase
+		}
+		if !ignoresCase {
+			kept = append(kept, arg)
+			continue
+		}
+
+		first, collides := taken[strings.ToLower(dest)]
+		if !collides || first == dest {
+			// The same name twice is left to the scheduler, which runs the
+			// copies one after the other.
+			taken[strings.ToLower(dest)] = dest
+			kept = append(kept, arg)
+			continue
+		}
+
+		err := fmt.Errorf("%w: %s", errCaseCollision, filepath.Base(first))
+		switch o.caseCollision {
+		case collisionFail:
+			return nil, fmt.Errorf("%s: %w", arg, err)
+		case collisionSkip:
+			o.report(logger, newTransferResult(arg, dest), err)
+			continue
+		}
+
+		renamed := caseFreeName(dest, taken)
+		taken[strings.ToLower(renamed)] = renamed
+		if o.caseRenames == nil {
+			o.caseRenames = map[string]string{}
+		}
+		o.caseRenames[arg] = renamed
+		logger.Warnf("saving %s as %s: %v", arg, renamed, err)
+		kept = append(kept, arg)
+	}
+	return kept, nil
+}
+
+// caseFreeName picks "name (n).ext" for dest such that it matches neither a
+// name already taken in the batch nor an existing file, ignoring case.
+func caseFreeName(dest string, taken map[string]string) string {
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, ok := taken[strings.ToLower(candidate)]; ok {
+			continue
+		}
+		if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// caseInsensitive reports whether the filesystem holding dir treats names
+// differing only in case as the same file. It creates a probe file with a
+// mixed-case name and looks it up with the case swapped; where that isn't
+// possible it goes by the platform's usual filesystem.
+func caseInsensitive(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".Case-Probe-")
+	if err != nil {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	name := probe.Name()
+	probe.Close()
+	defer os.Remove(name)
+
+	original, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	swapped := filepath.Join(filepath.Dir(name), swapCase(filepath.Base(name)))
+	info, err := os.Stat(swapped)
+	return err == nil && os.SameFile(original, info)
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCaseCollisions(t *testing.T) {
+	server := newFileServer(t)
+	dir := t.TempDir()
+	if !caseInsensitive(dir) {
+		t.Skip("the temporary directory tells names apart by case")
+	}
+	sources := []string{"tcp://" + server.addr() + "/Readme.txt", "tcp://" + server.addr() + "/README.TXT", "tcp://" + server.addr() + "/readme.txt"}
+
+	for _, test := range []struct {
+		policy string
+		files  string
+	}{
+		{"rename", "README (1).TXT Readme.txt readme (2).txt"},
+		{"skip", "Readme.txt"},
+	} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, "-case-collision", test.policy)
+		kept, err := opts.resolveCollisions(sources, opts.log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := runBatch(opts, kept, nil, opts.log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		entries, _ := os.ReadDir(".")
+		for _, entry := range entries {
+			files = append(files, entry.Name())
+		}
+		if got := strings.Join(files, " "); got != test.files {
+			t.Errorf("-case-collision %s saved %s, want %s", test.policy, got, test.files)
+		}
+		if want := strings.TrimSpace(strings.Repeat("downloaded ", len(files))); statuses(results) != want {
+			t.Errorf("-case-collision %s: statuses %s, want %s", test.policy, statuses(results), want)
+		}
+	}
+
+	opts := newTestOptions(t, "-case-collision", "fail")
+	chdir(t, dir)
+	if _, err := opts.resolveCollisions(sources, opts.log); !errors.Is(err, errCaseCollision) {
+		t.Errorf("-case-collision fail returned %v", err)
+	}
+}
+
+func TestCaseCollisionsOnCaseSensitiveFilesystems(t *testing.T) {
+	dir := t.TempDir()
+	if caseInsensitive(dir) {
+		t.Skip("the temporary directory ignores case")
+	}
+	chdir(t, dir)
+	sources := []string{"tcp://files:8000/Readme.txt", "tcp://files:8000/README.TXT"}
+	opts := newTestOptions(t, "-case-collision", "fail")
+	if kept, err := opts.resolveCollisions(sources, opts.log); err != nil || len(kept) != 2 {
+		t.Errorf("kept %v, %v; want both files", kept, err)
+	}
+
+	opts = newTestOptions(t, "-case-collision", "ignore")
+	if _, err := opts.resolveCollisions(sources, opts.log); err == nil {
+		t.Error("-case-collision ignore accepted")
+	}
+}
+
+func TestCaseFreeName(t *testing.T) {
+	chdir(t, t.TempDir())
+	if err := os.WriteFile("A (1).txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	taken := map[string]string{"a.txt": "a.txt", "a (2).txt": "A (2).TXT"}
+	if got := caseFreeName("A.txt", taken); got != "A (3).txt" {
+		t.Errorf("caseFreeName = %q, want A (3).txt", got)
+	}
+	if got := swapCase("Case-Probe-1x"); got != "cASE-pROBE-1X" {
+		t.Errorf("swapCase = %q", got)
+	}
+}
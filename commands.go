@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// commandInfo describes a subcommand for help output. failure prefixes the
+// error the command exits with.
+type commandInfo struct {
+	name    string
+	usage   string
+	summary string
+	failure string
+}
+
+// commands are listed by -h in this order. Running the binary with sources
+// and no command is the same as get.
+var commands = []commandInfo{
+	{"get", "get [flags] [[tcp://host:port/]file ...]", "download files; takes the global flags after the command too", "error downloading files"},
+	{"put", "put [tcp://host:port/[name]] file ...", "upload local files, under their base names unless one file is given a name", "error uploading files"},
+	{"ls", "ls [flags] [[tcp://host:port/]pattern]", "list the files on a server", "error listing files"},
+	{"stat", "stat [flags] [tcp://host:port/]file ...", "show the size, modification time, hash and extended attributes of files on a server", "error getting file status"},
+	{"rm", "rm [tcp://host:port/]file ...", "delete files on a server", "error removing files"},
+	{"du", "du [flags] [tcp://host:port/]dir ...", "show the total size and number of files under directories on a server", "error getting disk usage"},
+	{"quota", "quota [flags] [tcp://host:port]", "show how much of its storage quota a server has left for this client", "error getting quota"},
+	{"sync", "sync [flags] [tcp://host:port/] dir", "make a directory match a server's files, or with -bidirectional each other", "error syncing files"},
+	{"daemon", "daemon [flags]", "run downloads submitted over an HTTP or gRPC control API", "error running daemon"},
+	{"service", "service install|uninstall|run [-name name] [-- daemon flags]", "run the daemon as a Windows service", "error running service"},
+	{"decrypt", "decrypt -i identity [-o file] file ...", "decrypt files saved with -encrypt-to", "error decrypting files"},
+	{"noise-keygen", "noise-keygen file", "make a key for -noise-key, printing its public half for the server", "error generating key"},
+	{"login", "login [tcp://host:port]", "save a server's token in the OS credential store, reading it from stdin", "error logging in"},
+	{"logout", "logout [tcp://host:port]", "delete a server's token from the OS credential store", "error logging out"},
+	{"history", "history [flags]", "query the transfer history", "error reading history"},
+	{"stats", "stats [flags]", "summarize the transfer history", "error reading history"},
+	{"audit", "audit [file]", "verify the audit log's hash chain", "error verifying audit log"},
+	{"ping", "ping [flags] [tcp://host:port]", "check that a server accepts connections and the handshake; also called check", "error checking server"},
+	{"diagnose", "diagnose [flags] [tcp://host:port/]file", "time each phase of a download to find where it is slow", "error diagnosing connection"},
+	{"help", "help [command]", "show help for a command", "error showing help"},
+}
+
+func lookupCommand(name string) *commandInfo {
+	if name == "check" {
+		name = "ping"
+	}
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// newCommandFlags returns the flag set for a subcommand, with help that
+// shows its usage line and summary above its flags.
+func newCommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		if info := lookupCommand(name); info != nil {
+			fmt.Fprintf(out, "usage: %s %s\n\n%s.\n", programName(), info.usage, capitalize(info.summary))
+		}
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out, "\nFlags:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parseGetFlags parses the flags given after "get". They are the global
+// flags, sharing their values, so "get -o name file" works as well as
+// "-o name get file".
+func parseGetFlags(args []string) []string {
+	fs := newCommandFlags("get")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fs.Parse(args)
+	return fs.Args()
+}
+
+// usage is the top-level -h output.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command] [args]\n\nCommands:\n", programName())
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-14s%s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nWithout a command, the arguments are files to get. Run \"%s help command\" for a command's flags.\n", programName())
+	fmt.Fprintf(out, "\nThe exit status is 0 if everything succeeded, %d if some files of a batch, sync or metalink failed, %d if -fail-fast stopped it early, and 1, or 2 for invalid flags, for other errors.\n\nGlobal flags:\n", exitPartial, exitAborted)
+	flag.PrintDefaults()
+}
+
+// runCommand runs every subcommand but get, which is main's own path.
+func runCommand(opts *options, name string, globals, args []string, logger *leveledLogger) error {
+	switch name {
+	case "put":
+		return runPut(opts, args, logger)
+	case "ls":
+		return runList(opts, args)
+	case "stat":
+		return runStat(opts, args)
+	case "rm":
+		return runRemove(opts, args, logger)
+	case "du":
+		return runDiskUsage(opts, args)
+	case "quota":
+		return runQuota(opts, args)
+	case "sync":
+		return runSync(opts, args, logger)
+	case "daemon":
+		return runDaemon(opts, args, logger)
+	case "service":
+		return runService(opts, globals, args, logger)
+	case "decrypt":
+		return runDecrypt(opts, args)
+	case "noise-keygen":
+		return runNoiseKeygen(opts, args)
+	case "login":
+		return runLogin(opts, args)
+	case "logout":
+		return runLogout(opts, args)
+	case "history":
+		return runHistory(opts, args)
+	case "stats":
+		return runStats(opts, args)
+	case "audit":
+		return runAudit(opts, args)
+	case "ping":
+		return runPing(opts, args)
+	case "diagnose":
+		return runDiagnose(opts, args)
+	case "help":
+		return runHelp(args)
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// runHelp implements help [command]; a command's help comes from its own
+// -h, which exits.
+func runHelp(args []string) error {
+	switch len(args) {
+	case 0:
+		usage()
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("usage: %s help [command]", programName())
+	}
+	info := lookupCommand(args[0])
+	if info == nil {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	switch info.name {
+	case "get":
+		parseGetFlags([]string{"-h"})
+	case "audit", "help", "put", "rm", "login", "logout", "noise-keygen", "service":
+		// These take no flags, or like service, only after an argument
+		// and only on Windows; their usage line says it all.
+		newCommandFlags(info.name).Usage()
+		return nil
+	}
+	return runCommand(nil, info.name, nil, []string{"-h"}, nil)
+}
+
+func programName() string {
+	name := os.Args[0]
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSuffix(name, ".exe")
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout is captureStderr for os.Stdout.
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = file
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		file.Close()
+	})
+	return func() string {
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestPutUploadsFiles(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{})
+	dir := t.TempDir()
+	writeLocal(t, dir, "a.txt", "alpha", 1000)
+	writeLocal(t, dir, "b.txt", "bravo", 2000)
+	opts := newTestOptions(t)
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+
+	if err := runPut(opts, []string{"tcp://" + tree.addr() + "/", a, b}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPut(opts, []string{"tcp://" + tree.addr() + "/renamed.txt", a}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]treeFile{"a.txt": {"alpha", 1000}, "b.txt": {"bravo", 2000}, "renamed.txt": {"alpha", 1000}} {
+		if got := tree.files[name]; got != want {
+			t.Errorf("server has %s as %+v, want %+v", name, got, want)
+		}
+	}
+
+	if err := runPut(opts, []string{"tcp://" + tree.addr() + "/c.txt", a, b}, opts.log); err == nil {
+		t.Error("put one name for two files succeeded")
+	}
+	if err := runPut(opts, []string{"tcp://" + tree.addr() + "/"}, opts.log); err == nil {
+		t.Error("put without files succeeded")
+	}
+	if err := runPut(opts, []string{"tcp://" + tree.addr() + "/", filepath.Join(dir, "missing.txt"), a}, opts.log); err == nil || err.Error() != "1 of 2 files failed" {
+		t.Errorf("put of a missing file: %v", err)
+	}
+}
+
+func TestRemoveDeletesFiles(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{"a.txt": {"alpha", 1000}, "b.txt": {"bravo", 2000}})
+	opts := newTestOptions(t)
+
+	err := runRemove(opts, []string{"tcp://" + tree.addr() + "/a.txt", "tcp://" + tree.addr() + "/bad name"}, opts.log)
+	if err == nil || err.Error() != "1 of 2 files failed" {
+		t.Errorf("rm returned %v", err)
+	}
+	if _, ok := tree.files["a.txt"]; ok {
+		t.Error("a.txt is still on the server")
+	}
+	if _, ok := tree.files["b.txt"]; !ok {
+		t.Error("b.txt was removed")
+	}
+	if got, want := tree.commands(), "RM a.txt"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+}
+
+func TestStatFindsFiles(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{"a.txt": {"alpha", 1000}, "b.txt": {"bravo", 2000}})
+	opts := newTestOptions(t)
+	stdout := captureStdout(t)
+
+	err := runStat(opts, []string{"-json", "tcp://" + tree.addr() + "/b.txt", "tcp://" + tree.addr() + "/missing.txt"})
+	if err == nil || err.Error() != "1 of 2 files not found" {
+		t.Errorf("stat returned %v", err)
+	}
+	var entries []listEntry
+	if err := json.Unmarshal([]byte(stdout()), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "b.txt" || entries[0].Size != 5 || entries[0].ModTime.Unix() != 2000 {
+		t.Errorf("stat printed %+v", entries)
+	}
+
+	if err := runStat(opts, []string{"tcp://" + tree.addr() + "/*.txt"}); err == nil {
+		t.Error("stat of a pattern succeeded")
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	var out bytes.Buffer
+	fs := newCommandFlags("ls")
+	fs.SetOutput(&out)
+	fs.Bool("json", false, "print JSON")
+	fs.Usage()
+	for _, want := range []string{"usage: " + programName() + " ls [flags] [[tcp://host:port/]pattern]\n", "\nList the files on a server.\n", "\nFlags:\n", "-json"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("ls usage %q lacks %q", out.String(), want)
+		}
+	}
+
+	out.Reset()
+	fs = newCommandFlags("rm")
+	fs.SetOutput(&out)
+	fs.Usage()
+	if strings.Contains(out.String(), "Flags:") {
+		t.Errorf("rm usage lists flags: %q", out.String())
+	}
+
+	if info := lookupCommand("check"); info == nil || info.name != "ping" {
+		t.Errorf("check is %v, want ping", info)
+	}
+	if err := runHelp([]string{"frobnicate"}); err == nil {
+		t.Error("help for an unknown command succeeded")
+	}
+	if err := runCommand(nil, "frobnicate", nil, nil, nil); err == nil {
+		t.Error("unknown command ran")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfigPath is where the config file is looked for when -config
+// isn't given, such as ~/.config/tcp-file-client/config on Linux.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tcp-file-client", "config")
+}
+
+// argValue finds a flag such as -config among the command line arguments,
+// which have to be looked at before they are parsed so that they can
+// override the file.
+func argValue(fs *flag.FlagSet, args []string, flagName string) (value string, ok bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == flagName && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(name, flagName+"=") {
+			return strings.TrimPrefix(name, flagName+"="), true
+		}
+		// Skip the value of other flags given as "-name value".
+		if f := fs.Lookup(name); f != nil && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return "", false
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// configSetting is one "name = value" in the config file.
+type configSetting struct {
+	line  int
+	name  string
+	value string
+}
+
+// loadConfig sets flags from the config file. Each line is a flag name
+// without the dash, optionally followed by "=" and a value; a name alone
+// turns a boolean flag on, and lines starting with "#" are comments:
+//
+//	reconnect = 5
+//	retry-on = dial,transfer
+//	verify
+//
+// Settings for one server can be grouped into a named profile, which
+// -profile selects. A profile's settings override those outside it, and may
+// also be written on one line separated by commas:
+//
+//	profile prod {
+//		addr = files.example.com:8000
+//		tls
+//	}
+//	profile staging { addr = 10.0.0.5:8000, token = s3cret }
+//
+// Flags given on the command line are parsed afterwards and win. A missing
+// file is only an error when -config named it.
+func loadConfig(fs *flag.FlagSet, args []string) error {
+	path, explicit := argValue(fs, args, "config")
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	profile, _ := argValue(fs, args, "profile")
+	if path == "" {
+		if profile != "" {
+			return fmt.Errorf("no config file to find profile %q in", profile)
+		}
+		return nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit && profile == "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening config file: %w", err)
+	}
+	defer file.Close()
+
+	settings, profiles, err := parseConfig(fs, path, file)
+	if err != nil {
+		return err
+	}
+	if profile != "" {
+		selected, ok := profiles[profile]
+		if !ok {
+			return fmt.Errorf("%s: no profile %q", path, profile)
+		}
+		settings = append(settings, selected...)
+	}
+	for _, s := range settings {
+		if err := fs.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %w", path, s.line, s.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig reads the settings outside profiles and those of each
+// profile, checking that every name is a flag.
+func parseConfig(fs *flag.FlagSet, path string, r io.Reader) ([]configSetting, map[string][]configSetting, error) {
+	var settings []configSetting
+	profiles := map[string][]configSetting{}
+	// profile is the name of the profile being read, if any.
+	var profile string
+	inProfile := false
+
+	add := func(line int, text string) error {
+		name, value, ok := strings.Cut(text, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok {
+			value = "true"
+		}
+		if name == "config" || name == "profile" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, line, name)
+		}
+		s := configSetting{line: line, name: name, value: strings.Trim(value, `"`)}
+		if inProfile {
+			profiles[profile] = append(profiles[profile], s)
+		} else {
+			settings = append(settings, s)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if !inProfile && strings.HasPrefix(text, "profile ") {
+			header, body, ok := strings.Cut(strings.TrimPrefix(text, "profile "), "{")
+			profile = strings.TrimSpace(header)
+			if !ok || profile == "" || strings.ContainsAny(profile, " \t") {
+				return nil, nil, fmt.Errorf("%s:%d: expected \"profile name {\"", path, line)
+			}
+			if _, ok := profiles[profile]; ok {
+				return nil, nil, fmt.Errorf("%s:%d: profile %q is defined twice", path, line, profile)
+			}
+			profiles[profile] = nil
+			inProfile, text = true, strings.TrimSpace(body)
+		}
+		if inProfile {
+			closed := strings.HasSuffix(text, "}")
+			for _, item := range splitSettings(fs, strings.TrimSuffix(text, "}")) {
+				if err := add(line, item); err != nil {
+					return nil, nil, err
+				}
+			}
+			inProfile = !closed
+			continue
+		}
+		if err := add(line, text); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	if inProfile {
+		return nil, nil, fmt.Errorf("%s: profile %q is missing its closing \"}\"", path, profile)
+	}
+	return settings, profiles, nil
+}
+
+// splitSettings splits the comma-separated settings of a one-line profile.
+// Values may contain commas themselves, as in "retry-on = dial,transfer",
+// so a comma only starts a new setting when a flag name follows it.
+func splitSettings(fs *flag.FlagSet, text string) []string {
+	var items []string
+	for _, part := range strings.Split(text, ",") {
+		name, _, _ := strings.Cut(part, "=")
+		if len(items) > 0 && fs.Lookup(strings.TrimSpace(name)) == nil {
+			items[len(items)-1] += "," + part
+			continue
+		}
+		if strings.TrimSpace(part) != "" {
+			items = append(items, strings.TrimSpace(part))
+		}
+	}
+	return items
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newConfigFlags is a flag set with -config, -profile and a few settings
+// for the config file to set.
+func newConfigFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("profile", "", "")
+	fs.String("addr", DefaultServerAddress, "")
+	fs.String("token", "", "")
+	fs.String("retry-on", "", "")
+	fs.Int("reconnect", 0, "")
+	fs.Bool("tls", false, "")
+	return fs
+}
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigProfiles(t *testing.T) {
+	path := writeConfig(t, `# defaults
+reconnect = 5
+retry-on = dial
+
+profile prod {
+	addr = files.example.com:8000
+	tls
+}
+profile staging { addr = 10.0.0.5:8000, retry-on = dial,transfer, token = "s3cret" }
+`)
+	for _, test := range []struct {
+		args []string
+		want map[string]string
+	}{
+		{[]string{"-config", path}, map[string]string{"addr": DefaultServerAddress, "reconnect": "5", "retry-on": "dial", "tls": "false"}},
+		{[]string{"-config", path, "-profile", "prod"}, map[string]string{"addr": "files.example.com:8000", "reconnect": "5", "tls": "true"}},
+		{[]string{"-config=" + path, "-profile=staging"}, map[string]string{"addr": "10.0.0.5:8000", "retry-on": "dial,transfer", "token": "s3cret", "tls": "false"}},
+		// -config and -profile are found after flags taking values, and
+		// the command line still wins.
+		{[]string{"-reconnect", "3", "-tls", "-profile", "staging", "-config", path, "-addr", "other:1"}, map[string]string{"addr": "other:1", "reconnect": "3", "tls": "true", "token": "s3cret"}},
+	} {
+		fs := newConfigFlags()
+		if err := loadConfig(fs, test.args); err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range test.want {
+			if got := fs.Lookup(name).Value.String(); got != want {
+				t.Errorf("%v: %s is %q, want %q", test.args, name, got, want)
+			}
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for text, want := range map[string]string{
+		"colour = blue\n":                           `:1: unknown setting "colour"`,
+		"profile\n":                                 `:1: unknown setting "profile"`,
+		"reconnect = often\nprofile prod { }\n":     ":1: invalid value for reconnect",
+		"profile prod\n":                            `:1: expected "profile name {"`,
+		"profile a b {\n}\n":                        `:1: expected "profile name {"`,
+		"profile prod {\n\ttls\n":                   `profile "prod" is missing its closing "}"`,
+		"profile prod { tls }\nprofile prod { }\n":  `:2: profile "prod" is defined twice`,
+		"profile prod {\n\tcolour = blue\n}\n":      `:2: unknown setting "colour"`,
+		"profile staging { tls }\n":                 `no profile "prod"`,
+		"profile prod { reconnect = often }\n# x\n": ":1: invalid value for reconnect",
+	} {
+		path := writeConfig(t, text)
+		err := loadConfig(newConfigFlags(), []string{"-config", path, "-profile", "prod"})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("config %q: %v, want %s", text, err, want)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if err := loadConfig(newConfigFlags(), []string{"-config", missing}); err == nil {
+		t.Error("a missing -config file was accepted")
+	}
+}
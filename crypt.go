@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// ageSuffix is added to the names of files saved encrypted.
+const ageSuffix = ".age"
+
+// recipientList is the repeatable -encrypt-to flag. Each value is an age
+// public key (age1...), an SSH public key, or a file of either, one per
+// line, such as an age recipients file or authorized_keys.
+type recipientList struct {
+	values     []string
+	recipients []age.Recipient
+}
+
+func (l *recipientList) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *recipientList) Set(value string) error {
+	recipients, err := parseRecipients(value)
+	if err != nil {
+		return err
+	}
+	l.values = append(l.values, value)
+	l.recipients = append(l.recipients, recipients...)
+	return nil
+}
+
+func (l *recipientList) enabled() bool {
+	return len(l.recipients) > 0
+}
+
+func parseRecipients(value string) ([]age.Recipient, error) {
+	if strings.HasPrefix(value, "age1") || strings.HasPrefix(value, "ssh-") {
+		r, err := parseRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+
+	f, err := os.Open(value)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recipients file: %w", err)
+	}
+	defer f.Close()
+	var recipients []age.Recipient
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRecipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", value, n, err)
+		}
+		recipients = append(recipients, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading recipients file: %w", err)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients in %s", value)
+	}
+	return recipients, nil
+}
+
+func parseRecipient(s string) (age.Recipient, error) {
+	if strings.HasPrefix(s, "ssh-") {
+		return agessh.ParseRecipient(s)
+	}
+	return age.ParseX25519Recipient(s)
+}
+
+// loadIdentities reads an age identity file, as written by age-keygen, or
+// an unencrypted SSH private key.
+func loadIdentities(path string) ([]age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity file: %w", err)
+	}
+	if strings.Contains(string(data), "PRIVATE KEY-----") {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SSH key %s: %w", path, err)
+		}
+		return []age.Identity{identity}, nil
+	}
+	identities, err := age.ParseIdentities(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// encryptingSink encrypts a download to the -encrypt-to recipients before
+// it reaches the sink beneath, so the plaintext never touches the disk.
+// The checks above it still see the plaintext.
+type encryptingSink struct {
+	sink
+	w io.WriteCloser
+}
+
+func (o *options) encryptSink(out sink) (sink, error) {
+	w, err := age.Encrypt(out, o.encryptTo.recipients...)
+	if err != nil {
+		out.abort()
+		return nil, fmt.Errorf("error encrypting file: %w", err)
+	}
+	return &encryptingSink{sink: out, w: w}, nil
+}
+
+func (s *encryptingSink) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *encryptingSink) commit() error {
+	// Closing writes the last chunk and its authentication tag.
+	if err := s.w.Close(); err != nil {
+		s.sink.abort()
+		return fmt.Errorf("error encrypting file: %w", err)
+	}
+	return s.sink.commit()
+}
+
+func (s *encryptingSink) quarantine(dir string) error {
+	if q, ok := s.sink.(quarantiner); ok {
+		return q.quarantine(dir)
+	}
+	return s.sink.abort()
+}
+
+// runDecrypt implements the decrypt subcommand: decrypt -i identity [-o
+// file] file .... Each file is written without its .age suffix, or with
+// .out added when it has none; a file that fails authentication is removed
+// again, so no half-decrypted output is left behind.
+func runDecrypt(opts *options, args []string) error {
+	var identityFile, output string
+	fs := newCommandFlags("decrypt")
+	fs.StringVar(&identityFile, "i", "", "age identity `file`, or an SSH private key")
+	fs.StringVar(&output, "o", "", "write the plaintext to this `file`, or - for stdout; only with one file")
+	fs.Parse(args)
+	if identityFile == "" || fs.NArg() == 0 {
+		return errors.New("usage: decrypt -i identity [-o file] file ...")
+	}
+	if output != "" && fs.NArg() > 1 {
+		return errors.New("-o can only be given when decrypting one file")
+	}
+	identities, err := loadIdentities(identityFile)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range fs.Args() {
+		target := output
+		if target == "" {
+			if target = strings.TrimSuffix(name, ageSuffix); target == name {
+				target = name + ".out"
+			}
+		}
+		if err := decryptFile(name, target, identities); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func decryptFile(name, target string, identities []age.Identity) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer in.Close()
+	r, err := age.Decrypt(bufio.NewReader(in), identities...)
+	if err != nil {
+		return fmt.Errorf("error decrypting file: %w", err)
+	}
+
+	if target == "-" {
+		_, err := io.Copy(os.Stdout, r)
+		return err
+	}
+	out, err := os.OpenFile(target+partialSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return fmt.Errorf("error decrypting file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := os.Rename(out.Name(), target); err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+)
+
+// newAgeKey writes a new age identity file to dir and returns its path and
+// recipient.
+func newAgeKey(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(path, []byte("# created: today\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, identity.Recipient().String()
+}
+
+// newSSHKey writes a new unencrypted ed25519 SSH key to dir and returns its
+// path and authorized_keys line.
+func newSSHKey(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic)))
+}
+
+func decryptWith(t *testing.T, path, identityFile string) string {
+	t.Helper()
+	identities, err := loadIdentities(identityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		t.Fatalf("decrypting %s: %v", path, err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plaintext)
+}
+
+func TestEncryptToRecipients(t *testing.T) {
+	server := newFileServer(t)
+	keys := t.TempDir()
+	ageIdentity, ageRecipient := newAgeKey(t, keys)
+	sshIdentity, sshRecipient := newSSHKey(t, keys)
+	recipients := filepath.Join(keys, "recipients.txt")
+	if err := os.WriteFile(recipients, []byte("# the backup host\n"+sshRecipient+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-encrypt-to", ageRecipient, "-encrypt-to", recipients)
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if _, err := os.Stat("a.txt"); err == nil {
+		t.Error("the plaintext was saved")
+	}
+	if results[0].Destination != "a.txt.age" {
+		t.Errorf("saved to %s, want a.txt.age", results[0].Destination)
+	}
+	for _, identity := range []string{ageIdentity, sshIdentity} {
+		if got := decryptWith(t, "a.txt.age", identity); got != "contents of a.txt" {
+			t.Errorf("%s decrypts to %q", filepath.Base(identity), got)
+		}
+	}
+	// The checks see the plaintext.
+	sum := sha256.Sum256([]byte("contents of a.txt"))
+	if results[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 %s, want the plaintext's", results[0].SHA256)
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	dir := t.TempDir()
+	_, recipient := newAgeKey(t, dir)
+	empty := filepath.Join(dir, "empty.txt")
+	bad := filepath.Join(dir, "bad.txt")
+	os.WriteFile(empty, []byte("# nobody\n\n"), 0600)
+	os.WriteFile(bad, []byte(recipient+"\nage1nope\n"), 0600)
+
+	var l recipientList
+	if err := l.Set(recipient); err != nil || !l.enabled() {
+		t.Errorf("Set(%s): %v", recipient, err)
+	}
+	for value, want := range map[string]string{
+		"age1nope":                        "",
+		empty:                             "no recipients in",
+		bad:                               "bad.txt:2:",
+		filepath.Join(dir, "missing.txt"): "error opening recipients file",
+	} {
+		if err := l.Set(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Set(%s): %v, want %q", value, err, want)
+		}
+	}
+}
+
+func TestDecryptCommand(t *testing.T) {
+	dir := t.TempDir()
+	identity, recipient := newAgeKey(t, dir)
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	w, err := age.Encrypt(&encrypted, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "secret data")
+	w.Close()
+	good, tampered := filepath.Join(dir, "good.txt.age"), filepath.Join(dir, "tampered.age")
+	os.WriteFile(good, encrypted.Bytes(), 0600)
+	data := encrypted.Bytes()
+	data[len(data)-1] ^= 1
+	os.WriteFile(tampered, data, 0600)
+
+	if err := runDecrypt(nil, []string{"-i", identity, good}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "good.txt")); err != nil || string(data) != "secret data" {
+		t.Errorf("decrypted %q, %v", data, err)
+	}
+
+	if err := runDecrypt(nil, []string{"-i", identity, tampered}); err == nil {
+		t.Error("a tampered file decrypted")
+	}
+	for _, name := range []string{"tampered", "tampered" + partialSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("a tampered file left %s behind", name)
+		}
+	}
+
+	if err := runDecrypt(nil, []string{"-i", identity, "-o", filepath.Join(dir, "x"), good, good}); err == nil {
+		t.Error("-o with two files was accepted")
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"tcpFileClient/controlpb"
+)
+
+const DefaultControlAddress = "127.0.0.1:8420"
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+var (
+	errNoJob      = errors.New("no such job")
+	errJobStarted = errors.New("job has already started")
+)
+
+// daemonStats is published on /debug/vars next to the runtime's memstats.
+var daemonStats = expvar.NewMap("daemon")
+
+// job is one download submitted to the daemon.
+type job struct {
+	ID          string          `json:"id"`
+	Source      string          `json:"source"`
+	Destination string          `json:"destination,omitempty"`
+	State       string          `json:"state"`
+	Submitted   time.Time       `json:"submitted"`
+	Result      *transferResult `json:"result,omitempty"`
+
+	// CoalescedWith is the ID of the job this one follows; see
+	// coalesceLocked.
+	CoalescedWith string `json:"coalesced_with,omitempty"`
+	// Window is when the job may run, in the form of -window, which it
+	// replaces.
+	Window  string `json:"window,omitempty"`
+	windows timeWindows
+
+	// transferID identifies the job's progress events while it runs.
+	transferID string
+	progress   *progressEvent
+	// key, followers and handoff belong to job coalescing: handoff is the
+	// follower that takes over when this job is cancelled.
+	key       string
+	followers []*job
+	handoff   *job
+}
+
+// daemon runs downloads submitted over its HTTP control API, up to -parallel at
+// a time:
+//
+//	POST   /jobs       {"source": "...", "destination": "..."} queues a job
+//	GET    /jobs       lists the jobs, forgetting finished ones past -keep-jobs
+//	GET    /jobs/ID    shows one job
+//	DELETE /jobs/ID    cancels a job that hasn't started
+//
+// Every request but /healthz and /readyz needs the token in -token-file.
+type daemon struct {
+	opts   *options
+	logger *leveledLogger
+	seen   *seenDB
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	order  []*job
+	active map[string]*job
+	nextID int
+	queue  chan *job
+	// changed is closed and replaced whenever a job changes, for WatchJob.
+	changed chan struct{}
+
+	lastSuccess time.Time
+	lastFailure time.Time
+	probes      probes
+
+	// keepJobs is how many finished jobs are remembered; see pruneLocked.
+	keepJobs int
+	// token authorizes control requests and root holds every job's
+	// destination; see daemon_auth.go.
+	token string
+	root  string
+}
+
+func runDaemon(opts *options, args []string, logger *leveledLogger) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return serveDaemon(opts, args, logger, stop, nil)
+}
+
+// serveDaemon runs the daemon until a value arrives on stop, calling ready,
+// if not nil, once the control API is being served.
+func serveDaemon(opts *options, args []string, logger *leveledLogger, stop <-chan os.Signal, ready func()) error {
+	var listen, grpcListen string
+	var debug bool
+	var keepJobs int
+	var tokenFile, root string
+	fs := newCommandFlags("daemon")
+	fs.StringVar(&listen, "listen", DefaultControlAddress, "`address` of the HTTP control API; ignored when systemd passes the listener in with socket activation")
+	fs.StringVar(&grpcListen, "grpc-listen", "", "also serve the gRPC control API, defined in controlpb/control.proto, on this `address`")
+	fs.BoolVar(&debug, "debug", false, "serve net/http/pprof profiles under /debug/pprof/ and expvar under /debug/vars on the control listener")
+	fs.IntVar(&keepJobs, "keep-jobs", 1000, "remember at most this `many` finished and cancelled jobs, forgetting the oldest first; 0 means no limit")
+	fs.StringVar(&tokenFile, "token-file", statePath(DefaultControlTokenFilename), "`file` holding the token control API clients must send as \"Authorization: Bearer <token>\"; a random one is written there if it doesn't exist")
+	fs.StringVar(&root, "root", ".", "`directory` that job destinations are relative to and can't leave")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: daemon [flags]")
+	}
+	token, err := loadControlToken(tokenFile)
+	if err != nil {
+		return err
+	}
+	logger.Infof("control API token in %s", tokenFile)
+
+	d := &daemon{opts: opts, logger: logger, jobs: map[string]*job{}, active: map[string]*job{}, queue: make(chan *job, 1024), changed: make(chan struct{}), keepJobs: keepJobs, token: token, root: root}
+	opts.onProgress = d.progress
+	if opts.seenDB != "" {
+		seen, err := openSeenDB(opts.seenDB)
+		if err != nil {
+			return err
+		}
+		d.seen = seen
+	}
+
+	listener, err := activatedListener()
+	if err != nil {
+		return err
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", listen); err != nil {
+			return fmt.Errorf("error listening for control connections: %w", err)
+		}
+	}
+	server := &http.Server{Handler: d.handler(debug), ReadHeaderTimeout: ConnectionTimeout}
+	serveErr := make(chan error, 2)
+	var grpcServer *grpc.Server
+	if grpcListen != "" {
+		grpcListener, err := net.Listen("tcp", grpcListen)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("error listening for gRPC control connections: %w", err)
+		}
+		grpcServer = grpc.NewServer(grpc.UnaryInterceptor(d.unaryAuth), grpc.StreamInterceptor(d.streamAuth))
+		controlpb.RegisterControlServer(grpcServer, &controlServer{d: d})
+		// Serve returns nil once stopped.
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				serveErr <- err
+			}
+		}()
+		logger.Infof("daemon serving gRPC on %s", grpcListener.Addr())
+	}
+
+	workers := opts.parallel
+	if workers < 1 {
+		workers = 1
+	}
+	workerDone := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(workerDone)
+	}()
+
+	go func() { serveErr <- server.Serve(listener) }()
+	logger.Infof("daemon listening on %s", listener.Addr())
+	if ready != nil {
+		ready()
+	}
+
+	notify, notifyErr := openNotifier()
+	if notifyErr != nil {
+		logger.Warnf("%v", notifyErr)
+	}
+	stopNotify := make(chan struct{})
+	if notify != nil {
+		defer notify.Close()
+		if err := notify.send("READY=1", d.status()); err != nil {
+			logger.Warnf("%v", err)
+		}
+		go d.supervise(notify, stopNotify)
+	}
+
+	select {
+	case err = <-serveErr:
+	case sig := <-stop:
+		logger.Infof("received %s, finishing the running jobs", sig)
+		if notify != nil {
+			notify.send("STOPPING=1", "STATUS=finishing the running jobs")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+		err = server.Shutdown(ctx)
+		cancel()
+	}
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+
+	// Jobs still queued are dropped; only the one in progress is finished.
+	d.mu.Lock()
+	for _, j := range d.order {
+		if j.State == jobQueued {
+			j.State = jobCancelled
+		}
+	}
+	d.changedLocked()
+	d.mu.Unlock()
+	close(d.queue)
+	<-workerDone
+	close(stopNotify)
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (d *daemon) handler(debug bool) http.Handler {
+	// Only the health probes answer without the token.
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", d.requireToken(http.HandlerFunc(d.serveJobs)))
+	mux.Handle("/jobs/", d.requireToken(http.HandlerFunc(d.serveJob)))
+	mux.HandleFunc("/healthz", d.serveHealth)
+	mux.HandleFunc("/readyz", d.serveReady)
+	if debug {
+		mux.Handle("/debug/pprof/", d.requireToken(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", d.requireToken(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", d.requireToken(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", d.requireToken(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", d.requireToken(http.HandlerFunc(pprof.Trace)))
+		mux.Handle("/debug/vars", d.requireToken(expvar.Handler()))
+	}
+	return mux
+}
+
+// work runs queued jobs until the queue is closed.
+func (d *daemon) work() {
+	for j := range d.queue {
+		d.mu.Lock()
+		for j.State == jobCancelled && j.handoff != nil {
+			j = j.handoff
+		}
+		if j.State != jobQueued {
+			d.mu.Unlock()
+			continue
+		}
+		if d.deferLocked(j) {
+			d.mu.Unlock()
+			continue
+		}
+		result := newTransferResult(j.Source, "")
+		result.windows = j.windows
+		j.State, j.transferID = jobRunning, result.ID
+		j.followLocked()
+		d.changedLocked()
+		d.mu.Unlock()
+
+		result, finish, err := d.opts.getAs(result, j.Source, j.Destination, d.seen, d.logger)
+		if err == nil {
+			err = finish()
+		}
+		d.opts.report(d.logger, result, err)
+		d.opts.breaker.record(sourceHost(j.Source), err, d.logger)
+
+		daemonStats.Add("jobs_"+result.Status, 1)
+		daemonStats.Add("bytes", result.Bytes)
+
+		d.mu.Lock()
+		j.State, j.Result, j.progress = jobDone, result, nil
+		j.followLocked()
+		if d.active[j.key] == j {
+			delete(d.active, j.key)
+		}
+		d.changedLocked()
+		switch result.Status {
+		case statusDownloaded:
+			d.lastSuccess = time.Now().UTC()
+		case statusFailed:
+			d.lastFailure = time.Now().UTC()
+		}
+		d.pruneLocked()
+		d.mu.Unlock()
+	}
+}
+
+func (d *daemon) serveJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Encoding to a slow client mustn't hold up the workers.
+		d.mu.Lock()
+		jobs := make([]job, len(d.order))
+		for i, j := range d.order {
+			jobs[i] = *j
+		}
+		d.mu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		var request struct {
+			Source      string `json:"source"`
+			Destination string `json:"destination"`
+			Window      string `json:"window"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, _, err := parseSource(request.Source); err != nil {
+			http.Error(w, "invalid source: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		destination, err := d.confine(request.Source, request.Destination)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var windows timeWindows
+		if request.Window != "" {
+			var err error
+			if windows, err = parseTimeWindows(request.Window); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		j, err := d.submit(request.Source, destination, windows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, j)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submit queues a job and returns a copy of it, safe to use without d.mu.
+func (d *daemon) submit(source, destination string, windows timeWindows) (job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextID++
+	j := &job{ID: strconv.Itoa(d.nextID), Source: source, Destination: destination, State: jobQueued, Submitted: time.Now().UTC(), windows: windows}
+	if windows != nil {
+		j.Window = windows.String()
+	}
+	if !d.coalesceLocked(j) {
+		select {
+		case d.queue <- j:
+		default:
+			delete(d.active, j.key)
+			return job{}, errors.New("job queue is full")
+		}
+	}
+	d.jobs[j.ID] = j
+	d.order = append(d.order, j)
+	d.changedLocked()
+	daemonStats.Add("jobs_submitted", 1)
+	return *j, nil
+}
+
+// deferLocked puts a job whose window is closed back on the queue once it
+// opens, leaving the worker free for other jobs, and reports whether it
+// did. d.mu must be held.
+func (d *daemon) deferLocked(j *job) bool {
+	windows := j.windows
+	if windows == nil {
+		windows = d.opts.window
+	}
+	now := time.Now()
+	if windows.open(now) {
+		return false
+	}
+	next := windows.opens(now)
+	d.logger.Infof("job %s is outside its transfer window; starting it at %s", j.ID, next.Format("Mon 15:04"))
+	d.requeue(j, next.Sub(now))
+	return true
+}
+
+func (d *daemon) requeue(j *job, after time.Duration) {
+	time.AfterFunc(after, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Shutting down cancels queued jobs before closing the queue.
+		if j.State != jobQueued {
+			return
+		}
+		select {
+		case d.queue <- j:
+		default:
+			d.requeue(j, time.Second)
+		}
+	})
+}
+
+// cancel cancels a job that hasn't started and returns a copy of it.
+func (d *daemon) cancel(id string) (job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	j, ok := d.jobs[id]
+	if !ok {
+		return job{}, errNoJob
+	}
+	if j.State != jobQueued {
+		return *j, fmt.Errorf("%w: job is %s", errJobStarted, j.State)
+	}
+	j.State = jobCancelled
+	d.cancelCoalescedLocked(j)
+	d.changedLocked()
+	snapshot := *j
+	d.pruneLocked()
+	return snapshot, nil
+}
+
+// pruneLocked forgets the oldest finished and cancelled jobs beyond the
+// -keep-jobs most recent, so a long-running daemon doesn't keep every job
+// it was ever given. d.mu must be held.
+func (d *daemon) pruneLocked() {
+	if d.keepJobs <= 0 {
+		return
+	}
+	finished := 0
+	for _, j := range d.order {
+		if j.State == jobDone || j.State == jobCancelled {
+			finished++
+		}
+	}
+	if finished <= d.keepJobs {
+		return
+	}
+	order := d.order[:0]
+	for _, j := range d.order {
+		if finished > d.keepJobs && (j.State == jobDone || j.State == jobCancelled) {
+			delete(d.jobs, j.ID)
+			finished--
+			continue
+		}
+		order = append(order, j)
+	}
+	for i := len(order); i < len(d.order); i++ {
+		d.order[i] = nil
+	}
+	d.order = order
+}
+
+// progress records a running job's progress event.
+func (d *daemon) progress(e progressEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range d.order {
+		if j.State == jobRunning && j.transferID == e.ID {
+			j.progress = &e
+			j.followLocked()
+			d.changedLocked()
+			return
+		}
+	}
+}
+
+// changedLocked wakes the watchers of jobs; d.mu must be held.
+func (d *daemon) changedLocked() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *daemon) serveJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch r.Method {
+	case http.MethodGet:
+		d.mu.Lock()
+		j, ok := d.jobs[id]
+		var snapshot job
+		if ok {
+			snapshot = *j
+		}
+		d.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshot)
+	case http.MethodDelete:
+		j, err := d.cancel(id)
+		switch {
+		case errors.Is(err, errNoJob):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, "job is "+j.State, http.StatusConflict)
+		default:
+			writeJSON(w, http.StatusOK, j)
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
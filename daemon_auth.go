@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The control APIs act with the daemon's account, so every request but the
+// health probes has to carry the daemon's token, as
+// "Authorization: Bearer <token>" or the gRPC metadata of the same name,
+// and jobs can only write inside -root.
+
+const DefaultControlTokenFilename = "daemon.token"
+
+var errUnauthorized = errors.New("missing or wrong control token")
+
+// loadControlToken reads the token in path, first writing a random one
+// there, readable only by the daemon's user, if the file doesn't exist.
+func loadControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return "", fmt.Errorf("error creating control token: %w", err)
+		}
+		data = []byte(hex.EncodeToString(random) + "\n")
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", fmt.Errorf("error creating control token: %w", err)
+		}
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading control token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("control token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// authorized reports whether the Authorization value carries the token. A
+// daemon without a token lets nothing through.
+func (d *daemon) authorized(authorization string) bool {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return token != authorization && d.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+// requireToken wraps a control API handler with the token check.
+func (d *daemon) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorized(r.Header.Get("Authorization")) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (d *daemon) authorizeRPC(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		if d.authorized(authorization) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, errUnauthorized.Error())
+}
+
+func (d *daemon) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := d.authorizeRPC(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (d *daemon) streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := d.authorizeRPC(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// confine resolves a job's destination, by default the source's name,
+// inside -root. Absolute paths, paths that climb out with .. and sink URLs
+// are refused.
+func (d *daemon) confine(source, destination string) (string, error) {
+	if destination == "" {
+		destination = d.opts.destination(source)
+	}
+	clean := filepath.Clean(destination)
+	if strings.Contains(destination, "://") || filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" ||
+		strings.HasPrefix(clean, string(filepath.Separator)) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("destination %q is not a relative path inside -root", destination)
+	}
+	return filepath.Join(d.root, clean), nil
+}
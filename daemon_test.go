@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestDaemon(t *testing.T, keepJobs int) *daemon {
+	opts := newTestOptions(t)
+	return &daemon{opts: opts, logger: opts.log, jobs: map[string]*job{}, active: map[string]*job{}, queue: make(chan *job, 16), changed: make(chan struct{}), keepJobs: keepJobs, token: "secret", root: t.TempDir()}
+}
+
+// lockCheckingWriter fails the test if d.mu is held while the response is
+// written.
+type lockCheckingWriter struct {
+	*httptest.ResponseRecorder
+	t *testing.T
+	d *daemon
+}
+
+func (w lockCheckingWriter) Write(p []byte) (int, error) {
+	if !w.d.mu.TryLock() {
+		w.t.Error("response written with the daemon locked")
+	} else {
+		w.d.mu.Unlock()
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServeJobsEncodesUnlocked(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	if _, err := d.submit("tcp://files:8000/a.txt", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/jobs", "/jobs/1"} {
+		w := lockCheckingWriter{httptest.NewRecorder(), t, d}
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		d.handler(false).ServeHTTP(w, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "a.txt") {
+			t.Errorf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDaemonForgetsOldFinishedJobs(t *testing.T) {
+	d := newTestDaemon(t, 2)
+	for i := 1; i <= 4; i++ {
+		if _, err := d.submit("tcp://files:8000/"+strconv.Itoa(i)+".txt", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := d.cancel(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	for _, j := range d.order {
+		ids = append(ids, j.ID)
+	}
+	if got, want := strings.Join(ids, " "), "2 3 4"; got != want {
+		t.Errorf("jobs %q, want %q", got, want)
+	}
+	if _, ok := d.jobs["1"]; ok {
+		t.Error("job 1 is still remembered")
+	}
+}
+
+func TestDaemonRequiresToken(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	for _, test := range []struct {
+		path, authorization string
+		code                int
+	}{
+		{"/jobs", "", http.StatusUnauthorized},
+		{"/jobs", "Bearer wrong", http.StatusUnauthorized},
+		{"/jobs", "secret", http.StatusUnauthorized},
+		{"/jobs", "Bearer secret", http.StatusOK},
+		{"/jobs/1", "", http.StatusUnauthorized},
+		{"/debug/vars", "", http.StatusUnauthorized},
+		{"/healthz", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		d.handler(true).ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("GET %s with %q: %d, want %d", test.path, test.authorization, w.Code, test.code)
+		}
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+	if err := d.authorizeRPC(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("gRPC with the wrong token: %v", err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	if err := d.authorizeRPC(ctx); err != nil {
+		t.Errorf("gRPC with the token: %v", err)
+	}
+}
+
+func TestDaemonConfinesDestinations(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	for destination, want := range map[string]string{
+		"":            filepath.Join(d.root, "a.txt"),
+		"sub/b.txt":   filepath.Join(d.root, "sub", "b.txt"),
+		"sub/../c":    filepath.Join(d.root, "c"),
+		"/etc/passwd": "",
+		"../d.txt":    "",
+		"sub/../../e": "",
+		"s3://bucket": "",
+	} {
+		body := `{"source": "tcp://files:8000/a.txt", "destination": "` + destination + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		d.handler(false).ServeHTTP(w, r)
+		if want == "" {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("destination %q: %d, want %d", destination, w.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		var j job
+		if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil || w.Code != http.StatusAccepted {
+			t.Errorf("destination %q: %d %s", destination, w.Code, w.Body)
+			continue
+		}
+		if j.Destination != want {
+			t.Errorf("destination %q saved to %s, want %s", destination, j.Destination, want)
+		}
+	}
+}
+
+func TestLoadControlTokenCreatesPrivateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", DefaultControlTokenFilename)
+	token, err := loadControlToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Errorf("token %q, want 32 random bytes in hex", token)
+	}
+	if info, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("token file %v, %v; want mode 0600", info.Mode(), err)
+	}
+	if again, err := loadControlToken(path); err != nil || again != token {
+		t.Errorf("reloaded %q, %v; want %q", again, err, token)
+	}
+}
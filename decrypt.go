@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// decryptKey is the -decrypt-with flag: the key downloads were encrypted
+// with on the server, which the client decrypts them with as they arrive.
+// It is either age identities (an age-keygen file or an SSH private key)
+// or a 256-bit AES key, raw or in hex, for files in the aesStream format.
+type decryptKey struct {
+	path       string
+	identities []age.Identity
+	aesKey     []byte
+}
+
+func (k *decryptKey) String() string {
+	return k.path
+}
+
+func (k *decryptKey) Set(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading key file: %w", err)
+	}
+	k.path, k.identities, k.aesKey = path, nil, nil
+	if bytes.Contains(data, []byte("AGE-SECRET-KEY-")) || bytes.Contains(data, []byte("PRIVATE KEY-----")) {
+		k.identities, err = loadIdentities(path)
+		return err
+	}
+	if len(data) == 32 {
+		k.aesKey = data
+		return nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("%s is neither an age identity nor a 256-bit AES key", path)
+	}
+	k.aesKey = key
+	return nil
+}
+
+func (k *decryptKey) enabled() bool {
+	return k.path != ""
+}
+
+// decrypt wraps a download's stream. A stream that fails authentication,
+// including one cut short, fails the transfer as a verification error.
+func (k *decryptKey) decrypt(r io.ReadCloser) (io.ReadCloser, error) {
+	var plain io.Reader
+	if k.aesKey != nil {
+		s, err := newAESStream(r, k.aesKey)
+		if err != nil {
+			return nil, &classifiedError{classVerification, err}
+		}
+		plain = s
+	} else {
+		d, err := age.Decrypt(r, k.identities...)
+		if err != nil {
+			return nil, &classifiedError{classVerification, fmt.Errorf("error decrypting file: %w", err)}
+		}
+		plain = d
+	}
+	return &decryptingReader{plain: plain, Closer: r}, nil
+}
+
+type decryptingReader struct {
+	plain io.Reader
+	io.Closer
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	n, err := d.plain.Read(p)
+	if err != nil && err != io.EOF && classify(err) != classNetwork {
+		err = &classifiedError{classVerification, fmt.Errorf("error decrypting file: %w", err)}
+	}
+	return n, err
+}
+
+// aesStream reads the AES format for servers that encrypt files without
+// age:
+//
+//	"TFCAES1\n" | 7-byte random nonce prefix | chunk ...
+//
+// Each chunk is up to aesChunkSize bytes of plaintext sealed with
+// AES-256-GCM, so 16 bytes longer. Its nonce is the prefix, the chunk's
+// number as a 4-byte big-endian counter and a byte that is 1 for the last
+// chunk and 0 otherwise, as in the STREAM construction. The last chunk is
+// always shorter than a full one, even if that leaves it empty, so a file
+// truncated at a chunk boundary is detected.
+type aesStream struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   [12]byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+const (
+	aesMagic     = "TFCAES1\n"
+	aesChunkSize = 64 << 10
+)
+
+func newAESStream(r io.Reader, key []byte) (*aesStream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(aesMagic)+7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+	if string(header[:len(aesMagic)]) != aesMagic {
+		return nil, errors.New("file is not in the AES stream format")
+	}
+	s := &aesStream{r: r, aead: aead, chunk: make([]byte, aesChunkSize+aead.Overhead())}
+	copy(s.nonce[:7], header[len(aesMagic):])
+	return s, nil
+}
+
+func (s *aesStream) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *aesStream) next() error {
+	n, err := io.ReadFull(s.r, s.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		return errors.New("encrypted file is truncated")
+	case err != nil:
+		return err
+	}
+	if n < s.aead.Overhead() {
+		return errors.New("encrypted file is truncated")
+	}
+
+	binary.BigEndian.PutUint32(s.nonce[7:11], s.counter)
+	if last {
+		s.nonce[11] = 1
+	}
+	plain, err := s.aead.Open(s.chunk[:0], s.nonce[:], s.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("chunk %d failed authentication", s.counter)
+	}
+	if s.counter++; s.counter == 0 {
+		return errors.New("encrypted file has too many chunks")
+	}
+	s.plain, s.done = plain, last
+	return nil
+}
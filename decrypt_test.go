@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// sealAES writes plaintext in the aesStream format, as a server would.
+func sealAES(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []byte(aesMagic + "prefix!")
+	var nonce [12]byte
+	copy(nonce[:7], "prefix!")
+	for counter := uint32(0); ; counter++ {
+		n := len(plaintext)
+		last := n < aesChunkSize
+		if !last {
+			n = aesChunkSize
+		}
+		binary.BigEndian.PutUint32(nonce[7:11], counter)
+		if last {
+			nonce[11] = 1
+		}
+		out = aead.Seal(out, nonce[:], plaintext[:n], nil)
+		plaintext = plaintext[n:]
+		if last {
+			return out
+		}
+	}
+}
+
+func openAES(key, data []byte) ([]byte, error) {
+	s, err := newAESStream(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(s)
+}
+
+func TestAESStream(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, size := range []int{0, 10, aesChunkSize, 2*aesChunkSize + 5} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		got, err := openAES(key, sealAES(t, key, plaintext))
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: read back %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	sealed := sealAES(t, key, bytes.Repeat([]byte("x"), aesChunkSize))
+	header, full := len(aesMagic)+7, aesChunkSize+16
+	tampered := append([]byte(nil), sealed...)
+	tampered[header+5] ^= 1
+	wrongKey := bytes.Repeat([]byte{8}, 32)
+	for _, test := range []struct {
+		name string
+		key  []byte
+		data []byte
+		want string
+	}{
+		{"tampered", key, tampered, "chunk 0 failed authentication"},
+		// Without its empty last chunk, the file ends at a chunk boundary.
+		{"cut at a chunk", key, sealed[:header+full], "encrypted file is truncated"},
+		{"cut in a chunk", key, sealed[:header+100], "chunk 0 failed authentication"},
+		{"wrong key", wrongKey, sealed, "failed authentication"},
+		{"not encrypted", key, []byte("contents of a.txt"), "not in the AES stream format"},
+	} {
+		if _, err := openAES(test.key, test.data); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: %v, want %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDecryptKeyFormats(t *testing.T) {
+	dir := t.TempDir()
+	identity, _ := newAgeKey(t, dir)
+	raw, hexKey, short := filepath.Join(dir, "raw.key"), filepath.Join(dir, "hex.key"), filepath.Join(dir, "short.key")
+	key := bytes.Repeat([]byte{7}, 32)
+	os.WriteFile(raw, key, 0600)
+	os.WriteFile(hexKey, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	os.WriteFile(short, []byte(hex.EncodeToString(key[:24])), 0600)
+
+	var k decryptKey
+	if err := k.Set(identity); err != nil || len(k.identities) != 1 || k.aesKey != nil {
+		t.Errorf("age identity: %v", err)
+	}
+	for _, path := range []string{raw, hexKey} {
+		if err := k.Set(path); err != nil || !bytes.Equal(k.aesKey, key) || k.identities != nil {
+			t.Errorf("%s: key %x, %v", filepath.Base(path), k.aesKey, err)
+		}
+	}
+	if err := k.Set(short); err == nil {
+		t.Error("a 192-bit key was accepted")
+	}
+}
+
+// newServedFiles serves fixed contents by name, without a handshake.
+func newServedFiles(t *testing.T, files map[string][]byte) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok {
+			conn.Write(files[strings.TrimPrefix(line, "GET ")])
+		}
+	})
+}
+
+func TestDecryptWithDownloads(t *testing.T) {
+	keys := t.TempDir()
+	identity, recipient := newAgeKey(t, keys)
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	w, err := age.Encrypt(&encrypted, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "age plaintext")
+	w.Close()
+	tampered := append([]byte(nil), encrypted.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	aesKey := bytes.Repeat([]byte{7}, 32)
+	aesFile := filepath.Join(keys, "aes.key")
+	os.WriteFile(aesFile, aesKey, 0600)
+	server := newServedFiles(t, map[string][]byte{
+		"a.txt.age":   encrypted.Bytes(),
+		"bad.txt.age": tampered,
+		"b.bin":       sealAES(t, aesKey, []byte("aes plaintext")),
+	})
+
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-decrypt-with", identity, "-retry-on", "dial,transfer")
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt.age", "tcp://" + server.addr() + "/bad.txt.age"}, nil, opts.log)
+	if statuses(results) != "downloaded failed" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if data, err := os.ReadFile("a.txt"); err != nil || string(data) != "age plaintext" {
+		t.Errorf("saved %q, %v", data, err)
+	}
+	if results[1].ErrorClass != string(classVerification) || results[1].Attempts != 1 {
+		t.Errorf("tampered file failed as %s after %d attempts, want %s after 1", results[1].ErrorClass, results[1].Attempts, classVerification)
+	}
+	for _, name := range []string{"bad.txt", "bad.txt" + partialSuffix, "bad.txt.age"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("the tampered file left %s behind", name)
+		}
+	}
+
+	opts = newTestOptions(t, "-decrypt-with", aesFile)
+	results, err = runBatch(opts, []string{"tcp://" + server.addr() + "/b.bin"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if data, err := os.ReadFile("b.bin"); err != nil || string(data) != "aes plaintext" {
+		t.Errorf("saved %q, %v", data, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diagnosis is the report of the diagnose subcommand.
+type diagnosis struct {
+	Server          string   `json:"server"`
+	File            string   `json:"file"`
+	DialMS          float64  `json:"dial_ms"`
+	HandshakeMS     float64  `json:"handshake_ms,omitempty"`
+	FirstByteMS     float64  `json:"first_byte_ms"`
+	TransferMS      float64  `json:"transfer_ms"`
+	Bytes           int64    `json:"bytes"`
+	BytesPerSecond  float64  `json:"bytes_per_second"`
+	Stalls          int      `json:"stalls"`
+	StalledMS       float64  `json:"stalled_ms"`
+	LongestGapMS    float64  `json:"longest_gap_ms"`
+	Findings        []string `json:"findings,omitempty"`
+	legacyHandshake bool
+}
+
+// runDiagnose implements the diagnose subcommand: diagnose [flags]
+// [tcp://host:port/]file. It downloads the file to nowhere while timing
+// each phase of the connection. Gaps between reads longer than -stall are
+// counted as stalls; on an otherwise fast link they are the usual sign of
+// lost packets waiting for retransmission.
+func runDiagnose(opts *options, args []string) error {
+	var asJSON bool
+	var stall time.Duration
+	fs := newCommandFlags("diagnose")
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	fs.DurationVar(&stall, "stall", 200*time.Millisecond, "count gaps between reads longer than this `duration` as stalls")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		return errors.New("usage: diagnose [flags] [tcp://host:port/]file")
+	}
+	arg := DefaultFilename
+	if fs.NArg() == 1 {
+		arg = fs.Arg(0)
+	}
+	source, filename, err := parseSource(arg)
+	if err != nil {
+		return err
+	}
+	if source.Scheme != "tcp" {
+		return fmt.Errorf("diagnose only supports tcp:// sources, not %s", source.Scheme)
+	}
+
+	d := &diagnosis{Server: source.Host, File: filename}
+	if err := opts.diagnose(d, source, stall); err != nil {
+		return err
+	}
+	d.analyze(stall)
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(d)
+	}
+	return d.print(os.Stdout)
+}
+
+func (o *options) diagnose(d *diagnosis, source *url.URL, stall time.Duration) error {
+	conn, err := o.diagnoseConnect(d, source.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := o.requestFile(conn, source.Host, strings.TrimPrefix(source.Path, "/"), ""); err != nil {
+		return err
+	}
+
+	buffer := getBuffer(DefaultBufferSize)
+	defer putBuffer(buffer)
+	var first, last time.Time
+	for {
+		n, err := deadlineReader{conn}.Read(buffer)
+		now := time.Now()
+		if n > 0 {
+			if first.IsZero() {
+				first = now
+				d.FirstByteMS = milliseconds(now.Sub(start))
+			} else {
+				gap := now.Sub(last)
+				if gap > stall {
+					d.Stalls++
+					d.StalledMS += milliseconds(gap)
+				}
+				if milliseconds(gap) > d.LongestGapMS {
+					d.LongestGapMS = milliseconds(gap)
+				}
+			}
+			last = now
+			d.Bytes += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading data from connection: %w", err)
+		}
+	}
+
+	if d.Bytes > 0 {
+		d.TransferMS = milliseconds(last.Sub(first))
+		if elapsed := last.Sub(first).Seconds(); elapsed > 0 {
+			d.BytesPerSecond = float64(d.Bytes) / elapsed
+		}
+	}
+	return nil
+}
+
+// diagnoseConnect dials and, unless -legacy, greets the server, recording
+// how long each took. A server without the handshake closes the connection after the
+// HELLO, so it is dialed again for the transfer.
+func (o *options) diagnoseConnect(d *diagnosis, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := o.dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	d.DialMS = milliseconds(time.Since(start))
+	if o.legacy {
+		return conn, nil
+	}
+
+	start = time.Now()
+	_, err = o.handshake(address, conn, bufio.NewReader(deadlineReader{conn}), false)
+	switch {
+	case err == nil:
+		d.HandshakeMS = milliseconds(time.Since(start))
+		return conn, nil
+	case errors.Is(err, errNoHandshake):
+		conn.Close()
+		d.legacyHandshake = true
+		if conn, err = o.dial(address); err != nil {
+			return nil, fmt.Errorf("error connecting to server: %w", err)
+		}
+		return conn, nil
+	default:
+		conn.Close()
+		return nil, err
+	}
+}
+
+// analyze turns the measurements into findings a person can act on. The
+// thresholds are rough; they are meant to point at the slow phase, not to
+// grade the link.
+func (d *diagnosis) analyze(stall time.Duration) {
+	if d.legacyHandshake {
+		d.Findings = append(d.Findings, "the server does not support the handshake; the transfer used a second connection")
+	}
+	if d.DialMS > 500 {
+		d.Findings = append(d.Findings, "connecting is slow: check DNS, proxies and the network path")
+	}
+	if wait := d.FirstByteMS - d.DialMS; wait > 1000 && wait > 10*d.DialMS {
+		d.Findings = append(d.Findings, "the server is slow to start sending: it may be overloaded or reading from slow storage")
+	}
+	if d.Stalls > 0 {
+		d.Findings = append(d.Findings, fmt.Sprintf("%d stalls over %s, %.0f ms in total: a sign of packet loss and retransmission", d.Stalls, stall, d.StalledMS))
+	}
+	if d.Bytes == 0 {
+		d.Findings = append(d.Findings, "the server sent no data: the file may not exist")
+	}
+}
+
+func (d *diagnosis) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "server:\t%s\n", d.Server)
+	fmt.Fprintf(tw, "file:\t%s\n", d.File)
+	fmt.Fprintf(tw, "dial:\t%.1f ms\n", d.DialMS)
+	if d.legacyHandshake {
+		fmt.Fprintf(tw, "handshake:\tnot supported\n")
+	} else {
+		fmt.Fprintf(tw, "handshake:\t%.1f ms\n", d.HandshakeMS)
+	}
+	fmt.Fprintf(tw, "first byte:\t%.1f ms\n", d.FirstByteMS)
+	fmt.Fprintf(tw, "transfer:\t%d bytes in %.1f ms\n", d.Bytes, d.TransferMS)
+	fmt.Fprintf(tw, "throughput:\t%s/s\n", formatBytes(int64(d.BytesPerSecond)))
+	fmt.Fprintf(tw, "stalls:\t%d (%.0f ms, longest gap %.1f ms)\n", d.Stalls, d.StalledMS, d.LongestGapMS)
+	for _, finding := range d.Findings {
+		fmt.Fprintf(tw, "finding:\t%s\n", finding)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseCountsStalls(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := serveHello(r, conn)
+		if !ok || line != "GET a.txt" {
+			return
+		}
+		conn.Write([]byte("first half "))
+		time.Sleep(150 * time.Millisecond)
+		conn.Write([]byte("second half"))
+	})
+	opts := newTestOptions(t)
+	d := &diagnosis{Server: server.addr(), File: "a.txt"}
+
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}
+	if err := opts.diagnose(d, source, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	d.analyze(50 * time.Millisecond)
+	if d.Bytes != int64(len("first half second half")) || d.Stalls != 1 || d.LongestGapMS < 150 {
+		t.Errorf("diagnosis %+v, want 22 bytes with one stall of at least 150 ms", d)
+	}
+	if d.legacyHandshake {
+		t.Error("the handshake was reported unsupported")
+	}
+	if len(d.Findings) != 1 || !strings.Contains(d.Findings[0], "1 stalls over 50ms") {
+		t.Errorf("findings %q", d.Findings)
+	}
+}
+
+func TestDiagnoseLegacyServer(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok && line == "GET a.txt" {
+			conn.Write([]byte("old"))
+		}
+	})
+	opts := newTestOptions(t)
+	d := &diagnosis{Server: server.addr(), File: "a.txt"}
+
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}
+	if err := opts.diagnose(d, source, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d.analyze(time.Second)
+	if !d.legacyHandshake || d.Bytes != 3 || server.connections() != 2 {
+		t.Errorf("diagnosis %+v over %d connections, want 3 bytes over a second connection", d, server.connections())
+	}
+	var out strings.Builder
+	d.print(&out)
+	if !strings.Contains(out.String(), "handshake:   not supported") {
+		t.Errorf("printed\n%s", out.String())
+	}
+}
+
+func TestDiagnoseFindings(t *testing.T) {
+	d := &diagnosis{DialMS: 600, FirstByteMS: 8000}
+	d.analyze(time.Second)
+	want := []string{"connecting is slow", "slow to start sending", "sent no data"}
+	if len(d.Findings) != len(want) {
+		t.Fatalf("findings %q, want %d", d.Findings, len(want))
+	}
+	for i, finding := range d.Findings {
+		if !strings.Contains(finding, want[i]) {
+			t.Errorf("finding %q, want one about %q", finding, want[i])
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func (o *options) dial(address string) (net.Conn, error) {
+	return o.dialContext(context.Background(), address)
+}
+
+// dialContext is dial on behalf of the transfer in ctx, if any.
+func (o *options) dialContext(parent context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(parent, ConnectionTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := o.dialTransport(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	o.transferLog(ctx).Debugf("connected to %s in %s; reads and writes time out after %s without progress", address, time.Since(start).Round(time.Microsecond), ConnectionTimeout)
+	if err := o.socket.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if o.noise.enabled() {
+		return o.noise.client(conn)
+	}
+	if o.psk.enabled() {
+		return o.psk.client(conn)
+	}
+	if !o.tls.enabled() {
+		return conn, nil
+	}
+	return o.tls.client(ctx, conn, address)
+}
+
+// dialTransport connects to address through the configured proxy or SSH
+// tunnel, without adding TLS on top.
+func (o *options) dialTransport(ctx context.Context, address string) (net.Conn, error) {
+	dialer, err := o.proxyDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.ssh.enabled() {
+		return o.ssh.dial(dialer, address)
+	}
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return dialer.Dial("tcp", address)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// diskUsage is a server's answer to "DU dir", which servers with the "du"
+// capability compute over the whole tree under dir without sending a
+// listing:
+//
+//	DU logs/2024
+//	OK bytes=73400320 files=1200 dirs=12
+//
+// dir is relative to the server's root, and "." is the root itself.
+type diskUsage struct {
+	Server string `json:"server"`
+	Dir    string `json:"dir"`
+	Bytes  int64  `json:"bytes"`
+	Files  int64  `json:"files"`
+	Dirs   int64  `json:"dirs,omitempty"`
+}
+
+// validateDir checks a directory for DU: "." or names that would pass
+// validateFilename, joined with slashes.
+func validateDir(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	for _, name := range strings.Split(dir, "/") {
+		if name == "." || name == ".." || validateFilename(name) != nil {
+			return fmt.Errorf("invalid directory: %s", dir)
+		}
+	}
+	return nil
+}
+
+func (o *options) diskUsage(address, dir string) (*diskUsage, error) {
+	if dir = strings.Trim(dir, "/"); dir == "" {
+		dir = "."
+	}
+	if err := validateDir(dir); err != nil {
+		return nil, err
+	}
+	reply, err := o.command(address, "DU "+dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	du := &diskUsage{Server: address, Dir: dir}
+	fields := map[string]*int64{"bytes": &du.Bytes, "files": &du.Files, "dirs": &du.Dirs}
+	if err := parseCounts(reply, fields, "bytes"); err != nil {
+		return nil, err
+	}
+	return du, nil
+}
+
+// runDiskUsage implements the du subcommand: du [flags]
+// [tcp://host:port/]dir ....
+func runDiskUsage(opts *options, args []string) error {
+	var asJSON bool
+	fs := newCommandFlags("du")
+	fs.BoolVar(&asJSON, "json", false, "print each directory's usage as a line of JSON")
+	fs.Parse(args)
+	targets := fs.Args()
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+
+	failed := 0
+	for _, arg := range targets {
+		server, dir, err := remoteTarget(arg)
+		if err != nil {
+			return err
+		}
+		du, err := opts.diskUsage(server, dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+			failed++
+			continue
+		}
+		if asJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(du); err != nil {
+				return err
+			}
+			continue
+		}
+		name := du.Dir
+		if name == "." {
+			name = ""
+		}
+		fmt.Printf("%10s %8d files  %s\n", formatBytes(du.Bytes), du.Files, remoteURL(du.Server, name))
+	}
+	if failed > 0 {
+		return errors.New("could not get the usage of every directory")
+	}
+	return nil
+}
+
+// estimate logs how much a sync of the server's files involves at most, for
+// servers that answer DU; the listing says exactly what has changed.
+func (s *syncOptions) estimate(opts *options, address string, logger *leveledLogger) {
+	du, err := opts.diskUsage(address, ".")
+	if err != nil {
+		logger.Debugf("not estimating the sync from %s: %v", address, err)
+		return
+	}
+	logger.Infof("%s holds %d files, %s in total", address, du.Files, formatBytes(du.Bytes))
+}
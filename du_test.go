@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newDUServer answers "DU dir" from usage, keyed by dir, and with ERR for
+// other directories.
+func newDUServer(t *testing.T, log *eventLog, usage map[string]string) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		if !ok {
+			return
+		}
+		log.add(line)
+		if reply, ok := usage[strings.TrimPrefix(line, "DU ")]; ok {
+			conn.Write([]byte("OK " + reply + "\n"))
+		} else {
+			conn.Write([]byte("ERR no such directory\n"))
+		}
+	})
+}
+
+func TestDiskUsage(t *testing.T) {
+	var log eventLog
+	server := newDUServer(t, &log, map[string]string{
+		".":         "bytes=73400320 files=1200 dirs=12",
+		"logs/2024": "bytes=2048 files=2 owner=ops",
+	})
+	opts := newTestOptions(t)
+
+	for _, test := range []struct {
+		dir  string
+		want diskUsage
+	}{
+		{"", diskUsage{Dir: ".", Bytes: 73400320, Files: 1200, Dirs: 12}},
+		{"/", diskUsage{Dir: ".", Bytes: 73400320, Files: 1200, Dirs: 12}},
+		{"logs/2024/", diskUsage{Dir: "logs/2024", Bytes: 2048, Files: 2}},
+	} {
+		test.want.Server = server.addr()
+		if du, err := opts.diskUsage(server.addr(), test.dir); err != nil || *du != test.want {
+			t.Errorf("du %q: %+v, %v; want %+v", test.dir, du, err, test.want)
+		}
+	}
+	for _, dir := range []string{"../etc", "logs/./2024", "logs//2024", "bad name"} {
+		if _, err := opts.diskUsage(server.addr(), dir); err == nil || !strings.Contains(err.Error(), "invalid directory") {
+			t.Errorf("du %q: %v", dir, err)
+		}
+	}
+	if got, want := log.String(), "DU ., DU ., DU logs/2024"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+}
+
+func TestDiskUsageCommand(t *testing.T) {
+	var log eventLog
+	server := newDUServer(t, &log, map[string]string{"logs": "bytes=2048 files=2 dirs=1"})
+	opts := newTestOptions(t)
+	stdout := captureStdout(t)
+	stderr := captureStderr(t)
+
+	err := runDiskUsage(opts, []string{"tcp://" + server.addr() + "/logs", "tcp://" + server.addr() + "/missing"})
+	if err == nil {
+		t.Error("du of a missing directory succeeded")
+	}
+	if got, want := stdout(), fmt.Sprintf("%10s %8d files  %s\n", formatBytes(2048), 2, "tcp://"+server.addr()+"/logs"); got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+	if !strings.Contains(stderr(), "/missing: server error: no such directory") {
+		t.Errorf("reported %q", stderr())
+	}
+
+	if err := runDiskUsage(opts, []string{"-json", "tcp://" + server.addr() + "/logs"}); err != nil {
+		t.Fatal(err)
+	}
+	_, line, _ := strings.Cut(stdout(), "\n")
+	var du diskUsage
+	if err := json.Unmarshal([]byte(line), &du); err != nil || du != (diskUsage{Server: server.addr(), Dir: "logs", Bytes: 2048, Files: 2, Dirs: 1}) {
+		t.Errorf("JSON %q: %+v, %v", line, du, err)
+	}
+}
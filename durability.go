@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// nocacheChunk is how much a -nocache download writes between flushing and
+// dropping its pages.
+const nocacheChunk = 8 << 20
+
+// Write passes p to the file and, with -nocache, regularly pushes what was
+// written to disk and drops it from the page cache, so a huge download
+// doesn't evict everything else that is cached.
+func (s *fileSink) Write(p []byte) (int, error) {
+	n, err := s.File.Write(p)
+	if s.nocache {
+		s.unflushed += int64(n)
+		if s.unflushed >= nocacheChunk {
+			s.unflushed = 0
+			if err := dropPageCache(s.File); err != nil {
+				return n, fmt.Errorf("error flushing file: %w", err)
+			}
+		}
+	}
+	return n, err
+}
+
+// syncDir flushes a directory, so a file renamed into it is on stable
+// storage. Windows has no way to open a directory for that, and commits
+// renames to disk with the file.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDurableDownloads(t *testing.T) {
+	server := newFileServer(t)
+	for _, flag := range []string{"-fsync", "-nocache", "-fsync=false"} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, flag)
+		if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+			t.Fatalf("%s: %v", flag, err)
+		}
+		if data, _ := os.ReadFile("a.txt"); string(data) != "contents of a.txt" {
+			t.Errorf("%s: downloaded %q", flag, data)
+		}
+	}
+}
+
+func TestNocacheFlushesAsItWrites(t *testing.T) {
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-nocache")
+	out, _, err := opts.openFileSink("big.bin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := out.(*fileSink)
+	chunk := bytes.Repeat([]byte{'x'}, 3<<20)
+	for i := 0; i < 4; i++ {
+		if _, err := s.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third write passes 8 MiB and flushes; the fourth is unflushed.
+	if s.unflushed != 3<<20 {
+		t.Errorf("%d bytes unflushed, want %d", s.unflushed, 3<<20)
+	}
+	if err := s.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat("big.bin"); err != nil || info.Size() != 12<<20 {
+		t.Errorf("committed %v, %v", info, err)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	if err := syncDir(t.TempDir()); err != nil {
+		t.Error(err)
+	}
+	if err := syncDir(filepath.Join(t.TempDir(), "missing")); err == nil && runtime.GOOS != "windows" {
+		t.Error("synced a directory that doesn't exist")
+	}
+}
+
+func TestVerifyReadback(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-verify-readback")
+	if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile("a.txt"); string(data) != "contents of a.txt" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	// Storage that returns something other than what was written.
+	out, _, err := opts.openFileSink("b.txt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := out.(*fileSink)
+	s.Write([]byte("written"))
+	if err := os.WriteFile(s.File.Name(), []byte("garbled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("written"))
+	if err := s.commitVerified(hex.EncodeToString(sum[:])); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("commit of a garbled file returned %v, want a checksum mismatch", err)
+	}
+	for _, name := range []string{"b.txt", "b.txt" + partialSuffix} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%s left behind after the read-back failed", name)
+		}
+	}
+}
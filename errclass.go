@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// errorClass sorts failures by what retrying them could achieve.
+type errorClass string
+
+const (
+	// classNetwork is a dropped, refused or timed out connection, which a
+	// retry may well get past.
+	classNetwork errorClass = "network"
+	// classServer is the server answering with ERR, or with something the
+	// protocol doesn't allow: the file is missing, the token is wrong, and
+	// asking again changes nothing.
+	classServer errorClass = "server"
+	// classLocal is a failure reading or writing local files, such as a
+	// full disk or a missing directory.
+	classLocal errorClass = "local"
+	// classVerification is a file that arrived but failed its checksum,
+	// content or malware checks, or changed while it was fetched.
+	classVerification errorClass = "verification"
+	classUnknown      errorClass = ""
+)
+
+// serverError is an "ERR message" reply.
+type serverError struct {
+	message string
+}
+
+func (e *serverError) Error() string {
+	return "server error: " + e.message
+}
+
+// classifiedError pins a class on an error whose type alone wouldn't give
+// it the right one.
+type classifiedError struct {
+	class errorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classify says which class err belongs to. The checks run from the most
+// specific down, so a checksum failure found while reading a connection is
+// a verification failure, not a network one.
+func classify(err error) errorClass {
+	var classified *classifiedError
+	var server *serverError
+	var malformed *protocolError
+	var netErr net.Error
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	switch {
+	case err == nil:
+		return classUnknown
+	case errors.As(err, &classified):
+		return classified.class
+	case errors.Is(err, errChecksumMismatch), errors.Is(err, errSourceChanged), errors.Is(err, errContentRejected),
+		errors.Is(err, errInfected), errors.Is(err, errPinMismatch):
+		return classVerification
+	case errors.As(err, &server), errors.As(err, &malformed), errors.Is(err, errNoHandshake):
+		return classServer
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		// Before net.Error, which the syscall.Errno inside a PathError
+		// satisfies too.
+		return classLocal
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return classNetwork
+	}
+	return classUnknown
+}
+
+// retryable reports whether err is worth another attempt.
+func retryable(err error) bool {
+	return classify(err) == classNetwork
+}
+
+// permanent reports whether err is known not to be worth another attempt.
+// Errors that can't be classified are neither retryable nor permanent.
+func permanent(err error) bool {
+	class := classify(err)
+	return class != classNetwork && class != classUnknown
+}
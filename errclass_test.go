@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	_, pathErr := os.Open("/nonexistent/file")
+	for _, test := range []struct {
+		err  error
+		want errorClass
+	}{
+		{nil, classUnknown},
+		{errors.New("something else"), classUnknown},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, classNetwork},
+		{fmt.Errorf("error reading file: %w", io.ErrUnexpectedEOF), classNetwork},
+		{&serverError{message: "no such file"}, classServer},
+		{fmt.Errorf("error reading reply: %w", &protocolError{problem: "bad size", line: "SIZE x"}), classServer},
+		{pathErr, classLocal},
+		{&os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, classLocal},
+		{fmt.Errorf("error reading file: %w", errChecksumMismatch), classVerification},
+		{errInfected, classVerification},
+		{&classifiedError{class: classServer, err: io.ErrUnexpectedEOF}, classServer},
+	} {
+		if got := classify(test.err); got != test.want {
+			t.Errorf("classify(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+
+	if !retryable(io.ErrUnexpectedEOF) || retryable(&serverError{"gone"}) || retryable(errors.New("?")) {
+		t.Error("only network errors should be retryable")
+	}
+	if !permanent(&serverError{"gone"}) || permanent(io.ErrUnexpectedEOF) || permanent(errors.New("?")) {
+		t.Error("only classified, non-network errors should be permanent")
+	}
+}
+
+func TestResultsCarryErrorClass(t *testing.T) {
+	server := newTokenServer(t, "s3cret")
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-retry-on", "none", "-token", "wrong")
+
+	results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + refused.Addr().String() + "/b.txt"}, nil, opts.log)
+	if results[0].ErrorClass != "server" || results[1].ErrorClass != "network" {
+		t.Errorf("error classes %q (%s) and %q (%s), want server and network", results[0].ErrorClass, results[0].Error, results[1].ErrorClass, results[1].Error)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func openEventLog(source string) (logSink, error) {
+	return nil, errors.New("the Windows Event Log is only available on Windows")
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "testing"
+
+func TestEventLogOnlyOnWindows(t *testing.T) {
+	if _, err := openEventLog("tcp-file-client"); err == nil {
+		t.Error("opened the Windows Event Log")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogSink reports messages to the Windows Event Log. Debug messages are
+// left out; the Event Log is for the events an operator looks for, such as
+// completed and failed transfers.
+type eventLogSink struct {
+	log *eventlog.Log
+}
+
+const eventID = 1
+
+func openEventLog(source string) (logSink, error) {
+	// Registering the source needs administrator rights, so it is only
+	// attempted once; an unregistered source still logs, but Event Viewer
+	// shows a warning that the message description is missing.
+	if err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil && !strings.Contains(err.Error(), "exists") {
+		fmt.Fprintf(os.Stderr, "warning: could not register event source %s: %v\n", source, err)
+	}
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("error opening event log: %w", err)
+	}
+	l.Info(eventID, "started: "+strings.Join(os.Args[1:], " "))
+	return &eventLogSink{log: l}, nil
+}
+
+func (s *eventLogSink) write(level logLevel, message string, fields map[string]string) error {
+	switch level {
+	case levelError:
+		return s.log.Error(eventID, message)
+	case levelWarn:
+		return s.log.Warning(eventID, message)
+	case levelInfo:
+		return s.log.Info(eventID, message)
+	}
+	return nil
+}
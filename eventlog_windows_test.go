@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestEventLogWritesEachLevel(t *testing.T) {
+	sink, err := openEventLog("tcp-file-client-test")
+	if err != nil {
+		t.Skipf("cannot open the event log here: %v", err)
+	}
+	defer sink.(*eventLogSink).log.Close()
+	for level := levelDebug; level <= levelError; level++ {
+		if err := sink.write(level, "test message at "+level.String(), nil); err != nil {
+			t.Errorf("writing at %s: %v", level.String(), err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes. A batch or sync in which some files failed exits with
+// exitPartial, having carried on with the rest, or with -fail-fast, which
+// stops at the first failure, exitAborted; anything else that goes wrong
+// exits with 1, or 2 for invalid flags, as the flag package does.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitPartial = 3
+	exitAborted = 4
+)
+
+// batchFailure is what a batch or sync run that didn't fully succeed
+// returns.
+type batchFailure struct {
+	failed, total int
+	// skipped counts the files -fail-fast left unattempted.
+	skipped int
+	aborted bool
+}
+
+func (f *batchFailure) Error() string {
+	if f.aborted {
+		return fmt.Sprintf("stopped at the first failure (-fail-fast), leaving %d files unattempted", f.skipped)
+	}
+	return fmt.Sprintf("%d of %d files failed", f.failed, f.total)
+}
+
+func exitCode(err error) int {
+	var f *batchFailure
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &f) && f.aborted:
+		return exitAborted
+	case errors.As(err, &f):
+		return exitPartial
+	}
+	return exitError
+}
+
+// resultsExitCode is the exit code for a batch's results: exitAborted if
+// -fail-fast left any source unattempted, or else exitPartial if any file
+// failed.
+func resultsExitCode(results []*transferResult) int {
+	code := exitOK
+	for _, r := range results {
+		switch {
+		case r.unattempted:
+			return exitAborted
+		case r.Status == statusFailed:
+			code = exitPartial
+		}
+	}
+	return code
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Extensions change how the protocol behaves, unlike capabilities, which
+// only say which commands a server understands, so both sides have to agree
+// to each one. A server that can negotiate them lists "ext" among its
+// capabilities; the client then offers the extensions it would like and
+// the server answers with the ones it turns on:
+//
+//	EXT sha256 zstd
+//	OK sha256
+//
+// Neither side may assume an extension the other hasn't confirmed, so a
+// client and server that know different ones still work together, with
+// just the extensions they share, and neither sends EXT to, or expects it
+// from, an older peer.
+//
+// clientExtensions are the ones this client offers, in order:
+//
+//   - sha256: framed GET responses carry the file's digest after its size,
+//     which the client checks as the file arrives.
+var clientExtensions = []string{"sha256"}
+
+// maxExtensions bounds the server's answer, as maxCapabilities does HELLO's.
+const maxExtensions = 64
+
+// offeredExtensions are clientExtensions less those turned off with
+// -disable-extension.
+func (o *options) offeredExtensions() []string {
+	var names []string
+	for _, name := range clientExtensions {
+		if !o.disabledExtensions[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (o *options) disableExtension(name string) error {
+	if !containsString(clientExtensions, name) {
+		return fmt.Errorf("unknown extension %q: this client knows %s", name, strings.Join(clientExtensions, ", "))
+	}
+	if o.disabledExtensions == nil {
+		o.disabledExtensions = make(map[string]bool)
+	}
+	o.disabledExtensions[name] = true
+	return nil
+}
+
+// negotiateExtensions offers the client's extensions to a server that
+// negotiates them and records the ones it confirms in hello. The server
+// may only confirm extensions it was offered.
+func (o *options) negotiateExtensions(w io.Writer, r *bufio.Reader, hello *serverHello) error {
+	offered := o.offeredExtensions()
+	if !hello.supports("ext") || len(offered) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(w, "EXT "+strings.Join(offered, " ")+"\n"); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	reply, err := readReply(r)
+	if err != nil {
+		return fmt.Errorf("error negotiating extensions: %w", err)
+	}
+	confirmed := strings.Fields(reply)
+	if len(confirmed) > maxExtensions {
+		return &protocolError{fmt.Sprintf("more than %d extensions", maxExtensions), "OK " + reply}
+	}
+	for _, name := range confirmed {
+		if !containsString(offered, name) {
+			return &protocolError{fmt.Sprintf("extension %q was not offered", name), "OK " + reply}
+		}
+	}
+	hello.Extensions = confirmed
+	return nil
+}
+
+func (h *serverHello) extension(name string) bool {
+	return containsString(h.Extensions, name)
+}
+
+// parseFileHeader parses the text of a framed GET response: "size", or
+// with the sha256 extension, "size digest".
+func parseFileHeader(text string, hello *serverHello) (int64, []byte, error) {
+	line := "OK " + text
+	sizeText, digestText, hasDigest := strings.Cut(text, " ")
+	size, err := parseSize(sizeText, line)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !hasDigest {
+		return size, nil, nil
+	}
+	if !hello.extension("sha256") {
+		return 0, nil, &protocolError{"unexpected text after the size", line}
+	}
+	digest, err := hex.DecodeString(digestText)
+	if err != nil || len(digest) != sha256.Size {
+		return 0, nil, &protocolError{"invalid sha256", line}
+	}
+	return size, digest, nil
+}
+
+// digestReader checks what it reads, once it has read all size bytes,
+// against the sha256 the server sent.
+type digestReader struct {
+	r      *io.LimitedReader
+	hash   hash.Hash
+	digest []byte
+}
+
+func newDigestReader(r io.Reader, size int64, digest []byte) io.Reader {
+	if digest == nil {
+		return io.LimitReader(r, size)
+	}
+	return &digestReader{r: &io.LimitedReader{R: r, N: size}, hash: sha256.New(), digest: digest}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && d.r.N == 0 {
+		if sum := d.hash.Sum(nil); string(sum) != string(d.digest) {
+			return n, &classifiedError{classVerification, fmt.Errorf("sha256 mismatch: server sent %x, received %x", d.digest, sum)}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// extServer is a pipelining server that negotiates extensions, confirming
+// those in confirm that it is offered, or exactly confirm if force is set.
+// With sha256 on, it sends each file's digest, a wrong one for names
+// starting with "corrupt".
+type extServer struct {
+	*fakeServer
+	confirm []string
+	force   bool
+
+	mu      sync.Mutex
+	offered []string
+}
+
+func newExtServer(t *testing.T, force bool, confirm ...string) *extServer {
+	s := &extServer{confirm: confirm, force: force}
+	s.fakeServer = newFakeServer(t, s.serve)
+	return s
+}
+
+func (s *extServer) serve(n int, conn net.Conn, r *bufio.Reader) {
+	line, ok := serveHello(r, conn, "pipeline", "ext")
+	var on []string
+	if offer := strings.TrimPrefix(line, "EXT "); ok && offer != line {
+		offered := strings.Fields(offer)
+		s.mu.Lock()
+		s.offered = append(s.offered, offer)
+		s.mu.Unlock()
+		for _, name := range s.confirm {
+			if s.force || containsString(offered, name) {
+				on = append(on, name)
+			}
+		}
+		conn.Write([]byte("OK " + strings.Join(on, " ") + "\n"))
+		line, ok = readRequest(r)
+	}
+	for ; ok; line, ok = readRequest(r) {
+		name := strings.TrimPrefix(line, "GET ")
+		contents := "contents of " + name
+		if !containsString(on, "sha256") {
+			fmt.Fprintf(conn, "OK %d\n%s", len(contents), contents)
+			continue
+		}
+		sum := sha256.Sum256([]byte(contents))
+		if strings.HasPrefix(name, "corrupt") {
+			sum = sha256.Sum256([]byte("something else"))
+		}
+		fmt.Fprintf(conn, "OK %d %s\n%s", len(contents), hex.EncodeToString(sum[:]), contents)
+	}
+}
+
+func (s *extServer) offers() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.offered, ", ")
+}
+
+func TestSHA256Extension(t *testing.T) {
+	server := newExtServer(t, false, "sha256", "zstd")
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "4", "-retry-on", "none")
+	closePipelines(t, opts)
+
+	var sources []string
+	for _, name := range []string{"a.txt", "corrupt.txt", "b.txt"} {
+		sources = append(sources, "tcp://"+server.addr()+"/"+name)
+	}
+	results, _ := runBatch(opts, sources, nil, opts.log)
+	if got, want := statuses(results), "downloaded failed downloaded"; got != want {
+		t.Fatalf("statuses %q, want %q", got, want)
+	}
+	if results[1].ErrorClass != string(classVerification) || !strings.Contains(results[1].Error, "sha256 mismatch") {
+		t.Errorf("corrupt file failed with %s: %s", results[1].ErrorClass, results[1].Error)
+	}
+	// The mismatch doesn't break the pipeline.
+	if n := server.connections(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if got := server.offers(); got != "sha256" {
+		t.Errorf("offered %q, want sha256", got)
+	}
+}
+
+func TestExtensionNegotiation(t *testing.T) {
+	disabled := newExtServer(t, false, "sha256")
+	opts := newTestOptions(t, "-disable-extension", "sha256")
+	if result, err := opts.ping(disabled.addr()); err != nil || len(result.Hello.Extensions) != 0 {
+		t.Errorf("ping with sha256 disabled: %+v, %v", result.Hello, err)
+	}
+	if got := disabled.offers(); got != "" {
+		t.Errorf("offered %q with every extension disabled", got)
+	}
+
+	confirmed := newExtServer(t, false, "sha256")
+	if result, err := newTestOptions(t).ping(confirmed.addr()); err != nil || strings.Join(result.Hello.Extensions, " ") != "sha256" {
+		t.Errorf("ping: %+v, %v", result.Hello, err)
+	}
+
+	unoffered := newExtServer(t, true, "zstd")
+	if _, err := newTestOptions(t).ping(unoffered.addr()); err == nil || !strings.Contains(err.Error(), `extension "zstd" was not offered`) {
+		t.Errorf("ping of a server confirming zstd: %v", err)
+	}
+
+	// A server without "ext" is never sent EXT.
+	var log eventLog
+	old := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := serveHello(r, conn); ok {
+			log.add(line)
+		}
+	})
+	newTestOptions(t).ping(old.addr())
+	if strings.Contains(log.String(), "EXT") {
+		t.Errorf("server without ext got %s", log.String())
+	}
+
+	if err := opts.disableExtension("zstd"); err == nil {
+		t.Error("disabling an unknown extension succeeded")
+	}
+}
+
+func TestParseFileHeader(t *testing.T) {
+	sum := sha256.Sum256([]byte("x"))
+	digest := hex.EncodeToString(sum[:])
+	with, without := &serverHello{Extensions: []string{"sha256"}}, &serverHello{}
+	for _, test := range []struct {
+		text   string
+		hello  *serverHello
+		size   int64
+		digest bool
+		err    string
+	}{
+		{"12", without, 12, false, ""},
+		{"12", with, 12, false, ""},
+		{"12 " + digest, with, 12, true, ""},
+		{"12 " + digest, without, 0, false, "unexpected text after the size"},
+		{"12 abc", with, 0, false, "invalid sha256"},
+		{"12 " + digest[:62], with, 0, false, "invalid sha256"},
+		{"-1", with, 0, false, "size"},
+	} {
+		size, got, err := parseFileHeader(test.text, test.hello)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: %v, want %s", test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil || size != test.size || (got != nil) != test.digest {
+			t.Errorf("%q: size %d, digest %x, %v", test.text, size, got, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// remoteTarget splits a put, rm or stat argument into the server and the
+// file's name there; a bare name is on the default server.
+func remoteTarget(arg string) (server, name string, err error) {
+	if !strings.Contains(arg, "://") {
+		return ServerAddress, arg, nil
+	}
+	u, err := parseTCPURL(arg)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func remoteURL(server, name string) string {
+	return (&url.URL{Scheme: "tcp", Host: server, Path: "/" + name}).String()
+}
+
+// runPut implements the put subcommand: put [tcp://host:port/[name]] file
+// .... Each file is uploaded under its base name, or a single file under
+// the name in the url.
+func runPut(opts *options, args []string, logger *leveledLogger) error {
+	fs := newCommandFlags("put")
+	fs.Parse(args)
+
+	files := fs.Args()
+	server, name := ServerAddress, ""
+	if len(files) > 0 && strings.Contains(files[0], "://") {
+		var err error
+		if server, name, err = remoteTarget(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	if len(files) == 0 {
+		return errors.New("usage: put [tcp://host:port/[name]] file ...")
+	}
+	if name != "" && len(files) > 1 {
+		return errors.New("a remote name can only be given when putting one file")
+	}
+
+	opts.checkQuota(logger, server, files)
+	failed := 0
+	for _, local := range files {
+		remote := name
+		if remote == "" {
+			remote = filepath.Base(local)
+		}
+		result := newTransferResult(remoteURL(server, remote), local)
+		result.Action = actionUpload
+		err := validateFilename(remote)
+		if err == nil {
+			if info, statErr := os.Stat(local); statErr == nil {
+				result.Bytes = info.Size()
+			}
+			err = opts.putFile(server, remote, local)
+		}
+		opts.report(logger, result, err)
+		if result.Status == statusFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+// runRemove implements the rm subcommand: rm [tcp://host:port/]file ....
+func runRemove(opts *options, args []string, logger *leveledLogger) error {
+	fs := newCommandFlags("rm")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: rm [tcp://host:port/]file ...")
+	}
+
+	failed := 0
+	for _, arg := range fs.Args() {
+		server, name, err := remoteTarget(arg)
+		result := newTransferResult(arg, "")
+		result.Action = actionDeleteRemote
+		if err == nil {
+			result.Source = remoteURL(server, name)
+			if err = validateFilename(name); err == nil {
+				err = opts.removeFile(server, name)
+			}
+		}
+		opts.report(logger, result, err)
+		if result.Status == statusFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+// runStat implements the stat subcommand: stat [flags]
+// [tcp://host:port/]file .... It looks each file up in its server's
+// listing and prints what the listing says about it.
+func runStat(opts *options, args []string) error {
+	var asJSON, xattrs bool
+	fs := newCommandFlags("stat")
+	fs.BoolVar(&asJSON, "json", false, "print the files as a JSON array")
+	fs.BoolVar(&xattrs, "xattrs", false, "also ask the server for extended attributes")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: stat [flags] [tcp://host:port/]file ...")
+	}
+
+	var found []listEntry
+	missing := 0
+	for _, arg := range fs.Args() {
+		server, name, err := remoteTarget(arg)
+		if err != nil {
+			return err
+		}
+		if name == "" || isGlob(name) || strings.ContainsAny(name, " \t\r\n") {
+			return fmt.Errorf("stat takes file names, not %q", name)
+		}
+		entries, err := opts.list(server, &listFilter{pattern: name, xattrs: xattrs})
+		if err != nil {
+			return err
+		}
+		entry, ok := findEntry(entries, name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: no such file\n", arg)
+			missing++
+			continue
+		}
+		found = append(found, entry)
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(found); err != nil {
+			return err
+		}
+	} else {
+		for i, entry := range found {
+			if i > 0 {
+				fmt.Println()
+			}
+			printEntry(entry)
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d files not found", missing, fs.NArg())
+	}
+	return nil
+}
+
+func findEntry(entries []listEntry, name string) (listEntry, bool) {
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return listEntry{}, false
+}
+
+func printEntry(entry listEntry) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "name\t%s\n", entry.Name)
+	fmt.Fprintf(tw, "size\t%d (%s)\n", entry.Size, formatBytes(entry.Size))
+	fmt.Fprintf(tw, "modified\t%s\n", entry.ModTime.Local().Format(time.RFC3339))
+	if entry.SHA256 != "" {
+		fmt.Fprintf(tw, "sha256\t%s\n", entry.SHA256)
+	}
+	names := make([]string, 0, len(entry.Xattrs))
+	for name := range entry.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s%s\t%q\n", xattrPrefix, name, entry.Xattrs[name])
+	}
+	tw.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// filterRule is one -include or -exclude pattern.
+type filterRule struct {
+	include bool
+	pattern string
+}
+
+// filterRules are evaluated in the order given and the first matching rule
+// decides, as in rsync; names no rule matches are included. A pattern
+// containing a slash is matched against the whole remote path, otherwise
+// against the base name, so "-exclude '*.tmp'" applies in every directory.
+type filterRules []filterRule
+
+func (r *filterRules) adder(include bool) func(string) error {
+	return func(pattern string) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		*r = append(*r, filterRule{include: include, pattern: pattern})
+		return nil
+	}
+}
+
+func (r filterRules) allows(name string) bool {
+	name = strings.TrimPrefix(name, "/")
+	for _, rule := range r {
+		subject := name
+		if !strings.Contains(rule.pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(rule.pattern, subject); ok {
+			return rule.include
+		}
+	}
+	return true
+}
+
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// expandSources replaces glob arguments naming files on a tcp server with
+// the matching entries of the server's listing, and drops sources the
+// include/exclude rules reject.
+func (o *options) expandSources(args []string, logger *leveledLogger) ([]string, error) {
+	var sources []string
+	for _, arg := range args {
+		if !isGlob(sourcePath(arg)) {
+			if o.filters.allows(sourcePath(arg)) {
+				sources = append(sources, arg)
+			} else {
+				logger.Infof("skipped file %s", arg)
+			}
+			continue
+		}
+
+		server, pattern := ServerAddress, arg
+		if strings.Contains(arg, "://") {
+			u, err := parseTCPURL(arg)
+			if err != nil {
+				return nil, err
+			}
+			server, pattern = u.Host, strings.TrimPrefix(u.Path, "/")
+		}
+
+		entries, err := o.list(server, &listFilter{pattern: pattern})
+		if err != nil {
+			return nil, fmt.Errorf("error expanding %s: %w", arg, err)
+		}
+		if len(entries) == 0 {
+			logger.Warnf("%s matched no files", arg)
+		}
+		for _, entry := range entries {
+			if !o.filters.allows(entry.Name) {
+				continue
+			}
+			if server == ServerAddress && !strings.Contains(arg, "://") {
+				sources = append(sources, entry.Name)
+			} else {
+				sources = append(sources, "tcp://"+server+"/"+entry.Name)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// sourcePath is the remote path a source argument refers to.
+func sourcePath(arg string) string {
+	if _, rest, ok := strings.Cut(arg, "://"); ok {
+		if _, p, ok := strings.Cut(rest, "/"); ok {
+			return p
+		}
+		return ""
+	}
+	return arg
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFilterRulesFirstMatchWins(t *testing.T) {
+	opts := newTestOptions(t, "-include", "logs/keep.tmp", "-exclude", "*.tmp", "-exclude", "cache/*", "-include", "*.log", "-exclude", "*")
+	for name, want := range map[string]bool{
+		"app.log":       true,
+		"/logs/app.log": true,
+		"logs/keep.tmp": true,
+		"logs/x.tmp":    false,
+		"deep/a/b.tmp":  false,
+		"cache/a.log":   false,
+		"notes.txt":     false,
+	} {
+		if got := opts.filters.allows(name); got != want {
+			t.Errorf("allows(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if !newTestOptions(t).filters.allows("anything") {
+		t.Error("no rules rejected a file")
+	}
+	if err := newTestOptions(t).filters.adder(true)("[unclosed"); err == nil {
+		t.Error("accepted an invalid pattern")
+	}
+}
+
+func TestExpandSourcesListsGlobs(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		if !ok {
+			return
+		}
+		if line != "LIST logs/*" {
+			t.Errorf("request %q, want LIST logs/*", line)
+			return
+		}
+		conn.Write([]byte("logs/a.log\t1\t1700000000\t-\nlogs/b.tmp\t1\t1700000000\t-\nlogs/c.log\t1\t1700000000\t-\n"))
+	})
+	opts := newTestOptions(t, "-exclude", "*.tmp")
+
+	prefix := "tcp://" + server.addr() + "/"
+	sources, err := opts.expandSources([]string{prefix + "logs/*", prefix + "plain.tmp", prefix + "plain.txt"}, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{prefix + "logs/a.log", prefix + "logs/c.log", prefix + "plain.txt"}
+	if strings.Join(sources, " ") != strings.Join(want, " ") {
+		t.Errorf("sources %v, want %v", sources, want)
+	}
+}
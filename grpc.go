@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"tcpFileClient/controlpb"
+)
+
+// controlServer implements the gRPC control API on top of the same jobs as
+// the HTTP one.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+	d *daemon
+}
+
+func (s *controlServer) SubmitJob(ctx context.Context, r *controlpb.SubmitJobRequest) (*controlpb.Job, error) {
+	if _, _, err := parseSource(r.Source); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid source: %v", err)
+	}
+	destination, err := s.d.confine(r.Source, r.Destination)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var windows timeWindows
+	if r.Window != "" {
+		var err error
+		if windows, err = parseTimeWindows(r.Window); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	j, err := s.d.submit(r.Source, destination, windows)
+	if err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return j.proto(), nil
+}
+
+func (s *controlServer) CancelJob(ctx context.Context, r *controlpb.CancelJobRequest) (*controlpb.Job, error) {
+	j, err := s.d.cancel(r.Id)
+	switch {
+	case errors.Is(err, errNoJob):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return j.proto(), nil
+}
+
+func (s *controlServer) ListJobs(ctx context.Context, r *controlpb.ListJobsRequest) (*controlpb.ListJobsResponse, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	response := &controlpb.ListJobsResponse{}
+	for _, j := range s.d.order {
+		response.Jobs = append(response.Jobs, j.proto())
+	}
+	return response, nil
+}
+
+// WatchJob sends an update whenever the job differs from the last one
+// sent. Progress comes at most every progressInterval, so a slow client
+// only ever misses intermediate updates, never the final state.
+func (s *controlServer) WatchJob(r *controlpb.WatchJobRequest, stream controlpb.Control_WatchJobServer) error {
+	var last *controlpb.JobUpdate
+	for {
+		s.d.mu.Lock()
+		j, ok := s.d.jobs[r.Id]
+		var update *controlpb.JobUpdate
+		var finished bool
+		if ok {
+			update, finished = j.update(), j.State == jobDone || j.State == jobCancelled
+		}
+		changed := s.d.changed
+		s.d.mu.Unlock()
+
+		if !ok {
+			return status.Error(codes.NotFound, errNoJob.Error())
+		}
+		if last == nil || !proto.Equal(update, last) {
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+			last = update
+		}
+		if finished {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// proto converts a job; for one still in the daemon, d.mu must be held.
+func (j *job) proto() *controlpb.Job {
+	p := &controlpb.Job{
+		Id:            j.ID,
+		Source:        j.Source,
+		Destination:   j.Destination,
+		State:         j.State,
+		Submitted:     timestamppb.New(j.Submitted),
+		CoalescedWith: j.CoalescedWith,
+		Window:        j.Window,
+	}
+	if r := j.Result; r != nil {
+		p.Result = &controlpb.TransferResult{
+			Id:          r.ID,
+			Destination: r.Destination,
+			Status:      r.Status,
+			Bytes:       r.Bytes,
+			Sha256:      r.SHA256,
+			Error:       r.Error,
+			ErrorClass:  r.ErrorClass,
+			Attempts:    int32(r.Attempts),
+			DurationMs:  r.DurationMS,
+		}
+	}
+	return p
+}
+
+func (j *job) update() *controlpb.JobUpdate {
+	u := &controlpb.JobUpdate{Job: j.proto()}
+	if e := j.progress; e != nil {
+		u.Progress = &controlpb.Progress{Bytes: e.Bytes, Total: e.Total, Rate: e.Rate, EtaSeconds: e.ETASeconds}
+	}
+	return u
+}
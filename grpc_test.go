@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"tcpFileClient/controlpb"
+)
+
+// newTestControl serves d's gRPC control API in memory, as daemon
+// -grpc-listen does, and returns a client for it.
+func newTestControl(t *testing.T, d *daemon) controlpb.ControlClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.UnaryInterceptor(d.unaryAuth), grpc.StreamInterceptor(d.streamAuth))
+	controlpb.RegisterControlServer(server, &controlServer{d: d})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return controlpb.NewControlClient(conn)
+}
+
+// withToken is a context carrying the test daemon's token.
+func withToken() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+}
+
+func TestGRPCSubmitAndWatchJob(t *testing.T) {
+	server := newFileServer(t)
+	d := newTestDaemon(t, 0)
+	d.opts.onProgress = d.progress
+	client := newTestControl(t, d)
+	go d.work()
+	t.Cleanup(func() { close(d.queue) })
+
+	j, err := client.SubmitJob(withToken(), &controlpb.SubmitJobRequest{Source: "tcp://" + server.addr() + "/a.txt", Destination: "b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Id != "1" || j.Destination != filepath.Join(d.root, "b.txt") {
+		t.Errorf("submitted job %s to %s", j.Id, j.Destination)
+	}
+
+	stream, err := client.WatchJob(withToken(), &controlpb.WatchJobRequest{Id: j.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last *controlpb.JobUpdate
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = update
+	}
+	if last == nil || last.Job.State != jobDone || last.Job.Result == nil || last.Job.Result.Status != statusDownloaded {
+		t.Fatalf("watch ended with %v", last)
+	}
+	if data, err := os.ReadFile(j.Destination); err != nil || string(data) != "contents of a.txt" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+
+	list, err := client.ListJobs(withToken(), &controlpb.ListJobsRequest{})
+	if err != nil || len(list.Jobs) != 1 || list.Jobs[0].State != jobDone {
+		t.Errorf("ListJobs %v, %v", list, err)
+	}
+}
+
+func TestGRPCCancelJob(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	client := newTestControl(t, d)
+	j, err := client.SubmitJob(withToken(), &controlpb.SubmitJobRequest{Source: "tcp://files:8000/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, err := client.CancelJob(withToken(), &controlpb.CancelJobRequest{Id: j.Id})
+	if err != nil || cancelled.State != jobCancelled {
+		t.Fatalf("CancelJob %v, %v", cancelled, err)
+	}
+	// A watch of a finished job sends it once and ends.
+	stream, err := client.WatchJob(withToken(), &controlpb.WatchJobRequest{Id: j.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update, err := stream.Recv(); err != nil || update.Job.State != jobCancelled {
+		t.Errorf("watched %v, %v", update, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("watch of a cancelled job went on: %v", err)
+	}
+
+	if _, err := client.CancelJob(withToken(), &controlpb.CancelJobRequest{Id: j.Id}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("cancelling again: %v", err)
+	}
+	if _, err := client.CancelJob(withToken(), &controlpb.CancelJobRequest{Id: "9"}); status.Code(err) != codes.NotFound {
+		t.Errorf("cancelling a missing job: %v", err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	client := newTestControl(t, d)
+	for _, test := range []struct {
+		request *controlpb.SubmitJobRequest
+		code    codes.Code
+	}{
+		{&controlpb.SubmitJobRequest{Source: "tcp://files:8000/a.txt", Destination: "../a.txt"}, codes.InvalidArgument},
+		{&controlpb.SubmitJobRequest{Source: "tcp://files:8000/a.txt", Window: "soon"}, codes.InvalidArgument},
+		{&controlpb.SubmitJobRequest{Source: "tcp://files:8000/bad name"}, codes.InvalidArgument},
+	} {
+		if _, err := client.SubmitJob(withToken(), test.request); status.Code(err) != test.code {
+			t.Errorf("SubmitJob %v: %v, want %s", test.request, err, test.code)
+		}
+	}
+
+	if _, err := client.ListJobs(context.Background(), &controlpb.ListJobsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ListJobs without the token: %v", err)
+	}
+	stream, err := client.WatchJob(context.Background(), &controlpb.WatchJobRequest{Id: "9"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("WatchJob without the token: %v", err)
+	}
+	stream, err = client.WatchJob(withToken(), &controlpb.WatchJobRequest{Id: "9"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("watching a missing job: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"tcpFileClient/wirepb"
+)
+
+const clientVersion = "tcp-file-client/1"
+
+var errNoHandshake = errors.New("server does not support the handshake")
+
+// serverHello is what a server says about itself in reply to HELLO. The
+// exchange is
+//
+//	HELLO tcp-file-client/1
+//	OK tcp-file-server/1 list sum put rm
+//
+// naming the server's software and the optional commands it understands,
+// and may be followed by "AUTH token" when the client has a token. Servers
+// that predate the handshake close the connection without replying.
+type serverHello struct {
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	// Banner is the message the server sends everyone who connects.
+	Banner []string `json:"banner,omitempty"`
+	// Extensions are the extensions the server confirmed.
+	Extensions []string `json:"extensions,omitempty"`
+	// Wire is "protobuf" once the connection has switched to that mode.
+	Wire string `json:"wire,omitempty"`
+}
+
+func (h *serverHello) supports(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// authToken returns the token for a server: one refreshed after the server
+// said the old one expired, the -token flag, TCP_FILE_TOKEN, the one login
+// saved for it, or the password for it in .netrc, in that order.
+func (o *options) authToken(address string) string {
+	if token := o.refresh.current(address); token != "" {
+		return token
+	}
+	if o.token != "" {
+		return o.token
+	}
+	if token := os.Getenv("TCP_FILE_TOKEN"); token != "" {
+		return token
+	}
+	if token := o.keychainToken(address); token != "" {
+		return token
+	}
+	if e := o.netrc(address); e != nil {
+		return e.password
+	}
+	return ""
+}
+
+// handshake greets the server at address on conn and authenticates if a
+// token is configured. r must be the reader the rest of the connection is
+// read from. With wire, the connection switches to the protobuf wire mode
+// before authenticating if -wire allows; callers that go on to send text
+// requests pass false.
+func (o *options) handshake(address string, conn net.Conn, r *bufio.Reader, wire bool) (*serverHello, error) {
+	w := deadlineWriter{conn}
+	if _, err := io.WriteString(w, "HELLO "+clientVersion+"\n"); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	banner, hello, err := readHello(r)
+	o.banner.show(address, banner)
+	if err != nil {
+		return nil, err
+	}
+	hello.Banner = banner
+	o.log.Debugf("server %s says %s", conn.RemoteAddr(), strings.Join(append([]string{hello.Version}, hello.Capabilities...), " "))
+	if err := o.negotiateExtensions(w, r, hello); err != nil {
+		return nil, err
+	}
+	if wire {
+		if err := o.upgradeWire(conn, r, hello); err != nil {
+			return nil, err
+		}
+	}
+
+	if token := o.authToken(address); token != "" {
+		if err := o.authenticate(w, r, hello, token); tokenExpired(err) && o.refresh.enabled() {
+			o.log.Infof("token for %s has expired; refreshing it", address)
+			if token, err = o.refresh.refresh(address, token); err != nil {
+				return nil, err
+			}
+			err = o.authenticate(w, r, hello, token)
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		o.log.Debugf("authenticated to %s", conn.RemoteAddr())
+	}
+	return hello, nil
+}
+
+// dialRequest connects to the server at address for one text request, such
+// as a GET outside a pipeline or an RM, returning the reader its reply is
+// read from. When there is a token for the server, or with greet, the
+// connection handshakes first so that the token is sent, and refreshed if
+// it has expired, as on every other connection; the server's hello is
+// returned then, and nil otherwise. A server that closes the connection at
+// HELLO is dialed again and remembered, and gets its requests bare, as
+// without a token.
+func (o *options) dialRequest(ctx context.Context, address string, greet bool) (net.Conn, *bufio.Reader, *serverHello, error) {
+	conn, err := o.dialContext(ctx, address)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	r := bufio.NewReader(deadlineReader{conn})
+	if o.legacy || !greet && o.authToken(address) == "" || o.unhandshaked(address) {
+		return conn, r, nil, nil
+	}
+	hello, err := o.handshake(address, conn, r, false)
+	if err == nil {
+		return conn, r, hello, nil
+	}
+	conn.Close()
+	if !errors.Is(err, errNoHandshake) {
+		return nil, nil, nil, err
+	}
+
+	o.transferLog(ctx).Debugf("server %s does not support the handshake; sending requests without it", address)
+	o.noHandshakeMu.Lock()
+	if o.noHandshake == nil {
+		o.noHandshake = make(map[string]bool)
+	}
+	o.noHandshake[address] = true
+	o.noHandshakeMu.Unlock()
+	if conn, err = o.dialContext(ctx, address); err != nil {
+		return nil, nil, nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	return conn, bufio.NewReader(deadlineReader{conn}), nil, nil
+}
+
+func (o *options) unhandshaked(address string) bool {
+	o.noHandshakeMu.Lock()
+	defer o.noHandshakeMu.Unlock()
+	return o.noHandshake[address]
+}
+
+// readHello reads the server's reply to HELLO: the banner, if any, and then
+// OK with its version and capabilities, or ERR.
+func readHello(r *bufio.Reader) ([]string, *serverHello, error) {
+	banner, line, err := readBanner(r)
+	if errors.Is(err, io.EOF) {
+		return nil, nil, errNoHandshake
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := parseFrame(line, false)
+	if err != nil {
+		return banner, nil, err
+	}
+	if f.kind == frameErr {
+		return banner, nil, &serverError{f.text}
+	}
+	hello, err := parseHello(f.text)
+	return banner, hello, err
+}
+
+func (o *options) authenticate(w io.Writer, r *bufio.Reader, hello *serverHello, token string) error {
+	if hello.Wire == string(wireProtobuf) {
+		if err := writeWire(w, &wirepb.Request{Kind: &wirepb.Request_Auth{Auth: &wirepb.Auth{Token: token}}}); err != nil {
+			return err
+		}
+		reply, err := readWireReply(r)
+		if err != nil {
+			return fmt.Errorf("error authenticating: %w", err)
+		}
+		if reply.GetOk() == nil {
+			return &protocolError{"expected OK", ""}
+		}
+		return nil
+	}
+	if _, err := io.WriteString(w, "AUTH "+token+"\n"); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	if _, err := readReply(r); err != nil {
+		return fmt.Errorf("error authenticating: %w", err)
+	}
+	return nil
+}
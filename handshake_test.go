@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tokenServer is a text protocol server that wants tokens: each connection
+// must handshake and AUTH with a valid one before its request, or gets ERR.
+type tokenServer struct {
+	*fakeServer
+
+	mu sync.Mutex
+	// valid holds the tokens AUTH accepts; expired those it answers with
+	// "ERR token expired".
+	valid, expired map[string]bool
+	// requests are the requests served, each after the token that
+	// authenticated its connection.
+	requests []string
+	// onRequest, if set, is called with mu held after each request is
+	// recorded.
+	onRequest func()
+}
+
+func newTokenServer(t *testing.T, valid ...string) *tokenServer {
+	s := &tokenServer{valid: map[string]bool{}, expired: map[string]bool{}}
+	for _, token := range valid {
+		s.valid[token] = true
+	}
+	s.fakeServer = newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) { s.serve(conn, r) })
+	return s
+}
+
+func (s *tokenServer) expire(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.valid, token)
+	s.expired[token] = true
+}
+
+func (s *tokenServer) serve(conn net.Conn, r *bufio.Reader) {
+	line, ok := serveHello(r, conn, "list", "rm")
+	var token string
+	for ok && strings.HasPrefix(line, "AUTH ") {
+		candidate := strings.TrimPrefix(line, "AUTH ")
+		s.mu.Lock()
+		valid, expired := s.valid[candidate], s.expired[candidate]
+		s.mu.Unlock()
+		switch {
+		case valid:
+			token = candidate
+			conn.Write([]byte("OK\n"))
+		case expired:
+			conn.Write([]byte("ERR token expired\n"))
+		default:
+			conn.Write([]byte("ERR invalid token\n"))
+		}
+		line, ok = readRequest(r)
+	}
+	if !ok {
+		return
+	}
+	if token == "" {
+		conn.Write([]byte("ERR not authenticated\n"))
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, token+" "+line)
+	if s.onRequest != nil {
+		s.onRequest()
+	}
+	s.mu.Unlock()
+
+	verb, name, _ := strings.Cut(line, " ")
+	switch verb {
+	case "GET":
+		conn.Write([]byte("contents of " + name))
+	case "RM":
+		conn.Write([]byte("OK\n"))
+	case "LIST":
+		conn.Write([]byte("a.txt\t3\t1700000000\t-\n"))
+	default:
+		conn.Write([]byte("ERR unknown command\n"))
+	}
+}
+
+func (s *tokenServer) served() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func TestTokenSentOnEveryRequest(t *testing.T) {
+	server := newTokenServer(t, "s3cret")
+	opts := newTestOptions(t, "-token", "s3cret")
+
+	reader, _, err := opts.openSource(context.Background(), &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "contents of a.txt" {
+		t.Errorf("GET returned %q, %v", data, err)
+	}
+	if err := opts.removeFile(server.addr(), "b.txt"); err != nil {
+		t.Errorf("RM: %v", err)
+	}
+	entries, err := opts.list(server.addr(), &listFilter{})
+	if err != nil || len(entries) != 1 {
+		t.Errorf("LIST returned %v, %v", entries, err)
+	}
+
+	want := []string{"s3cret GET a.txt", "s3cret RM b.txt", "s3cret LIST"}
+	if got := server.served(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("served %q, want %q", got, want)
+	}
+}
+
+func TestRequestWithoutHandshakeSupport(t *testing.T) {
+	// A server from before the handshake hangs up on HELLO.
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		if ok && strings.HasPrefix(line, "GET ") {
+			conn.Write([]byte("old"))
+		}
+	})
+	opts := newTestOptions(t, "-token", "s3cret", "-reconnect", "0")
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}
+
+	for i := 0; i < 2; i++ {
+		reader, _, err := opts.openSource(context.Background(), source, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "old" {
+			t.Errorf("GET returned %q, %v", data, err)
+		}
+	}
+	// The second GET goes straight to the request.
+	if n := server.connections(); n != 3 {
+		t.Errorf("%d connections, want 3", n)
+	}
+}
+
+// FuzzReadHello reads the reply to HELLO from whatever a server might
+// send.
+func FuzzReadHello(f *testing.F) {
+	f.Add([]byte("OK tcp-file-server/1 list sum put rm\n"))
+	f.Add([]byte("MOTD maintenance tonight\nMOTD\nOK tcp-file-server/2 pipeline proto ext\n"))
+	f.Add([]byte("ERR go away\n"))
+	f.Add([]byte("OK\n"))
+	f.Add([]byte("OK " + strings.Repeat("cap ", maxCapabilities+1) + "\n"))
+	f.Add([]byte(strings.Repeat("MOTD x\n", maxBannerLines+1)))
+	f.Add([]byte(""))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		banner, hello, err := readHello(bufio.NewReader(strings.NewReader(string(data))))
+		if len(banner) > maxBannerLines {
+			t.Errorf("banner of %d lines", len(banner))
+		}
+		if err != nil {
+			if hello != nil {
+				t.Error("returned a hello with an error")
+			}
+			return
+		}
+		if hello.Version == "" {
+			t.Error("hello without a version")
+		}
+		if len(hello.Capabilities) > maxCapabilities {
+			t.Errorf("%d capabilities", len(hello.Capabilities))
+		}
+	})
+}
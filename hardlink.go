@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// linkIndex remembers a local path for each content hash sync has seen this
+// run, so that with -hardlink a later file with the same content becomes a
+// hard link to it instead of another copy.
+type linkIndex struct {
+	paths  map[string]string
+	linked int
+	saved  int64
+}
+
+func (x *linkIndex) add(sha256, path string) {
+	if sha256 == "" {
+		return
+	}
+	if x.paths == nil {
+		x.paths = map[string]string{}
+	}
+	if _, ok := x.paths[strings.ToLower(sha256)]; !ok {
+		x.paths[strings.ToLower(sha256)] = path
+	}
+}
+
+// link makes destination a hard link to the file already holding content
+// with the given hash, if there is one. size is counted as saved.
+func (x *linkIndex) link(opts *options, sha256, destination string, size int64) (string, error) {
+	existing, ok := x.paths[strings.ToLower(sha256)]
+	if sha256 == "" || !ok || existing == destination {
+		return "", nil
+	}
+	if same, err := sameFile(existing, destination); err != nil || same {
+		return existing, err
+	}
+
+	tmp := destination + partialSuffix
+	os.Remove(tmp)
+	if err := os.Link(existing, tmp); err != nil {
+		return "", fmt.Errorf("error linking file: %w", err)
+	}
+	if err := opts.backup.backup(destination); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, destination); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("error linking file: %w", err)
+	}
+	x.linked++
+	x.saved += size
+	return existing, nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, fmt.Errorf("error linking file: %w", err)
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, nil
+	}
+	return os.SameFile(ai, bi), nil
+}
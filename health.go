@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reachabilityTTL is how long a server probe by /readyz is reused, so that
+// frequent probes by an orchestrator don't each open a connection to every
+// server.
+const reachabilityTTL = 15 * time.Second
+
+// health is the body of /healthz and /readyz.
+type health struct {
+	Status        string               `json:"status"`
+	Reasons       []string             `json:"reasons,omitempty"`
+	Queued        int                  `json:"queued"`
+	Running       int                  `json:"running"`
+	QueueCapacity int                  `json:"queue_capacity"`
+	LastSuccess   *time.Time           `json:"last_success,omitempty"`
+	LastFailure   *time.Time           `json:"last_failure,omitempty"`
+	Servers       []serverReachability `json:"servers,omitempty"`
+}
+
+type serverReachability struct {
+	Server    string    `json:"server"`
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
+}
+
+// probes caches server reachability for /readyz.
+type probes struct {
+	mu      sync.Mutex
+	servers map[string]serverReachability
+}
+
+func (p *probes) check(opts *options, server string) serverReachability {
+	p.mu.Lock()
+	last, ok := p.servers[server]
+	p.mu.Unlock()
+	if ok && time.Since(last.Checked) < reachabilityTTL {
+		return last
+	}
+
+	result := serverReachability{Server: server, Checked: time.Now().UTC()}
+	if _, err := opts.ping(server); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Reachable = true
+	}
+	p.mu.Lock()
+	if p.servers == nil {
+		p.servers = map[string]serverReachability{}
+	}
+	p.servers[server] = result
+	p.mu.Unlock()
+	return result
+}
+
+// state reports the queue and the last transfers. It takes d.mu, so a
+// daemon wedged while holding it stops answering /healthz.
+func (d *daemon) state() health {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h := health{Status: "ok", QueueCapacity: cap(d.queue)}
+	for _, j := range d.order {
+		switch j.State {
+		case jobQueued:
+			h.Queued++
+		case jobRunning:
+			h.Running++
+		}
+	}
+	if !d.lastSuccess.IsZero() {
+		t := d.lastSuccess
+		h.LastSuccess = &t
+	}
+	if !d.lastFailure.IsZero() {
+		t := d.lastFailure
+		h.LastFailure = &t
+	}
+	return h
+}
+
+// servers lists the tcp servers of the jobs still to finish, and the default
+// server. Servers only finished jobs used don't decide readiness.
+func (d *daemon) servers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := map[string]bool{ServerAddress: true}
+	for _, j := range d.order {
+		if j.State != jobQueued && j.State != jobRunning {
+			continue
+		}
+		if source, _, err := parseSource(j.Source); err == nil && source.Scheme == "tcp" {
+			seen[source.Host] = true
+		}
+	}
+	servers := make([]string, 0, len(seen))
+	for server := range seen {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// serveHealth answers /healthz: the daemon is alive whenever it can answer,
+// whatever state the servers are in.
+func (d *daemon) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.state())
+}
+
+// serveReady answers /readyz, with 503 while the job queue is full or a
+// server the daemon fetches from can't be reached.
+func (d *daemon) serveReady(w http.ResponseWriter, r *http.Request) {
+	h := d.state()
+	if h.Queued >= h.QueueCapacity {
+		h.Reasons = append(h.Reasons, "job queue is full")
+	}
+	for _, server := range d.servers() {
+		result := d.probes.check(d.opts, server)
+		h.Servers = append(h.Servers, result)
+		if !result.Reachable {
+			h.Reasons = append(h.Reasons, "server "+server+" is unreachable")
+		}
+	}
+
+	code := http.StatusOK
+	if len(h.Reasons) > 0 {
+		h.Status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
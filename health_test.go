@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probeDaemon makes an unauthenticated GET of path, as an orchestrator's
+// probe does.
+func probeDaemon(t *testing.T, d *daemon, path string) (int, health) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	d.handler(false).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var h health
+	if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+		t.Fatalf("%s answered %s: %v", path, w.Body, err)
+	}
+	return w.Code, h
+}
+
+// useDefaultServer points the default server at address for the rest of
+// the test. Parsing options resets it to -addr, so it comes after.
+func useDefaultServer(t *testing.T, address string) {
+	saved := ServerAddress
+	ServerAddress = address
+	t.Cleanup(func() { ServerAddress = saved })
+}
+
+func TestHealthz(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	d.order = []*job{{State: jobRunning}, {State: jobQueued}, {State: jobQueued}, {State: jobDone}}
+	d.lastSuccess = time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	code, h := probeDaemon(t, d, "/healthz")
+	if code != http.StatusOK || h.Status != "ok" || h.Running != 1 || h.Queued != 2 || h.QueueCapacity != 16 {
+		t.Errorf("/healthz %d %+v", code, h)
+	}
+	if h.LastSuccess == nil || !h.LastSuccess.Equal(d.lastSuccess) || h.LastFailure != nil {
+		t.Errorf("/healthz reports last success %v and failure %v", h.LastSuccess, h.LastFailure)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	server := newFileServer(t)
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+
+	d := newTestDaemon(t, 0)
+	useDefaultServer(t, server.addr())
+	if code, h := probeDaemon(t, d, "/readyz"); code != http.StatusOK || h.Status != "ok" || len(h.Servers) != 1 || !h.Servers[0].Reachable {
+		t.Errorf("idle daemon: /readyz %d %+v", code, h)
+	}
+
+	// Only servers of unfinished jobs count.
+	d.order = []*job{{Source: "tcp://" + gone.Addr().String() + "/a.txt", State: jobDone}}
+	if code, _ := probeDaemon(t, d, "/readyz"); code != http.StatusOK {
+		t.Errorf("finished job on an unreachable server: /readyz %d", code)
+	}
+	d.order[0].State = jobQueued
+	code, h := probeDaemon(t, d, "/readyz")
+	if code != http.StatusServiceUnavailable || h.Status != "unavailable" || len(h.Reasons) != 1 || !strings.Contains(h.Reasons[0], gone.Addr().String()) {
+		t.Errorf("queued job on an unreachable server: /readyz %d %+v", code, h)
+	}
+
+	d = newTestDaemon(t, 0)
+	useDefaultServer(t, server.addr())
+	d.queue = make(chan *job, 1)
+	d.order = []*job{{Source: "tcp://" + server.addr() + "/a.txt", State: jobQueued}}
+	if code, h := probeDaemon(t, d, "/readyz"); code != http.StatusServiceUnavailable || strings.Join(h.Reasons, ",") != "job queue is full" {
+		t.Errorf("full queue: /readyz %d %+v", code, h)
+	}
+}
+
+func TestReadyzReusesProbes(t *testing.T) {
+	server := newFileServer(t)
+	d := newTestDaemon(t, 0)
+	useDefaultServer(t, server.addr())
+	for i := 0; i < 3; i++ {
+		if code, _ := probeDaemon(t, d, "/readyz"); code != http.StatusOK {
+			t.Fatalf("/readyz %d", code)
+		}
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("three probes connected %d times, want once within %s", n, reachabilityTTL)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const DefaultHistoryFilename = "tcp-client-history.db"
+
+// statePath is where the client keeps the state file name, such as the
+// history database, unless a flag says otherwise: under $XDG_STATE_HOME if
+// it is set, or else the user's cache directory, such as
+// ~/.cache/tcp-file-client on Linux, so that running the client in some
+// directory doesn't leave its databases there.
+func statePath(name string) string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserCacheDir(); err != nil {
+			return name
+		}
+	}
+	return filepath.Join(dir, "tcp-file-client", name)
+}
+
+// recordsHistory reports whether a command records transfers in the
+// history database or reads it, and so should open it; "" is get.
+func recordsHistory(command string) bool {
+	switch command {
+	case "", "get", "put", "sync", "daemon", "service", "history", "stats":
+		return true
+	}
+	return false
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS transfers (
+	id          INTEGER PRIMARY KEY,
+	transfer_id TEXT NOT NULL DEFAULT '',
+	time        TEXT NOT NULL,
+	file        TEXT NOT NULL,
+	source      TEXT NOT NULL,
+	server      TEXT NOT NULL,
+	action      TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	bytes       INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	sha256      TEXT NOT NULL,
+	attempts    INTEGER NOT NULL,
+	error       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transfers_time ON transfers (time);
+CREATE INDEX IF NOT EXISTS transfers_file ON transfers (file);
+CREATE INDEX IF NOT EXISTS transfers_server ON transfers (server);
+`
+
+// historyDB is the SQLite database of past transfers. Unlike the log it
+// keeps every result in a queryable form, however often the log rotates.
+type historyDB struct {
+	db *sql.DB
+}
+
+func openHistory(path string) (*historyDB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+	// Several clients may share the database, so writers wait for each
+	// other's locks instead of failing at once.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+	// Databases from before transfer IDs lack the column.
+	if _, err := db.Exec("ALTER TABLE transfers ADD COLUMN transfer_id TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, fmt.Errorf("error upgrading history database: %w", err)
+	}
+	return &historyDB{db: db}, nil
+}
+
+func (h *historyDB) add(r *transferResult) error {
+	finished := r.finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	attempts := r.Attempts
+	if attempts == 0 {
+		attempts = 1
+	}
+
+	_, err := h.db.Exec(`INSERT INTO transfers (transfer_id, time, file, source, server, action, status, bytes, duration_ms, sha256, attempts, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, finished.UTC().Format(time.RFC3339Nano), r.file(), r.Source, sourceHost(r.Source), r.verb(), r.Status,
+		r.Bytes, r.duration().Milliseconds(), r.SHA256, attempts, r.Error)
+	if err != nil {
+		return fmt.Errorf("error recording transfer history: %w", err)
+	}
+	return nil
+}
+
+// historyEntry is a row of the transfers table as the history subcommand
+// prints it.
+type historyEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	File     string    `json:"file"`
+	Source   string    `json:"source"`
+	Server   string    `json:"server"`
+	Action   string    `json:"action"`
+	Status   string    `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration int64     `json:"duration_ms"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type historyQuery struct {
+	since  string
+	failed bool
+	file   string
+	server string
+	limit  int
+	json   bool
+}
+
+func (q *historyQuery) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&q.since, "since", "", "only show transfers after this `time`: a duration such as 24h, a date or an RFC 3339 time")
+	fs.BoolVar(&q.failed, "failed", false, "only show failed transfers")
+	fs.StringVar(&q.file, "file", "", "only show files matching this glob `pattern`; without a slash it matches the base name")
+	fs.StringVar(&q.server, "server", "", "only show transfers from this `host:port`")
+	fs.IntVar(&q.limit, "n", 0, "show at most this many transfers, newest first; 0 shows all")
+	fs.BoolVar(&q.json, "json", false, "print the transfers as a JSON array")
+}
+
+// parseSince accepts a duration before now, a date or an RFC 3339 time.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid -since %q: use a duration, a date or an RFC 3339 time", value)
+}
+
+// runHistory implements the history subcommand: history [flags].
+func runHistory(opts *options, args []string) error {
+	var q historyQuery
+	fs := newCommandFlags("history")
+	q.registerFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: history [flags]")
+	}
+	if opts.history == nil {
+		return errors.New("the history database is disabled")
+	}
+	if _, err := path.Match(q.file, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", q.file, err)
+	}
+
+	entries, err := opts.history.query(&q)
+	if err != nil {
+		return err
+	}
+	return q.print(os.Stdout, entries)
+}
+
+func (h *historyDB) query(q *historyQuery) ([]historyEntry, error) {
+	var where []string
+	var args []interface{}
+	if q.since != "" {
+		since, err := parseSince(q.since, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		// Times are stored as UTC RFC 3339, so they sort as text.
+		where = append(where, "time >= ?")
+		args = append(args, since.UTC().Format(time.RFC3339Nano))
+	}
+	if q.failed {
+		where = append(where, "status = ?")
+		args = append(args, statusFailed)
+	}
+	if q.server != "" {
+		where = append(where, "server = ?")
+		args = append(args, q.server)
+	}
+	query := "SELECT transfer_id, time, file, source, server, action, status, bytes, duration_ms, sha256, attempts, error FROM transfers"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC"
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading transfer history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []historyEntry{}
+	for rows.Next() && (q.limit <= 0 || len(entries) < q.limit) {
+		var e historyEntry
+		var when string
+		if err := rows.Scan(&e.ID, &when, &e.File, &e.Source, &e.Server, &e.Action, &e.Status, &e.Bytes, &e.Duration, &e.SHA256, &e.Attempts, &e.Error); err != nil {
+			return nil, fmt.Errorf("error reading transfer history: %w", err)
+		}
+		if e.Time, err = time.Parse(time.RFC3339Nano, when); err != nil {
+			return nil, fmt.Errorf("invalid time %q in transfer history", when)
+		}
+		if q.file != "" && !q.matchFile(e.File) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading transfer history: %w", err)
+	}
+	return entries, nil
+}
+
+// matchFile matches the -file pattern like -include does: against the base
+// name unless the pattern contains a slash.
+func (q *historyQuery) matchFile(file string) bool {
+	if !strings.Contains(q.file, "/") {
+		file = path.Base(file)
+	}
+	ok, _ := path.Match(q.file, file)
+	return ok
+}
+
+func (q *historyQuery) print(w io.Writer, entries []historyEntry) error {
+	if q.json {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tSTATUS\tACTION\tBYTES\tDURATION\tSERVER\tFILE\tERROR")
+	for _, e := range entries {
+		duration := time.Duration(e.Duration) * time.Millisecond
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", e.ID, e.Time.Local().Format("2006-01-02 15:04:05"), e.Status, e.Action, e.Bytes, duration, e.Server, e.File, e.Error)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T) *historyDB {
+	t.Helper()
+	h, err := openHistory(filepath.Join(t.TempDir(), "state", DefaultHistoryFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.Close() })
+	return h
+}
+
+func TestHistoryRecordsTransfers(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	opts := newTestOptions(t, "-retry-on", "none")
+	opts.history = newTestHistory(t)
+
+	runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + refused.Addr().String() + "/b.txt"}, nil, opts.log)
+	entries, err := opts.history.query(&historyQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("history has %d transfers, want 2", len(entries))
+	}
+	failed, ok := entries[0], entries[1]
+	if ok.File != "a.txt" || ok.Server != server.addr() || ok.Action != "download" || ok.Status != statusDownloaded ||
+		ok.Bytes != int64(len("contents of a.txt")) || ok.SHA256 == "" || ok.Attempts != 1 || ok.ID == "" {
+		t.Errorf("recorded %+v for a.txt", ok)
+	}
+	if failed.File != "b.txt" || failed.Status != statusFailed || failed.Error == "" {
+		t.Errorf("recorded %+v for b.txt", failed)
+	}
+}
+
+func TestHistoryUpgradesOldDatabases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultHistoryFilename)
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE transfers (id INTEGER PRIMARY KEY, time TEXT NOT NULL, file TEXT NOT NULL, source TEXT NOT NULL,
+		server TEXT NOT NULL, action TEXT NOT NULL, status TEXT NOT NULL, bytes INTEGER NOT NULL, duration_ms INTEGER NOT NULL,
+		sha256 TEXT NOT NULL, attempts INTEGER NOT NULL, error TEXT NOT NULL)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+	if err := h.add(&transferResult{ID: "t1", Source: "tcp://files:8000/a.txt", Status: statusUploaded, Action: actionUpload}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := h.query(&historyQuery{})
+	if err != nil || len(entries) != 1 || entries[0].ID != "t1" {
+		t.Errorf("upgraded database returned %+v, %v", entries, err)
+	}
+}
+
+func TestRecordsHistory(t *testing.T) {
+	for command, want := range map[string]bool{"": true, "get": true, "put": true, "history": true, "stats": true, "ls": false, "ping": false, "audit": false} {
+		if recordsHistory(command) != want {
+			t.Errorf("command %q opens the history database: %t, want %t", command, !want, want)
+		}
+	}
+}
+
+func TestHistoryQueries(t *testing.T) {
+	h := newTestHistory(t)
+	now := time.Now()
+	for _, r := range []*transferResult{
+		{ID: "t1", Source: "tcp://a:8000/logs/old.log", Destination: "logs/old.log", Status: statusDownloaded, finished: now.Add(-48 * time.Hour)},
+		{ID: "t2", Source: "tcp://a:8000/x.txt", Destination: "x.txt", Status: statusFailed, Error: "refused", finished: now.Add(-2 * time.Hour)},
+		{ID: "t3", Source: "tcp://b:8000/logs/new.log", Destination: "logs/new.log", Status: statusDownloaded, finished: now.Add(-time.Hour)},
+		{ID: "t4", Source: "tcp://b:8000/y.txt", Destination: "y.txt", Status: statusFailed, Error: "timeout", finished: now},
+	} {
+		if err := h.add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query historyQuery
+		want  string
+	}{
+		{historyQuery{}, "t4 t3 t2 t1"},
+		{historyQuery{since: "24h"}, "t4 t3 t2"},
+		{historyQuery{failed: true}, "t4 t2"},
+		{historyQuery{server: "a:8000"}, "t2 t1"},
+		{historyQuery{file: "*.log"}, "t3 t1"},
+		{historyQuery{file: "logs/n*"}, "t3"},
+		{historyQuery{limit: 2}, "t4 t3"},
+		{historyQuery{file: "*.log", limit: 1}, "t3"},
+		{historyQuery{since: "24h", failed: true, server: "b:8000"}, "t4"},
+	} {
+		entries, err := h.query(&test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if got := strings.Join(ids, " "); got != test.want {
+			t.Errorf("query %+v returned %s, want %s", test.query, got, test.want)
+		}
+	}
+
+	if _, err := h.query(&historyQuery{since: "last week"}); err == nil {
+		t.Error("accepted -since \"last week\"")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 5, 6, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"90m":                  now.Add(-90 * time.Minute),
+		"2026-05-01T08:00:00Z": time.Date(2026, 5, 1, 8, 0, 0, 0, time.UTC),
+		"2026-05-01":           time.Date(2026, 5, 1, 0, 0, 0, 0, time.Local),
+	} {
+		if got, err := parseSince(value, now); err != nil || !got.Equal(want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+}
+
+func TestHistoryPrint(t *testing.T) {
+	entries := []historyEntry{{ID: "t1", Time: time.Now(), File: "a.txt", Server: "a:8000", Action: "download", Status: statusFailed, Bytes: 5, Duration: 1500, Error: "refused"}}
+
+	var table bytes.Buffer
+	if err := (&historyQuery{}).print(&table, entries); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 2 || strings.Fields(lines[0])[0] != "ID" || strings.Join(strings.Fields(lines[1])[3:], " ") != "failed download 5 1.5s a:8000 a.txt refused" {
+		t.Errorf("table:\n%s", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := (&historyQuery{json: true}).print(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []historyEntry
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 1 || decoded[0].Error != "refused" {
+		t.Errorf("JSON %s decoded to %+v, %v", out.String(), decoded, err)
+	}
+	out.Reset()
+	(&historyQuery{json: true}).print(&out, []historyEntry{})
+	if strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("empty JSON history is %q, want []", out.String())
+	}
+}
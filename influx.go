@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxWriter writes a point in InfluxDB line protocol for every transfer
+// that completes, for Telegraf or InfluxDB itself to pick up, to a file
+// that it appends to or, for a udp://host:port destination, as datagrams:
+//
+//	tcp_file_client_transfer,server=files:8000,action=download,status=downloaded bytes=1048576i,duration_ms=812i,attempts=1i,id="3f2a…",file="a.txt" 1700000000000000000
+//
+// Failed transfers are tagged with their error class as well.
+type influxWriter struct {
+	measurement string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func newInfluxWriter(destination, measurement string) (*influxWriter, error) {
+	if strings.HasPrefix(destination, "udp://") {
+		conn, err := net.Dial("udp", strings.TrimPrefix(destination, "udp://"))
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to influx endpoint: %w", err)
+		}
+		return &influxWriter{measurement: measurement, w: conn}, nil
+	}
+	f, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening influx file: %w", err)
+	}
+	return &influxWriter{measurement: measurement, w: f}, nil
+}
+
+func (w *influxWriter) record(r *transferResult) error {
+	finished := r.finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	attempts := r.Attempts
+	if attempts == 0 {
+		attempts = 1
+	}
+
+	var b strings.Builder
+	b.WriteString(influxEscape(w.measurement, ", "))
+	tags := [][2]string{{"server", sourceHost(r.Source)}, {"action", r.verb()}, {"status", r.Status}}
+	if r.ErrorClass != "" {
+		tags = append(tags, [2]string{"error_class", r.ErrorClass})
+	}
+	for _, tag := range tags {
+		if tag[1] != "" {
+			b.WriteString("," + tag[0] + "=" + influxEscape(tag[1], ",= "))
+		}
+	}
+	fmt.Fprintf(&b, " bytes=%di,duration_ms=%di,attempts=%di,id=%s,file=%s", r.Bytes, r.duration().Milliseconds(), attempts, influxString(r.ID), influxString(r.file()))
+	b.WriteString(" " + strconv.FormatInt(finished.UnixNano(), 10) + "\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := io.WriteString(w.w, b.String()); err != nil {
+		return fmt.Errorf("error writing influx metrics: %w", err)
+	}
+	return nil
+}
+
+// influxEscape backslash-escapes the characters in special, which differ
+// between measurements and tags.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\n' {
+			c = ' '
+		}
+		if strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func (w *influxWriter) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxLineProtocol(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.influx")
+	w, err := newInfluxWriter(path, "transfers, all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Unix(1700000000, 0)
+	failed := &transferResult{ID: "7", Source: "tcp://files:8000/a.txt", Destination: `say "hi".txt`, Status: statusFailed, ErrorClass: "network", Bytes: 512, Attempts: 2, started: started, finished: started.Add(812 * time.Millisecond)}
+	if err := w.record(failed); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// Reopening the file appends to it.
+	if w, err = newInfluxWriter(path, "transfers"); err != nil {
+		t.Fatal(err)
+	}
+	deleted := &transferResult{ID: "8", Source: "tcp://files:8000/b.txt", Action: actionDeleteRemote, Status: "deleted", started: started, finished: started}
+	if err := w.record(deleted); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `transfers\,\ all,server=files:8000,action=download,status=failed,error_class=network bytes=512i,duration_ms=812i,attempts=2i,id="7",file="say \"hi\".txt" 1700000000812000000` + "\n" +
+		`transfers,server=files:8000,action=delete,status=deleted bytes=0i,duration_ms=0i,attempts=1i,id="8",file="tcp://files:8000/b.txt" 1700000000000000000` + "\n"
+	if string(data) != want {
+		t.Errorf("wrote\n%s\nwant\n%s", data, want)
+	}
+
+	if got, want := influxEscape("a=b, c\nd", ",= "), `a\=b\,\ c\ d`; got != want {
+		t.Errorf("escaped tag %q, want %q", got, want)
+	}
+	if _, err := newInfluxWriter(filepath.Join(t.TempDir(), "missing", "metrics.influx"), "transfers"); err == nil {
+		t.Error("opened a file in a missing directory")
+	}
+}
+
+func TestInfluxRecordsBatch(t *testing.T) {
+	address, read := newStatsdListener(t)
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-influx", "udp://"+address)
+	var err error
+	if opts.influxWriter, err = newInfluxWriter(opts.influx, opts.influxName); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { opts.influxWriter.Close() })
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	line := read()
+	prefix := "tcp_file_client_transfer,server=" + server.addr() + ",action=download,status=downloaded bytes=17i,"
+	if !strings.HasPrefix(line, prefix) || !strings.Contains(line, `,attempts=1i,id="`+results[0].ID+`",file="a.txt" `) || !strings.HasSuffix(line, "\n") {
+		t.Errorf("sent %q", line)
+	}
+}
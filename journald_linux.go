@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// toJournal reports whether the client was started by systemd with stderr
+// connected to the journal, which systemd signals by setting JOURNAL_STREAM
+// to the device and inode of that stream.
+func (o *options) toJournal() bool {
+	if !o.journald {
+		return false
+	}
+	device, inode, ok := strings.Cut(os.Getenv("JOURNAL_STREAM"), ":")
+	if !ok {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return device == strconv.FormatUint(uint64(st.Dev), 10) && inode == strconv.FormatUint(st.Ino, 10)
+}
+
+// journalSink writes entries to the journal using its native protocol, so
+// that fields like FILE and BYTES can be matched with journalctl.
+type journalSink struct {
+	conn net.Conn
+}
+
+func openJournal() (logSink, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the journal: %w", err)
+	}
+	return &journalSink{conn: conn}, nil
+}
+
+func (s *journalSink) write(level logLevel, message string, fields map[string]string) error {
+	var entry bytes.Buffer
+	writeJournalField(&entry, "MESSAGE", message)
+	writeJournalField(&entry, "PRIORITY", strconv.Itoa(syslogSeverities[level]))
+	writeJournalField(&entry, "SYSLOG_IDENTIFIER", "tcp-file-client")
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeJournalField(&entry, name, fields[name])
+	}
+
+	_, err := s.conn.Write(entry.Bytes())
+	return err
+}
+
+// writeJournalField appends NAME=value, or for values containing newlines
+// the name, the value's little-endian 64-bit length and the value itself.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
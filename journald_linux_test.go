@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJournalEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &journalSink{conn: conn}
+	defer conn.Close()
+
+	if err := sink.write(levelWarn, "two\nlines", map[string]string{"TRANSFER_ID": "t1", "FILE": "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	journal.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n" +
+		"PRIORITY=4\nSYSLOG_IDENTIFIER=tcp-file-client\nFILE=a.txt\nTRANSFER_ID=t1\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("journal entry %q, want %q", got, want)
+	}
+}
+
+func TestJournalReplacesStderrUnderSystemd(t *testing.T) {
+	stderr := captureStderr(t)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JOURNAL_STREAM", fmt.Sprintf("%d:%d", st.Dev, st.Ino))
+
+	if opts := newTestOptions(t, "-journald=false"); opts.toJournal() {
+		t.Error("-journald=false logs to the journal")
+	}
+	opts := newTestOptions(t, "-log-file", "-")
+	if !opts.toJournal() {
+		t.Fatal("not logging to the journal with JOURNAL_STREAM naming stderr")
+	}
+	out, closeLog, err := opts.openLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(out, "hello\n")
+	closeLog()
+	if got := stderr(); got != "" {
+		t.Errorf("wrote %q to stderr as well as the journal", got)
+	}
+
+	t.Setenv("JOURNAL_STREAM", fmt.Sprintf("%d:%d", st.Dev, st.Ino+1))
+	if opts.toJournal() {
+		t.Error("logging to the journal with JOURNAL_STREAM naming another stream")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func (o *options) toJournal() bool {
+	return false
+}
+
+func openJournal() (logSink, error) {
+	return nil, errors.New("the journal is only available on Linux")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"tcpFileClient/wirepb"
+)
+
+// keepaliveOptions keep an idle pipeline from being dropped by NATs and
+// firewalls that forget quiet connections, as happens to a daemon's
+// pipeline between jobs. Once the connection has been idle for the
+// interval, the client sends
+//
+//	PING
+//	OK
+//
+// to servers that list "ping" among their capabilities, or a Ping message
+// in the protobuf wire mode, and again every interval while it stays idle.
+// A ping that gets no reply within the connection timeout is a miss; the
+// reply is still expected, and skipped when it comes. After failures
+// misses in a row, or any other error, the connection is dead, and is
+// replaced with a new one, handshake and all, unless -reconnect is 0, so
+// the next job doesn't find it gone.
+type keepaliveOptions struct {
+	interval time.Duration
+	failures int
+}
+
+func (k *keepaliveOptions) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&k.interval, "keepalive", 0, "ping a pipelined connection after it has been idle this long, and again as often while it stays idle, so NATs and firewalls keep it open; 0 disables it")
+	fs.IntVar(&k.failures, "keepalive-failures", 3, "consider a connection dead once this many keepalive pings in a row go unanswered")
+}
+
+// keepalive pings p while it is idle, until it is closed or found dead.
+func (p *pipeline) keepalive(k keepaliveOptions) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if !p.ping(k) {
+			return
+		}
+	}
+}
+
+// ping sends one keepalive ping if p has been idle for the interval. It
+// returns false once p is dead.
+func (p *pipeline) ping(k keepaliveOptions) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken.Load() {
+		return false
+	}
+	if p.busy.Load() || len(p.pending) > 0 || time.Since(time.Unix(0, p.lastUsed.Load())) < k.interval {
+		return true
+	}
+
+	err := p.sendPing()
+	if err == nil {
+		p.pings++
+		err = p.readPings()
+	}
+	var netErr net.Error
+	switch {
+	case err == nil:
+		p.missed = 0
+		p.log.Debugf("keepalive ping to %s answered", p.host)
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		if p.missed++; p.missed < k.failures {
+			p.log.Debugf("keepalive ping to %s unanswered (%d of %d)", p.host, p.missed, k.failures)
+			return true
+		}
+		err = fmt.Errorf("%d keepalive pings in a row unanswered", p.missed)
+	}
+	p.log.Warnf("connection to %s is dead: %v", p.host, err)
+	if p.opts.reconnects > 0 {
+		err := p.reconnect("")
+		if err == nil {
+			return true
+		}
+		p.log.Warnf("error reconnecting to %s: %v", p.host, err)
+	}
+	p.broken.Store(true)
+	p.conn.Close()
+	return false
+}
+
+func (p *pipeline) sendPing() error {
+	w := deadlineWriter{p.conn}
+	if p.binary {
+		return writeWire(w, &wirepb.Request{Kind: &wirepb.Request_Ping{Ping: &wirepb.Ping{}}})
+	}
+	if _, err := io.WriteString(w, "PING\n"); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	return nil
+}
+
+// readPings reads the replies to keepalive pings still outstanding, which
+// come before the response to any GET sent after them.
+func (p *pipeline) readPings() error {
+	for p.pings > 0 {
+		var err error
+		if p.binary {
+			var reply *wirepb.Reply
+			if reply, err = readWireReply(p.r); err == nil && reply.GetOk() == nil {
+				err = &protocolError{"expected OK", ""}
+			}
+		} else {
+			_, err = readReply(p.r)
+		}
+		if err != nil {
+			return err
+		}
+		p.pings--
+	}
+	return nil
+}
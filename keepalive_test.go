@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPingServer is a pipelining server that answers PING, logging each
+// request with its connection number. With dropFirst set, it hangs up on
+// the first connection's first PING instead.
+func newPingServer(t *testing.T, log *eventLog, dropFirst bool) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		for line, ok := serveHello(r, conn, "pipeline", "ping"); ok; line, ok = readRequest(r) {
+			log.add(fmt.Sprint(n, " ", line))
+			if line == "PING" {
+				if dropFirst && n == 0 {
+					return
+				}
+				conn.Write([]byte("OK\n"))
+				continue
+			}
+			contents := "contents of " + strings.TrimPrefix(line, "GET ")
+			fmt.Fprintf(conn, "OK %d\n%s", len(contents), contents)
+		}
+	})
+}
+
+// waitFor polls until cond holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestKeepaliveKeepsPipelineOpen(t *testing.T) {
+	var log eventLog
+	server := newPingServer(t, &log, false)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "2", "-keepalive", "50ms")
+	closePipelines(t, opts)
+
+	get := func(name string) {
+		t.Helper()
+		results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/" + name}, nil, opts.log)
+		if err != nil || statuses(results) != "downloaded" {
+			t.Fatalf("%s: batch returned %v with %s", name, err, statuses(results))
+		}
+	}
+	get("a.txt")
+	waitFor(t, "keepalive pings", func() bool { return strings.Count(log.String(), "0 PING") >= 2 })
+	get("b.txt")
+
+	if n := server.connections(); n != 1 {
+		t.Errorf("%d connections, want the pipeline kept open", n)
+	}
+	if !strings.HasPrefix(log.String(), "0 GET a.txt, 0 PING") || !strings.Contains(log.String(), "0 GET b.txt") {
+		t.Errorf("server saw %s", log.String())
+	}
+}
+
+func TestKeepaliveReplacesDeadPipeline(t *testing.T) {
+	var log eventLog
+	server := newPingServer(t, &log, true)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "2", "-keepalive", "50ms")
+	closePipelines(t, opts)
+
+	if results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	// The keepalive redials on its own, and goes on pinging the new
+	// connection, before anything else is asked for.
+	waitFor(t, "a ping on a new connection", func() bool { return strings.Contains(log.String(), "1 PING") })
+	if got := log.String(); !strings.HasPrefix(got, "0 GET a.txt, 0 PING, 1 PING") {
+		t.Errorf("server saw %s", got)
+	}
+}
+
+func TestKeepaliveWithoutReconnect(t *testing.T) {
+	var log eventLog
+	server := newPingServer(t, &log, true)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "2", "-keepalive", "50ms", "-reconnect", "0")
+	closePipelines(t, opts)
+
+	get := func(name string) {
+		t.Helper()
+		results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/" + name}, nil, opts.log)
+		if err != nil || statuses(results) != "downloaded" {
+			t.Fatalf("%s: batch returned %v with %s", name, err, statuses(results))
+		}
+	}
+	get("a.txt")
+	waitFor(t, "the dropped ping", func() bool { return strings.Contains(log.String(), "0 PING") })
+	time.Sleep(200 * time.Millisecond)
+	if n := server.connections(); n != 1 {
+		t.Errorf("%d connections before the next job, want no redial with -reconnect 0", n)
+	}
+	// The next job finds the pipeline marked dead and dials a new one.
+	get("b.txt")
+	if !strings.Contains(log.String(), "1 GET b.txt") {
+		t.Errorf("server saw %s", log.String())
+	}
+}
+
+// timeoutReader fails every read as a timeout would.
+type timeoutReader struct{}
+
+func (timeoutReader) Read([]byte) (int, error) { return 0, timeoutError{} }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestKeepaliveCountsMisses(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, server)
+
+	opts := newTestOptions(t, "-reconnect", "0")
+	p := &pipeline{opts: opts, host: "example.com", log: opts.log, conn: client, r: bufio.NewReader(timeoutReader{}), done: make(chan struct{})}
+	k := keepaliveOptions{interval: time.Millisecond, failures: 3}
+
+	p.busy.Store(true)
+	if !p.ping(k) || p.pings != 0 {
+		t.Errorf("pinged a busy pipeline: %d pings outstanding", p.pings)
+	}
+	p.busy.Store(false)
+
+	for i := 1; i < k.failures; i++ {
+		if !p.ping(k) || p.missed != i {
+			t.Fatalf("ping %d: missed %d, broken %v", i, p.missed, p.broken.Load())
+		}
+	}
+	if p.ping(k) || !p.broken.Load() {
+		t.Errorf("pipeline alive after %d misses", k.failures)
+	}
+	// The unanswered pings are still owed replies.
+	if p.pings != k.failures {
+		t.Errorf("%d pings outstanding, want %d", p.pings, k.failures)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("dead connection left open: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// keychainService is the service name tokens are stored under in the macOS
+// Keychain, Windows Credential Manager or the Secret Service (libsecret) on
+// other systems, with the server's host:port as the account.
+const keychainService = "tcp-file-client"
+
+// keychainCache remembers lookups, so that a batch asks the credential store
+// once per server however many connections it opens.
+type keychainCache struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// keychainToken returns the token login stored for address, or "".
+func (o *options) keychainToken(address string) string {
+	if !o.keychain {
+		return ""
+	}
+	c := &o.keychainTokens
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.tokens[address]; ok {
+		return token
+	}
+
+	token, err := keyring.Get(keychainService, address)
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		o.log.Debugf("error reading credential store: %v", err)
+	}
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[address] = token
+	return token
+}
+
+// runLogin implements the login subcommand: login [tcp://host:port]. It
+// reads a token, without echoing it when stdin is a terminal, and saves it
+// in the credential store for the server.
+func runLogin(opts *options, args []string) error {
+	fs := newCommandFlags("login")
+	fs.Parse(args)
+	address, err := loginServer(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	var token string
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "Token for %s: ", address)
+		data, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("error reading token: %w", err)
+		}
+		token = string(data)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("error reading token: %w", err)
+		}
+		token = line
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return errors.New("the token must be one word")
+	}
+
+	if err := keyring.Set(keychainService, address, token); err != nil {
+		return fmt.Errorf("error saving token in credential store: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "saved token for %s\n", address)
+	return nil
+}
+
+// runLogout implements the logout subcommand: logout [tcp://host:port].
+func runLogout(opts *options, args []string) error {
+	fs := newCommandFlags("logout")
+	fs.Parse(args)
+	address, err := loginServer(fs.Args())
+	if err != nil {
+		return err
+	}
+	err = keyring.Delete(keychainService, address)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("no token saved for %s", address)
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting token from credential store: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "deleted token for %s\n", address)
+	return nil
+}
+
+func loginServer(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return ServerAddress, nil
+	case 1:
+		u, err := parseTCPURL(args[0])
+		if err != nil {
+			return "", err
+		}
+		return u.Host, nil
+	}
+	return "", errors.New("usage: login|logout [tcp://host:port]")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLegacyNeverHandshakes(t *testing.T) {
+	var log eventLog
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		if !ok {
+			return
+		}
+		log.add(line)
+		if name := strings.TrimPrefix(line, "GET "); name != line {
+			conn.Write([]byte("contents of " + name))
+		}
+	})
+	chdir(t, t.TempDir())
+	// Even a token, which would otherwise be sent in a handshake, doesn't
+	// make -legacy greet the server.
+	opts := newTestOptions(t, "-legacy", "-token", "s3cret")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if data, err := os.ReadFile("a.txt"); err != nil || string(data) != "contents of a.txt" {
+		t.Errorf("saved %q, %v", data, err)
+	}
+
+	result, err := opts.ping(server.addr())
+	if err != nil || !result.Connected || result.Hello != nil {
+		t.Errorf("ping: %+v, %v", result, err)
+	}
+
+	d := &diagnosis{Server: server.addr(), File: "b.txt"}
+	if err := opts.diagnose(d, &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/b.txt"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d.Bytes != int64(len("contents of b.txt")) || d.legacyHandshake {
+		t.Errorf("diagnosis %+v", d)
+	}
+
+	if got, want := log.String(), "GET a.txt, GET b.txt"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+	if n := server.connections(); n != 3 {
+		t.Errorf("%d connections, want one each for get, ping and diagnose", n)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errTooLarge = errors.New("file exceeds -max-size")
+
+// checkDeclaredSize rejects a transfer up front when the size the server
+// announced is over -max-size. Unknown sizes (-1) are checked as data
+// arrives instead.
+func (o *options) checkDeclaredSize(size int64) error {
+	if o.maxSize > 0 && size > int64(o.maxSize) {
+		return fmt.Errorf("declared size %s: %w", formatBytes(size), errTooLarge)
+	}
+	return nil
+}
+
+// limitWriter guards against servers that send more than they declared, or
+// declare nothing, by failing once the transfer passes -max-size. offset
+// counts bytes an earlier attempt already wrote.
+func (o *options) limitWriter(w io.Writer, offset int64) io.Writer {
+	if o.maxSize <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, remaining: int64(o.maxSize) - offset}
+}
+
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, errTooLarge
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// skipOversized reports whether a failed transfer was only too large and
+// should be logged as skipped rather than failed.
+func (o *options) skipOversized(err error) bool {
+	return o.maxSizeAction == "skip" && errors.Is(err, errTooLarge)
+}
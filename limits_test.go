@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaxSizeRefusesDeclaredSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	chdir(t, dir)
+	opts := newTestOptions(t, "-max-size", "10", "-retry-on", "none")
+
+	results, _ := runBatch(opts, []string{server.URL + "/big.bin"}, nil, opts.log)
+	if statuses(results) != statusFailed || !strings.Contains(results[0].Error, "declared size") {
+		t.Fatalf("status %s with %q, want a failure over the declared size", statuses(results), results[0].Error)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("left behind %v", files)
+	}
+}
+
+func TestMaxSizeStopsUndeclaredSize(t *testing.T) {
+	server := newFileServer(t)
+	for action, want := range map[string]string{"abort": statusFailed, "skip": statusSkipped} {
+		dir := t.TempDir()
+		chdir(t, dir)
+		opts := newTestOptions(t, "-max-size", "10", "-max-size-action", action, "-retry-on", "none")
+
+		results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+		if got := statuses(results); got != want {
+			t.Errorf("-max-size-action %s: status %s, want %s", action, got, want)
+		}
+		if _, err := os.Stat("a.txt"); err == nil {
+			t.Errorf("-max-size-action %s: the oversized file was kept", action)
+		}
+	}
+	opts := newTestOptions(t, "-max-size", "100")
+	chdir(t, t.TempDir())
+	if results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil || statuses(results) != statusDownloaded {
+		t.Errorf("a file under -max-size: %v, %s", err, statuses(results))
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// listEntry is one file in a LIST reply. The server sends an entry per line
+// as tab-separated name, size in bytes, modification time in Unix seconds
+// and hex sha256 ("-" when it has none), then closes the connection. A line
+// starting with "ERR " reports a failure instead. Further fields may follow
+// for extensions such as extended attributes (see xattrPrefix).
+//
+// The request may carry a glob and filters the server applies before
+// replying: "LIST logs/* maxage=86400 minsize=1048576". Ages are in seconds
+// relative to the server's clock, so clock skew doesn't matter to servers
+// that apply them, which say so with the "filter" capability; for others
+// the client filters the listing against its own clock.
+type listEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	// Xattrs holds the extended attributes the server listed, by name.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+type listOptions struct {
+	long    bool
+	json    bool
+	sortBy  string
+	reverse bool
+	filter  listFilter
+}
+
+type listFilter struct {
+	pattern   string
+	newerThan time.Duration
+	olderThan time.Duration
+	minSize   byteSize
+	maxSize   byteSize
+	// xattrs asks the server to list extended attributes too.
+	xattrs bool
+}
+
+func (l *listOptions) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&l.long, "l", false, "show size, modification time and hash for each file")
+	fs.BoolVar(&l.json, "json", false, "print the listing as a JSON array")
+	fs.StringVar(&l.sortBy, "sort", "name", "sort by `key`: name, size or time")
+	fs.BoolVar(&l.reverse, "r", false, "reverse the sort order")
+	fs.DurationVar(&l.filter.newerThan, "newer-than", 0, "only list files modified within this `duration`, such as 24h")
+	fs.DurationVar(&l.filter.olderThan, "older-than", 0, "only list files last modified longer than this `duration` ago")
+	fs.Var(&l.filter.minSize, "min-size", "only list files of at least this `size`, such as 1M")
+	fs.Var(&l.filter.maxSize, "max-size", "only list files of at most this `size`")
+}
+
+// request builds the LIST line for the filter.
+func (f *listFilter) request() string {
+	var args []string
+	if f.newerThan > 0 {
+		args = append(args, "maxage="+strconv.FormatInt(int64(f.newerThan/time.Second), 10))
+	}
+	if f.olderThan > 0 {
+		args = append(args, "minage="+strconv.FormatInt(int64(f.olderThan/time.Second), 10))
+	}
+	if f.minSize > 0 {
+		args = append(args, "minsize="+strconv.FormatInt(int64(f.minSize), 10))
+	}
+	if f.maxSize > 0 {
+		args = append(args, "maxsize="+strconv.FormatInt(int64(f.maxSize), 10))
+	}
+	if f.xattrs {
+		args = append(args, "xattrs=1")
+	}
+
+	if f.pattern == "" && len(args) == 0 {
+		return "LIST\n"
+	}
+	pattern := f.pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	return "LIST " + strings.Join(append([]string{pattern}, args...), " ") + "\n"
+}
+
+// match applies the filter locally as well, so servers that predate
+// filtering and return everything still produce the right listing. Ages
+// are left to a server that says it filters, with serverAges, since
+// checking them against this client's clock would bring back the skew.
+func (f *listFilter) match(entry listEntry, now time.Time, serverAges bool) bool {
+	if f.pattern != "" {
+		if ok, _ := path.Match(f.pattern, entry.Name); !ok {
+			return false
+		}
+	}
+	if age := now.Sub(entry.ModTime); !serverAges {
+		if f.newerThan > 0 && age > f.newerThan {
+			return false
+		}
+		if f.olderThan > 0 && age < f.olderThan {
+			return false
+		}
+	}
+	if f.minSize > 0 && entry.Size < int64(f.minSize) {
+		return false
+	}
+	if f.maxSize > 0 && entry.Size > int64(f.maxSize) {
+		return false
+	}
+	return true
+}
+
+// runList implements the ls subcommand: ls [flags] [[tcp://host:port/]pattern].
+func runList(opts *options, args []string) error {
+	var l listOptions
+	fs := newCommandFlags("ls")
+	l.registerFlags(fs)
+	fs.Parse(args)
+
+	server := &url.URL{Scheme: "tcp", Host: ServerAddress}
+	if fs.NArg() > 1 {
+		return errors.New("ls takes at most one pattern or server url")
+	}
+	if fs.NArg() == 1 {
+		l.filter.pattern = fs.Arg(0)
+		if strings.Contains(fs.Arg(0), "://") {
+			u, err := parseTCPURL(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			server, l.filter.pattern = u, strings.TrimPrefix(u.Path, "/")
+		}
+	}
+	if strings.ContainsAny(l.filter.pattern, " \t\r\n") {
+		return fmt.Errorf("pattern %q must not contain whitespace", l.filter.pattern)
+	}
+	if _, err := path.Match(l.filter.pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", l.filter.pattern, err)
+	}
+
+	entries, err := opts.list(server.Host, &l.filter)
+	if err != nil {
+		return err
+	}
+	if err := sortEntries(entries, l.sortBy, l.reverse); err != nil {
+		return err
+	}
+	return l.print(os.Stdout, entries)
+}
+
+func (o *options) list(address string, filter *listFilter) ([]listEntry, error) {
+	// Whether the server applies age filters itself decides whether the
+	// listing is filtered again against this client's clock.
+	ages := filter.newerThan > 0 || filter.olderThan > 0
+	conn, r, hello, err := o.dialRequest(context.Background(), address, ages)
+	if err != nil {
+		return nil, err
+	}
+	serverAges := hello != nil && hello.supports("filter")
+	defer conn.Close()
+
+	request, err := o.signRequest(address, strings.TrimSuffix(filter.request(), "\n"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(request + "\n")); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	o.log.Debugf("sent %s to %s", request, address)
+
+	now := time.Now()
+	entries := []listEntry{}
+	for n := 0; ; n++ {
+		line, err := readLine(r, maxListingLine)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading listing: %w", err)
+		}
+		if n == maxListingEntries {
+			return nil, &protocolError{fmt.Sprintf("listing of more than %d files", maxListingEntries), line}
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, &serverError{strings.TrimPrefix(line, "ERR ")}
+		}
+		entry, err := parseListEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		if filter.match(entry, now, serverAges) && o.filters.allows(entry.Name) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func parseTCPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "tcp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server url %q", raw)
+	}
+	return u, nil
+}
+
+func parseListEntry(line string) (listEntry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 4 || fields[0] == "" {
+		return listEntry{}, &protocolError{"invalid listing line", line}
+	}
+	size, err := parseSize(fields[1], line)
+	if err != nil {
+		return listEntry{}, err
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return listEntry{}, &protocolError{"invalid time in listing line", line}
+	}
+
+	entry := listEntry{Name: fields[0], Size: size, ModTime: time.Unix(mtime, 0).UTC()}
+	if fields[3] != "-" {
+		if digest, err := hex.DecodeString(fields[3]); err != nil || len(digest) != sha256.Size {
+			return listEntry{}, &protocolError{"invalid sha256 in listing line", line}
+		}
+		entry.SHA256 = fields[3]
+	}
+	// Later fields are optional extensions; unknown ones are skipped.
+	for _, field := range fields[4:] {
+		if entry.Xattrs == nil {
+			entry.Xattrs = map[string][]byte{}
+		}
+		if err := parseXattrField(field, entry.Xattrs); err != nil {
+			return listEntry{}, fmt.Errorf("%w in listing line %q", err, line)
+		}
+	}
+	return entry, nil
+}
+
+func sortEntries(entries []listEntry, by string, reverse bool) error {
+	var less func(a, b listEntry) bool
+	switch by {
+	case "name":
+		less = func(a, b listEntry) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b listEntry) bool { return a.Size < b.Size }
+	case "time":
+		less = func(a, b listEntry) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		return fmt.Errorf("unknown sort key %q", by)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return nil
+}
+
+func (l *listOptions) print(w io.Writer, entries []listEntry) error {
+	if l.json {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	if !l.long {
+		for _, entry := range entries {
+			fmt.Fprintln(w, entry.Name)
+		}
+		return nil
+	}
+
+	// Sizes are right-aligned like ls -l; the other columns are left-aligned.
+	sizeWidth := 0
+	for _, entry := range entries {
+		if n := len(strconv.FormatInt(entry.Size, 10)); n > sizeWidth {
+			sizeWidth = n
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		hash := entry.SHA256
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(tw, "%*d\t%s\t%s\t%s\n", sizeWidth, entry.Size, entry.ModTime.Local().Format("2006-01-02 15:04"), hash, entry.Name)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListAgesUseServerClock lists from a server whose clock is an hour
+// behind, so a file it modified a minute ago looks an hour old here.
+func TestListAgesUseServerClock(t *testing.T) {
+	mtime := time.Now().Add(-time.Hour - time.Minute).Unix()
+	for _, capabilities := range [][]string{{"list", "filter"}, {"list"}} {
+		server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+			line, ok := serveHello(r, conn, capabilities...)
+			if !ok {
+				return
+			}
+			if line != "LIST * maxage=600" {
+				t.Errorf("request %q", line)
+			}
+			conn.Write([]byte("fresh.log\t1\t" + strconv.FormatInt(mtime, 10) + "\t-\n"))
+		})
+		opts := newTestOptions(t)
+		entries, err := opts.list(server.addr(), &listFilter{newerThan: 10 * time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A server that doesn't say it filters may have sent everything.
+		want := 0
+		if containsString(capabilities, "filter") {
+			want = 1
+		}
+		if len(entries) != want {
+			t.Errorf("with capabilities %v: listed %d files, want %d", capabilities, len(entries), want)
+		}
+	}
+}
+
+func testEntries() []listEntry {
+	return []listEntry{
+		{Name: "b.log", Size: 2048, ModTime: time.Unix(1700000300, 0).UTC()},
+		{Name: "a.txt", Size: 3, ModTime: time.Unix(1700000000, 0).UTC(), SHA256: strings.Repeat("ab", 32)},
+		{Name: "c.bin", Size: 100, ModTime: time.Unix(1700000200, 0).UTC()},
+	}
+}
+
+func entryNames(entries []listEntry) string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestSortEntries(t *testing.T) {
+	for _, test := range []struct {
+		by      string
+		reverse bool
+		want    string
+	}{
+		{"name", false, "a.txt b.log c.bin"},
+		{"name", true, "c.bin b.log a.txt"},
+		{"size", false, "a.txt c.bin b.log"},
+		{"time", false, "a.txt c.bin b.log"},
+		{"time", true, "b.log c.bin a.txt"},
+	} {
+		entries := testEntries()
+		if err := sortEntries(entries, test.by, test.reverse); err != nil {
+			t.Fatal(err)
+		}
+		if got := entryNames(entries); got != test.want {
+			t.Errorf("sort by %s (reverse %v): %s, want %s", test.by, test.reverse, got, test.want)
+		}
+	}
+	if err := sortEntries(testEntries(), "owner", false); err == nil {
+		t.Error("sorted by an unknown key")
+	}
+}
+
+func TestListPrintFormats(t *testing.T) {
+	entries := testEntries()
+	sortEntries(entries, "name", false)
+
+	var short bytes.Buffer
+	(&listOptions{}).print(&short, entries)
+	if got, want := short.String(), "a.txt\nb.log\nc.bin\n"; got != want {
+		t.Errorf("short listing %q, want %q", got, want)
+	}
+
+	var long bytes.Buffer
+	(&listOptions{long: true}).print(&long, entries)
+	mtime := func(i int) string { return entries[i].ModTime.Local().Format("2006-01-02 15:04") }
+	want := "   3  " + mtime(0) + "  " + strings.Repeat("ab", 32) + "  a.txt\n" +
+		"2048  " + mtime(1) + "  -" + strings.Repeat(" ", 65) + "b.log\n" +
+		" 100  " + mtime(2) + "  -" + strings.Repeat(" ", 65) + "c.bin\n"
+	if got := long.String(); got != want {
+		t.Errorf("long listing\n%s\nwant\n%s", got, want)
+	}
+
+	var encoded bytes.Buffer
+	(&listOptions{json: true}).print(&encoded, entries)
+	var decoded []listEntry
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if entryNames(decoded) != entryNames(entries) || decoded[0].SHA256 != entries[0].SHA256 || !decoded[1].ModTime.Equal(entries[1].ModTime) {
+		t.Errorf("JSON listing %s", encoded.String())
+	}
+	if strings.Contains(encoded.String(), `"sha256": ""`) {
+		t.Errorf("JSON listing has empty hashes: %s", encoded.String())
+	}
+}
+
+func FuzzParseListEntry(f *testing.F) {
+	f.Add("a.txt\t3\t1700000000\t-")
+	f.Add("logs/app.log\t1048576\t1700000000\tba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	f.Add("b.bin\t0\t0\t-\txattr.user.comment=aGVsbG8=\tsomething.else")
+	f.Add("b.bin\t0\t0\t-\txattr.=\txattr.a=!!")
+	f.Add("\t1\t1\t-")
+	f.Add("c\t-1\t1\t-")
+	f.Add("c\t99999999999999999999\t1\t-")
+	f.Add("c\t1\t-9223372036854775808\tnothex")
+	f.Fuzz(func(t *testing.T, line string) {
+		entry, err := parseListEntry(line)
+		if err != nil {
+			return
+		}
+		if entry.Name == "" || strings.Contains(entry.Name, "\t") {
+			t.Errorf("accepted the name %q", entry.Name)
+		}
+		if entry.Size < 0 {
+			t.Errorf("accepted the size %d", entry.Size)
+		}
+		if entry.SHA256 != "" && len(entry.SHA256) != 64 {
+			t.Errorf("accepted the digest %q", entry.SHA256)
+		}
+	})
+}
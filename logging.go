@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// openLog opens the destinations selected by -log-file and -log-stderr. The
+// returned function closes the log file, if there is one.
+func (o *options) openLog() (io.Writer, func(), error) {
+	var writers []io.Writer
+	closeLog := func() {}
+
+	// Under systemd, whatever would go to stderr goes to the journal with
+	// its fields instead; see openJournal.
+	var stderr io.Writer = os.Stderr
+	if o.toJournal() {
+		stderr = io.Discard
+	}
+
+	switch o.logFile {
+	case "":
+	case "-":
+		writers = append(writers, stderr)
+	default:
+		file, err := os.OpenFile(o.logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		writers = append(writers, file)
+		closeLog = func() { file.Close() }
+	}
+	if o.logStderr && o.logFile != "-" {
+		writers = append(writers, stderr)
+	}
+
+	switch len(writers) {
+	case 0:
+		return io.Discard, closeLog, nil
+	case 1:
+		return writers[0], closeLog, nil
+	}
+	return io.MultiWriter(writers...), closeLog, nil
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l *logLevel) String() string {
+	if l == nil || int(*l) >= len(logLevelNames) {
+		return "info"
+	}
+	return logLevelNames[*l]
+}
+
+func (l *logLevel) Set(value string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(value, name) {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q: use debug, info, warn or error", value)
+}
+
+// leveledLogger writes messages at or above its level. Info and error messages
+// are written as they are, which keeps the long-standing log format; debug
+// and warning messages are marked as such.
+type leveledLogger struct {
+	out    *log.Logger
+	level  logLevel
+	sinks  []logSink
+	fields map[string]string
+}
+
+// A logSink is an additional log destination that keeps each message's
+// level, such as syslog. Fields are journald-style names, like FILE, that
+// describe what the message is about.
+type logSink interface {
+	write(level logLevel, message string, fields map[string]string) error
+}
+
+// with returns a logger that attaches fields to its messages for the sinks
+// that record them.
+func (l *leveledLogger) with(fields map[string]string) *leveledLogger {
+	if l == nil {
+		return nil
+	}
+	c := *l
+	c.fields = map[string]string{}
+	for k, v := range l.fields {
+		c.fields[k] = v
+	}
+	for k, v := range fields {
+		c.fields[k] = v
+	}
+	return &c
+}
+
+// transferLog is o.log, tagged with the ID of the transfer in ctx.
+func (o *options) transferLog(ctx context.Context) *leveledLogger {
+	id := transferID(ctx)
+	if id == "" {
+		return o.log
+	}
+	return o.log.with(map[string]string{"TRANSFER_ID": id})
+}
+
+func (l *leveledLogger) enabled(level logLevel) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *leveledLogger) logf(level logLevel, prefix, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	if id := l.fields["TRANSFER_ID"]; id != "" {
+		prefix = "[" + id + "] " + prefix
+	}
+	l.out.Output(3, prefix+message)
+	for _, sink := range l.sinks {
+		if err := sink.write(level, message, l.fields); err != nil {
+			l.out.Output(3, "warning: "+err.Error())
+		}
+	}
+}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, "debug: ", format, args...)
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, "", format, args...)
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, "warning: ", format, args...)
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, "", format, args...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogLevelFiltersMessages(t *testing.T) {
+	for _, test := range []struct {
+		level string
+		want  string
+	}{
+		{"debug", "debug: one\ntwo\nwarning: three\nfour\n"},
+		{"INFO", "two\nwarning: three\nfour\n"},
+		{"warn", "warning: three\nfour\n"},
+		{"error", "four\n"},
+	} {
+		var level logLevel
+		if err := level.Set(test.level); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		logger := &leveledLogger{out: log.New(&out, "", 0), level: level}
+		logger.Debugf("one")
+		logger.Infof("two")
+		logger.Warnf("three")
+		logger.Errorf("four")
+		if out.String() != test.want {
+			t.Errorf("-log-level %s logged %q, want %q", test.level, out.String(), test.want)
+		}
+	}
+
+	var level logLevel
+	if err := level.Set("verbose"); err == nil {
+		t.Error("-log-level verbose accepted")
+	}
+	var opts options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.registerFlags(fs)
+	if opts.logLevel != levelInfo {
+		t.Errorf("default -log-level %s, want info", &opts.logLevel)
+	}
+}
+
+func TestDebugLogsProtocolSteps(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t)
+	var out bytes.Buffer
+	opts.log = &leveledLogger{out: log.New(&out, "", 0), level: levelDebug}
+
+	if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if want := "debug: sent GET a.txt to " + server.addr(); !strings.Contains(out.String(), want) {
+		t.Errorf("debug log %q lacks %q", out.String(), want)
+	}
+
+	out.Reset()
+	opts.log.level = levelInfo
+	if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/b.txt"}, nil, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "debug:") {
+		t.Errorf("info log has debug messages: %q", out.String())
+	}
+}
+
+// captureStderr points os.Stderr at a file for the rest of the test and
+// returns a function reading what was written to it.
+func captureStderr(t *testing.T) func() string {
+	t.Helper()
+	t.Setenv("JOURNAL_STREAM", "")
+	file, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = file
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		file.Close()
+	})
+	return func() string {
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestLogDestinations(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		args             []string
+		toFile, toStderr bool
+	}{
+		{[]string{"-log-file", ""}, false, false},
+		{[]string{"-log-file", "-"}, false, true},
+		{[]string{"-log-file", "-", "-log-stderr"}, false, true},
+		{[]string{"-log-file", filepath.Join(dir, "a.log")}, true, false},
+		{[]string{"-log-file", filepath.Join(dir, "b.log"), "-log-stderr"}, true, true},
+	} {
+		stderr := captureStderr(t)
+		opts := newTestOptions(t, test.args...)
+		out, closeLog, err := opts.openLog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, "hello\n")
+		closeLog()
+
+		if got, want := stderr(), map[bool]string{true: "hello\n"}[test.toStderr]; got != want {
+			t.Errorf("%v wrote %q to stderr, want %q", test.args, got, want)
+		}
+		if test.toFile {
+			data, err := os.ReadFile(opts.logFile)
+			if err != nil || string(data) != "hello\n" {
+				t.Errorf("%v wrote %q to the log file (%v)", test.args, data, err)
+			}
+		}
+	}
+}
+
+func TestLogFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions(t, "-log-file", path)
+	out, closeLog, err := opts.openLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(out, "later\n")
+	closeLog()
+	if data, _ := os.ReadFile(path); string(data) != "earlier\nlater\n" {
+		t.Errorf("log file has %q, want both runs", data)
+	}
+
+	opts = newTestOptions(t, "-log-file", filepath.Join(path, "not-a-dir", "client.log"))
+	if _, _, err := opts.openLog(); err == nil {
+		t.Error("opened a log file under a regular file")
+	}
+}
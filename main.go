@@ -22,58 +22,121 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	ServerAddress      = "127.0.0.1:8000"
-	DefaultBufferSize  = 8192
-	DefaultLogFilename = "tcp-client.log"
-	ConnectionTimeout  = 30 * time.Second
+	DefaultServerAddress = "127.0.0.1:8000"
+	DefaultBufferSize    = 8192
+	DefaultLogFilename   = "tcp-client.log"
+	DefaultFilename      = "test.txt"
+	ConnectionTimeout    = 30 * time.Second
 )
 
 var (
 	FilenameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	// ServerAddress is the server for sources given without a url, set
+	// with -addr.
+	ServerAddress = DefaultServerAddress
 )
 
-func downloadFile(conn net.Conn, filename string, bufferSize int) error {
-	request := fmt.Sprintf("GET %s\n", filename)
-	if _, err := conn.Write([]byte(request)); err != nil {
-		return fmt.Errorf("error sending request: %w", err)
+func downloadFile(opts *options, source *url.URL, destination string, bufferSize int, result *transferResult) error {
+	out, err := fetchFile(opts, source, destination, bufferSize, result)
+	if err != nil {
+		return err
 	}
+	return out.commit()
+}
 
-	file, err := os.Create(filename)
+// fetchFile transfers a file into its sink and leaves committing it to the
+// caller, so batches can finalize one file while the next is transferred.
+func fetchFile(opts *options, source *url.URL, destination string, bufferSize int, result *transferResult) (sink, error) {
+	out, offset, err := opts.openSink(destination)
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	buffer := make([]byte, bufferSize)
-	for {
-		if err := conn.SetReadDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
-			return fmt.Errorf("error setting read deadline: %w", err)
+	ctx := opts.transferContext(result)
+	reader, size, offset, err := opts.openResumed(ctx, source, out, offset)
+	if err != nil {
+		out.abort()
+		return nil, err
+	}
+	if out, err = opts.checkSink(out, offset, result); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if err := opts.checkDeclaredSize(size); err != nil {
+		reader.Close()
+		out.abort()
+		return nil, err
+	}
+	raw := reader
+	if opts.decryptWith.enabled() {
+		if reader, err = opts.decryptWith.decrypt(raw); err != nil {
+			raw.Close()
+			out.abort()
+			return nil, err
 		}
+		// The server's size is the ciphertext's.
+		size = -1
+	}
+
+	var w io.Writer = out
+	if progress := opts.newProgress(result.ID, destination, offset, size); progress != nil {
+		defer progress.finish()
+		w = io.MultiWriter(out, progress)
+	}
+
+	// Some backends only learn whether the transfer succeeded when the
+	// stream is closed, so the close error counts too.
+	n, err := opts.transfer(ctx, w, reader, bufferSize)
+	result.Bytes = offset + n
+	result.Attempts = 1
+	if r, ok := raw.(*reconnectingReader); ok {
+		result.Attempts += r.reconnected
+	}
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		out.abort()
+		return nil, err
+	}
+	return out, nil
+}
 
-		bytesRead, err := conn.Read(buffer)
+func copyData(w io.Writer, r io.Reader, bufferSize int) (int64, error) {
+	var total int64
+	buffer := getBuffer(bufferSize)
+	defer putBuffer(buffer)
+	for {
+		bytesRead, err := r.Read(buffer)
+		if bytesRead > 0 {
+			if _, err := w.Write(buffer[:bytesRead]); err != nil {
+				return total, fmt.Errorf("error writing data to file: %w", err)
+			}
+			total += int64(bytesRead)
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("error reading data from connection: %w", err)
-		}
-
-		if _, err = file.Write(buffer[:bytesRead]); err != nil {
-			return fmt.Errorf("error writing data to file: %w", err)
+			return total, fmt.Errorf("error reading data from connection: %w", err)
 		}
 	}
 
-	return nil
+	return total, nil
 }
 
 func validateFilename(filename string) error {
@@ -83,34 +146,479 @@ func validateFilename(filename string) error {
 	return nil
 }
 
-func main() {
-	conn, err := net.DialTimeout("tcp", ServerAddress, ConnectionTimeout)
+type options struct {
+	metalink   string
+	proxy      string
+	noProxy    string
+	socket     socketOptions
+	tls        tlsOptions
+	noise      noiseOptions
+	psk        pskOptions
+	ssh        sshOptions
+	output     string
+	autoRename bool
+	// caseCollision is the -case-collision policy; caseRenames holds the
+	// names it picked for sources in the current batch.
+	caseCollision string
+	caseRenames   map[string]string
+	backup        backupMode
+	preserve      preserveOptions
+	chmod         fileMode
+	chmodUmask    bool
+	chown         owner
+	fsync         bool
+	nocache       bool
+	// verifyReadback rereads each file after writing it; see commitVerified.
+	verifyReadback bool
+	token          string
+	keychain       bool
+	keychainTokens keychainCache
+	useNetrc       bool
+	netrcEntries   netrcCache
+	refresh        tokenRefresher
+	signRequests   bool
+	encryptTo      recipientList
+	decryptWith    decryptKey
+	resume         bool
+	// verifyResume is how many bytes before the resume offset are fetched
+	// again and compared with the partial file.
+	verifyResume byteSize
+	partial      partialPolicy
+	reconnects   int
+	retry        retryPolicy
+	queueDepth   int
+	progress     progressMode
+	progressFD   int
+	smoothing    rateSmoothing
+	// progressOut receives -progress=json events. onProgress, when set,
+	// receives every transfer's progress events in their place, for code
+	// that drives transfers itself.
+	progressOut io.Writer
+	onProgress  func(progressEvent)
+	split       byteSize
+	join        bool
+	filters     filterRules
+
+	// queue holds the sources still to be fetched, which pipelining
+	// requests ahead of time.
+	pipelineDepth int
+	wire          wireMode
+	queue         []string
+	// disabledExtensions are the extensions -disable-extension keeps the
+	// client from offering.
+	disabledExtensions map[string]bool
+
+	sendTransferID bool
+	banner         bannerPrinter
+	keepalive      keepaliveOptions
+	// legacy talks to servers that predate the handshake exactly as the
+	// first clients did.
+	legacy bool
+	// noHandshake holds the servers dialRequest found to predate the
+	// handshake.
+	noHandshakeMu sync.Mutex
+	noHandshake   map[string]bool
+
+	parallel          int
+	failFast          bool
+	parallelPerServer int
+	connections       int
+
+	limitRate      byteSize
+	limitRateTotal byteSize
+	totalLimiter   *rateLimiter
+	rateSchedule   rateSchedule
+	scheduleLimit  *rateLimiter
+	minSpeed       byteSize
+	minSpeedTime   time.Duration
+
+	maxSize         byteSize
+	maxSizeAction   string
+	content         contentPolicy
+	quarantine      string
+	quarantineFirst bool
+	clamd           string
+	jsonResults     bool
+	seenDB          string
+	skipSeen        bool
+	auditLog        string
+	audit           *auditLog
+	historyDB       string
+	history         *historyDB
+	statsd          statsdOptions
+	statsdClient    *statsdClient
+	influx          string
+	influxName      string
+	influxWriter    *influxWriter
+	runReport       runReport
+
+	breaker   breaker
+	budget    budget
+	window    timeWindows
+	logLevel  logLevel
+	logFile   string
+	logStderr bool
+	syslog    syslogOptions
+	eventLog  string
+	journald  bool
+	log       *leveledLogger
+
+	listingsMu sync.Mutex
+	listings   map[string]map[string]listEntry
+
+	backendsMu   sync.Mutex
+	openBackends map[string]backend
+}
+
+func (o *options) registerFlags(fs *flag.FlagSet) {
+	o.logLevel = levelInfo
+	fs.Var(&o.logLevel, "log-level", "log messages of this `level` and above: debug, info, warn or error")
+	fs.StringVar(&o.logFile, "log-file", DefaultLogFilename, "append the log to this `file`; - means stderr and an empty name disables the file")
+	fs.BoolVar(&o.logStderr, "log-stderr", false, "also write the log to stderr")
+	fs.BoolVar(&o.journald, "journald", true, "when run by systemd, log to the journal with structured fields instead of as text on stderr")
+	o.syslog.registerFlags(fs)
+	fs.StringVar(&o.eventLog, "eventlog", "", "on Windows, also report transfers and failures to the Event Log under this `source` name; add -log-file \"\" to log there only")
+	fs.StringVar(&o.metalink, "metalink", "", "download the files described by a Metalink (.meta4) document")
+	fs.StringVar(&o.proxy, "proxy", "", "proxy `url` to dial through (socks5://, socks5h:// or http://); defaults to ALL_PROXY")
+	fs.StringVar(&o.noProxy, "noproxy", "", "comma-separated `hosts` to connect to directly; defaults to NO_PROXY")
+	fs.StringVar(&o.output, "o", "", "write the download to this `destination` (a path, FIFO or device, or an s3://, gs:// or azblob:// URL) instead of the remote file's name")
+	fs.StringVar(&ServerAddress, "addr", DefaultServerAddress, "`host:port` of the server for files given without a tcp:// url")
+	fs.BoolVar(&o.keychain, "keychain", true, "look up the token saved with login in the OS credential store when -token and TCP_FILE_TOKEN aren't set")
+	fs.BoolVar(&o.useNetrc, "netrc", true, "look up tokens, and ftp and http logins, by host in $NETRC or ~/.netrc when none is given otherwise")
+	fs.BoolVar(&o.signRequests, "sign-requests", false, "add a timestamp, a nonce and an HMAC keyed with the token to every request, for servers that refuse replayed requests")
+	fs.StringVar(&o.token, "token", "", "authenticate to the server with this `token`, which every connection then sends in the handshake; defaults to TCP_FILE_TOKEN")
+	fs.BoolVar(&o.autoRename, "auto-rename", false, "save to \"name (1).ext\", \"name (2).ext\" and so on instead of replacing a file that already exists")
+	fs.StringVar(&o.caseCollision, "case-collision", collisionRename, "what to do when sources in one batch would be saved under names differing only in case on a case-insensitive filesystem: `policy` rename, skip or fail")
+	fs.Var(&o.backup, "backup", "rename a file a download replaces to file.~1~, file.~2~ and so on; -backup=SUFFIX keeps one backup named file+SUFFIX instead")
+	fs.Var(&o.preserve, "preserve", "copy this comma-separated `metadata` from the server's listing onto downloaded files where the filesystem supports it: xattrs, acls or all")
+	fs.Var(&o.chmod, "chmod", "give downloaded files this octal `mode`, such as 0640, regardless of the umask")
+	fs.BoolVar(&o.chmodUmask, "chmod-umask", false, "take the process umask off the -chmod mode rather than forcing it exactly")
+	fs.Var(&o.chown, "chown", "give downloaded files this `owner`: user, user:group or :group, by name or ID; changing the user needs privileges")
+	fs.BoolVar(&o.fsync, "fsync", false, "flush each downloaded file and its directory to stable storage before reporting success")
+	fs.BoolVar(&o.nocache, "nocache", false, "keep downloads out of the page cache by flushing them as they are written and, on Linux, dropping their pages, for huge files that would otherwise evict everything else")
+	fs.Var(&o.encryptTo, "encrypt-to", "encrypt downloads with age to this `recipient` before they reach the disk, saving them as name.age: an age or SSH public key, or a file of them; may be repeated. Use the decrypt command to read them")
+	fs.Var(&o.decryptWith, "decrypt-with", "decrypt downloads the server stores encrypted as they arrive, with the age identity or SSH private key in this `file`, or the 256-bit AES key in it for files in the TFCAES1 format; a file that fails authentication fails the download")
+	fs.BoolVar(&o.verifyReadback, "verify-readback", false, "after flushing each download to disk, read it back and check its sha256 against what was received, to catch storage that silently corrupts data; implies -fsync")
+	fs.BoolVar(&o.resume, "continue", false, "resume partially downloaded files instead of starting over")
+	fs.Var(&o.partial, "partial", "what to do with the .part file of a failed download: `policy` delete, keep for -continue, or keep:age such as keep:7d to remove it on a later run once it is that old (default keep with -continue, delete without)")
+	fs.Var(&o.verifyResume, "verify-resume", "before resuming, fetch the last `bytes` of the partial file again, such as 64K, and start over if they differ")
+	fs.IntVar(&o.reconnects, "reconnect", DefaultReconnects, "redial and resume up to this many `times` when a connection breaks mid-transfer; 0 disables it")
+	o.retry.registerFlags(fs)
+	o.refresh.registerFlags(fs)
+	o.keepalive.registerFlags(fs)
+	fs.BoolVar(&o.sendTransferID, "send-transfer-id", false, "send each transfer's ID to the server, as \"GET name id=ID\" or an X-Transfer-ID header, for servers that log it")
+	fs.BoolVar(&o.banner.quiet, "q", false, "don't show the banners servers send everyone who connects, such as notices of maintenance")
+	fs.BoolVar(&o.legacy, "legacy", false, "talk to old minimal servers as the original client did: send a bare \"GET name\" and read the file until the server closes the connection, with no handshake, in ping and diagnose too")
+	fs.IntVar(&o.pipelineDepth, "pipeline", 0, "keep up to this many GET `requests` in flight on one connection to servers that support pipelining; 0 opens a connection per file")
+	fs.Func("disable-extension", "don't offer this protocol `extension` to servers, such as sha256; may be repeated", o.disableExtension)
+	fs.Var(&o.wire, "wire", "encode requests and replies after the handshake as `mode` text, protobuf for the binary mode, which every GET then handshakes for and fails without, or auto to use protobuf on pipelines to servers that offer it (default auto)")
+	fs.IntVar(&o.queueDepth, "queue-depth", DefaultQueueDepth, "`buffers` queued between the goroutine reading the connection and the one writing to disk; 1 reads and writes in turn")
+	fs.Var(&o.progress, "progress", "show transfer progress on stderr; -progress=json prints JSON progress events instead")
+	fs.Var(&o.smoothing, "progress-smoothing", "how progress averages speed and ETA: `mode` instant, ewma[:window] such as ewma:10s, or average over the whole transfer (default ewma:5s)")
+	fs.IntVar(&o.progressFD, "progress-fd", 1, "write -progress=json events to this open file `descriptor`, such as 3")
+	fs.Var(&o.split, "split", "write the download as numbered parts of at most this `size` (such as 1G) with a manifest of their hashes")
+	fs.BoolVar(&o.join, "join", false, "fetch each source as the parts listed in its .manifest.json on the server and reassemble them")
+	fs.Func("include", "only transfer files matching this glob `pattern`; -include and -exclude rules are checked in order and the first match wins", o.filters.adder(true))
+	fs.Func("exclude", "skip files matching this glob `pattern`", o.filters.adder(false))
+	fs.BoolVar(&o.failFast, "fail-fast", false, "stop a batch, sync or -metalink download at the first file that fails instead of carrying on with the rest, exiting with status 4 rather than 3")
+	fs.IntVar(&o.parallel, "parallel", 1, "transfer up to this many files at once, in batches and the daemon")
+	fs.IntVar(&o.parallelPerServer, "parallel-per-server", 0, "transfer at most this many files at once from any one server in a batch; 0 means no limit beyond -parallel")
+	fs.IntVar(&o.connections, "connections", 1, "fetch up to this many parts of a -join download at once, each over its own connection")
+	fs.Var(&o.limitRate, "limit-rate", "limit each transfer to this many `bytes` per second, such as 500K or 2M")
+	fs.Var(&o.limitRateTotal, "limit-rate-total", "limit all concurrent transfers together to this many `bytes` per second")
+	fs.Var(&o.rateSchedule, "limit-rate-schedule", "limit all concurrent transfers together by the time of day, local time, with comma-separated `periods` such as 08:00-18:00=1M; there is no limit outside them")
+	fs.Var(&o.minSpeed, "min-speed", "abort a transfer that stays slower than this many `bytes` per second for -min-speed-time, and reconnect if -reconnect allows")
+	fs.DurationVar(&o.minSpeedTime, "min-speed-time", 30*time.Second, "how long a transfer may stay under -min-speed")
+	fs.Var(&o.maxSize, "max-size", "refuse any file larger than this `size`, whether declared by the server or observed while downloading")
+	fs.StringVar(&o.maxSizeAction, "max-size-action", "abort", "what to do with files over -max-size: `abort` counts them as failures, skip only logs them")
+	fs.Func("accept-types", "only accept files whose content sniffs as one of these comma-separated `kinds` (gzip, bzip2, xz, zstd, zip, tar, parquet, csv, json, text, pdf, png, jpeg, gif, executable, empty)", typeListAdder(&o.content.accept))
+	fs.Func("reject-types", "reject files whose content sniffs as any of these comma-separated `kinds`, such as executable", typeListAdder(&o.content.reject))
+	fs.StringVar(&o.quarantine, "quarantine", "", "move rejected or infected files into this `directory` for inspection instead of deleting them")
+	fs.BoolVar(&o.quarantineFirst, "quarantine-first", false, "download into the -quarantine directory and move files to their destination only once every check has passed; failed files stay in quarantine")
+	fs.StringVar(&o.clamd, "clamd", "", "scan every download with clamd at this `address` (host:port, or unix:/path for its socket) before accepting it")
+	fs.BoolVar(&o.jsonResults, "json", false, "print the result of each file to stdout as a line of JSON")
+	fs.StringVar(&o.seenDB, "seen-db", statePath(DefaultSeenFilename), "`file` that records every successful download; empty disables it")
+	fs.StringVar(&o.auditLog, "audit-log", "", "append a hash-chained record of every download, upload and delete to `file`; check it with the audit subcommand")
+	fs.StringVar(&o.historyDB, "history-db", statePath(DefaultHistoryFilename), "SQLite `file` that records every transfer for the history and stats subcommands; empty disables it")
+	o.runReport.registerFlags(fs)
+	o.statsd.registerFlags(fs)
+	fs.StringVar(&o.influx, "influx", "", "append a point in InfluxDB line protocol for every transfer to this `file`, or send it to udp://host:port, for Telegraf")
+	fs.StringVar(&o.influxName, "influx-measurement", "tcp_file_client_transfer", "InfluxDB `measurement` the -influx points belong to")
+	fs.BoolVar(&o.skipSeen, "skip-seen", false, "skip sources recorded in -seen-db unless the server lists them with a different size or hash")
+	o.breaker.registerFlags(fs)
+	o.budget.registerFlags(fs)
+	fs.Var(&o.window, "window", "only transfer files during these `times` of day, local time, such as 01:00-05:00; separate several with commas. Outside them transfers don't start, and those under way pause")
+	o.socket.registerFlags(fs)
+	o.tls.registerFlags(fs)
+	o.noise.registerFlags(fs)
+	fs.StringVar(&o.psk.file, "psk-file", "", "encrypt connections with the secret in this `file`, which the server shares, instead of TLS")
+	o.ssh.registerFlags(fs)
+}
+
+// upcoming lists the files still queued for host, in the order they are
+// fetched, so they can be requested ahead.
+func (o *options) upcoming(host string) []string {
+	var names []string
+	for _, arg := range o.queue {
+		if source, name, err := parseSource(arg); err == nil && source.Scheme == "tcp" && source.Host == host {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// destination returns where a command line source is saved.
+func (o *options) destination(arg string) string {
+	if o.output != "" {
+		return o.output
+	}
+	if renamed, ok := o.caseRenames[arg]; ok {
+		return renamed
+	}
+	_, filename, _ := parseSource(arg)
+	name := localName(filename)
+	if o.decryptWith.enabled() && o.decryptWith.aesKey == nil {
+		name = strings.TrimSuffix(name, ageSuffix)
+	}
+	if o.encryptTo.enabled() {
+		name += ageSuffix
+	}
+	return name
+}
+
+// get transfers one command line source to filename, or to o.destination
+// if it is empty. The returned finish commits the file and records it in
+// seen; it is nil when get fails.
+func (o *options) get(arg, filename string, seen *seenDB, logger *leveledLogger) (*transferResult, func() error, error) {
+	return o.getAs(newTransferResult(arg, ""), arg, filename, seen, logger)
+}
+
+// getAs is get with a result the caller has already created, so that it
+// knows the transfer's ID up front.
+func (o *options) getAs(result *transferResult, arg, filename string, seen *seenDB, logger *leveledLogger) (*transferResult, func() error, error) {
+	source, _, err := parseSource(arg)
 	if err != nil {
-		fmt.Println("error connecting to server:", err)
+		return result, nil, fmt.Errorf("invalid source: %w", err)
+	}
+	if filename == "" {
+		filename = o.destination(arg)
+	}
+	filename = longPath(filename)
+	if o.autoRename {
+		filename = freeName(filename)
+	}
+	result.Destination = filename
+
+	if o.skipSeen && seen != nil {
+		if record, ok := seen.seen(source.String(), o.remoteEntry(source.String())); ok {
+			return result, nil, fmt.Errorf("%w on %s", errSeen, record.Time.Format(time.RFC3339))
+		}
+	}
+
+	fetch := fetchFile
+	if o.join {
+		fetch = fetchJoined
+	}
+	out, err := fetch(o, source, filename, DefaultBufferSize, result)
+	if err != nil {
+		return result, nil, err
+	}
+
+	finish := func() error {
+		if err := out.commit(); err != nil {
+			return err
+		}
+		if o.preserve.enabled() {
+			if err := o.applyMetadata(filename, o.remoteEntry(source.String())); err != nil {
+				return err
+			}
+		}
+		if seen != nil {
+			record := seenRecord{Source: source.String(), Name: path.Base(source.Path), Size: result.Bytes, SHA256: result.SHA256, Time: time.Now().UTC()}
+			if err := seen.add(record); err != nil {
+				logger.Errorf("%v", err)
+			}
+		}
+		return nil
+	}
+	return result, finish, nil
+}
+
+func main() {
+	var opts options
+	opts.registerFlags(flag.CommandLine)
+	flag.String("config", defaultConfigPath(), "read default flag values from this `file`")
+	flag.String("profile", "", "also apply the settings of this `profile` in the config file")
+	flag.Usage = usage
+	if err := loadConfig(flag.CommandLine, os.Args[1:]); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer conn.Close()
+	flag.Parse()
+
+	// Arguments naming no command are files to get.
+	args := flag.Args()
+	var command string
+	if len(args) > 0 && lookupCommand(args[0]) != nil {
+		command, args = lookupCommand(args[0]).name, args[1:]
+	}
+	if command == "get" {
+		args = parseGetFlags(args)
+	}
 
-	logFilename := DefaultLogFilename
-	logFile, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	logOutput, closeLog, err := opts.openLog()
 	if err != nil {
 		fmt.Println("error creating log file:", err)
 		os.Exit(1)
 	}
-	defer logFile.Close()
+	defer closeLog()
 
-	logger := log.New(logFile, "", log.LstdFlags)
+	logger := &leveledLogger{out: log.New(logOutput, "", log.LstdFlags), level: opts.logLevel}
+	opts.log = logger
+	opts.openProgress()
+	opts.totalLimiter = newRateLimiter(int64(opts.limitRateTotal))
+	opts.scheduleLimit = newScheduledLimiter(opts.rateSchedule, logger)
+	if err := opts.syslog.attach(logger); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if opts.toJournal() {
+		sink, err := openJournal()
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		logger.sinks = append(logger.sinks, sink)
+	}
+	if opts.eventLog != "" {
+		sink, err := openEventLog(opts.eventLog)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		logger.sinks = append(logger.sinks, sink)
+	}
 
-	filename := "test.txt"
-	if err := validateFilename(filename); err != nil {
-		logger.Println("invalid filename:", err)
+	if opts.maxSizeAction != "abort" && opts.maxSizeAction != "skip" {
+		logger.Errorf("invalid -max-size-action %q", opts.maxSizeAction)
+		os.Exit(1)
+	}
+	if opts.pipelineDepth > 0 && (opts.parallel > 1 || opts.connections > 1) {
+		logger.Errorf("-pipeline sends a batch over one connection and cannot be combined with -parallel or -connections")
+		os.Exit(1)
+	}
+	if opts.quarantineFirst && opts.quarantine == "" {
+		logger.Errorf("-quarantine-first needs a -quarantine directory")
+		os.Exit(1)
+	}
+	if opts.encryptTo.enabled() && (opts.resume || opts.verifyReadback) {
+		logger.Errorf("-encrypt-to cannot be combined with -continue or -verify-readback, which need the plaintext on disk")
+		os.Exit(1)
+	}
+	if opts.noise.enabled() && opts.tls.enabled() {
+		logger.Errorf("-noise-server-key replaces TLS and cannot be combined with the TLS flags")
+		os.Exit(1)
+	}
+	if opts.psk.enabled() && (opts.noise.enabled() || opts.tls.enabled()) {
+		logger.Errorf("-psk-file replaces TLS and Noise and cannot be combined with their flags")
+		os.Exit(1)
+	}
+	if opts.legacy && (opts.pipelineDepth > 0 || opts.wire == wireProtobuf || opts.signRequests || opts.sendTransferID || opts.noise.enabled() || opts.psk.enabled()) {
+		logger.Errorf("-legacy sends bare GET requests and cannot be combined with -pipeline, -wire protobuf, -sign-requests, -send-transfer-id, -noise-server-key or -psk-file")
+		os.Exit(1)
+	}
+	if opts.decryptWith.enabled() && (opts.resume || opts.join) {
+		logger.Errorf("-decrypt-with cannot be combined with -continue, whose offset is into the plaintext on disk, or with -join")
 		os.Exit(1)
 	}
 
-	if err := downloadFile(conn, filename, DefaultBufferSize); err != nil {
-		logger.Println("error downloading file:", err)
+	if opts.auditLog != "" && command != "audit" {
+		if opts.audit, err = openAuditLog(opts.auditLog); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.historyDB != "" && recordsHistory(command) {
+		if opts.history, err = openHistory(opts.historyDB); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.statsd.address != "" {
+		if opts.statsdClient, err = newStatsdClient(opts.statsd); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		defer opts.statsdClient.Close()
+	}
+	if opts.influx != "" {
+		if opts.influxWriter, err = newInfluxWriter(opts.influx, opts.influxName); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		defer opts.influxWriter.Close()
+	}
+
+	opts.collectPartials(logger)
+
+	if opts.metalink != "" {
+		if opts.output != "" {
+			logger.Errorf("-o cannot be combined with -metalink, whose files are saved under the names it lists")
+			os.Exit(1)
+		}
+		if err := downloadMetalink(&opts, opts.metalink, DefaultBufferSize, logger); err != nil {
+			logger.Errorf("error downloading metalink: %v", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if command != "" && command != "get" {
+		globals := os.Args[1 : len(os.Args)-len(args)-1]
+		if err := runCommand(&opts, command, globals, args, logger); err != nil {
+			logger.Errorf("%s: %v", lookupCommand(command).failure, err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	if len(args) == 0 {
+		args = []string{DefaultFilename}
+	}
+	args, err = opts.expandSources(args, logger)
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if opts.output != "" && len(args) > 1 {
+		logger.Errorf("-o can only be used with a single source")
+		os.Exit(1)
+	}
+	if args, err = opts.resolveCollisions(args, logger); err != nil {
+		logger.Errorf("%v", err)
 		os.Exit(1)
 	}
 
-	logger.Printf("downloaded file %s\n", filename)
+	var seen *seenDB
+	if opts.seenDB != "" {
+		if seen, err = openSeenDB(opts.seenDB); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	results, err := runBatch(&opts, args, seen, logger)
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+	code := resultsExitCode(results)
+	if exitCode(err) == exitAborted {
+		// -fail-fast may have stopped at the last source, leaving none
+		// unattempted.
+		code = exitAborted
+	}
+	if code != exitOK {
+		os.Exit(code)
+	}
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// Hash types from RFC 5854 in order of preference.
+var metalinkHashTypes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha-512", sha512.New},
+	{"sha-384", sha512.New384},
+	{"sha-256", sha256.New},
+	{"sha-1", sha1.New},
+	{"md5", md5.New},
+}
+
+type metalink struct {
+	Files []metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hashes []metalinkHash  `xml:"hash"`
+	Pieces *metalinkPieces `xml:"pieces"`
+	URLs   []metalinkURL   `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority int    `xml:"priority,attr"`
+	Location string `xml:"location,attr"`
+	Value    string `xml:",chardata"`
+}
+
+func parseMetalink(path string) (*metalink, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metalink: %w", err)
+	}
+
+	ml, err := decodeMetalink(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ml.Files) == 0 {
+		return nil, fmt.Errorf("metalink %s describes no files", path)
+	}
+	return ml, nil
+}
+
+func decodeMetalink(data []byte) (*metalink, error) {
+	var ml metalink
+	if err := xml.Unmarshal(data, &ml); err != nil {
+		return nil, fmt.Errorf("error parsing metalink: %w", err)
+	}
+	return &ml, nil
+}
+
+func newMetalinkHash(hashType string) func() hash.Hash {
+	for _, t := range metalinkHashTypes {
+		if strings.EqualFold(t.name, hashType) {
+			return t.new
+		}
+	}
+	return nil
+}
+
+// strongestHash returns the preferred supported hash of the file, or nil if
+// the metalink does not list one we know.
+func (f *metalinkFile) strongestHash() *metalinkHash {
+	for _, t := range metalinkHashTypes {
+		for i := range f.Hashes {
+			if strings.EqualFold(f.Hashes[i].Type, t.name) {
+				return &f.Hashes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// mirrors returns the file's URLs ordered by priority. URLs without a
+// priority sort after the ones that have one.
+func (f *metalinkFile) mirrors() []metalinkURL {
+	urls := append([]metalinkURL(nil), f.URLs...)
+	sort.SliceStable(urls, func(i, j int) bool {
+		pi, pj := urls[i].Priority, urls[j].Priority
+		if pi == 0 || pj == 0 {
+			return pi != 0 && pj == 0
+		}
+		return pi < pj
+	})
+	return urls
+}
+
+// metalinkVerifier checks the piece hashes while data is being written and
+// the whole-file hash once the transfer is complete, so a bad mirror is
+// abandoned as soon as its first corrupt piece arrives.
+type metalinkVerifier struct {
+	file *metalinkFile
+
+	fileHash     hash.Hash
+	expectedHash string
+
+	pieceHash    hash.Hash
+	pieceLength  int64
+	pieceWritten int64
+	piece        int
+
+	written int64
+}
+
+func newMetalinkVerifier(f *metalinkFile) (*metalinkVerifier, error) {
+	v := &metalinkVerifier{file: f}
+
+	if h := f.strongestHash(); h != nil {
+		v.fileHash = newMetalinkHash(h.Type)()
+		v.expectedHash = strings.ToLower(strings.TrimSpace(h.Value))
+	}
+
+	if p := f.Pieces; p != nil && p.Length > 0 && len(p.Hashes) > 0 {
+		newHash := newMetalinkHash(p.Type)
+		if newHash == nil {
+			return nil, fmt.Errorf("unsupported piece hash type %q", p.Type)
+		}
+		v.pieceHash = newHash()
+		v.pieceLength = p.Length
+	}
+
+	return v, nil
+}
+
+func (v *metalinkVerifier) Write(data []byte) (int, error) {
+	if v.fileHash != nil {
+		v.fileHash.Write(data)
+	}
+	v.written += int64(len(data))
+
+	if v.pieceHash == nil {
+		return len(data), nil
+	}
+
+	n := 0
+	for len(data) > 0 {
+		chunk := data
+		if remaining := v.pieceLength - v.pieceWritten; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		v.pieceHash.Write(chunk)
+		v.pieceWritten += int64(len(chunk))
+		n += len(chunk)
+		data = data[len(chunk):]
+
+		if v.pieceWritten == v.pieceLength {
+			if err := v.checkPiece(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (v *metalinkVerifier) checkPiece() error {
+	hashes := v.file.Pieces.Hashes
+	if v.piece >= len(hashes) {
+		return fmt.Errorf("piece %d: no hash listed: %w", v.piece, errChecksumMismatch)
+	}
+
+	sum := hex.EncodeToString(v.pieceHash.Sum(nil))
+	if sum != strings.ToLower(strings.TrimSpace(hashes[v.piece])) {
+		return fmt.Errorf("piece %d: %w", v.piece, errChecksumMismatch)
+	}
+
+	v.pieceHash.Reset()
+	v.pieceWritten = 0
+	v.piece++
+	return nil
+}
+
+func (v *metalinkVerifier) verify() error {
+	if v.file.Size > 0 && v.written != v.file.Size {
+		return fmt.Errorf("received %d bytes, expected %d", v.written, v.file.Size)
+	}
+
+	if v.pieceHash != nil && v.pieceWritten > 0 {
+		if err := v.checkPiece(); err != nil {
+			return err
+		}
+	}
+
+	if v.fileHash != nil {
+		sum := hex.EncodeToString(v.fileHash.Sum(nil))
+		if sum != v.expectedHash {
+			return fmt.Errorf("file hash: %w", errChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+func downloadMetalink(opts *options, path string, bufferSize int, logger *leveledLogger) error {
+	ml, err := parseMetalink(path)
+	if err != nil {
+		return err
+	}
+
+	failure := &batchFailure{total: len(ml.Files)}
+	for i := range ml.Files {
+		f := &ml.Files[i]
+		if !opts.filters.allows(f.Name) {
+			logger.Infof("skipped file %s", f.Name)
+			continue
+		}
+		result := newTransferResult(f.Name, f.Name)
+		opts.report(logger, result, downloadMetalinkFile(opts, f, bufferSize, logger, result))
+		if result.Status == statusFailed {
+			if failure.failed++; opts.failFast {
+				failure.aborted, failure.skipped = true, len(ml.Files)-i-1
+				break
+			}
+		}
+	}
+
+	if failure.failed > 0 {
+		return failure
+	}
+	return nil
+}
+
+func downloadMetalinkFile(opts *options, f *metalinkFile, bufferSize int, logger *leveledLogger, result *transferResult) error {
+	if err := validateFilename(f.Name); err != nil {
+		return err
+	}
+	if err := opts.checkDeclaredSize(f.Size); err != nil {
+		return err
+	}
+
+	mirrors := f.mirrors()
+	if len(mirrors) == 0 {
+		return errors.New("no mirrors listed")
+	}
+
+	for _, mirror := range mirrors {
+		err := downloadFromMirror(opts, f, strings.TrimSpace(mirror.Value), bufferSize, result)
+		if err == nil || errors.Is(err, errTooLarge) {
+			return err
+		}
+		logger.Warnf("mirror %s failed for %s: %v", strings.TrimSpace(mirror.Value), f.Name, err)
+	}
+
+	return fmt.Errorf("all %d mirrors failed", len(mirrors))
+}
+
+func downloadFromMirror(opts *options, f *metalinkFile, rawURL string, bufferSize int, result *transferResult) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid mirror url: %w", err)
+	}
+
+	verifier, err := newMetalinkVerifier(f)
+	if err != nil {
+		return err
+	}
+
+	ctx := opts.transferContext(result)
+	reader, _, err := opts.openSource(ctx, u, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Data from a mirror that fails verification must never be resumed.
+	out, _, err := opts.openFileSink(f.Name, false)
+	if err != nil {
+		return err
+	}
+	if out, err = opts.checkSink(out, 0, result); err != nil {
+		return err
+	}
+
+	n, err := opts.transfer(ctx, io.MultiWriter(verifier, out), reader, bufferSize)
+	result.Bytes = n
+	if err != nil {
+		out.abort()
+		return err
+	}
+	if err := verifier.verify(); err != nil {
+		out.abort()
+		return err
+	}
+	return out.commit()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzDecodeMetalink(f *testing.F) {
+	f.Add([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.txt">
+    <size>3</size>
+    <hash type="sha-256">ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad</hash>
+    <pieces length="2" type="sha-1">
+      <hash>da23614e02469a0d7c7bd1bdab5c9c474b1904dc</hash>
+      <hash>84a516841ba77a5b4648de2cd0dfcb30ea46dbb4</hash>
+    </pieces>
+    <url priority="2">tcp://mirror-b:8000/a.txt</url>
+    <url priority="1" location="de">tcp://mirror-a:8000/a.txt</url>
+    <url>http://fallback/a.txt</url>
+  </file>
+</metalink>`))
+	f.Add([]byte(`<metalink><file name="b"><pieces length="-1" type="md5"><hash/></pieces></file></metalink>`))
+	f.Add([]byte(`<metalink><file name="c"><pieces length="1" type="crc32"><hash>00</hash></pieces></file></metalink>`))
+	f.Add([]byte(`<metalink><file><size>-5</size></file>`))
+	f.Add([]byte(`<metalink/>`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ml, err := decodeMetalink(data)
+		if err != nil {
+			return
+		}
+		for i := range ml.Files {
+			file := &ml.Files[i]
+			if mirrors := file.mirrors(); len(mirrors) != len(file.URLs) {
+				t.Errorf("%d mirrors for %d urls", len(mirrors), len(file.URLs))
+			}
+			v, err := newMetalinkVerifier(file)
+			if err != nil {
+				continue
+			}
+			v.Write([]byte("abc"))
+			v.verify()
+		}
+	})
+}
+
+func TestMetalinkFailuresMapToBatchExitCodes(t *testing.T) {
+	server := newFileServer(t)
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	dir := t.TempDir()
+	chdir(t, dir)
+	path := filepath.Join(dir, "files.meta4")
+	document := `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.txt"><url>tcp://` + refused.Addr().String() + `/a.txt</url></file>
+  <file name="b.txt"><url>tcp://` + server.addr() + `/b.txt</url></file>
+</metalink>`
+	if err := os.WriteFile(path, []byte(document), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args []string
+		code int
+		b    bool
+	}{
+		{[]string{"-retry-on", "none"}, exitPartial, true},
+		{[]string{"-retry-on", "none", "-fail-fast"}, exitAborted, false},
+	} {
+		os.Remove("b.txt")
+		opts := newTestOptions(t, test.args...)
+		err := downloadMetalink(opts, path, DefaultBufferSize, opts.log)
+		if code := exitCode(err); code != test.code {
+			t.Errorf("with %s: exit code %d for %v, want %d", strings.Join(test.args, " "), code, err, test.code)
+		}
+		if _, err := os.Stat("b.txt"); (err == nil) != test.b {
+			t.Errorf("with %s: b.txt downloaded %v, want %v", strings.Join(test.args, " "), err == nil, test.b)
+		}
+	}
+}
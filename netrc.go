@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// netrcEntry is one machine (or the default) in a .netrc file.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// netrcCache reads the .netrc file the first time credentials are needed.
+type netrcCache struct {
+	once    sync.Once
+	entries []netrcEntry
+}
+
+// netrcPath is $NETRC, or .netrc (_netrc on Windows, as curl names it) in
+// the home directory.
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	return filepath.Join(home, name)
+}
+
+// netrc returns the credentials for the server at address: the entry for
+// its host:port if there is one, then for its host, then the default. It
+// returns nil when -netrc is off or nothing matches.
+func (o *options) netrc(address string) *netrcEntry {
+	if !o.useNetrc {
+		return nil
+	}
+	c := &o.netrcEntries
+	c.once.Do(func() {
+		path := netrcPath()
+		entries, err := readNetrc(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			o.log.Warnf("ignoring %s: %v", path, err)
+		default:
+			c.entries = entries
+		}
+	})
+
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	var byHost, fallback *netrcEntry
+	for i := range c.entries {
+		e := &c.entries[i]
+		switch {
+		case e.machine == address:
+			return e
+		case e.machine == host && byHost == nil:
+			byHost = e
+		case e.machine == "" && fallback == nil:
+			fallback = e
+		}
+	}
+	if byHost != nil {
+		return byHost
+	}
+	return fallback
+}
+
+// readNetrc parses a .netrc file. Like ftp, it refuses a file holding
+// passwords that other users can read or write.
+func readNetrc(path string) ([]netrcEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseNetrc(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if mode := info.Mode().Perm(); mode&0o077 != 0 {
+			for _, e := range entries {
+				if e.password != "" {
+					return nil, fmt.Errorf("it has passwords and mode %#o; run chmod 600 on it", mode)
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+func parseNetrc(data string) ([]netrcEntry, error) {
+	var entries []netrcEntry
+	lines := strings.Split(data, "\n")
+	for n := 0; n < len(lines); n++ {
+		fields := strings.Fields(lines[n])
+		for i := 0; i < len(fields); i++ {
+			word := fields[i]
+			if strings.HasPrefix(word, "#") {
+				break
+			}
+			value := func() (string, error) {
+				i++
+				if i == len(fields) {
+					return "", fmt.Errorf("line %d: %s needs a value", n+1, word)
+				}
+				return fields[i], nil
+			}
+			switch word {
+			case "machine":
+				machine, err := value()
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, netrcEntry{machine: machine})
+			case "default":
+				entries = append(entries, netrcEntry{})
+			case "login", "password", "account", "port":
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				if len(entries) == 0 {
+					return nil, fmt.Errorf("line %d: %s before the first machine", n+1, word)
+				}
+				current := &entries[len(entries)-1]
+				switch word {
+				case "login":
+					current.login = v
+				case "password":
+					current.password = v
+				}
+			case "macdef":
+				// A macro runs to the next blank line.
+				for n++; n < len(lines) && strings.TrimSpace(lines[n]) != ""; n++ {
+				}
+				i = len(fields)
+			default:
+				return nil, fmt.Errorf("line %d: unknown keyword %q", n+1, word)
+			}
+		}
+	}
+	return entries, nil
+}
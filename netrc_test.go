@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetrcTokenSentWithRequests(t *testing.T) {
+	server := newTokenServer(t, "from-netrc")
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(path, []byte("machine 127.0.0.1\nlogin ignored\npassword from-netrc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NETRC", path)
+	t.Setenv("TCP_FILE_TOKEN", "")
+	opts := newTestOptions(t, "-netrc=true")
+
+	reader, _, err := opts.openSource(context.Background(), &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.list(server.addr(), &listFilter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	served := server.served()
+	if len(served) != 2 || served[0] != "from-netrc GET a.txt" || served[1] != "from-netrc LIST" {
+		t.Errorf("served %q, want GET and LIST authenticated with the .netrc token", served)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// dropPageCache only flushes where pages can't be dropped from the cache.
+func dropPageCache(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// noiseSuite is the only cipher suite offered; the pattern is IK when the
+// client has a static key of its own and NK when it stays anonymous.
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// noiseMaxPlain is the most plaintext one transport message carries: Noise
+// messages are at most 65535 bytes, including the 16-byte tag.
+const noiseMaxPlain = 65535 - 16
+
+// noiseOptions encrypt connections with the Noise protocol instead of TLS,
+// for deployments without certificates: the server's static public key is
+// given with -noise-server-key, and the client's own key, which the server
+// can check against the keys it allows, with -noise-key. Both are Curve25519
+// keys, exchanged out of band; noise-keygen makes them.
+//
+// It is negotiated in the handshake. A server that offers it lists "noise"
+// among its capabilities, and the client answers with
+//
+//	NOISE Noise_IK_25519_ChaChaPoly_BLAKE2s
+//
+// and, after "OK", the handshake messages, each preceded by its length as
+// two big-endian bytes as are the transport messages after it. Inside the
+// encrypted channel the connection starts over, with HELLO or a request.
+type noiseOptions struct {
+	keyFile   string
+	serverKey string
+
+	once   sync.Once
+	static noise.DHKey
+	peer   []byte
+	err    error
+}
+
+func (n *noiseOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&n.serverKey, "noise-server-key", "", "encrypt connections with the Noise protocol instead of TLS, trusting the server with this hex Curve25519 public `key`")
+	fs.StringVar(&n.keyFile, "noise-key", "", "with -noise-server-key, identify the client to the server with the static private key in this `file`, made with noise-keygen; without it the client is anonymous")
+}
+
+func (n *noiseOptions) enabled() bool {
+	return n.serverKey != ""
+}
+
+func (n *noiseOptions) setup() error {
+	n.once.Do(func() {
+		if n.peer, n.err = hex.DecodeString(strings.TrimSpace(n.serverKey)); n.err != nil || len(n.peer) != 32 {
+			n.err = errors.New("-noise-server-key must be a 64-digit hex public key")
+			return
+		}
+		if n.keyFile != "" {
+			n.static, n.err = readNoiseKey(n.keyFile)
+		}
+	})
+	return n.err
+}
+
+func readNoiseKey(path string) (noise.DHKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return noise.DHKey{}, fmt.Errorf("error reading noise key: %w", err)
+	}
+	private, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != 32 {
+		return noise.DHKey{}, fmt.Errorf("%s does not hold a hex Curve25519 private key", path)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, fmt.Errorf("invalid noise key %s: %w", path, err)
+	}
+	return noise.DHKey{Private: private, Public: public}, nil
+}
+
+// client negotiates Noise on conn and returns the encrypted connection,
+// closing conn if that fails.
+func (n *noiseOptions) client(conn net.Conn) (net.Conn, error) {
+	c, err := n.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (n *noiseOptions) negotiate(conn net.Conn) (net.Conn, error) {
+	if err := n.setup(); err != nil {
+		return nil, err
+	}
+	config := noise.Config{
+		CipherSuite: noiseSuite,
+		Pattern:     noise.HandshakeNK,
+		Initiator:   true,
+		PeerStatic:  n.peer,
+		Random:      rand.Reader,
+	}
+	if n.static.Private != nil {
+		config.Pattern = noise.HandshakeIK
+		config.StaticKeypair = n.static
+	}
+	state, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, fmt.Errorf("error starting noise handshake: %w", err)
+	}
+	protocol := "Noise_" + config.Pattern.Name + "_25519_ChaChaPoly_BLAKE2s"
+
+	w := deadlineWriter{conn}
+	r := bufio.NewReader(deadlineReader{conn})
+	if _, err := io.WriteString(w, "HELLO "+clientVersion+"\n"); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("error negotiating noise: %w", err)
+	}
+	hello, err := parseHello(reply)
+	if err != nil {
+		return nil, err
+	}
+	if !hello.supports("noise") {
+		return nil, errors.New("server does not offer the noise transport")
+	}
+	if _, err := io.WriteString(w, "NOISE "+protocol+"\n"); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if _, err := readReply(r); err != nil {
+		return nil, fmt.Errorf("error negotiating noise: %w", err)
+	}
+
+	// Both patterns take one message each way.
+	message, _, _, err := state.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error during noise handshake: %w", err)
+	}
+	if err := writeNoiseFrame(w, message); err != nil {
+		return nil, err
+	}
+	message, err = readNoiseFrame(r)
+	if err != nil {
+		// A server that doesn't accept the client's key, or has a different
+		// key of its own, hangs up here.
+		return nil, fmt.Errorf("error during noise handshake: %w", err)
+	}
+	_, send, recv, err := state.ReadMessage(nil, message)
+	if err != nil {
+		return nil, fmt.Errorf("error during noise handshake: %w", err)
+	}
+	return &sealedConn{
+		Conn: conn,
+		r:    r,
+		seal: func(p []byte) ([]byte, error) { return send.Encrypt(nil, nil, p) },
+		open: func(p []byte) ([]byte, error) { return recv.Decrypt(p[:0], nil, p) },
+	}, nil
+}
+
+func writeNoiseFrame(w io.Writer, message []byte) error {
+	frame := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(frame, uint16(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return fmt.Errorf("error sending data: %w", err)
+	}
+	return nil
+}
+
+func readNoiseFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// sealedConn is a connection after the Noise or pre-shared key handshake,
+// carrying messages framed as in Noise and sealed with an AEAD: seal and
+// open are each only called with their side's lock held. Deadlines and
+// addresses are the underlying connection's.
+type sealedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	readMu sync.Mutex
+	open   func([]byte) ([]byte, error)
+	plain  []byte
+
+	writeMu sync.Mutex
+	seal    func([]byte) ([]byte, error)
+}
+
+func (c *sealedConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.plain) == 0 {
+		message, err := readNoiseFrame(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if c.plain, err = c.open(message); err != nil {
+			return 0, &classifiedError{classVerification, fmt.Errorf("error decrypting message: %w", err)}
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *sealedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxPlain {
+			chunk = chunk[:noiseMaxPlain]
+		}
+		message, err := c.seal(chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := writeNoiseFrame(c.Conn, message); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// runNoiseKeygen implements noise-keygen file: it saves a new private key
+// for -noise-key and prints the public key to give to the server.
+func runNoiseKeygen(opts *options, args []string) error {
+	fs := newCommandFlags("noise-keygen")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: noise-keygen file")
+	}
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %w", err)
+	}
+	f, err := os.OpenFile(fs.Arg(0), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating key file: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key.Private)); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	fmt.Println(hex.EncodeToString(key.Public))
+	return nil
+}
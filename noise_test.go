@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+// noiseServer is a file server that only talks Noise, accepting clients
+// with any of its allowed static keys, or anonymous ones if allowed is
+// empty.
+type noiseServer struct {
+	*fakeServer
+	key     noise.DHKey
+	allowed [][]byte
+
+	mu        sync.Mutex
+	protocols []string
+	clients   []string
+}
+
+func newNoiseServer(t *testing.T, allowed ...[]byte) *noiseServer {
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &noiseServer{key: key, allowed: allowed}
+	s.fakeServer = newFakeServer(t, s.serve)
+	return s
+}
+
+func (s *noiseServer) publicKey() string {
+	return hex.EncodeToString(s.key.Public)
+}
+
+func (s *noiseServer) serve(n int, conn net.Conn, r *bufio.Reader) {
+	line, ok := serveHello(r, conn, "noise")
+	protocol := strings.TrimPrefix(line, "NOISE ")
+	if !ok || protocol == line {
+		return
+	}
+	config := noise.Config{CipherSuite: noiseSuite, Pattern: noise.HandshakeNK, StaticKeypair: s.key, Random: rand.Reader}
+	if protocol == "Noise_IK_25519_ChaChaPoly_BLAKE2s" {
+		config.Pattern = noise.HandshakeIK
+	}
+	state, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return
+	}
+	conn.Write([]byte("OK\n"))
+
+	message, err := readNoiseFrame(r)
+	if err != nil {
+		return
+	}
+	if _, _, _, err := state.ReadMessage(nil, message); err != nil {
+		return
+	}
+	client := hex.EncodeToString(state.PeerStatic())
+	if len(s.allowed) > 0 && !s.allows(state.PeerStatic()) {
+		return
+	}
+	s.mu.Lock()
+	s.protocols = append(s.protocols, protocol)
+	s.clients = append(s.clients, client)
+	s.mu.Unlock()
+	message, recv, send, err := state.WriteMessage(nil, nil)
+	if err != nil || writeNoiseFrame(conn, message) != nil {
+		return
+	}
+
+	serveSealed(&sealedConn{
+		Conn: conn,
+		r:    r,
+		seal: func(p []byte) ([]byte, error) { return send.Encrypt(nil, nil, p) },
+		open: func(p []byte) ([]byte, error) { return recv.Decrypt(p[:0], nil, p) },
+	})
+}
+
+// serveSealed answers a GET, after an optional HELLO, inside an encrypted
+// channel.
+func serveSealed(sealed *sealedConn) {
+	inner := bufio.NewReader(sealed)
+	line, ok := readRequest(inner)
+	if ok && strings.HasPrefix(line, "HELLO ") {
+		sealed.Write([]byte("OK tcp-file-server/1\n"))
+		line, ok = readRequest(inner)
+	}
+	if name := strings.TrimPrefix(line, "GET "); ok && name != line {
+		sealed.Write(noiseContents(name))
+	}
+}
+
+func (s *noiseServer) allows(key []byte) bool {
+	for _, allowed := range s.allowed {
+		if bytes.Equal(allowed, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// last returns the protocol and client key of the last client let in.
+func (s *noiseServer) last() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.protocols) == 0 {
+		return "", ""
+	}
+	return s.protocols[len(s.protocols)-1], s.clients[len(s.clients)-1]
+}
+
+// noiseContents is what the noise and psk servers hold as name; big spans
+// several transport messages.
+func noiseContents(name string) []byte {
+	if name == "big" {
+		return bytes.Repeat([]byte("0123456789"), 20000)
+	}
+	return []byte("contents of " + name)
+}
+
+// newNoiseKey makes a client key with noise-keygen and returns its file
+// and public key.
+func newNoiseKey(t *testing.T) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "noise.key")
+	stdout := captureStdout(t)
+	if err := runNoiseKeygen(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	public, err := hex.DecodeString(strings.TrimSpace(stdout()))
+	if err != nil || len(public) != 32 {
+		t.Fatalf("noise-keygen printed %q", stdout())
+	}
+	if info, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		t.Errorf("key file %v, %v; want it private", info, err)
+	}
+	if err := runNoiseKeygen(nil, []string{path}); err == nil {
+		t.Error("noise-keygen overwrote a key")
+	}
+	return path, public
+}
+
+func TestNoiseTransport(t *testing.T) {
+	keyFile, public := newNoiseKey(t)
+	otherFile, _ := newNoiseKey(t)
+	anonymous := newNoiseServer(t)
+	restricted := newNoiseServer(t, public)
+
+	for _, test := range []struct {
+		name           string
+		server         *noiseServer
+		args           []string
+		protocol, peer string
+	}{
+		{"anonymous", anonymous, nil, "Noise_NK_25519_ChaChaPoly_BLAKE2s", ""},
+		{"with a key", restricted, []string{"-noise-key", keyFile}, "Noise_IK_25519_ChaChaPoly_BLAKE2s", hex.EncodeToString(public)},
+	} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, append([]string{"-noise-server-key", test.server.publicKey()}, test.args...)...)
+		results, err := runBatch(opts, []string{"tcp://" + test.server.addr() + "/a.txt", "tcp://" + test.server.addr() + "/big"}, nil, opts.log)
+		if err != nil || statuses(results) != "downloaded downloaded" {
+			t.Fatalf("%s: batch returned %v with %s", test.name, err, statuses(results))
+		}
+		for _, name := range []string{"a.txt", "big"} {
+			if data, err := os.ReadFile(name); err != nil || !bytes.Equal(data, noiseContents(name)) {
+				t.Errorf("%s: saved %d bytes of %s, %v", test.name, len(data), name, err)
+			}
+		}
+		if protocol, peer := test.server.last(); protocol != test.protocol || peer != test.peer {
+			t.Errorf("%s: server saw %s with key %q, want %s with %q", test.name, protocol, peer, test.protocol, test.peer)
+		}
+	}
+
+	other, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		serveHello(r, conn)
+	})
+	for _, test := range []struct {
+		name, server, serverKey, keyFile, want string
+	}{
+		{"client key not allowed", restricted.addr(), restricted.publicKey(), otherFile, "error during noise handshake"},
+		{"anonymous client refused", restricted.addr(), restricted.publicKey(), "", "error during noise handshake"},
+		{"wrong server key", anonymous.addr(), hex.EncodeToString(other.Public), "", "error during noise handshake"},
+		{"server without noise", plain.addr(), anonymous.publicKey(), "", "server does not offer the noise transport"},
+		{"bad server key", anonymous.addr(), "abcd", "", "64-digit hex public key"},
+	} {
+		opts := newTestOptions(t, "-noise-server-key", test.serverKey, "-noise-key", test.keyFile)
+		if _, err := opts.dial(test.server); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: dial returned %v, want %q", test.name, err, test.want)
+		}
+	}
+}
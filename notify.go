@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusInterval is how often STATUS= is refreshed when systemd hasn't
+// asked for watchdog pings, which would carry it otherwise.
+const statusInterval = 10 * time.Second
+
+// notifier sends sd_notify messages to the socket systemd names in
+// NOTIFY_SOCKET for services with Type=notify.
+type notifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration
+}
+
+// openNotifier returns nil when the client isn't run by systemd as a
+// notify service.
+func openNotifier() (*notifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(path, "@") {
+		// An abstract socket.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to systemd notify socket: %w", err)
+	}
+	return &notifier{conn: conn, watchdog: watchdogInterval()}, nil
+}
+
+// watchdogInterval is the WatchdogSec= of the service, if it applies to
+// this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func (n *notifier) send(states ...string) error {
+	if _, err := n.conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return fmt.Errorf("error notifying systemd: %w", err)
+	}
+	return nil
+}
+
+func (n *notifier) Close() error {
+	return n.conn.Close()
+}
+
+// supervise pings the watchdog at half its interval and keeps STATUS=
+// current until stop is closed. Each ping needs the daemon's lock, so a
+// daemon wedged while holding it stops pinging and is restarted.
+func (d *daemon) supervise(n *notifier, stop <-chan struct{}) {
+	interval := statusInterval
+	if n.watchdog > 0 {
+		interval = n.watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		states := []string{d.status()}
+		if n.watchdog > 0 {
+			states = append(states, "WATCHDOG=1")
+		}
+		if err := n.send(states...); err != nil {
+			d.logger.Warnf("%v", err)
+		}
+	}
+}
+
+// status is the STATUS= line systemctl status shows for the daemon.
+func (d *daemon) status() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, j := range d.order {
+		counts[j.State]++
+	}
+	return fmt.Sprintf("STATUS=%d running, %d queued, %d done", counts[jobRunning], counts[jobQueued], counts[jobDone])
+}
@@ -0,0 +1,114 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotify stands in for systemd's notify socket and returns a channel
+// of the messages sent to it.
+func listenNotify(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	messages := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return messages
+}
+
+func TestNotifierSendsStates(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if n, err := openNotifier(); n != nil || err != nil {
+		t.Errorf("notifier %v, %v without NOTIFY_SOCKET", n, err)
+	}
+
+	messages := listenNotify(t)
+	n, err := openNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if err := n.send("READY=1", "STATUS=starting"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-messages:
+		if got != "READY=1\nSTATUS=starting" {
+			t.Errorf("systemd got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	for _, test := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", fmt.Sprint(os.Getpid()), 30 * time.Second},
+		{"30000000", "1", 0},
+		{"-5", "", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := watchdogInterval(); got != test.want {
+			t.Errorf("WATCHDOG_USEC=%s WATCHDOG_PID=%s gives %s, want %s", test.usec, test.pid, got, test.want)
+		}
+	}
+}
+
+func TestSupervisePingsWatchdog(t *testing.T) {
+	messages := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", "")
+	n, err := openNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	d := newTestDaemon(t, 10)
+	d.order = []*job{{State: jobRunning}, {State: jobQueued}, {State: jobQueued}, {State: jobDone}}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.supervise(n, stop)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-messages:
+			if want := "STATUS=1 running, 2 queued, 1 done\nWATCHDOG=1"; got != want {
+				t.Errorf("ping %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no watchdog ping")
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialPolicy is the -partial flag: what happens to the .part file of a
+// download that fails. "delete" removes it, "keep" leaves it for -continue,
+// and "keep:7d" leaves it but has later runs remove partial files that
+// haven't been written to for that long. The zero value keeps partial files
+// only when -continue is set, as before the flag existed.
+type partialPolicy struct {
+	set    bool
+	keep   bool
+	maxAge time.Duration
+}
+
+func (p *partialPolicy) String() string {
+	switch {
+	case !p.set:
+		return ""
+	case !p.keep:
+		return "delete"
+	case p.maxAge > 0:
+		return "keep:" + p.maxAge.String()
+	}
+	return "keep"
+}
+
+func (p *partialPolicy) Set(value string) error {
+	policy, age, hasAge := strings.Cut(value, ":")
+	switch {
+	case policy == "delete" && !hasAge:
+		*p = partialPolicy{set: true}
+	case policy == "keep" && !hasAge:
+		*p = partialPolicy{set: true, keep: true}
+	case policy == "keep":
+		d, err := parseAge(age)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid age %q: use a duration such as 36h or a number of days such as 7d", age)
+		}
+		*p = partialPolicy{set: true, keep: true, maxAge: d}
+	default:
+		return fmt.Errorf("unknown policy %q: use delete, keep or keep:age", value)
+	}
+	return nil
+}
+
+// parseAge is time.ParseDuration that also takes whole days, such as 7d.
+func parseAge(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// keepPartial reports whether a failed download's .part file is left behind.
+func (o *options) keepPartial() bool {
+	if o.partial.set {
+		return o.partial.keep
+	}
+	return o.resume
+}
+
+// partialDirs are the directories this run writes .part files into.
+func (o *options) partialDirs() []string {
+	dirs := []string{"."}
+	if o.output != "" && !strings.Contains(o.output, "://") {
+		dirs = append(dirs, filepath.Dir(o.output))
+	}
+	if o.quarantineFirst {
+		dirs = append(dirs, o.quarantine)
+	}
+	return dirs
+}
+
+// collectPartials removes .part files older than the -partial keep:age from
+// the directories this run downloads into, so failed runs don't leave them
+// behind forever.
+func (o *options) collectPartials(logger *leveledLogger) {
+	if o.partial.maxAge <= 0 {
+		return
+	}
+	seen := map[string]bool{}
+	for _, dir := range o.partialDirs() {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), partialSuffix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < o.partial.maxAge {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				logger.Warnf("error removing stale partial file: %v", err)
+				continue
+			}
+			logger.Infof("removed partial file %s, last written %s", path, info.ModTime().Format(time.RFC3339))
+		}
+	}
+}
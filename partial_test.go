@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartialPolicy(t *testing.T) {
+	// The server breaks off every download halfway.
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if _, ok := readRequest(r); ok {
+			conn.Write([]byte(strings.Repeat("x", 1000)))
+			resetConn(conn)
+		}
+	})
+	for _, test := range []struct {
+		args []string
+		kept bool
+	}{
+		{nil, false},
+		{[]string{"-continue"}, true},
+		{[]string{"-partial", "keep"}, true},
+		{[]string{"-partial", "keep:7d"}, true},
+		{[]string{"-continue", "-partial", "delete"}, false},
+	} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, append([]string{"-reconnect", "0", "-retry-on", "none"}, test.args...)...)
+		results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+		if results[0].Status != statusFailed {
+			t.Fatalf("%v: broken download %s", test.args, results[0].Status)
+		}
+		if _, err := os.Stat("a.txt" + partialSuffix); (err == nil) != test.kept {
+			t.Errorf("%v: partial file kept %t, want %t", test.args, err == nil, test.kept)
+		}
+	}
+}
+
+func TestParsePartialPolicy(t *testing.T) {
+	for value, want := range map[string]partialPolicy{
+		"delete":   {set: true},
+		"keep":     {set: true, keep: true},
+		"keep:7d":  {set: true, keep: true, maxAge: 7 * 24 * time.Hour},
+		"keep:36h": {set: true, keep: true, maxAge: 36 * time.Hour},
+	} {
+		var p partialPolicy
+		if err := p.Set(value); err != nil || p != want {
+			t.Errorf("-partial %s parsed as %+v, %v", value, p, err)
+		}
+	}
+	for _, bad := range []string{"discard", "delete:7d", "keep:", "keep:0d", "keep:soon"} {
+		var p partialPolicy
+		if err := p.Set(bad); err == nil {
+			t.Errorf("-partial %s accepted", bad)
+		}
+	}
+}
+
+func TestCollectPartialsRemovesStaleFiles(t *testing.T) {
+	chdir(t, t.TempDir())
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	for _, name := range []string{"old.txt" + partialSuffix, "new.txt" + partialSuffix, "old.txt"} {
+		if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(name, "old") {
+			os.Chtimes(name, old, old)
+		}
+	}
+	opts := newTestOptions(t, "-partial", "keep:7d")
+	opts.collectPartials(opts.log)
+
+	var left []string
+	entries, _ := os.ReadDir(".")
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if got, want := strings.Join(left, " "), "new.txt.part old.txt"; got != want {
+		t.Errorf("left %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// fileMode is the -chmod flag, an octal permission mode such as 0640.
+type fileMode struct {
+	set  bool
+	mode os.FileMode
+}
+
+func (m *fileMode) String() string {
+	if m == nil || !m.set {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(m.mode))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid mode %q: use octal permissions such as 0640", value)
+	}
+	*m = fileMode{set: true, mode: os.FileMode(mode)}
+	return nil
+}
+
+// owner is the -chown flag: user, user:group or :group, by name or number.
+type owner struct {
+	spec     string
+	uid, gid int
+}
+
+func (o *owner) String() string {
+	if o == nil {
+		return ""
+	}
+	return o.spec
+}
+
+func (o *owner) Set(value string) error {
+	name, group, _ := strings.Cut(value, ":")
+	if name == "" && group == "" {
+		return fmt.Errorf("invalid owner %q: use user, user:group or :group", value)
+	}
+	*o = owner{spec: value, uid: -1, gid: -1}
+	if name != "" {
+		uid, err := lookupID(name, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown user %q: %w", name, err)
+		}
+		o.uid = uid
+	}
+	if group != "" {
+		gid, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown group %q: %w", group, err)
+		}
+		o.gid = gid
+	}
+	return nil
+}
+
+// lookupID takes a numeric ID as it is and looks names up with lookup.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// setPermissions gives a newly created download file the -chmod mode and
+// -chown owner. Without -chmod the file keeps the 0666 it was created with
+// less the umask. The mode is forced exactly unless -chmod-umask asks for
+// the umask to be taken off it too.
+func (o *options) setPermissions(file *os.File) error {
+	if o.chmod.set {
+		mode := o.chmod.mode
+		if o.chmodUmask {
+			mode &^= processUmask()
+		}
+		if err := file.Chmod(mode); err != nil {
+			return fmt.Errorf("error changing file mode: %w", err)
+		}
+	}
+	if o.chown.spec != "" {
+		if err := file.Chown(o.chown.uid, o.chown.gid); err != nil {
+			return fmt.Errorf("error changing file owner: %w", err)
+		}
+	}
+	return nil
+}
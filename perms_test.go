@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParsePermissionFlags(t *testing.T) {
+	var m fileMode
+	if err := m.Set("0640"); err != nil || m.mode != 0640 || m.String() != "0640" {
+		t.Errorf("-chmod 0640 gives %s, %v", &m, err)
+	}
+	for _, bad := range []string{"rw-r-----", "1777", "0800", ""} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("-chmod %q accepted", bad)
+		}
+	}
+
+	for value, want := range map[string]owner{
+		"1000":     {spec: "1000", uid: 1000, gid: -1},
+		"1000:100": {spec: "1000:100", uid: 1000, gid: 100},
+		":100":     {spec: ":100", uid: -1, gid: 100},
+		"0:0":      {spec: "0:0", uid: 0, gid: 0},
+	} {
+		var o owner
+		if err := o.Set(value); err != nil || o != want {
+			t.Errorf("-chown %s gives %+v, %v", value, o, err)
+		}
+	}
+	for _, bad := range []string{":", "no-such-user-here", ":no-such-group-here"} {
+		var o owner
+		if err := o.Set(bad); err == nil {
+			t.Errorf("-chown %q accepted", bad)
+		}
+	}
+}
+
+func TestChmodDownloads(t *testing.T) {
+	if os.PathSeparator != '/' {
+		t.Skip("file modes are Unix permissions")
+	}
+	server := newFileServer(t)
+	for _, test := range []struct {
+		args []string
+		want os.FileMode
+	}{
+		{[]string{"-chmod", "0640"}, 0640},
+		{[]string{"-chmod", "0604"}, 0604},
+		{[]string{"-chmod", "0666", "-chmod-umask"}, 0666 &^ processUmask()},
+	} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, test.args...)
+		if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != test.want {
+			t.Errorf("%v: mode %04o, want %04o", test.args, info.Mode().Perm(), test.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// pingResult is the outcome of one ping. Durations are in milliseconds so
+// monitoring systems can graph them without parsing Go duration strings.
+type pingResult struct {
+	Server      string       `json:"server"`
+	Connected   bool         `json:"connected"`
+	DialMS      float64      `json:"dial_ms"`
+	HandshakeMS float64      `json:"handshake_ms,omitempty"`
+	Hello       *serverHello `json:"hello,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// runPing implements the ping subcommand (also called check): ping [flags]
+// [tcp://host:port]. It connects and completes the handshake, including
+// authentication when a token is configured, without transferring a file,
+// and fails if any step does.
+func runPing(opts *options, args []string) error {
+	var asJSON bool
+	fs := newCommandFlags("ping")
+	fs.BoolVar(&asJSON, "json", false, "print the result as JSON")
+	fs.Parse(args)
+
+	server := &url.URL{Scheme: "tcp", Host: ServerAddress}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		u, err := parseTCPURL(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		server = u
+	default:
+		return errors.New("usage: ping [flags] [tcp://host:port]")
+	}
+
+	result, err := opts.ping(server.Host)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		if encodeErr := encoder.Encode(result); encodeErr != nil {
+			return encodeErr
+		}
+	} else {
+		result.print(os.Stdout)
+	}
+	return err
+}
+
+func (o *options) ping(address string) (*pingResult, error) {
+	result := &pingResult{Server: address}
+
+	start := time.Now()
+	conn, err := o.dial(address)
+	if err != nil {
+		return result, fmt.Errorf("error connecting to server: %w", err)
+	}
+	defer conn.Close()
+	result.Connected = true
+	result.DialMS = milliseconds(time.Since(start))
+
+	if o.legacy {
+		return result, nil
+	}
+	start = time.Now()
+	hello, err := o.handshake(address, conn, bufio.NewReader(deadlineReader{conn}), true)
+	if errors.Is(err, errNoHandshake) && o.authToken(address) == "" {
+		// A legacy server is still reachable; there is just nothing to
+		// negotiate with it.
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	result.HandshakeMS = milliseconds(time.Since(start))
+	result.Hello = hello
+	return result, nil
+}
+
+func (r *pingResult) print(w io.Writer) {
+	if !r.Connected {
+		fmt.Fprintf(w, "%s: %s\n", r.Server, r.Error)
+		return
+	}
+	fmt.Fprintf(w, "%s: connected in %.1f ms", r.Server, r.DialMS)
+	switch {
+	case r.Error != "":
+		fmt.Fprintf(w, ", %s\n", r.Error)
+	case r.Hello == nil:
+		fmt.Fprintln(w, ", no handshake (legacy server)")
+	default:
+		fmt.Fprintf(w, ", handshake %.1f ms, %s", r.HandshakeMS, r.Hello.Version)
+		if len(r.Hello.Capabilities) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(r.Hello.Capabilities, " "))
+		}
+		if len(r.Hello.Extensions) > 0 {
+			fmt.Fprintf(w, ", extensions %s", strings.Join(r.Hello.Extensions, " "))
+		}
+		if r.Hello.Wire != "" {
+			fmt.Fprintf(w, ", %s wire mode", r.Hello.Wire)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
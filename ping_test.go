@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPingHandshakesAndAuthenticates(t *testing.T) {
+	server := newTokenServer(t, "s3cret")
+
+	result, err := newTestOptions(t, "-token", "s3cret").ping(server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Connected || result.Hello == nil || strings.Join(result.Hello.Capabilities, " ") != "list rm" {
+		t.Errorf("ping result %+v", result)
+	}
+	var out bytes.Buffer
+	result.print(&out)
+	if !strings.Contains(out.String(), "tcp-file-server/1 (list rm)") {
+		t.Errorf("printed %q", out.String())
+	}
+	if served := server.served(); len(served) != 0 {
+		t.Errorf("ping sent requests %q", served)
+	}
+
+	if _, err := newTestOptions(t, "-token", "wrong").ping(server.addr()); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("ping with a wrong token returned %v", err)
+	}
+}
+
+func TestPingLegacyAndUnreachableServers(t *testing.T) {
+	legacy := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		readRequest(r)
+	})
+	result, err := newTestOptions(t).ping(legacy.addr())
+	if err != nil || !result.Connected || result.Hello != nil {
+		t.Errorf("pinging a legacy server: %+v, %v", result, err)
+	}
+	var out bytes.Buffer
+	result.print(&out)
+	if !strings.HasSuffix(out.String(), ", no handshake (legacy server)\n") {
+		t.Errorf("printed %q", out.String())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	result, err = newTestOptions(t, "-retry-on", "none").ping(ln.Addr().String())
+	if err == nil || result.Connected {
+		t.Errorf("pinging a closed port: %+v, %v", result, err)
+	}
+}
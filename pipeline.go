@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A pipeline keeps one connection open to a server and sends GET requests
+// ahead of the responses still coming back, so a batch of small files isn't
+// dominated by a round trip per file.
+//
+// It needs framing, which servers offer with the "pipeline" capability:
+// after the handshake each GET is answered with "OK size" and exactly size
+// bytes, or with "ERR message", and the connection stays open for the next
+// request. Responses come back in request order.
+type pipeline struct {
+	opts    *options
+	host    string
+	log     *leveledLogger
+	conn    net.Conn
+	r       *bufio.Reader
+	hello   *serverHello
+	pending []string
+	// binary is set when the connection is in the protobuf wire mode.
+	binary bool
+	broken atomic.Bool
+
+	// mu is held while requests and responses are exchanged, and by
+	// keepalive pings, which are only sent while busy is unset: no
+	// response is being read. pings counts replies to them still
+	// outstanding, and missed those that went unanswered in a row.
+	mu       sync.Mutex
+	busy     atomic.Bool
+	lastUsed atomic.Int64
+	pings    int
+	missed   int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pipeline returns the open pipeline to host, dialing one if needed. It
+// returns nil if the server doesn't support pipelining, and remembers that.
+func (b *tcpBackend) pipeline(host string) (*pipeline, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p := b.pipelines[host]; p != nil {
+		if !p.broken.Load() {
+			return p, nil
+		}
+		p.close()
+		delete(b.pipelines, host)
+	}
+	if b.unpipelined[host] {
+		return nil, nil
+	}
+
+	p := &pipeline{opts: b.opts, host: host, log: b.opts.log, done: make(chan struct{})}
+	err := p.connect()
+	if errors.Is(err, errNotPipelined) {
+		if b.unpipelined == nil {
+			b.unpipelined = make(map[string]bool)
+		}
+		b.unpipelined[host] = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.keepalive.interval > 0 && p.hello.supports("ping") {
+		go p.keepalive(b.opts.keepalive)
+	}
+	if b.pipelines == nil {
+		b.pipelines = make(map[string]*pipeline)
+	}
+	b.pipelines[host] = p
+	return p, nil
+}
+
+var errNotPipelined = errors.New("server does not support pipelining")
+
+// connect dials p's server and greets it, authenticating as the handshake
+// does, ready for requests.
+func (p *pipeline) connect() error {
+	conn, err := p.opts.dial(p.host)
+	if err != nil {
+		return fmt.Errorf("error connecting to server: %w", err)
+	}
+	r := bufio.NewReader(deadlineReader{conn})
+	hello, err := p.opts.handshake(p.host, conn, r, true)
+	if errors.Is(err, errNoHandshake) || err == nil && !hello.supports("pipeline") {
+		err = errNotPipelined
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn, p.r, p.hello, p.binary = conn, r, hello, hello.Wire == string(wireProtobuf)
+	p.pings, p.missed = 0, 0
+	p.broken.Store(false)
+	p.touch()
+	return nil
+}
+
+// reconnect replaces p's dead connection with a new one and sends the
+// requests still waiting for a response again, first if it isn't among
+// them, so the batch carries on where it was.
+func (p *pipeline) reconnect(first string) error {
+	p.conn.Close()
+	names := p.pending
+	if first != "" && !p.isPending(first) {
+		names = append([]string{first}, names...)
+	}
+	p.pending = nil
+	if err := p.connect(); err != nil {
+		p.broken.Store(true)
+		return err
+	}
+	for _, name := range names {
+		if err := p.send(name); err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		p.log.Infof("reconnected to %s; sent %d requests again", p.host, len(names))
+	} else {
+		p.log.Infof("reconnected to %s", p.host)
+	}
+	return nil
+}
+
+// get returns the response to GET name, first topping the pipeline up with
+// requests for the upcoming files. Responses to requests the batch no
+// longer wants, such as sources skipped since they were requested, are read
+// and thrown away.
+//
+// If the connection turns out to be dead before the response starts, p
+// reconnects once, unless -reconnect is 0, and asks again rather than fail.
+func (p *pipeline) get(name string, upcoming []string, depth int) (io.ReadCloser, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.touch()
+
+	body, size, err := p.request(name, upcoming, depth)
+	if err != nil && p.broken.Load() && classify(err) == classNetwork && p.opts.reconnects > 0 {
+		p.log.Warnf("connection to %s broke: %v; reconnecting", p.host, err)
+		if err := p.reconnect(name); err != nil {
+			return nil, 0, err
+		}
+		body, size, err = p.request(name, upcoming, depth)
+	}
+	return body, size, err
+}
+
+func (p *pipeline) request(name string, upcoming []string, depth int) (io.ReadCloser, int64, error) {
+	index := -1
+	for i, pending := range p.pending {
+		if pending == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		if err := p.send(name); err != nil {
+			return nil, 0, err
+		}
+		index = len(p.pending) - 1
+	}
+	for _, next := range upcoming {
+		if len(p.pending) >= depth {
+			break
+		}
+		if !p.isPending(next) {
+			if err := p.send(next); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	for i := 0; i < index; i++ {
+		body, _, err := p.next()
+		if err == nil {
+			err = body.Close()
+		}
+		if err != nil && p.broken.Load() {
+			return nil, 0, err
+		}
+	}
+	return p.next()
+}
+
+func (p *pipeline) isPending(name string) bool {
+	for _, pending := range p.pending {
+		if pending == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pipeline) send(name string) error {
+	request := p.opts.requestFile
+	if p.binary {
+		request = p.opts.requestWireFile
+	}
+	if err := request(p.conn, p.host, name, ""); err != nil {
+		p.broken.Store(true)
+		return err
+	}
+	p.pending = append(p.pending, name)
+	p.log.Debugf("pipelined GET %s (%d in flight)", name, len(p.pending))
+	return nil
+}
+
+// next reads the header of the oldest outstanding response.
+func (p *pipeline) next() (io.ReadCloser, int64, error) {
+	p.pending = p.pending[1:]
+	if err := p.readPings(); err != nil {
+		p.broken.Store(true)
+		return nil, 0, err
+	}
+	var size int64
+	var digest []byte
+	var err error
+	if p.binary {
+		size, digest, err = readWireFile(p.r)
+	} else {
+		size, digest, err = p.readHeader()
+	}
+	var server *serverError
+	if errors.As(err, &server) {
+		return nil, 0, err
+	}
+	if err != nil {
+		p.broken.Store(true)
+		return nil, 0, err
+	}
+	p.busy.Store(true)
+	return &pipelineBody{p: p, r: newDigestReader(p.r, size, digest)}, size, nil
+}
+
+func (p *pipeline) touch() {
+	p.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (p *pipeline) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.mu.Lock()
+		p.conn.Close()
+		p.mu.Unlock()
+	})
+}
+
+func (p *pipeline) readHeader() (int64, []byte, error) {
+	reply, err := readReply(p.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return parseFileHeader(reply, p.hello)
+}
+
+// pipelineBody reads one response. Closing it early skips the rest of the
+// response so the next one can be read. A response whose digest doesn't
+// match still ends where its header said, so it leaves the pipeline usable.
+type pipelineBody struct {
+	p *pipeline
+	r io.Reader
+}
+
+func (b *pipelineBody) Read(data []byte) (int, error) {
+	n, err := b.r.Read(data)
+	switch {
+	case err == io.EOF:
+		b.done()
+	case err != nil && classify(err) != classVerification:
+		b.p.broken.Store(true)
+	}
+	return n, err
+}
+
+func (b *pipelineBody) Close() error {
+	defer b.done()
+	if _, err := io.Copy(io.Discard, b.r); err != nil && classify(err) != classVerification {
+		b.p.broken.Store(true)
+		return fmt.Errorf("error skipping response: %w", err)
+	}
+	return nil
+}
+
+// done marks the response read, so the connection counts as idle from now.
+func (b *pipelineBody) done() {
+	b.p.touch()
+	b.p.busy.Store(false)
+}
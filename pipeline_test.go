@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPipelineServer answers pipelined GETs with "OK size" and the contents,
+// or ERR for names starting with "missing". It holds the first response
+// back for a moment and counts how many requests arrived meanwhile.
+func newPipelineServer(t *testing.T, queued *int32) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := serveHello(r, conn, "pipeline")
+		if !ok {
+			return
+		}
+		requests := make(chan string, 16)
+		go func() {
+			defer close(requests)
+			for ok {
+				requests <- line
+				line, ok = readRequest(r)
+			}
+		}()
+
+		first := true
+		for request := range requests {
+			if first {
+				time.Sleep(100 * time.Millisecond)
+				atomic.StoreInt32(queued, int32(len(requests)))
+				first = false
+			}
+			name := strings.TrimPrefix(request, "GET ")
+			if strings.HasPrefix(name, "missing") {
+				conn.Write([]byte("ERR no such file\n"))
+				continue
+			}
+			contents := "contents of " + name
+			fmt.Fprintf(conn, "OK %d\n%s", len(contents), contents)
+		}
+	})
+}
+
+// closePipelines hangs up the pipelines opts kept open, before the fake
+// servers wait for their connections to end.
+func closePipelines(t *testing.T, opts *options) {
+	t.Cleanup(func() {
+		opts.backendsMu.Lock()
+		defer opts.backendsMu.Unlock()
+		if b, ok := opts.openBackends["tcp"].(*tcpBackend); ok {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, p := range b.pipelines {
+				p.close()
+			}
+		}
+	})
+}
+
+func TestPipelineSendsRequestsAhead(t *testing.T) {
+	var queued int32
+	server := newPipelineServer(t, &queued)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "4", "-retry-on", "none")
+	closePipelines(t, opts)
+
+	var sources []string
+	for _, name := range []string{"a.txt", "missing.txt", "b.txt", "c.txt"} {
+		sources = append(sources, "tcp://"+server.addr()+"/"+name)
+	}
+	results, _ := runBatch(opts, sources, nil, opts.log)
+	if got, want := statuses(results), "downloaded failed downloaded downloaded"; got != want {
+		t.Errorf("statuses %q, want %q", got, want)
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if n := atomic.LoadInt32(&queued); n != 3 {
+		t.Errorf("%d requests waiting behind the first, want 3", n)
+	}
+}
+
+func TestPipelineFallsBackWithoutCapability(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := serveHello(r, conn); ok && strings.HasPrefix(line, "GET ") {
+			conn.Write([]byte("contents of " + strings.TrimPrefix(line, "GET ")))
+		}
+	})
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-pipeline", "4")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + server.addr() + "/b.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Errorf("batch returned %v with %s", err, statuses(results))
+	}
+	// One connection finds out the server doesn't pipeline, then one per file.
+	if n := server.connections(); n != 3 {
+		t.Errorf("%d connections, want 3", n)
+	}
+}
+
+func TestPipelineReconnectsWhenConnectionDrops(t *testing.T) {
+	for _, test := range []struct {
+		reconnects string
+		statuses   string
+		want       string
+	}{
+		{"1", "downloaded downloaded downloaded", "1 GET b.txt, 1 GET c.txt"},
+		{"0", "downloaded failed downloaded", "1 GET c.txt"},
+	} {
+		// The first connection answers the first request it is sent and
+		// hangs up once it has read the rest.
+		var log eventLog
+		server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+			for line, ok := serveHello(r, conn, "pipeline"); ok; line, ok = readRequest(r) {
+				name := strings.TrimPrefix(line, "GET ")
+				if n == 0 {
+					if name == "c.txt" {
+						return
+					}
+					if name != "a.txt" {
+						continue
+					}
+				} else {
+					log.add(fmt.Sprint(n, " ", line))
+				}
+				contents := "contents of " + name
+				fmt.Fprintf(conn, "OK %d\n%s", len(contents), contents)
+			}
+		})
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, "-pipeline", "4", "-retry-on", "none", "-reconnect", test.reconnects)
+		closePipelines(t, opts)
+
+		var sources []string
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			sources = append(sources, "tcp://"+server.addr()+"/"+name)
+		}
+		results, _ := runBatch(opts, sources, nil, opts.log)
+		if got := statuses(results); got != test.statuses {
+			t.Errorf("-reconnect %s: statuses %q, want %q", test.reconnects, got, test.statuses)
+		}
+		// The new connection is sent what was still waiting, in order.
+		if got := log.String(); got != test.want {
+			t.Errorf("-reconnect %s: second connection saw %s, want %s", test.reconnects, got, test.want)
+		}
+		if n := server.connections(); n != 2 {
+			t.Errorf("-reconnect %s: %d connections, want 2", test.reconnects, n)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "sync"
+
+// bufferPool recycles transfer buffers across files and concurrent
+// transfers, so a long batch doesn't allocate a fresh buffer (or ring of
+// them) for every file. It stores pointers to avoid an allocation on Put.
+var bufferPool sync.Pool
+
+func getBuffer(size int) []byte {
+	if p, ok := bufferPool.Get().(*[]byte); ok && cap(*p) >= size {
+		return (*p)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putBuffer(buffer []byte) {
+	buffer = buffer[:cap(buffer)]
+	bufferPool.Put(&buffer)
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+// benchBufferSize is a variable so that make can't put the buffers on the
+// stack, as it can when their size is a constant.
+var benchBufferSize = DefaultBufferSize
+
+// BenchmarkBufferMake is what every transfer did before buffers were
+// pooled, for comparison with BenchmarkBufferPool: a fresh buffer per
+// file, many files at once.
+func BenchmarkBufferMake(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buffer := make([]byte, benchBufferSize)
+			buffer[0] = 1
+		}
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buffer := getBuffer(benchBufferSize)
+			buffer[0] = 1
+			putBuffer(buffer)
+		}
+	})
+}
+
+// BenchmarkBufferRing allocates a -queue-depth ring as copyQueued does.
+func BenchmarkBufferRing(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		ring := make([][]byte, DefaultQueueDepth)
+		for pb.Next() {
+			for i := range ring {
+				ring[i] = getBuffer(benchBufferSize)
+			}
+			for _, buffer := range ring {
+				putBuffer(buffer)
+			}
+		}
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// progressMode is the -progress flag. A bare -progress draws the bar, so it
+// keeps working as the boolean flag it used to be; -progress=json selects
+// machine-readable events.
+type progressMode int
+
+const (
+	progressOff progressMode = iota
+	progressBar
+	progressJSON
+)
+
+func (m *progressMode) String() string {
+	if m == nil {
+		return "off"
+	}
+	return [...]string{"off", "bar", "json"}[*m]
+}
+
+func (m *progressMode) Set(value string) error {
+	switch value {
+	case "false", "off":
+		*m = progressOff
+	case "true", "bar":
+		*m = progressBar
+	case "json":
+		*m = progressJSON
+	default:
+		return fmt.Errorf("unknown progress mode %q: use bar or json", value)
+	}
+	return nil
+}
+
+func (m *progressMode) IsBoolFlag() bool {
+	return true
+}
+
+// rateSmoothing is the -progress-smoothing flag: how the speed and ETA
+// shown by progress are averaged.
+type rateSmoothing struct {
+	mode   string
+	window time.Duration
+}
+
+const (
+	smoothingInstant = "instant"
+	smoothingEWMA    = "ewma"
+	smoothingAverage = "average"
+)
+
+func (s *rateSmoothing) String() string {
+	if s == nil || s.mode == "" {
+		return smoothingEWMA
+	}
+	if s.mode == smoothingEWMA && s.window > 0 {
+		return smoothingEWMA + ":" + s.window.String()
+	}
+	return s.mode
+}
+
+func (s *rateSmoothing) Set(value string) error {
+	mode, window, hasWindow := strings.Cut(value, ":")
+	switch mode {
+	case smoothingInstant, smoothingAverage:
+		if hasWindow {
+			return fmt.Errorf("%s smoothing takes no window", mode)
+		}
+	case smoothingEWMA:
+		if hasWindow {
+			d, err := time.ParseDuration(window)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid smoothing window %q", window)
+			}
+			s.window = d
+		}
+	default:
+		return fmt.Errorf("unknown smoothing %q: use instant, ewma[:window] or average", value)
+	}
+	s.mode = mode
+	return nil
+}
+
+// DefaultSmoothingWindow is the time constant of the EWMA: a change in
+// speed is mostly reflected after about this long.
+const DefaultSmoothingWindow = 5 * time.Second
+
+// rateMeter turns byte counts sampled at each progress update into a speed.
+// Instant uses only the bytes since the previous sample, which jumps around
+// on bursty links; the EWMA weighs each sample by how much time it covers
+// relative to the window; average is over the whole transfer.
+type rateMeter struct {
+	smoothing rateSmoothing
+	started   time.Time
+	last      time.Time
+	lastBytes int64
+	rate      float64
+}
+
+func (m *rateMeter) sample(now time.Time, bytes int64) float64 {
+	elapsed := now.Sub(m.last).Seconds()
+	if elapsed <= 0 {
+		return m.rate
+	}
+	current := float64(bytes-m.lastBytes) / elapsed
+	switch m.smoothing.mode {
+	case smoothingInstant:
+		m.rate = current
+	case smoothingAverage:
+		m.rate = float64(bytes) / now.Sub(m.started).Seconds()
+	default:
+		window := m.smoothing.window
+		if window <= 0 {
+			window = DefaultSmoothingWindow
+		}
+		if m.last.Equal(m.started) {
+			m.rate = current
+		} else {
+			alpha := 1 - math.Exp(-elapsed/window.Seconds())
+			m.rate += alpha * (current - m.rate)
+		}
+	}
+	m.last, m.lastBytes = now, bytes
+	return m.rate
+}
+
+// progressEvent is a line of -progress=json output. Event is "progress"
+// while the transfer runs and "done" once, at the end.
+type progressEvent struct {
+	Event      string  `json:"event"`
+	ID         string  `json:"id"`
+	File       string  `json:"file"`
+	Bytes      int64   `json:"bytes"`
+	Total      int64   `json:"total,omitempty"`
+	Rate       float64 `json:"rate"`
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+}
+
+// progressWriter reports progress for one transfer, either as a single
+// updating line or as events passed to a callback, at most every
+// progressInterval. When the backend reports the file size the line
+// includes a percentage and the events an ETA.
+type progressWriter struct {
+	out      io.Writer
+	callback func(progressEvent)
+	id       string
+	name     string
+	total    int64
+	offset   int64
+	written  int64
+	meter    rateMeter
+	lastDraw time.Time
+	line     string
+}
+
+// newProgress returns the progress writer for a transfer, or nil when
+// progress is off. An onProgress callback takes precedence over -progress.
+func (o *options) newProgress(id, name string, offset, total int64) *progressWriter {
+	now := time.Now()
+	p := &progressWriter{
+		out: os.Stderr, id: id, name: name, total: total, offset: offset, written: offset,
+		meter: rateMeter{smoothing: o.smoothing, started: now, last: now},
+	}
+	switch {
+	case o.onProgress != nil:
+		p.callback = o.onProgress
+	case o.progress == progressJSON:
+		p.callback = o.writeProgressEvent
+	case o.progress != progressBar:
+		return nil
+	}
+	return p
+}
+
+// writeProgressEvent prints an event as a line of JSON for -progress=json.
+func (o *options) writeProgressEvent(e progressEvent) {
+	line, _ := json.Marshal(e)
+	o.progressOut.Write(append(line, '\n'))
+}
+
+// openProgress picks the output for JSON events: stdout, or the already
+// open file descriptor given with -progress-fd, such as 3.
+func (o *options) openProgress() {
+	o.progressOut = os.Stdout
+	if o.progressFD != 1 {
+		o.progressOut = os.NewFile(uintptr(o.progressFD), fmt.Sprintf("fd%d", o.progressFD))
+	}
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.written += int64(len(data))
+	if time.Since(p.lastDraw) >= progressInterval {
+		p.draw("progress")
+	}
+	return len(data), nil
+}
+
+func (p *progressWriter) draw(event string) {
+	p.lastDraw = time.Now()
+	// Resumed bytes were not transferred in this run, so the meter doesn't
+	// count them.
+	rate := p.meter.sample(p.lastDraw, p.written-p.offset)
+	var eta time.Duration
+	if p.total > p.written && rate > 0 {
+		eta = time.Duration(float64(p.total-p.written) / rate * float64(time.Second))
+	}
+
+	if p.callback != nil {
+		e := progressEvent{Event: event, ID: p.id, File: p.name, Bytes: p.written, Rate: rate, ETASeconds: eta.Seconds()}
+		if p.total > 0 {
+			e.Total = p.total
+		}
+		p.callback(e)
+		return
+	}
+
+	speed := formatBytes(int64(rate)) + "/s"
+	if p.total > 0 {
+		percent := float64(p.written) * 100 / float64(p.total)
+		line := fmt.Sprintf("\r%s  %s / %s  %3.0f%%  %s", p.name, formatBytes(p.written), formatBytes(p.total), percent, speed)
+		if eta > 0 {
+			// Rounded up, so the last second doesn't show as "ETA 0s".
+			line += "  ETA " + (eta + time.Second - 1).Truncate(time.Second).String()
+		}
+		// Pad over what is left of a longer previous line.
+		fmt.Fprintf(p.out, "%-*s", len(p.line), line)
+		p.line = line
+		return
+	}
+	line := fmt.Sprintf("\r%s  %s  %s", p.name, formatBytes(p.written), speed)
+	fmt.Fprintf(p.out, "%-*s", len(p.line), line)
+	p.line = line
+}
+
+func (p *progressWriter) finish() {
+	p.draw("done")
+	if p.callback == nil {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
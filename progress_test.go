@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressFlag(t *testing.T) {
+	for args, want := range map[string]progressMode{
+		"":                progressOff,
+		"-progress":       progressBar,
+		"-progress=bar":   progressBar,
+		"-progress=json":  progressJSON,
+		"-progress=false": progressOff,
+	} {
+		var opts options
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts.registerFlags(fs)
+		if err := fs.Parse(strings.Fields(args)); err != nil {
+			t.Fatal(err)
+		}
+		if opts.progress != want {
+			t.Errorf("%q selects progress %s, want %s", args, &opts.progress, &want)
+		}
+	}
+	var mode progressMode
+	if err := mode.Set("xml"); err == nil {
+		t.Error("-progress=xml accepted")
+	}
+}
+
+func TestJSONProgressEvents(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-progress=json")
+	var out bytes.Buffer
+	opts.progressOut = &out
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []progressEvent
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var e progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("progress line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		t.Fatal("no progress events")
+	}
+	done := events[len(events)-1]
+	if done.Event != "done" || done.ID != results[0].ID || done.File != "a.txt" || done.Bytes != int64(len("contents of a.txt")) {
+		t.Errorf("last event %+v, want done for all of a.txt", done)
+	}
+	for _, e := range events[:len(events)-1] {
+		if e.Event != "progress" {
+			t.Errorf("event %+v before done", e)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	opts := newTestOptions(t, "-progress")
+	p := opts.newProgress("t1", "a.bin", 0, 4096)
+	p.out = &out
+	p.Write(make([]byte, 1024))
+	p.finish()
+	if got := out.String(); !strings.HasPrefix(got, "\ra.bin  1.0 KiB / 4.0 KiB   25%  ") || !strings.HasSuffix(got, "\n") {
+		t.Errorf("progress bar %q", got)
+	}
+
+	if newTestOptions(t).newProgress("t1", "a.bin", 0, 4096) != nil {
+		t.Error("progress without -progress")
+	}
+}
+
+func TestProgressCallbackIsThrottled(t *testing.T) {
+	opts := newTestOptions(t, "-progress=json")
+	var out bytes.Buffer
+	opts.progressOut = &out
+	var events []progressEvent
+	opts.onProgress = func(e progressEvent) { events = append(events, e) }
+
+	p := opts.newProgress("t1", "a.bin", 100, 100+1000)
+	for i := 0; i < 1000; i++ {
+		p.Write([]byte{0})
+	}
+	p.finish()
+	// The first write reports at once; the rest come well within
+	// progressInterval of it.
+	if len(events) != 2 || events[0].Bytes != 101 || events[1].Event != "done" || events[1].Bytes != 1100 || events[1].Total != 1100 {
+		t.Errorf("callback got %+v, want the first write and done", events)
+	}
+	if out.Len() != 0 {
+		t.Errorf("-progress=json printed %q alongside the callback", out.String())
+	}
+}
+
+func TestRateSmoothing(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// 1000 B/s for ten seconds, then a second-long burst at 11000 B/s.
+	samples := []int64{}
+	for i := 1; i <= 10; i++ {
+		samples = append(samples, int64(i)*1000)
+	}
+	samples = append(samples, 21000)
+
+	for _, test := range []struct {
+		smoothing string
+		want      float64
+	}{
+		{"instant", 11000},
+		{"average", 21000.0 / 11},
+		{"ewma", 1000 + 10000*(1-math.Exp(-1.0/5))},
+		{"ewma:1s", 1000 + 10000*(1-math.Exp(-1))},
+	} {
+		var s rateSmoothing
+		if err := s.Set(test.smoothing); err != nil {
+			t.Fatal(err)
+		}
+		m := rateMeter{smoothing: s, started: start, last: start}
+		var rate float64
+		for i, bytes := range samples {
+			rate = m.sample(start.Add(time.Duration(i+1)*time.Second), bytes)
+		}
+		if math.Abs(rate-test.want) > 0.001 {
+			t.Errorf("%s smoothing gives %.3f B/s, want %.3f", test.smoothing, rate, test.want)
+		}
+	}
+
+	for _, bad := range []string{"median", "instant:5s", "ewma:soon", "ewma:-1s"} {
+		var s rateSmoothing
+		if err := s.Set(bad); err == nil {
+			t.Errorf("-progress-smoothing %s accepted", bad)
+		}
+	}
+}
+
+func TestETARoundsUp(t *testing.T) {
+	var out bytes.Buffer
+	opts := newTestOptions(t, "-progress", "-progress-smoothing", "average")
+	p := opts.newProgress("t1", "a.bin", 0, 2500)
+	p.out = &out
+	p.meter.started = time.Now().Add(-time.Second)
+	p.meter.last = p.meter.started
+	p.Write(make([]byte, 1000))
+	if got := out.String(); !strings.HasSuffix(got, "  ETA 2s") {
+		t.Errorf("progress %q, want an ETA of 2s for 1500 bytes at about 1000 B/s", got)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on what a server may send, so that a hostile or broken one can't
+// make the client buffer without end.
+const (
+	// maxReplyLength bounds a reply or response header line, "\n"
+	// included.
+	maxReplyLength = 4 << 10
+	// maxListingLine bounds a listing line, which can carry extended
+	// attributes.
+	maxListingLine = 64 << 10
+	// maxListingEntries bounds how many files one listing may name.
+	maxListingEntries = 1 << 20
+	maxCapabilities   = 64
+)
+
+// protocolError is a server sending something the protocol doesn't allow.
+// It fails the request without a retry, and a pipeline that reads one is
+// not used again, since where the next response starts is unknown.
+type protocolError struct {
+	problem string
+	line    string
+}
+
+func (e *protocolError) Error() string {
+	if e.line == "" {
+		// Binary messages have no line worth quoting.
+		return "protocol error: " + e.problem
+	}
+	line := e.line
+	if len(line) > 80 {
+		line = line[:80] + "..."
+	}
+	return fmt.Sprintf("protocol error: %s in %q", e.problem, line)
+}
+
+// frameType is what a reply line is. The server answers every request with
+// exactly one of
+//
+//	OK [text]
+//	ERR message
+//
+// except SUM, whose reply may also be the bare digest, as servers sent it
+// before replies were framed: that is a data frame, which nothing else
+// accepts.
+type frameType int
+
+const (
+	frameOK frameType = iota
+	frameErr
+	frameData
+)
+
+type frame struct {
+	kind frameType
+	text string
+}
+
+// readLine reads one line of at most limit bytes and returns it without
+// its line ending. A line must end in "\n", optionally after "\r", and may
+// hold tabs but no other control characters or invalid UTF-8. It returns
+// io.EOF alone when the server hung up before sending anything.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return "", &protocolError{fmt.Sprintf("line longer than %d bytes", limit), string(append(line, chunk...))}
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if len(line) == 0 {
+				return "", err
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", &classifiedError{classNetwork, fmt.Errorf("error reading reply: line cut off: %w", err)}
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if !utf8.Valid(line) {
+		return "", &protocolError{"invalid UTF-8", string(line)}
+	}
+	for _, c := range line {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return "", &protocolError{fmt.Sprintf("control character %#x", c), string(line)}
+		}
+	}
+	return string(line), nil
+}
+
+// parseFrame sorts a reply line by its type. Anything but OK and ERR is an
+// error unless data frames are allowed.
+func parseFrame(line string, allowData bool) (frame, error) {
+	switch {
+	case line == "OK":
+		return frame{kind: frameOK}, nil
+	case strings.HasPrefix(line, "OK "):
+		return frame{kind: frameOK, text: strings.TrimSpace(line[3:])}, nil
+	case strings.HasPrefix(line, "ERR "):
+		if message := strings.TrimSpace(line[4:]); message != "" {
+			return frame{kind: frameErr, text: message}, nil
+		}
+	case allowData && line != "" && !strings.HasPrefix(line, "OK") && !strings.HasPrefix(line, "ERR"):
+		return frame{kind: frameData, text: strings.TrimSpace(line)}, nil
+	}
+	return frame{}, &protocolError{"expected OK or ERR", line}
+}
+
+// readFrame reads and parses one reply line. An ERR reply comes back as a
+// serverError.
+func readFrame(r *bufio.Reader, allowData bool) (frame, error) {
+	line, err := readLine(r, maxReplyLength)
+	if err == io.EOF {
+		// The server hanging up before it answers looks like any other
+		// dropped connection.
+		return frame{}, &classifiedError{classNetwork, fmt.Errorf("error reading reply: %w", err)}
+	}
+	if err != nil {
+		return frame{}, err
+	}
+	f, err := parseFrame(line, allowData)
+	if err != nil {
+		return frame{}, err
+	}
+	if f.kind == frameErr {
+		return frame{}, &serverError{f.text}
+	}
+	return f, nil
+}
+
+// readReply reads a one-line reply: "ERR message" becomes an error, and
+// "OK text" is returned as text.
+func readReply(r *bufio.Reader) (string, error) {
+	f, err := readFrame(r, false)
+	return f.text, err
+}
+
+// parseSize parses a size from a response header: decimal digits only, no
+// sign, and small enough for an int64.
+func parseSize(s, line string) (int64, error) {
+	if s == "" || len(s) > 19 || strings.Trim(s, "0123456789") != "" {
+		return 0, &protocolError{"invalid size", line}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &protocolError{"invalid size", line}
+	}
+	return size, nil
+}
+
+// parseCounts parses a reply of key=value fields whose values are sizes or
+// counts, such as "used=1024 limit=4096", into fields. Keys it isn't given
+// are skipped, so servers can add more; required names the one key that
+// must be present.
+func parseCounts(text string, fields map[string]*int64, required string) error {
+	line := "OK " + text
+	found := false
+	for _, field := range strings.Fields(text) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return &protocolError{"field without a value", line}
+		}
+		target := fields[key]
+		if target == nil {
+			continue
+		}
+		n, err := parseSize(value, line)
+		if err != nil {
+			return err
+		}
+		*target = n
+		found = found || key == required
+	}
+	if !found {
+		return &protocolError{"reply without " + required, line}
+	}
+	return nil
+}
+
+// parseHello parses the reply to HELLO: the server's version and at most
+// maxCapabilities capabilities.
+func parseHello(text string) (*serverHello, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, &protocolError{"HELLO reply without a version", "OK " + text}
+	}
+	if len(fields)-1 > maxCapabilities {
+		return nil, &protocolError{fmt.Sprintf("more than %d capabilities", maxCapabilities), "OK " + text}
+	}
+	return &serverHello{Version: fields[0], Capabilities: fields[1:]}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// FuzzReadFrame reads replies from whatever a server might send, which
+// must come back as frames or errors, never more than the limits allow.
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte("OK\n"), false)
+	f.Add([]byte("OK 1024\r\nERR no such file\n"), false)
+	f.Add([]byte("ERR \n"), false)
+	f.Add([]byte("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad\n"), true)
+	f.Add([]byte("OKAY\n"), true)
+	f.Add([]byte("OK \x00\n"), false)
+	f.Add([]byte("OK \xff\xfe\n"), false)
+	f.Add([]byte("OK cut off"), false)
+	f.Add(bytes.Repeat([]byte("x"), maxReplyLength+1), true)
+	f.Fuzz(func(t *testing.T, data []byte, allowData bool) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for i := 0; i <= len(data); i++ {
+			frame, err := readFrame(r, allowData)
+			var serverErr *serverError
+			switch {
+			case errors.As(err, &serverErr):
+				if serverErr.message == "" {
+					t.Error("ERR reply without a message")
+				}
+				continue
+			case err != nil:
+				return
+			}
+			if frame.kind == frameData && !allowData {
+				t.Errorf("data frame %q where none is allowed", frame.text)
+			}
+			if len(frame.text) >= maxReplyLength {
+				t.Errorf("reply of %d bytes", len(frame.text))
+			}
+			if strings.ContainsAny(frame.text, "\r\n\x00") {
+				t.Errorf("reply %q holds control characters", frame.text)
+			}
+		}
+		t.Fatal("readFrame returned more frames than there were bytes")
+	})
+}
+
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("line\n"), 16)
+	f.Add([]byte("tab\tseparated\r\n"), 16)
+	f.Add([]byte("too long for the limit\n"), 8)
+	f.Add([]byte("no newline"), 64)
+	f.Fuzz(func(t *testing.T, data []byte, limit int) {
+		if limit <= 0 || limit > 1<<20 {
+			return
+		}
+		line, err := readLine(bufio.NewReader(bytes.NewReader(data)), limit)
+		if err != nil {
+			if err != io.EOF && len(data) == 0 {
+				t.Errorf("empty input gave %v, want io.EOF", err)
+			}
+			return
+		}
+		if len(line) >= limit {
+			t.Errorf("line of %d bytes over the %d byte limit", len(line), limit)
+		}
+	})
+}
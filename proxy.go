@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// proxyDialer builds the dialer used to reach the server. An explicit -proxy
+// wins over ALL_PROXY, and NO_PROXY (or -noproxy) lists hosts that are always
+// dialed directly, following the conventions used by curl and friends.
+func (o *options) proxyDialer() (proxy.Dialer, error) {
+	direct := &net.Dialer{Timeout: ConnectionTimeout, Control: o.socket.control}
+
+	proxyURL := o.proxy
+	if proxyURL == "" {
+		proxyURL = getenvAny("ALL_PROXY", "all_proxy")
+	}
+	if proxyURL == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	viaProxy, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring proxy: %w", err)
+	}
+
+	noProxy := o.noProxy
+	if noProxy == "" {
+		noProxy = getenvAny("NO_PROXY", "no_proxy")
+	}
+	if strings.TrimSpace(noProxy) == "*" {
+		return direct, nil
+	}
+	if noProxy == "" {
+		return viaProxy, nil
+	}
+
+	perHost := proxy.NewPerHost(viaProxy, direct)
+	addNoProxy(perHost, noProxy)
+	return perHost, nil
+}
+
+// addNoProxy registers NO_PROXY entries. Unlike PerHost.AddFromString, a bare
+// host name also matches its subdomains and ports are ignored, which is how
+// the variable is interpreted by most other tools.
+func addNoProxy(perHost *proxy.PerHost, noProxy string) {
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			perHost.AddNetwork(network)
+			continue
+		}
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			entry = host
+		}
+		entry = strings.Trim(entry, "[]")
+		if ip := net.ParseIP(entry); ip != nil {
+			perHost.AddIP(ip)
+			continue
+		}
+
+		perHost.AddZone(strings.TrimPrefix(entry, "*"))
+	}
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using CONNECT.
+type httpConnectDialer struct {
+	proxyAddress string
+	auth         string
+	forward      proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{proxyAddress: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.proxyAddress = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := u.User.Username() + ":" + password
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error setting proxy deadline: %w", err)
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		request.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending proxy request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading proxy response: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection: %s", response.Status)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error clearing proxy deadline: %w", err)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns data the proxy sent after its response headers before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// newConnectProxy is an HTTP proxy that tunnels CONNECT requests, and
+// counts them.
+func newConnectProxy(t *testing.T) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		request, err := http.ReadRequest(r)
+		if err != nil || request.Method != http.MethodConnect {
+			return
+		}
+		target, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(target, r)
+		io.Copy(conn, target)
+	})
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	target := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		conn.Write([]byte("hello"))
+	})
+	for _, test := range []struct {
+		noProxy string
+		proxied bool
+	}{
+		{"", true},
+		{"example.com", true},
+		{"example.com, 127.0.0.1", false},
+		{"127.0.0.0/8", false},
+		{"*", false},
+	} {
+		proxy := newConnectProxy(t)
+		t.Setenv("ALL_PROXY", "http://"+proxy.addr())
+		t.Setenv("NO_PROXY", test.noProxy)
+		dialer, err := newTestOptions(t).proxyDialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial("tcp", target.addr())
+		if err != nil {
+			t.Fatalf("NO_PROXY=%q: %v", test.noProxy, err)
+		}
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(data) != "hello" {
+			t.Errorf("NO_PROXY=%q: read %q, %v", test.noProxy, data, err)
+		}
+		if proxied := proxy.connections() > 0; proxied != test.proxied {
+			t.Errorf("NO_PROXY=%q: proxied %v, want %v", test.noProxy, proxied, test.proxied)
+		}
+	}
+}
+
+func TestProxyFlagOverridesEnvironment(t *testing.T) {
+	target := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {})
+	proxy := newConnectProxy(t)
+	t.Setenv("ALL_PROXY", "http://127.0.0.1:1")
+	t.Setenv("NO_PROXY", "")
+	dialer, err := newTestOptions(t, "-proxy", "http://"+proxy.addr()).proxyDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if proxy.connections() != 1 {
+		t.Errorf("%d connections to -proxy, want 1", proxy.connections())
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// pskOptions encrypt connections with a secret both ends already share, for
+// point-to-point links that can't run TLS or Noise. The exchange, after a
+// HELLO reply that lists "psk", is
+//
+//	PSK 64-hex-digit-client-nonce
+//	OK 64-hex-digit-server-nonce
+//
+// Each direction then gets its own ChaCha20-Poly1305 key, derived with
+// HKDF-SHA256 from the secret, salted with both nonces, so no two
+// connections share keys. Messages are framed as in the Noise transport,
+// with a 64-bit counter as the nonce, and each side starts by sending an
+// empty one, which proves it has the secret before anything else is sent.
+// As with Noise, the connection then starts over inside the channel.
+type pskOptions struct {
+	file string
+
+	once   sync.Once
+	secret []byte
+	err    error
+}
+
+func (p *pskOptions) enabled() bool {
+	return p.file != ""
+}
+
+func (p *pskOptions) setup() error {
+	p.once.Do(func() {
+		data, err := os.ReadFile(p.file)
+		if err != nil {
+			p.err = fmt.Errorf("error reading pre-shared key: %w", err)
+			return
+		}
+		if p.secret = bytes.TrimSpace(data); len(p.secret) < 16 {
+			p.err = fmt.Errorf("the pre-shared key in %s is shorter than 16 bytes", p.file)
+		}
+	})
+	return p.err
+}
+
+// client negotiates the pre-shared key mode on conn, closing it on failure.
+func (p *pskOptions) client(conn net.Conn) (net.Conn, error) {
+	c, err := p.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *pskOptions) negotiate(conn net.Conn) (net.Conn, error) {
+	if err := p.setup(); err != nil {
+		return nil, err
+	}
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	w := deadlineWriter{conn}
+	r := bufio.NewReader(deadlineReader{conn})
+	if _, err := io.WriteString(w, "HELLO "+clientVersion+"\n"); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("error negotiating pre-shared key: %w", err)
+	}
+	hello, err := parseHello(reply)
+	if err != nil {
+		return nil, err
+	}
+	if !hello.supports("psk") {
+		return nil, errors.New("server does not offer the pre-shared key mode")
+	}
+	if _, err := io.WriteString(w, "PSK "+hex.EncodeToString(clientNonce)+"\n"); err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if reply, err = readReply(r); err != nil {
+		return nil, fmt.Errorf("error negotiating pre-shared key: %w", err)
+	}
+	serverNonce, err := hex.DecodeString(reply)
+	if err != nil || len(serverNonce) != 32 {
+		return nil, fmt.Errorf("invalid PSK reply %q", reply)
+	}
+
+	salt := append(clientNonce, serverNonce...)
+	send, err := p.direction(salt, "client to server")
+	if err != nil {
+		return nil, err
+	}
+	recv, err := p.direction(salt, "server to client")
+	if err != nil {
+		return nil, err
+	}
+	c := &sealedConn{Conn: conn, r: r, seal: send.seal, open: recv.open}
+
+	message, _ := c.seal(nil)
+	if err := writeNoiseFrame(w, message); err != nil {
+		return nil, err
+	}
+	message, err = readNoiseFrame(r)
+	if err != nil {
+		// The server hangs up on a client whose secret differs.
+		return nil, fmt.Errorf("error negotiating pre-shared key: %w", err)
+	}
+	if _, err := c.open(message); err != nil {
+		return nil, errors.New("the server has a different pre-shared key")
+	}
+	return c, nil
+}
+
+// pskCipher seals one direction's messages, numbering them.
+type pskCipher struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func (p *pskOptions) direction(salt []byte, info string) (*pskCipher, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, p.secret, salt, []byte("tcp-file-client psk "+info)), key); err != nil {
+		return nil, fmt.Errorf("error deriving keys: %w", err)
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving keys: %w", err)
+	}
+	return &pskCipher{aead: aead}, nil
+}
+
+func (c *pskCipher) nonce() ([]byte, error) {
+	if c.counter == ^uint64(0) {
+		return nil, errors.New("message counter exhausted")
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], c.counter)
+	c.counter++
+	return nonce, nil
+}
+
+func (c *pskCipher) seal(p []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, nonce, p, nil), nil
+}
+
+func (c *pskCipher) open(p []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Open(p[:0], nonce, p, nil)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pskServer is a file server that only talks the pre-shared key mode.
+type pskServer struct {
+	*fakeServer
+	secret pskOptions
+
+	mu     sync.Mutex
+	nonces []string
+}
+
+func newPSKServer(t *testing.T, secretFile string) *pskServer {
+	s := &pskServer{secret: pskOptions{file: secretFile}}
+	if err := s.secret.setup(); err != nil {
+		t.Fatal(err)
+	}
+	s.fakeServer = newFakeServer(t, s.serve)
+	return s
+}
+
+func (s *pskServer) serve(n int, conn net.Conn, r *bufio.Reader) {
+	line, ok := serveHello(r, conn, "psk")
+	clientNonce, err := hex.DecodeString(strings.TrimPrefix(line, "PSK "))
+	if !ok || err != nil || len(clientNonce) != 32 {
+		return
+	}
+	s.mu.Lock()
+	s.nonces = append(s.nonces, hex.EncodeToString(clientNonce))
+	s.mu.Unlock()
+	serverNonce := []byte(strings.Repeat("s", 32))
+	conn.Write([]byte("OK " + hex.EncodeToString(serverNonce) + "\n"))
+
+	salt := append(clientNonce, serverNonce...)
+	send, err := s.secret.direction(salt, "server to client")
+	if err != nil {
+		return
+	}
+	recv, err := s.secret.direction(salt, "client to server")
+	if err != nil {
+		return
+	}
+	sealed := &sealedConn{Conn: conn, r: r, seal: send.seal, open: recv.open}
+	message, err := readNoiseFrame(r)
+	if err != nil {
+		return
+	}
+	if _, err := sealed.open(message); err != nil {
+		return
+	}
+	message, _ = sealed.seal(nil)
+	if writeNoiseFrame(conn, message) != nil {
+		return
+	}
+	serveSealed(sealed)
+}
+
+func writeSecret(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "psk")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPSKTransport(t *testing.T) {
+	secret := writeSecret(t, "correct horse battery staple")
+	server := newPSKServer(t, secret)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-psk-file", secret)
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + server.addr() + "/big"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	for _, name := range []string{"a.txt", "big"} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != string(noiseContents(name)) {
+			t.Errorf("saved %d bytes of %s, %v", len(data), name, err)
+		}
+	}
+	server.mu.Lock()
+	nonces := server.nonces
+	server.mu.Unlock()
+	if len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("client nonces %v, want a fresh one per connection", nonces)
+	}
+
+	plain := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		serveHello(r, conn)
+	})
+	for _, test := range []struct {
+		name, server, secret, want string
+	}{
+		{"different secret", server.addr(), writeSecret(t, "incorrect horse battery staple"), "error negotiating pre-shared key"},
+		{"short secret", server.addr(), writeSecret(t, "tiny"), "shorter than 16 bytes"},
+		{"missing secret", server.addr(), filepath.Join(t.TempDir(), "missing"), "error reading pre-shared key"},
+		{"server without psk", plain.addr(), secret, "server does not offer the pre-shared key mode"},
+	} {
+		opts := newTestOptions(t, "-psk-file", test.secret)
+		if _, err := opts.dial(test.server); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: dial returned %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPSKCipherNumbersMessages(t *testing.T) {
+	p := pskOptions{secret: []byte("correct horse battery staple")}
+	salt := make([]byte, 64)
+	sender, err := p.direction(salt, "client to server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, _ := p.direction(salt, "client to server")
+	other, _ := p.direction(salt, "server to client")
+
+	first, _ := sender.seal([]byte("one"))
+	second, _ := sender.seal([]byte("two"))
+	if _, err := other.open(append([]byte(nil), first...)); err == nil {
+		t.Error("the other direction's key opened a message")
+	}
+	// Replaying or reordering messages fails: the counter is the nonce.
+	if _, err := receiver.open(append([]byte(nil), second...)); err == nil {
+		t.Error("the second message opened first")
+	}
+	receiver, _ = p.direction(salt, "client to server")
+	for i, message := range [][]byte{first, second} {
+		if plain, err := receiver.open(message); err != nil || string(plain) != []string{"one", "two"}[i] {
+			t.Errorf("message %d opened to %q, %v", i, plain, err)
+		}
+	}
+}
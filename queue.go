@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const DefaultQueueDepth = 4
+
+// transfer copies r to w. With a -queue-depth above 1, reading and writing
+// run in separate goroutines joined by a ring of that many buffers, so a
+// slow disk write doesn't leave the socket unread, and a stalled socket
+// doesn't leave the disk idle with data waiting.
+func (o *options) transfer(ctx context.Context, w io.Writer, r io.Reader, bufferSize int) (int64, error) {
+	if windows := o.transferWindows(ctx); len(windows) > 0 {
+		r = &windowReader{ctx: ctx, r: r, windows: windows, log: o.transferLog(ctx)}
+	}
+	if limiters := o.rateLimiters(ctx); len(limiters) > 0 {
+		r = newThrottledReader(r, limiters)
+	}
+	if o.log.enabled(levelDebug) {
+		meter := &readMeter{log: o.transferLog(ctx), r: r, since: time.Now()}
+		defer meter.flush()
+		r = meter
+	}
+	if o.queueDepth <= 1 {
+		return copyData(w, r, bufferSize)
+	}
+	return copyQueued(w, r, bufferSize, o.queueDepth)
+}
+
+func copyQueued(w io.Writer, r io.Reader, bufferSize, depth int) (int64, error) {
+	// Only depth buffers exist, so sends on either channel never block.
+	free := make(chan []byte, depth)
+	full := make(chan []byte, depth)
+	for i := 0; i < depth; i++ {
+		free <- getBuffer(bufferSize)
+	}
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(full)
+		for {
+			var buffer []byte
+			select {
+			case <-stop:
+				readErr <- nil
+				return
+			default:
+			}
+			select {
+			case buffer = <-free:
+			case <-stop:
+				readErr <- nil
+				return
+			}
+			n, err := r.Read(buffer)
+			if n > 0 {
+				full <- buffer[:n]
+			} else {
+				free <- buffer
+			}
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- fmt.Errorf("error reading data from connection: %w", err)
+				return
+			}
+		}
+	}()
+
+	var total int64
+	for buffer := range full {
+		if _, err := w.Write(buffer); err != nil {
+			// The reader stops before its next read; release waits for it,
+			// so that nothing reads r once this returns.
+			close(stop)
+			putBuffer(buffer)
+			release(full, free)
+			return total, fmt.Errorf("error writing data to file: %w", err)
+		}
+		total += int64(len(buffer))
+		free <- buffer[:cap(buffer)]
+	}
+	release(full, free)
+	return total, <-readErr
+}
+
+// release returns the ring's buffers to the pool once the reader has
+// stopped and closed full.
+func release(full, free chan []byte) {
+	for buffer := range full {
+		putBuffer(buffer)
+	}
+	for {
+		select {
+		case buffer := <-free:
+			putBuffer(buffer)
+		default:
+			return
+		}
+	}
+}
+
+// readMeter logs at debug level how much was read each second.
+type readMeter struct {
+	log   *leveledLogger
+	r     io.Reader
+	since time.Time
+	reads int
+	bytes int64
+	total int64
+}
+
+func (m *readMeter) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.reads++
+	m.bytes += int64(n)
+	m.total += int64(n)
+	if time.Since(m.since) >= time.Second {
+		m.flush()
+	}
+	return n, err
+}
+
+func (m *readMeter) flush() {
+	if m.reads > 0 {
+		m.log.Debugf("read %d bytes in %d reads over %s, %d in total", m.bytes, m.reads, time.Since(m.since).Round(time.Millisecond), m.total)
+	}
+	m.since, m.reads, m.bytes = time.Now(), 0, 0
+}
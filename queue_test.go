@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// endlessReader fills every read, counting them.
+type endlessReader struct {
+	reads atomic.Int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	return len(p), nil
+}
+
+type failingWriter struct {
+	after int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.after == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.after--
+	return len(p), nil
+}
+
+func TestCopyQueuedWriteErrorStopsReader(t *testing.T) {
+	r := &endlessReader{}
+	if _, err := copyQueued(&failingWriter{after: 3}, r, 1024, 4); err == nil {
+		t.Fatal("copy succeeded despite the write error")
+	}
+	reads := r.reads.Load()
+	time.Sleep(20 * time.Millisecond)
+	if n := r.reads.Load(); n != reads {
+		t.Errorf("%d reads after copyQueued returned", n-reads)
+	}
+}
+
+func TestCopyQueuedCopiesInOrder(t *testing.T) {
+	data := make([]byte, 1<<20+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, depth := range []int{2, 4, 16} {
+		var out bytes.Buffer
+		// Short reads make the buffers come back partly filled.
+		n, err := copyQueued(&out, iotest.HalfReader(bytes.NewReader(data)), 4096, depth)
+		if err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("depth %d: copied %d bytes, %v; want the %d bytes in order", depth, n, err, len(data))
+		}
+	}
+}
+
+func TestCopyQueuedReadError(t *testing.T) {
+	r := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection reset")))
+	var out bytes.Buffer
+	n, err := copyQueued(&out, r, 1024, 4)
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("copy returned %v, want the read error", err)
+	}
+	if n != 7 || out.String() != "partial" {
+		t.Errorf("copied %d bytes %q before the error, want 7", n, out.String())
+	}
+}
+
+func benchmarkCopy(b *testing.B, queueDepth int) {
+	const size = 8 << 20
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := io.LimitReader(&endlessReader{}, size)
+			var err error
+			if queueDepth <= 1 {
+				_, err = copyData(io.Discard, r, DefaultBufferSize)
+			} else {
+				_, err = copyQueued(io.Discard, r, DefaultBufferSize, queueDepth)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// The copies draw their buffers from bufferPool, so however many run at
+// once, they allocate next to nothing per file once it is warm.
+func BenchmarkCopyData(b *testing.B) {
+	benchmarkCopy(b, 1)
+}
+
+func BenchmarkCopyQueued(b *testing.B) {
+	benchmarkCopy(b, DefaultQueueDepth)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// quota is a server's answer to QUOTA, which servers with the "quota"
+// capability accept:
+//
+//	QUOTA
+//	OK used=1048576 limit=10737418240 files=12 max-files=1000
+//
+// with sizes in bytes. A missing limit or max-files means there is none,
+// and fields the client doesn't know are ignored, so servers can add more.
+type quota struct {
+	Server   string `json:"server"`
+	Used     int64  `json:"used_bytes"`
+	Limit    int64  `json:"limit_bytes,omitempty"`
+	Files    int64  `json:"files,omitempty"`
+	MaxFiles int64  `json:"max_files,omitempty"`
+}
+
+func parseQuota(text string) (*quota, error) {
+	q := &quota{}
+	fields := map[string]*int64{"used": &q.Used, "limit": &q.Limit, "files": &q.Files, "max-files": &q.MaxFiles}
+	if err := parseCounts(text, fields, "used"); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// left returns how many bytes the quota still allows, and false if it has
+// no limit.
+func (q *quota) left() (int64, bool) {
+	if q.Limit == 0 {
+		return 0, false
+	}
+	if q.Used >= q.Limit {
+		return 0, true
+	}
+	return q.Limit - q.Used, true
+}
+
+// filesLeft is left for the file count.
+func (q *quota) filesLeft() (int64, bool) {
+	if q.MaxFiles == 0 {
+		return 0, false
+	}
+	if q.Files >= q.MaxFiles {
+		return 0, true
+	}
+	return q.MaxFiles - q.Files, true
+}
+
+func (o *options) quota(address string) (*quota, error) {
+	reply, err := o.command(address, "QUOTA", nil)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseQuota(reply)
+	if err != nil {
+		return nil, err
+	}
+	q.Server = address
+	return q, nil
+}
+
+func (q *quota) print() {
+	fmt.Printf("%s: %s used", q.Server, formatBytes(q.Used))
+	if left, ok := q.left(); ok {
+		fmt.Printf(" of %s, %s left", formatBytes(q.Limit), formatBytes(left))
+	} else {
+		fmt.Print(", no size limit")
+	}
+	if q.MaxFiles > 0 {
+		fmt.Printf("; %d of %d files", q.Files, q.MaxFiles)
+	} else if q.Files > 0 {
+		fmt.Printf("; %d files", q.Files)
+	}
+	fmt.Println()
+}
+
+// runQuota implements the quota subcommand: quota [flags] [tcp://host:port].
+func runQuota(opts *options, args []string) error {
+	var asJSON bool
+	fs := newCommandFlags("quota")
+	fs.BoolVar(&asJSON, "json", false, "print the quota as JSON")
+	fs.Parse(args)
+
+	server := &url.URL{Scheme: "tcp", Host: ServerAddress}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		u, err := parseTCPURL(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		server = u
+	default:
+		return errors.New("usage: quota [flags] [tcp://host:port]")
+	}
+
+	q, err := opts.quota(server.Host)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(q)
+	}
+	q.print()
+	return nil
+}
+
+// checkQuota warns before an upload batch that the server's quota won't
+// hold it. The uploads are still attempted, since the server has the last
+// word; a server that doesn't report a quota is not checked.
+func (o *options) checkQuota(logger *leveledLogger, address string, files []string) {
+	var total int64
+	for _, local := range files {
+		if info, err := os.Stat(local); err == nil {
+			total += info.Size()
+		}
+	}
+	q, err := o.quota(address)
+	if err != nil {
+		logger.Debugf("not checking the quota on %s: %v", address, err)
+		return
+	}
+	if left, ok := q.left(); ok && total > left {
+		logger.Warnf("uploading %s to %s, which has only %s of its quota left; the uploads past it may fail", formatBytes(total), address, formatBytes(left))
+	}
+	if left, ok := q.filesLeft(); ok && int64(len(files)) > left {
+		logger.Warnf("uploading %d files to %s, which has room for only %d more", len(files), address, left)
+	}
+}
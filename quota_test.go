@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newQuotaServer answers QUOTA with reply.
+func newQuotaServer(t *testing.T, reply string) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok && line == "QUOTA" {
+			conn.Write([]byte(reply + "\n"))
+		}
+	})
+}
+
+func TestParseQuota(t *testing.T) {
+	for text, want := range map[string]quota{
+		"used=5":                              {Used: 5},
+		"used=5 limit=10 files=2 max-files=3": {Used: 5, Limit: 10, Files: 2, MaxFiles: 3},
+		"limit=10 used=5 colour=blue":         {Used: 5, Limit: 10},
+	} {
+		if q, err := parseQuota(text); err != nil || *q != want {
+			t.Errorf("%q: %+v, %v; want %+v", text, q, err, want)
+		}
+	}
+	for _, text := range []string{"used=0 limit=10737418240 files=0 max-files", "limit=10", "used=-1", "used=lots"} {
+		if q, err := parseQuota(text); err == nil {
+			t.Errorf("%q parsed to %+v", text, q)
+		}
+	}
+
+	for _, test := range []struct {
+		q           quota
+		left, files int64
+		limited     bool
+	}{
+		{quota{Used: 5}, 0, 0, false},
+		{quota{Used: 5, Limit: 8, Files: 1, MaxFiles: 4}, 3, 3, true},
+		{quota{Used: 9, Limit: 8, Files: 5, MaxFiles: 4}, 0, 0, true},
+	} {
+		left, ok := test.q.left()
+		files, filesOK := test.q.filesLeft()
+		if left != test.left || files != test.files || ok != test.limited || filesOK != test.limited {
+			t.Errorf("%+v: %d bytes (%v) and %d files (%v) left", test.q, left, ok, files, filesOK)
+		}
+	}
+}
+
+func TestQuotaCommand(t *testing.T) {
+	server := newQuotaServer(t, "OK used=1048576 limit=10485760 files=12 max-files=1000 shards=3")
+	opts := newTestOptions(t)
+	stdout := captureStdout(t)
+
+	if err := runQuota(opts, []string{"tcp://" + server.addr()}); err != nil {
+		t.Fatal(err)
+	}
+	want := server.addr() + ": " + formatBytes(1048576) + " used of " + formatBytes(10485760) + ", " + formatBytes(9437184) + " left; 12 of 1000 files\n"
+	if got := stdout(); got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	if err := runQuota(opts, []string{"-json", "tcp://" + server.addr()}); err != nil {
+		t.Fatal(err)
+	}
+	var q quota
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(stdout(), want)), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q != (quota{Server: server.addr(), Used: 1048576, Limit: 10485760, Files: 12, MaxFiles: 1000}) {
+		t.Errorf("JSON quota %+v", q)
+	}
+
+	refusing := newQuotaServer(t, "ERR unknown command")
+	if err := runQuota(opts, []string{"tcp://" + refusing.addr()}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("quota of a server without it: %v", err)
+	}
+}
+
+func TestCheckQuotaWarnsBeforeUploads(t *testing.T) {
+	dir := t.TempDir()
+	writeLocal(t, dir, "a.txt", strings.Repeat("a", 600), 1000)
+	writeLocal(t, dir, "b.txt", strings.Repeat("b", 600), 1000)
+	files := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}
+	for _, test := range []struct {
+		reply string
+		want  []string
+	}{
+		{"OK used=0 limit=2000 files=0 max-files=10", nil},
+		{"OK used=1000 limit=2000", []string{"uploading 1.2 KiB", "only 1000 B of its quota left"}},
+		{"OK used=0 files=9 max-files=10", []string{"uploading 2 files", "room for only 1 more"}},
+		{"ERR unknown command", nil},
+	} {
+		server := newQuotaServer(t, test.reply)
+		opts := newTestOptions(t)
+		var out bytes.Buffer
+		logger := &leveledLogger{out: log.New(&out, "", 0), level: levelInfo}
+		opts.checkQuota(logger, server.addr(), files)
+		for _, want := range test.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: warned %q, want %q", test.reply, out.String(), want)
+			}
+		}
+		if test.want == nil && out.Len() > 0 {
+			t.Errorf("%s: warned %q", test.reply, out.String())
+		}
+	}
+}
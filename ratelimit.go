@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of bytes, refilled at rate bytes per second
+// and holding at most a second's worth. Transfers take tokens after reading
+// and sleep off any debt, so several transfers sharing one limiter get its
+// rate between them.
+type rateLimiter struct {
+	// schedule, for -limit-rate-schedule, sets rate by the time of day;
+	// a rate of 0 lets transfers through unlimited.
+	schedule rateSchedule
+	log      *leveledLogger
+
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// newScheduledLimiter returns a limiter that follows s, or nil if s is
+// empty.
+func newScheduledLimiter(s rateSchedule, logger *leveledLogger) *rateLimiter {
+	if len(s) == 0 {
+		return nil
+	}
+	l := &rateLimiter{schedule: s, log: logger, last: time.Now()}
+	l.rate, _ = s.rateAt(l.last)
+	l.tokens = l.rate
+	return l
+}
+
+// follow switches l to the rate the schedule sets at now; l.mu must be
+// held. The bucket starts full again at the new rate.
+func (l *rateLimiter) follow(now time.Time) {
+	rate, period := l.schedule.rateAt(now)
+	if rate == l.rate {
+		return
+	}
+	if rate == 0 {
+		l.log.Infof("bandwidth schedule: transfers unlimited until the next scheduled period")
+	} else {
+		l.log.Infof("bandwidth schedule: limiting transfers to %s/s for %s", formatBytes(int64(rate)), period)
+	}
+	l.rate, l.tokens = rate, rate
+}
+
+// limit returns l's current rate, or 0 for none.
+func (l *rateLimiter) limit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.schedule != nil {
+		l.follow(time.Now())
+	}
+	return l.rate
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.schedule != nil {
+		l.follow(now)
+		if l.rate == 0 {
+			l.last = now
+			l.mu.Unlock()
+			return
+		}
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt, rate := l.tokens, l.rate
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / rate * float64(time.Second)))
+	}
+}
+
+// rateLimiters returns the limiters a transfer has to obey: its own for
+// -limit-rate and the one shared by every transfer for -limit-rate-total.
+func (o *options) rateLimiters(ctx context.Context) []*rateLimiter {
+	var limiters []*rateLimiter
+	if state, ok := ctx.Value(transferKey{}).(*transferState); ok && state.limiter != nil {
+		limiters = append(limiters, state.limiter)
+	}
+	if o.totalLimiter != nil {
+		limiters = append(limiters, o.totalLimiter)
+	}
+	if o.scheduleLimit != nil {
+		limiters = append(limiters, o.scheduleLimit)
+	}
+	return limiters
+}
+
+type throttledReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func newThrottledReader(r io.Reader, limiters []*rateLimiter) *throttledReader {
+	return &throttledReader{r: r, limiters: limiters}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Reads are kept to a tenth of the slowest rate, so a limited transfer
+	// moves steadily instead of in a burst followed by a long pause. The
+	// rates are checked on every read, as a schedule can change them.
+	chunk := 0
+	for _, l := range t.limiters {
+		if rate := l.limit(); rate > 0 {
+			if c := int(rate / 10); chunk == 0 || c < chunk {
+				chunk = c
+			}
+			if chunk < 1 {
+				chunk = 1
+			}
+		}
+	}
+	if chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
+
+// rateSchedule is -limit-rate-schedule: rates for times of day, such as
+// 08:00-18:00=1M to hold every transfer together to 1 MiB/s during the
+// working day. Periods are separated by commas and follow the form of
+// -window; the first that contains the time applies, and outside them all
+// there is no limit. Running transfers change speed as the periods do.
+type rateSchedule []scheduledRate
+
+type scheduledRate struct {
+	period timeWindow
+	rate   int64
+}
+
+func (s *rateSchedule) String() string {
+	if s == nil {
+		return ""
+	}
+	specs := make([]string, len(*s))
+	for i, r := range *s {
+		specs[i] = r.period.String() + "=" + formatBytes(r.rate)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (s *rateSchedule) Set(value string) error {
+	var schedule rateSchedule
+	for _, spec := range strings.Split(value, ",") {
+		period, rate, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("invalid rate schedule %q: want periods such as 08:00-18:00=1M", spec)
+		}
+		window, err := parseTimeWindow(period)
+		if err != nil {
+			return err
+		}
+		bytes, err := parseByteSize(rate)
+		if err != nil {
+			return fmt.Errorf("invalid rate in %q: %w", spec, err)
+		}
+		if bytes <= 0 {
+			return fmt.Errorf("invalid rate in %q: it must be positive", spec)
+		}
+		schedule = append(schedule, scheduledRate{window, bytes})
+	}
+	*s = schedule
+	return nil
+}
+
+// rateAt returns the rate in force at t, and the period that sets it, or 0
+// outside them all.
+func (s rateSchedule) rateAt(t time.Time) (float64, timeWindow) {
+	for _, r := range s {
+		if r.period.contains(t) {
+			return float64(r.rate), r.period
+		}
+	}
+	return 0, timeWindow{}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRateLimiterWaitWhileRateChanges has the rate change under a waiting
+// transfer, as a shared -limit-rate-schedule limiter does between periods.
+func TestRateLimiterWaitWhileRateChanges(t *testing.T) {
+	const rate = 1 << 20
+	l := newRateLimiter(rate)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			l.mu.Lock()
+			l.rate = float64(rate + i%2)
+			l.mu.Unlock()
+		}
+	}()
+	// Empty the bucket, then run into debt short enough to sleep off.
+	l.wait(rate)
+	for i := 0; i < 200; i++ {
+		l.wait(100)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// readThrottled reads size bytes of zeros through the limiters and returns
+// how long it took and the largest single read.
+func readThrottled(size int64, limiters []*rateLimiter) (time.Duration, int) {
+	start := time.Now()
+	r := newThrottledReader(io.LimitReader(zeros{}, size), limiters)
+	largest := 0
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > largest {
+			largest = n
+		}
+		if err != nil {
+			return time.Since(start), largest
+		}
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestLimitRate(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("a limiter for no limit")
+	}
+
+	// The bucket starts with a second's worth, so 30000 bytes at 20000 B/s
+	// take half a second.
+	elapsed, largest := readThrottled(30000, []*rateLimiter{newRateLimiter(20000)})
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("30000 bytes at 20000 B/s took %s, want about 500ms", elapsed)
+	}
+	if largest > 2000 {
+		t.Errorf("read %d bytes at once, want at most a tenth of the rate", largest)
+	}
+}
+
+func TestLimitRateTotalIsShared(t *testing.T) {
+	opts := newTestOptions(t, "-limit-rate", "1M", "-limit-rate-total", "20000")
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		ctx := opts.transferContext(&transferResult{ID: strconv.Itoa(i)})
+		limiters := opts.rateLimiters(ctx)
+		if len(limiters) != 2 || limiters[0] == opts.totalLimiter || limiters[1] != opts.totalLimiter {
+			t.Fatalf("transfer limited by %v, want its own limiter and the total one", limiters)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readThrottled(15000, limiters)
+		}()
+	}
+	wg.Wait()
+	// Together they read 30000 bytes, the same half second as one
+	// transfer at the total rate.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("two transfers sharing 20000 B/s took %s for 30000 bytes, want about 500ms", elapsed)
+	}
+}
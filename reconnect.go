@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+const DefaultReconnects = 3
+
+var errSourceChanged = errors.New("file changed on the server during the transfer")
+
+// reconnectingReader redials the source when the connection breaks partway
+// through a transfer and carries on from the next byte it needs, so a
+// dropped connection costs a reconnect rather than the whole download. A
+// source that declared its size and then ends short counts as broken too.
+type reconnectingReader struct {
+	ctx    context.Context
+	opts   *options
+	source *url.URL
+	offset int64
+	size   int64
+	reader io.ReadCloser
+
+	remaining   int
+	reconnected int
+}
+
+func (r *reconnectingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.reader.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.size >= 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			// Progress was made, so the next break gets a full set of retries.
+			r.remaining = r.opts.reconnects
+			if err != io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if err == nil || err == io.EOF || r.remaining <= 0 || permanent(err) {
+			return n, err
+		}
+		if err := r.reconnect(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reconnect replaces the broken reader, backing off between attempts.
+func (r *reconnectingReader) reconnect(cause error) error {
+	r.opts.transferLog(r.ctx).Warnf("transfer of %s broke at byte %d: %v; reconnecting", r.source, r.offset, cause)
+	r.reader.Close()
+	for r.remaining > 0 {
+		if err := r.opts.retry.wait(r.ctx, r.opts.reconnects-r.remaining, cause); err != nil {
+			r.reader = io.NopCloser(eofReader{})
+			return err
+		}
+		r.remaining--
+
+		reader, size, err := r.opts.openSourceOnce(r.ctx, r.source, r.offset)
+		if err != nil {
+			cause = err
+			continue
+		}
+		if r.size >= 0 && size >= 0 && size != r.size {
+			reader.Close()
+			return errSourceChanged
+		}
+		r.reader = reader
+		r.reconnected++
+		return nil
+	}
+	r.reader = io.NopCloser(eofReader{})
+	return fmt.Errorf("giving up after %d reconnects: %w", r.opts.reconnects, cause)
+}
+
+func (r *reconnectingReader) Close() error {
+	return r.reader.Close()
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
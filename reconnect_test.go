@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// resetConn drops conn with a TCP reset, which a reader sees as an error
+// rather than the end of the file.
+func resetConn(conn net.Conn) {
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+func TestReconnectResumesTextTransfer(t *testing.T) {
+	data := strings.Repeat("0123456789", 10000)
+	for _, test := range []struct {
+		reconnects  string
+		connections int
+		ok          bool
+	}{
+		{"1", 2, true},
+		{"0", 1, false},
+	} {
+		// The first connection breaks halfway through.
+		server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+			if _, ok := readRequest(r); !ok {
+				return
+			}
+			if n == 0 {
+				conn.Write([]byte(data[:len(data)/2]))
+				resetConn(conn)
+				return
+			}
+			conn.Write([]byte(data))
+		})
+		opts := newTestOptions(t, "-reconnect", test.reconnects, "-retry-backoff", "1ms", "-retry-jitter", "0")
+		source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.txt"}
+		reader, _, err := opts.openSource(context.Background(), source, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if test.ok && (err != nil || string(got) != data) {
+			t.Errorf("-reconnect %s: read %d bytes, %v; want all %d", test.reconnects, len(got), err, len(data))
+		}
+		if !test.ok && err == nil {
+			t.Errorf("-reconnect %s: a broken transfer read as complete", test.reconnects)
+		}
+		if n := server.connections(); n != test.connections {
+			t.Errorf("-reconnect %s: %d connections, want %d", test.reconnects, n, test.connections)
+		}
+	}
+}
+
+func TestReconnectNoticesChangedFile(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 10000)
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if n == 0 {
+			serveWireFile(t, conn, r, data, len(data)/2)
+			return
+		}
+		serveWireFile(t, conn, r, append(data, "more"...), 0)
+	})
+
+	opts := newTestOptions(t, "-wire", "protobuf", "-retry-backoff", "1ms", "-retry-jitter", "0")
+	source := &url.URL{Scheme: "tcp", Host: server.addr(), Path: "/a.bin"}
+	reader, _, err := opts.openSource(context.Background(), source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); !errors.Is(err, errSourceChanged) {
+		t.Errorf("read returned %v, want %v", err, errSourceChanged)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// tokenRefresher gets a new token when a server says the current one has
+// expired, from -token-command or -token-url. A server reports expiry by
+// answering AUTH with
+//
+//	ERR token expired
+//
+// and keeping the connection open for another AUTH, so the handshake can
+// carry on with the new token and the transfer never notices.
+type tokenRefresher struct {
+	command string
+	url     string
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (t *tokenRefresher) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&t.command, "token-command", "", "when a server says the token has expired, run this shell `command` and use the first line it prints as the new token; TCP_FILE_SERVER holds the server's host:port")
+	fs.StringVar(&t.url, "token-url", "", "when a server says the token has expired, POST to this `url` with the old token as a bearer token, and use the token in the reply, plain text or JSON with a token or access_token field")
+}
+
+func (t *tokenRefresher) enabled() bool {
+	return t.command != "" || t.url != ""
+}
+
+// current returns the token last refreshed for address, or "".
+func (t *tokenRefresher) current(address string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tokens[address]
+}
+
+// refresh replaces the stale token for address. Connections that find it
+// expired at the same time share one refresh: whoever comes second gets
+// the token the first one fetched.
+func (t *tokenRefresher) refresh(address, stale string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token := t.tokens[address]; token != "" && token != stale {
+		return token, nil
+	}
+
+	var token string
+	var err error
+	if t.command != "" {
+		token, err = t.runCommand(address)
+	} else {
+		token, err = t.fetch(stale)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error refreshing token: %w", err)
+	}
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", errors.New("error refreshing token: the new token must be one word")
+	}
+	if t.tokens == nil {
+		t.tokens = map[string]string{}
+	}
+	t.tokens[address] = token
+	return token, nil
+}
+
+func (t *tokenRefresher) runCommand(address string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+	shell, arg := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, arg = "cmd", "/C"
+	}
+	cmd := exec.CommandContext(ctx, shell, arg, t.command)
+	cmd.Env = append(os.Environ(), "TCP_FILE_SERVER="+address)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %q: %w", t.command, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+func (t *tokenRefresher) fetch(stale string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+stale)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", t.url, response.Status)
+	}
+
+	body := io.LimitReader(response.Body, 64<<10)
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType == "application/json" {
+		var reply struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(body).Decode(&reply); err != nil {
+			return "", fmt.Errorf("error decoding reply: %w", err)
+		}
+		if reply.Token != "" {
+			return reply.Token, nil
+		}
+		return reply.AccessToken, nil
+	}
+	line, err := bufio.NewReader(body).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("error reading reply: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// tokenExpired reports whether err is the server saying the token has
+// expired.
+func tokenExpired(err error) bool {
+	var server *serverError
+	return errors.As(err, &server) && strings.HasPrefix(server.message, "token expired")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// chdir changes to dir for the rest of the test, where batches save files.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestTokenExpiresMidBatch(t *testing.T) {
+	server := newTokenServer(t, "old")
+	// The token runs out once the first file has been requested.
+	server.mu.Lock()
+	server.onRequest = func() {
+		if len(server.requests) == 1 {
+			delete(server.valid, "old")
+			server.expired["old"] = true
+			server.valid["new"] = true
+		}
+	}
+	server.mu.Unlock()
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-token", "old", "-token-command", "echo new")
+
+	var sources []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		sources = append(sources, "tcp://"+server.addr()+"/"+name)
+	}
+	results, err := runBatch(opts, sources, nil, opts.log)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != statusDownloaded {
+			t.Errorf("%s: %s %s", r.Source, r.Status, r.Error)
+		}
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != "contents of "+name {
+			t.Errorf("%s holds %q, %v", name, data, err)
+		}
+	}
+
+	want := []string{"old GET a.txt", "new GET b.txt", "new GET c.txt"}
+	if got := server.served(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("served %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// command sends a one-line request, followed by body when there is one, and
+// reads the one-line reply.
+func (o *options) command(address, request string, body io.Reader) (string, error) {
+	return o.exchange(address, request, body, false)
+}
+
+// exchange is command, also accepting a bare data line as the reply when
+// allowData is set.
+func (o *options) exchange(address, request string, body io.Reader, allowData bool) (string, error) {
+	conn, r, _, err := o.dialRequest(context.Background(), address, false)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	request, err = o.signRequest(address, request)
+	if err != nil {
+		return "", err
+	}
+	conn.SetWriteDeadline(time.Now().Add(ConnectionTimeout))
+	if _, err := io.WriteString(conn, request+"\n"); err != nil {
+		return "", fmt.Errorf("error sending request: %w", err)
+	}
+	o.log.Debugf("sent %s to %s", request, address)
+	if body != nil {
+		if _, err := io.Copy(deadlineWriter{conn}, body); err != nil {
+			return "", fmt.Errorf("error sending data: %w", err)
+		}
+	}
+
+	f, err := readFrame(r, allowData)
+	return f.text, err
+}
+
+// putFile uploads a local file with "PUT name size mtime" followed by
+// exactly size bytes. The server stamps the file with mtime (Unix seconds).
+func (o *options) putFile(address, name, local string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("error opening local file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening local file: %w", err)
+	}
+
+	request := fmt.Sprintf("PUT %s %d %d", name, info.Size(), info.ModTime().Unix())
+	_, err = o.command(address, request, io.LimitReader(file, info.Size()))
+	return err
+}
+
+// removeFile deletes a file on the server with "RM name".
+func (o *options) removeFile(address, name string) error {
+	_, err := o.command(address, "RM "+name, nil)
+	return err
+}
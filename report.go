@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runReport is -report: a file written at the end of a batch or sync run
+// with a row for every file in it, including those skipped and, with a
+// download budget, deferred. Its format follows the file's extension:
+//
+//   - .csv: a header and then name, size, duration, rate, status, error and
+//     sha256 columns, with sizes in bytes, durations in seconds and rates
+//     in bytes per second, for spreadsheets.
+//   - .html: a page with a summary, a table of the files that sorts by any
+//     column and the details of the failures, for nightly job emails; see
+//     writeHTMLReport.
+type runReport struct {
+	path string
+
+	mu      sync.Mutex
+	results []*transferResult
+}
+
+var reportFormats = []string{".csv", ".html"}
+
+func (r *runReport) registerFlags(fs *flag.FlagSet) {
+	fs.Func("report", "at the end of a batch or sync, write a report of every file in it to this `file`, in the format its extension names: .csv or .html", func(path string) error {
+		if ext := strings.ToLower(filepath.Ext(path)); !containsString(reportFormats, ext) {
+			return fmt.Errorf("unknown report format %q: want %s", ext, strings.Join(reportFormats, ", "))
+		}
+		r.path = path
+		return nil
+	})
+}
+
+func (r *runReport) add(result *transferResult) {
+	if r.path == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+}
+
+// write writes the report, adding the sources the budget deferred.
+func (r *runReport) write(b *budget, logger *leveledLogger) {
+	if r.path == "" {
+		return
+	}
+	r.mu.Lock()
+	results := append([]*transferResult(nil), r.results...)
+	r.mu.Unlock()
+	results = append(results, b.deferredResults()...)
+
+	write := writeCSVReport
+	if strings.EqualFold(filepath.Ext(r.path), ".html") {
+		write = writeHTMLReport
+	}
+	if err := write(r.path, results); err != nil {
+		logger.Errorf("%v", err)
+		return
+	}
+	logger.Infof("wrote a report of %d files to %s", len(results), r.path)
+}
+
+func writeCSVReport(path string, results []*transferResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating report: %w", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"name", "size", "duration", "rate", "status", "error", "sha256"})
+	for _, result := range results {
+		d := time.Duration(result.DurationMS) * time.Millisecond
+		var rate string
+		if d > 0 && result.Bytes > 0 {
+			rate = strconv.FormatFloat(float64(result.Bytes)/d.Seconds(), 'f', 0, 64)
+		}
+		w.Write([]string{
+			result.file(),
+			strconv.FormatInt(result.Bytes, 10),
+			strconv.FormatFloat(d.Seconds(), 'f', 3, 64),
+			rate,
+			result.Status,
+			result.Error,
+			result.SHA256,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
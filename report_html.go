@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"time"
+)
+
+// htmlReport is the data of an .html -report: one self-contained page, with
+// its styles and the script that sorts the table inline, so it can be
+// attached to an email as it is.
+type htmlReport struct {
+	Generated time.Time
+	Host      string
+	Files     int
+	Bytes     int64
+	Elapsed   time.Duration
+	Rate      int64
+	Statuses  []statusCount
+	Rows      []htmlRow
+	Failures  []htmlRow
+}
+
+type statusCount struct {
+	Status string
+	Count  int
+}
+
+type htmlRow struct {
+	Name       string
+	Source     string
+	Bytes      int64
+	Seconds    float64
+	Rate       int64
+	Status     string
+	Error      string
+	ErrorClass string
+	SHA256     string
+}
+
+func writeHTMLReport(path string, results []*transferResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating report: %w", err)
+	}
+	if err := htmlReportTemplate.Execute(f, newHTMLReport(results)); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+func newHTMLReport(results []*transferResult) *htmlReport {
+	report := &htmlReport{Generated: time.Now(), Files: len(results)}
+	report.Host, _ = os.Hostname()
+	counts := map[string]int{}
+	var first, last time.Time
+	for _, r := range results {
+		counts[r.Status]++
+		report.Bytes += r.Bytes
+		d := time.Duration(r.DurationMS) * time.Millisecond
+		row := htmlRow{Name: r.file(), Source: r.Source, Bytes: r.Bytes, Seconds: d.Seconds(), Status: r.Status, Error: r.Error, ErrorClass: r.ErrorClass, SHA256: r.SHA256}
+		if row.Seconds > 0 {
+			row.Rate = int64(float64(r.Bytes) / row.Seconds)
+		}
+		report.Rows = append(report.Rows, row)
+		if r.Status == statusFailed {
+			report.Failures = append(report.Failures, row)
+		}
+
+		if r.started.IsZero() {
+			continue
+		}
+		if first.IsZero() || r.started.Before(first) {
+			first = r.started
+		}
+		if end := r.started.Add(d); end.After(last) {
+			last = end
+		}
+	}
+	if !first.IsZero() {
+		report.Elapsed = last.Sub(first).Round(time.Millisecond)
+		if s := report.Elapsed.Seconds(); s > 0 {
+			report.Rate = int64(float64(report.Bytes) / s)
+		}
+	}
+	for status, n := range counts {
+		report.Statuses = append(report.Statuses, statusCount{status, n})
+	}
+	sort.Slice(report.Statuses, func(i, j int) bool { return report.Statuses[i].Status < report.Statuses[j].Status })
+	return report
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Transfer report, {{time .Generated}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.15em; margin-top: 2em; }
+table { border-collapse: collapse; font-size: 0.9em; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+th { background: #f4f4f4; }
+#files th { cursor: pointer; user-select: none; }
+#files th[data-dir="asc"]::after { content: " \25B2"; }
+#files th[data-dir="desc"]::after { content: " \25BC"; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+td.hash { font-family: monospace; font-size: 0.85em; }
+.failed { color: #b00020; }
+.summary td:first-child { font-weight: bold; }
+pre { white-space: pre-wrap; margin: 0; }
+</style>
+</head>
+<body>
+<h1>Transfer report</h1>
+<p>Generated {{time .Generated}}{{with .Host}} on {{.}}{{end}}.</p>
+
+<table class="summary">
+<tr><td>Files</td><td>{{.Files}}</td></tr>
+{{range .Statuses}}<tr><td>{{.Status}}</td><td{{if eq .Status "failed"}} class="failed"{{end}}>{{.Count}}</td></tr>
+{{end}}<tr><td>Transferred</td><td>{{bytes .Bytes}}</td></tr>
+{{if .Elapsed}}<tr><td>Elapsed</td><td>{{.Elapsed}}</td></tr>
+<tr><td>Average rate</td><td>{{bytes .Rate}}/s</td></tr>
+{{end}}</table>
+
+<h2>Files</h2>
+<table id="files">
+<thead><tr><th>Name</th><th data-type="num">Size</th><th data-type="num">Duration</th><th data-type="num">Rate</th><th>Status</th><th>SHA-256</th></tr></thead>
+<tbody>
+{{range .Rows}}<tr{{if eq .Status "failed"}} class="failed"{{end}}><td>{{.Name}}</td><td class="num" data-value="{{.Bytes}}">{{bytes .Bytes}}</td><td class="num" data-value="{{.Seconds}}">{{printf "%.3f s" .Seconds}}</td><td class="num" data-value="{{.Rate}}">{{if .Rate}}{{bytes .Rate}}/s{{end}}</td><td>{{.Status}}</td><td class="hash">{{.SHA256}}</td></tr>
+{{end}}</tbody>
+</table>
+
+{{if .Failures}}<h2>Failures</h2>
+<table>
+<thead><tr><th>File</th><th>Source</th><th>Class</th><th>Error</th></tr></thead>
+<tbody>
+{{range .Failures}}<tr><td>{{.Name}}</td><td>{{.Source}}</td><td>{{.ErrorClass}}</td><td><pre>{{.Error}}</pre></td></tr>
+{{end}}</tbody>
+</table>
+{{end}}
+<script>
+document.querySelectorAll("#files th").forEach(function (th, column) {
+  th.addEventListener("click", function () {
+    var body = document.querySelector("#files tbody");
+    var numeric = th.dataset.type === "num";
+    var dir = th.dataset.dir === "asc" ? "desc" : "asc";
+    document.querySelectorAll("#files th").forEach(function (other) { delete other.dataset.dir; });
+    th.dataset.dir = dir;
+    var key = function (row) {
+      var cell = row.cells[column];
+      return numeric ? parseFloat(cell.dataset.value) || 0 : cell.textContent.toLowerCase();
+    };
+    Array.from(body.rows).sort(function (a, b) {
+      var x = key(a), y = key(b);
+      var order = x < y ? -1 : x > y ? 1 : 0;
+      return dir === "asc" ? order : -order;
+    }).forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCSVReportDurationEndsAtReport(t *testing.T) {
+	opts := newTestOptions(t)
+	// As sync reports its transfers: without a finish time of their own.
+	result := newTransferResult("tcp://files:8000/a.txt", "a.txt")
+	result.started = time.Now().Add(-time.Second)
+	result.Bytes = 1000
+	opts.report(opts.log, result, nil)
+
+	// The report is written well after the transfer ended.
+	time.Sleep(300 * time.Millisecond)
+	path := filepath.Join(t.TempDir(), "report.csv")
+	if err := writeCSVReport(path, []*transferResult{result}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seconds, err := strconv.ParseFloat(rows[1][2], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seconds < 1 || seconds > 1.2 {
+		t.Errorf("duration %.3f s, want about 1 s", seconds)
+	}
+}
+
+func TestHTMLReportDurationsEndAtReport(t *testing.T) {
+	opts := newTestOptions(t)
+	now := time.Now()
+	a := newTransferResult("tcp://files:8000/a.txt", "a.txt")
+	a.started, a.finished = now.Add(-2*time.Second), now.Add(-time.Second)
+	opts.report(opts.log, a, nil)
+	// b failed before finishing, so has no finish time of its own.
+	b := newTransferResult("tcp://files:8000/b.txt", "b.txt")
+	b.started = now.Add(-1500 * time.Millisecond)
+	opts.report(opts.log, b, errors.New("connection reset"))
+
+	time.Sleep(300 * time.Millisecond)
+	report := newHTMLReport([]*transferResult{a, b})
+	for i, want := range []float64{1, 1.5} {
+		if got := report.Rows[i].Seconds; got < want || got > want+0.2 {
+			t.Errorf("%s took %.3f s, want %.1f s", report.Rows[i].Name, got, want)
+		}
+	}
+	if report.Elapsed < 2*time.Second || report.Elapsed > 2200*time.Millisecond {
+		t.Errorf("elapsed %s, want 2s", report.Elapsed)
+	}
+}
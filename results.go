@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusDownloaded = "downloaded"
+	statusUploaded   = "uploaded"
+	statusDeleted    = "deleted"
+	statusSkipped    = "skipped"
+	statusConflict   = "conflict"
+	statusFailed     = "failed"
+	// statusDeferred is for sources a download budget left for later,
+	// which are never transferred or reported, only listed in -report and
+	// a batch's results.
+	statusDeferred = "deferred"
+)
+
+// Actions other than downloading, used by bidirectional sync.
+const (
+	actionUpload       = "upload"
+	actionDeleteLocal  = "delete-local"
+	actionDeleteRemote = "delete-remote"
+)
+
+// transferResult is the outcome of one file. Every result is logged, and
+// with -json it is also printed to stdout as a line of JSON.
+type transferResult struct {
+	ID          string `json:"id"`
+	Action      string `json:"action,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	Status      string `json:"status"`
+	Bytes       int64  `json:"bytes"`
+	SHA256      string `json:"sha256,omitempty"`
+	Scan        string `json:"scan,omitempty"`
+	Conflict    string `json:"conflict,omitempty"`
+	Error       string `json:"error,omitempty"`
+	ErrorClass  string `json:"error_class,omitempty"`
+	// Attempts is the number of connections the transfer used, and
+	// DurationMS how long it took, set when the result is reported.
+	Attempts   int   `json:"attempts"`
+	DurationMS int64 `json:"duration_ms"`
+
+	// expectSHA256, when set, is checked before the file is committed.
+	expectSHA256 string
+	// started and finished go into the transfer history. A zero finished
+	// time means the result is reported as soon as it is done.
+	started  time.Time
+	finished time.Time
+	// windows, when set, replace -window for this transfer.
+	windows timeWindows
+	// unattempted marks a skipped source -fail-fast never started.
+	unattempted bool
+}
+
+// newTransferResult starts the result of one transfer and gives it a new ID,
+// which tags its log lines and history and, with -send-transfer-id, is sent to
+// the server so both sides' logs can be matched up.
+func newTransferResult(source, destination string) *transferResult {
+	return &transferResult{ID: newTransferID(), Source: source, Destination: destination, started: time.Now()}
+}
+
+type transferKey struct{}
+
+// transferState is what the requests made on behalf of one transfer share,
+// however many connections it uses.
+type transferState struct {
+	id      string
+	limiter *rateLimiter
+	windows timeWindows
+
+	// retrying is when the transfer first had to retry, for -retry-budget.
+	mu       sync.Mutex
+	retrying time.Time
+}
+
+// retryingFor starts the transfer's retry clock if it isn't running yet and
+// returns how long it has been running.
+func (s *transferState) retryingFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retrying.IsZero() {
+		s.retrying = time.Now()
+	}
+	return time.Since(s.retrying)
+}
+
+// duration returns how long the transfer took, or 0 if it didn't start.
+func (r *transferResult) duration() time.Duration {
+	if r.started.IsZero() {
+		return 0
+	}
+	finished := r.finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	return finished.Sub(r.started)
+}
+
+// transferContext returns the context for a transfer's requests.
+func (o *options) transferContext(result *transferResult) context.Context {
+	state := &transferState{id: result.ID, limiter: newRateLimiter(int64(o.limitRate)), windows: result.windows}
+	return context.WithValue(context.Background(), transferKey{}, state)
+}
+
+func transferID(ctx context.Context) string {
+	if state, ok := ctx.Value(transferKey{}).(*transferState); ok {
+		return state.id
+	}
+	return ""
+}
+
+func newTransferID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand doesn't fail on supported platforms; fall back to the
+		// clock rather than leave the transfer without an ID.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// file is the file the result is about: the local one, unless the action
+// was on the server.
+func (r *transferResult) file() string {
+	if r.Action == actionUpload || r.Action == actionDeleteRemote || r.Destination == "" {
+		return r.Source
+	}
+	return r.Destination
+}
+
+// verb describes the result's action, as in "would download file".
+func (r *transferResult) verb() string {
+	switch r.Action {
+	case actionUpload:
+		return "upload"
+	case actionDeleteLocal, actionDeleteRemote:
+		return "delete"
+	}
+	return "download"
+}
+
+// skipped reports whether a transfer that ended in err is reported as
+// skipped rather than failed.
+func (o *options) skipped(err error) bool {
+	return o.skipOversized(err) || errors.Is(err, errSeen) || errors.Is(err, errCaseCollision)
+}
+
+func (o *options) report(logger *leveledLogger, r *transferResult, err error) {
+	// Everything but the batch, which stamps its transfers as they end and
+	// reports them in order, reports a transfer as soon as it is over.
+	if r.finished.IsZero() {
+		r.finished = time.Now()
+	}
+	logger = logger.with(map[string]string{"TRANSFER_ID": r.ID, "FILE": r.file(), "BYTES": strconv.FormatInt(r.Bytes, 10)})
+
+	switch {
+	case err == nil && r.Action == actionUpload:
+		r.Status = statusUploaded
+		logger.Infof("uploaded file %s", r.Source)
+	case err == nil && r.Action == actionDeleteRemote:
+		r.Status = statusDeleted
+		logger.Infof("deleted remote file %s", r.Source)
+	case err == nil && r.Action == actionDeleteLocal:
+		r.Status = statusDeleted
+		logger.Infof("deleted local file %s", r.Destination)
+	case err == nil:
+		r.Status = statusDownloaded
+		o.budget.spend(r.Bytes)
+		if r.Scan != "" {
+			logger.Infof("downloaded file %s (scan: %s)", r.Destination, r.Scan)
+		} else {
+			logger.Infof("downloaded file %s", r.Destination)
+		}
+	case o.skipped(err):
+		r.Status, r.Error = statusSkipped, err.Error()
+		logger.Infof("skipped file %s: %v", r.Source, err)
+	case errors.Is(err, errConflict):
+		r.Status, r.Error = statusConflict, err.Error()
+		logger.Warnf("conflict on file %s: %v", r.Source, err)
+	default:
+		r.Status, r.Error, r.ErrorClass = statusFailed, err.Error(), string(classify(err))
+		logger.Errorf("error %sing file %s: %v", strings.TrimSuffix(r.verb(), "e"), r.Source, err)
+	}
+	r.DurationMS = r.duration().Milliseconds()
+
+	if o.audit != nil && r.Status != statusSkipped {
+		if err := o.audit.add(r); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+	if o.history != nil && r.Status != statusSkipped {
+		if err := o.history.add(r); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+	o.runReport.add(r)
+	if o.statsdClient != nil {
+		if err := o.statsdClient.record(r); err != nil {
+			logger.Debugf("%v", err)
+		}
+	}
+	if o.influxWriter != nil {
+		if err := o.influxWriter.record(r); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+	o.printJSON(r)
+}
+
+// printJSON prints r to stdout with -json.
+func (o *options) printJSON(r *transferResult) {
+	if o.jsonResults {
+		json.NewEncoder(os.Stdout).Encode(r)
+	}
+}
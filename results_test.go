@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTransferIDsTagRequestsAndLogs(t *testing.T) {
+	requests := make(chan string, 2)
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok {
+			requests <- line
+			conn.Write([]byte("contents"))
+		}
+	})
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-send-transfer-id")
+	var out bytes.Buffer
+	opts.log = &leveledLogger{out: log.New(&out, "", 0), level: levelDebug}
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + server.addr() + "/b.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results[0].ID) != 16 || results[0].ID == results[1].ID {
+		t.Fatalf("transfer IDs %q and %q, want two different 16-digit IDs", results[0].ID, results[1].ID)
+	}
+	for _, r := range results {
+		name := strings.TrimPrefix(r.Source, "tcp://"+server.addr()+"/")
+		if got, want := <-requests, "GET "+name+" id="+r.ID; got != want {
+			t.Errorf("server got %q, want %q", got, want)
+		}
+		if want := "[" + r.ID + "] debug: sent GET " + name; !strings.Contains(out.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTransferIDsOnlySentWhenAsked(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Transfer-ID")
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+
+	for _, send := range []bool{false, true} {
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, "-send-transfer-id="+strconv.FormatBool(send))
+		results, err := runBatch(opts, []string{server.URL + "/a.txt"}, nil, opts.log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]string{true: results[0].ID}[send]; header != want {
+			t.Errorf("-send-transfer-id=%t sent X-Transfer-ID %q, want %q", send, header, want)
+		}
+	}
+}
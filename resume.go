@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// openResumed opens the source where the partial file in out ends. With
+// -verify-resume, the last bytes already on disk are fetched again and
+// compared before anything is appended, so a partial file that was
+// corrupted or belongs to a different version of the file is thrown away
+// and the download starts over instead of being completed with the wrong
+// prefix. It returns the offset the download really continues from.
+func (o *options) openResumed(ctx context.Context, source *url.URL, out sink, offset int64) (io.ReadCloser, int64, int64, error) {
+	f, ok := out.(*fileSink)
+	overlap := int64(o.verifyResume)
+	if offset == 0 || overlap <= 0 || !ok {
+		reader, size, err := o.openSource(ctx, source, offset)
+		return reader, size, offset, err
+	}
+	if overlap > offset {
+		overlap = offset
+	}
+
+	reader, size, err := o.openSource(ctx, source, offset-overlap)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	match, err := f.tailMatches(reader, overlap)
+	if err != nil {
+		reader.Close()
+		return nil, 0, 0, err
+	}
+	if match {
+		o.transferLog(ctx).Debugf("last %d bytes of %s match the server; resuming at byte %d", overlap, f.Name(), offset)
+		return reader, size, offset, nil
+	}
+
+	reader.Close()
+	o.transferLog(ctx).Warnf("partial file %s does not match %s; starting over", f.Name(), source)
+	if err := f.Truncate(0); err != nil {
+		return nil, 0, 0, fmt.Errorf("error truncating partial file: %w", err)
+	}
+	reader, size, err = o.openSource(ctx, source, 0)
+	return reader, size, 0, err
+}
+
+// tailMatches compares the last n bytes of the partial file with the next n
+// bytes of r. A source that ends first doesn't match.
+func (s *fileSink) tailMatches(r io.Reader, n int64) (bool, error) {
+	partial, err := os.Open(s.Name())
+	if err != nil {
+		return false, fmt.Errorf("error reading partial file: %w", err)
+	}
+	defer partial.Close()
+	info, err := partial.Stat()
+	if err != nil {
+		return false, fmt.Errorf("error reading partial file: %w", err)
+	}
+	local := io.NewSectionReader(partial, info.Size()-n, n)
+
+	want := make([]byte, 32*1024)
+	got := make([]byte, len(want))
+	for n > 0 {
+		chunk := int64(len(want))
+		if chunk > n {
+			chunk = n
+		}
+		if _, err := io.ReadFull(local, want[:chunk]); err != nil {
+			return false, fmt.Errorf("error reading partial file: %w", err)
+		}
+		if _, err := io.ReadFull(r, got[:chunk]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("error reading data from connection: %w", err)
+		}
+		if !bytes.Equal(want[:chunk], got[:chunk]) {
+			return false, nil
+		}
+		n -= chunk
+	}
+	return true, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyResume(t *testing.T) {
+	server := newFileServer(t)
+	for _, test := range []struct {
+		partial string
+		args    []string
+		want    string
+		warned  bool
+	}{
+		{"contents of", []string{"-verify-resume", "4"}, "contents of a.txt", false},
+		{"CONTENTS of", []string{"-verify-resume", "64K"}, "contents of a.txt", true},
+		{"contents OF", []string{"-verify-resume", "2"}, "contents of a.txt", true},
+		// Without the check, the wrong prefix is kept.
+		{"CONTENTS of", nil, "CONTENTS of a.txt", false},
+	} {
+		chdir(t, t.TempDir())
+		if err := os.WriteFile("a.txt"+partialSuffix, []byte(test.partial), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts := newTestOptions(t, append([]string{"-continue"}, test.args...)...)
+		var out bytes.Buffer
+		opts.log = &leveledLogger{out: log.New(&out, "", 0), level: levelDebug}
+
+		if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile("a.txt"); string(data) != test.want {
+			t.Errorf("partial %q with %v: downloaded %q, want %q", test.partial, test.args, data, test.want)
+		}
+		if warned := strings.Contains(out.String(), "does not match"); warned != test.warned {
+			t.Errorf("partial %q with %v: warned %t, want %t:\n%s", test.partial, test.args, warned, test.warned, out.String())
+		}
+	}
+}
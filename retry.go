@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// retryPolicy says how broken connections are retried. -reconnect sets how
+// many retries follow a failure; between them the delay starts at
+// -retry-backoff and doubles up to -retry-max-backoff, each delay varied
+// by up to -retry-jitter so that many clients cut off at once don't come
+// back in lockstep. -retry-budget caps the time a single transfer may
+// spend retrying, and -retry-on selects the phases that are retried at all.
+type retryPolicy struct {
+	initial  time.Duration
+	max      time.Duration
+	jitter   float64
+	budget   time.Duration
+	dial     bool
+	transfer bool
+}
+
+func (p *retryPolicy) registerFlags(fs *flag.FlagSet) {
+	p.transfer = true
+	fs.DurationVar(&p.initial, "retry-backoff", time.Second, "delay before the first retry; each further retry waits twice as long")
+	fs.DurationVar(&p.max, "retry-max-backoff", 30*time.Second, "longest delay between retries")
+	fs.Float64Var(&p.jitter, "retry-jitter", 0.2, "vary each retry delay randomly by up to this `fraction`, such as 0.2 for ±20%")
+	fs.DurationVar(&p.budget, "retry-budget", 0, "give up once a transfer has spent this long retrying; 0 means no limit")
+	fs.Func("retry-on", "comma-separated `phases` to retry: dial (connecting at the start), transfer (reconnecting mid-transfer), or none (default \"transfer\")", p.setPhases)
+}
+
+func (p *retryPolicy) setPhases(value string) error {
+	p.dial, p.transfer = false, false
+	for _, phase := range strings.Split(value, ",") {
+		switch strings.TrimSpace(phase) {
+		case "dial":
+			p.dial = true
+		case "transfer":
+			p.transfer = true
+		case "none", "":
+		default:
+			return fmt.Errorf("unknown retry phase %q: use dial, transfer or none", phase)
+		}
+	}
+	return nil
+}
+
+// delay returns how long to wait before retry number n, counting from 0.
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := p.initial
+	for i := 0; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	if p.jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// wait sleeps before retry number n of the transfer in ctx, which failed
+// with cause. Without sleeping, it returns an error if that would go over
+// -retry-budget, and it stops early with ctx's error once ctx is done.
+func (p *retryPolicy) wait(ctx context.Context, n int, cause error) error {
+	d := p.delay(n)
+	if p.budget > 0 {
+		if state, ok := ctx.Value(transferKey{}).(*transferState); ok {
+			if state.retryingFor()+d > p.budget {
+				return fmt.Errorf("retry budget of %s used up: %w", p.budget, cause)
+			}
+		}
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryWaitStopsWithContext(t *testing.T) {
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	u, err := url.Parse("tcp://" + refused.Addr().String() + "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions(t, "-retry-on", "dial", "-retry-backoff", "1m", "-retry-jitter", "0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = opts.openSource(ctx, u, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("openSource returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("openSource took %s after its context ended", elapsed)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"time"
+)
+
+// batch runs the command line sources, up to -parallel at a time and at
+// most -parallel-per-server against any one server. A file that has been
+// transferred is finalized (checked, scanned and moved into place) in the
+// background, which frees its slot for the next transfer; results are
+// reported in the order the transfers started, once finalizing is done.
+type batch struct {
+	opts   *options
+	seen   *seenDB
+	logger *leveledLogger
+
+	queue     []string
+	running   int
+	perServer map[string]int
+	// busy holds the destinations being written; another source for the
+	// same file waits until the earlier copy has been moved into place, so
+	// that it doesn't reuse its partial file.
+	busy map[string]bool
+
+	started []*batchItem
+	events  chan batchEvent
+	// results are those of the files reported so far, in order.
+	results []*transferResult
+	total   int
+	failed  int
+	// aborted is set once -fail-fast has stopped the batch, leaving
+	// skipped sources unattempted.
+	aborted bool
+	skipped int
+	// waiting is set while the batch waits for -window to open.
+	waiting bool
+
+	// unattempted are the results of the sources -fail-fast skipped.
+	unattempted []*transferResult
+}
+
+type batchItem struct {
+	arg         string
+	host        string
+	destination string
+	result      *transferResult
+	err         error
+	done        bool
+}
+
+// A batchEvent reports that an item's transfer ended, or, with finished
+// set, that it was finalized too.
+type batchEvent struct {
+	item     *batchItem
+	result   *transferResult
+	err      error
+	finished bool
+}
+
+// runBatch fetches args and returns the result of each file, in the order
+// they started, with the status, bytes, attempts, duration and error of
+// each, so that callers can act on the files one by one. Sources that
+// -fail-fast left unattempted follow as skipped, and then those the
+// download budget deferred. The error, a *batchFailure, only summarizes
+// them: it is nil if none failed.
+func runBatch(opts *options, args []string, seen *seenDB, logger *leveledLogger) ([]*transferResult, error) {
+	b := &batch{
+		opts:      opts,
+		seen:      seen,
+		logger:    logger,
+		queue:     opts.coalesceSources(args, logger),
+		perServer: map[string]int{},
+		busy:      map[string]bool{},
+		events:    make(chan batchEvent),
+	}
+	b.total = len(b.queue)
+
+	for len(b.queue) > 0 || len(b.started) > 0 {
+		wait := b.fill()
+		if len(b.started) == 0 {
+			// Every remaining server has an open circuit.
+			time.Sleep(wait)
+			continue
+		}
+
+		var cooldown <-chan time.Time
+		if wait > 0 {
+			cooldown = time.After(wait)
+		}
+		select {
+		case e := <-b.events:
+			b.handle(e)
+		case <-cooldown:
+		}
+	}
+	opts.budget.report(logger)
+	opts.runReport.write(&opts.budget, logger)
+	results := append(b.results, b.unattempted...)
+	for _, r := range opts.budget.deferredResults() {
+		opts.printJSON(r)
+		results = append(results, r)
+	}
+	if b.failed > 0 {
+		return results, &batchFailure{failed: b.failed, total: b.total, skipped: b.skipped, aborted: b.aborted}
+	}
+	return results, nil
+}
+
+// fill starts transfers until a limit is reached or nothing in the queue
+// may start yet. It returns how long until a paused server may be tried
+// again, or 0 if that isn't what is holding the queue up.
+func (b *batch) fill() time.Duration {
+	parallel := b.opts.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	if now := time.Now(); len(b.queue) > 0 && !b.opts.window.open(now) {
+		next := b.opts.window.opens(now)
+		if !b.waiting {
+			b.logger.Infof("outside the transfer window; waiting until %s to start the next %d transfers", next.Format("Mon 15:04"), len(b.queue))
+			b.waiting = true
+		}
+		return next.Sub(now)
+	}
+	b.waiting = false
+	for len(b.queue) > 0 && b.running < parallel && !b.spent() {
+		i, wait := b.opts.breaker.next(b.queue, b.blocked)
+		if i < 0 {
+			return wait
+		}
+		arg := b.queue[i]
+		b.queue = append(b.queue[:i], b.queue[i+1:]...)
+		b.opts.queue = b.queue
+		b.start(arg)
+	}
+	return 0
+}
+
+// spent reports whether the download budget allows no more transfers, in
+// which case it defers whatever is still queued.
+func (b *batch) spent() bool {
+	if !b.opts.budget.enabled() {
+		return false
+	}
+	// Transfers that haven't been reported yet count too, unless they
+	// failed.
+	files, bytes := 0, int64(0)
+	for _, item := range b.started {
+		if item.err == nil {
+			files++
+			if item.result != nil {
+				bytes += item.result.Bytes
+			}
+		}
+	}
+	if !b.opts.budget.exhausted(files, bytes) {
+		return false
+	}
+	b.opts.budget.deferSources(b.queue...)
+	b.queue, b.opts.queue = nil, nil
+	return true
+}
+
+// blocked reports whether arg has to wait for a running transfer.
+func (b *batch) blocked(arg string) bool {
+	if b.busy[b.opts.destination(arg)] {
+		return true
+	}
+	limit := b.opts.parallelPerServer
+	return limit > 0 && b.perServer[sourceHost(arg)] >= limit
+}
+
+func (b *batch) start(arg string) {
+	item := &batchItem{arg: arg, host: sourceHost(arg), destination: b.opts.destination(arg)}
+	b.started = append(b.started, item)
+	b.running++
+	b.perServer[item.host]++
+	b.busy[item.destination] = true
+
+	go func() {
+		result, finish, err := b.opts.get(arg, "", b.seen, b.logger)
+		// Reporting may wait for earlier transfers, which shouldn't count
+		// towards this one's duration.
+		if err != nil {
+			result.finished = time.Now()
+		}
+		b.events <- batchEvent{item: item, result: result, err: err}
+		if err != nil {
+			return
+		}
+		err = finish()
+		result.finished = time.Now()
+		b.events <- batchEvent{item: item, result: result, err: err, finished: true}
+	}()
+}
+
+func (b *batch) handle(e batchEvent) {
+	item := e.item
+	if !e.finished {
+		b.running--
+		if b.perServer[item.host]--; b.perServer[item.host] == 0 {
+			delete(b.perServer, item.host)
+		}
+		item.result = e.result
+		if e.err == nil {
+			return
+		}
+	}
+
+	item.err, item.done = e.err, true
+	delete(b.busy, item.destination)
+	b.opts.breaker.record(item.host, e.err, b.logger)
+	if e.err != nil && !b.opts.skipped(e.err) {
+		// Stop now rather than once the failure is reported, which
+		// waits for the transfers started before it.
+		b.failFast()
+	}
+
+	for len(b.started) > 0 && b.started[0].done {
+		head := b.started[0]
+		b.started = b.started[1:]
+		b.opts.report(b.logger, head.result, head.err)
+		b.results = append(b.results, head.result)
+		if head.result.Status == statusFailed {
+			b.failed++
+		}
+	}
+}
+
+// failFast stops the batch after a failure with -fail-fast, leaving what
+// is queued unattempted; transfers already under way are finished.
+func (b *batch) failFast() {
+	if !b.opts.failFast {
+		return
+	}
+	// Failing the last source still aborts the batch, for the exit code.
+	b.aborted = true
+	if len(b.queue) == 0 {
+		return
+	}
+	b.skipped = len(b.queue)
+	b.logger.Warnf("stopping the batch at its first failure (-fail-fast); %d files were not attempted", len(b.queue))
+	for _, arg := range b.queue {
+		b.logger.Infof("not attempted file %s", arg)
+		r := &transferResult{ID: newTransferID(), Source: arg, Destination: b.opts.destination(arg), Status: statusSkipped, Error: "not attempted after an earlier failure (-fail-fast)", unattempted: true}
+		b.opts.runReport.add(r)
+		b.opts.printJSON(r)
+		b.unattempted = append(b.unattempted, r)
+	}
+	b.queue, b.opts.queue = nil, nil
+}
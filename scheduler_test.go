@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newFileServer(t *testing.T) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok && strings.HasPrefix(line, "GET ") {
+			conn.Write([]byte("contents of " + strings.TrimPrefix(line, "GET ")))
+		}
+	})
+}
+
+func statuses(results []*transferResult) string {
+	var s []string
+	for _, r := range results {
+		s = append(s, r.Status)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestBatchResultsIncludeUnattempted(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	// Nothing listens on the first source's port.
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	opts := newTestOptions(t, "-fail-fast", "-retry-on", "none")
+
+	results, err := runBatch(opts, []string{"tcp://" + refused.Addr().String() + "/a.txt", "tcp://" + server.addr() + "/b.txt", "tcp://" + server.addr() + "/c.txt"}, nil, opts.log)
+	if err == nil {
+		t.Fatal("batch succeeded")
+	}
+	if got, want := statuses(results), "failed skipped skipped"; got != want {
+		t.Errorf("statuses %q, want %q", got, want)
+	}
+	if code := resultsExitCode(results); code != exitAborted {
+		t.Errorf("exit code %d, want %d", code, exitAborted)
+	}
+}
+
+func TestBatchResultsIncludeDeferred(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-max-files", "1")
+
+	var sources []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		sources = append(sources, "tcp://"+server.addr()+"/"+name)
+	}
+	results, err := runBatch(opts, sources, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(results), "downloaded deferred deferred"; got != want {
+		t.Errorf("statuses %q, want %q", got, want)
+	}
+	if results[1].Source != sources[1] || results[2].Source != sources[2] {
+		t.Errorf("deferred %s and %s, want b.txt and c.txt", results[1].Source, results[2].Source)
+	}
+	if code := resultsExitCode(results); code != exitOK {
+		t.Errorf("exit code %d, want %d", code, exitOK)
+	}
+}
+
+func TestFailFastAbortsAtLastSource(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	opts := newTestOptions(t, "-fail-fast", "-retry-on", "none")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + refused.Addr().String() + "/b.txt"}, nil, opts.log)
+	if got, want := statuses(results), "downloaded failed"; got != want {
+		t.Errorf("statuses %q, want %q", got, want)
+	}
+	if code := exitCode(err); code != exitAborted {
+		t.Errorf("exit code %d for %v, want %d", code, err, exitAborted)
+	}
+}
+
+// eventLog records what fake servers saw, in order.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.events, ", ")
+}
+
+// newLoggingFileServer is newFileServer, logging its GETs under tag.
+func newLoggingFileServer(t *testing.T, log *eventLog, tag string) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok && strings.HasPrefix(line, "GET ") {
+			log.add(tag + " " + line)
+			conn.Write([]byte("contents of " + strings.TrimPrefix(line, "GET ")))
+		}
+	})
+}
+
+// newSlowClamd is a clamd that logs each scan and takes a while over files
+// named slow*.
+func newSlowClamd(t *testing.T, log *eventLog) string {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if _, err := r.ReadString(0); err != nil {
+			return
+		}
+		var stream []byte
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return
+			}
+			chunk := make([]byte, binary.BigEndian.Uint32(size[:]))
+			if len(chunk) == 0 {
+				break
+			}
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+		name := strings.TrimPrefix(string(stream), "contents of ")
+		if strings.HasPrefix(name, "slow") {
+			time.Sleep(150 * time.Millisecond)
+		}
+		log.add("scanned " + name)
+		conn.Write([]byte("stream: OK\x00"))
+	}).addr()
+}
+
+func TestBatchFinalizesWhileNextTransfers(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	clamd := newSlowClamd(t, &log)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-clamd", clamd)
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/slow.txt", "tcp://" + server.addr() + "/b.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if results[0].Source != "tcp://"+server.addr()+"/slow.txt" {
+		t.Errorf("first result for %s, want slow.txt", results[0].Source)
+	}
+	if got, want := log.String(), "server GET slow.txt, server GET b.txt, scanned b.txt, scanned slow.txt"; got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+}
+
+func TestBatchWaitsForEarlierCopyOfSameFile(t *testing.T) {
+	var log eventLog
+	first := newLoggingFileServer(t, &log, "first")
+	second := newLoggingFileServer(t, &log, "second")
+	clamd := newSlowClamd(t, &log)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-clamd", clamd, "-parallel", "2")
+
+	results, err := runBatch(opts, []string{"tcp://" + first.addr() + "/slow.txt", "tcp://" + second.addr() + "/slow.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if got, want := log.String(), "first GET slow.txt, scanned slow.txt, second GET slow.txt, scanned slow.txt"; got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+}
+
+// concurrency tracks how many requests a fake server handles at once.
+type concurrency struct {
+	mu          sync.Mutex
+	active, max int
+}
+
+func (c *concurrency) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+}
+
+func (c *concurrency) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+}
+
+func (c *concurrency) peak() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
+
+// newSlowFileServer is newFileServer, taking a moment over each file so
+// that concurrent transfers overlap, counted in total and in c.
+func newSlowFileServer(t *testing.T, total, c *concurrency) *fakeServer {
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok {
+			total.enter()
+			c.enter()
+			time.Sleep(50 * time.Millisecond)
+			total.leave()
+			c.leave()
+			conn.Write([]byte("contents of " + strings.TrimPrefix(line, "GET ")))
+		}
+	})
+}
+
+func TestBatchConcurrencyLimits(t *testing.T) {
+	for _, test := range []struct {
+		args                []string
+		wantTotal, wantEach int
+	}{
+		{nil, 1, 1},
+		{[]string{"-parallel", "6"}, 6, 3},
+		{[]string{"-parallel", "4", "-parallel-per-server", "1"}, 2, 1},
+		{[]string{"-parallel", "6", "-parallel-per-server", "2"}, 4, 2},
+	} {
+		var total, first, second concurrency
+		servers := []*fakeServer{newSlowFileServer(t, &total, &first), newSlowFileServer(t, &total, &second)}
+		chdir(t, t.TempDir())
+		opts := newTestOptions(t, test.args...)
+
+		var sources []string
+		for i := 0; i < 6; i++ {
+			sources = append(sources, "tcp://"+servers[i%2].addr()+"/f"+strconv.Itoa(i))
+		}
+		results, err := runBatch(opts, sources, nil, opts.log)
+		if err != nil || statuses(results) != strings.TrimSpace(strings.Repeat("downloaded ", 6)) {
+			t.Fatalf("%v: batch returned %v with %s", test.args, err, statuses(results))
+		}
+		if total.peak() != test.wantTotal || first.peak() != test.wantEach || second.peak() != test.wantEach {
+			t.Errorf("%v: %d transfers at once, %d and %d per server; want %d and %d", test.args, total.peak(), first.peak(), second.peak(), test.wantTotal, test.wantEach)
+		}
+	}
+}
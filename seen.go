@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSeenFilename = "tcp-client.seen"
+
+var errSeen = errors.New("already downloaded")
+
+// seenRecord is one successfully downloaded file. Records are keyed by the
+// source they came from, so a file still counts as seen after it has been
+// moved away locally.
+type seenRecord struct {
+	Source string    `json:"source"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// seenDB is an append-only JSON lines file of seenRecords; later records for
+// a source replace earlier ones when it is loaded.
+type seenDB struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]seenRecord
+}
+
+func openSeenDB(path string) (*seenDB, error) {
+	db := &seenDB{path: path, records: map[string]seenRecord{}}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error opening seen database: %w", err)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening seen database: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record seenRecord
+		// A torn last line from an interrupted run is ignored.
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil && record.Source != "" {
+			db.records[record.Source] = record
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading seen database: %w", err)
+	}
+	return db, nil
+}
+
+func (db *seenDB) add(record seenRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(db.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening seen database: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing seen database: %w", err)
+	}
+	db.records[record.Source] = record
+	return nil
+}
+
+// seen reports whether source was downloaded before. When the server's
+// listing describes the file, a changed size or hash means it is new again.
+func (db *seenDB) seen(source string, remote *listEntry) (seenRecord, bool) {
+	db.mu.Lock()
+	record, ok := db.records[source]
+	db.mu.Unlock()
+	if !ok || remote == nil {
+		return record, ok
+	}
+	if remote.Size != record.Size {
+		return record, false
+	}
+	if remote.SHA256 != "" && !strings.EqualFold(remote.SHA256, record.SHA256) {
+		return record, false
+	}
+	return record, true
+}
+
+// remoteEntry looks a tcp source up in its server's listing, which is
+// fetched once per server. Servers that can't list simply yield nothing.
+func (o *options) remoteEntry(source string) *listEntry {
+	u, err := parseTCPURL(source)
+	if err != nil {
+		return nil
+	}
+
+	o.listingsMu.Lock()
+	defer o.listingsMu.Unlock()
+	if o.listings == nil {
+		o.listings = map[string]map[string]listEntry{}
+	}
+	listing, ok := o.listings[u.Host]
+	if !ok {
+		listing = map[string]listEntry{}
+		if entries, err := o.list(u.Host, &listFilter{xattrs: o.preserve.enabled()}); err == nil {
+			for _, entry := range entries {
+				listing[entry.Name] = entry
+			}
+		}
+		o.listings[u.Host] = listing
+	}
+
+	if entry, ok := listing[strings.TrimPrefix(u.Path, "/")]; ok {
+		return &entry
+	}
+	return nil
+}
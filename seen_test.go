@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSeenDBDefaultsToStateDir(t *testing.T) {
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	path := statePath(DefaultSeenFilename)
+	if want := filepath.Join(state, "tcp-file-client", DefaultSeenFilename); path != want {
+		t.Fatalf("seen database at %s, want %s", path, want)
+	}
+
+	// The directory doesn't exist until the database is first opened.
+	db, err := openSeenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.add(seenRecord{Source: "tcp://files:8000/a.txt", Name: "a.txt", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openSeenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.seen("tcp://files:8000/a.txt", nil); !ok {
+		t.Error("a.txt not recorded as seen")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	"tcpFileClient/wirepb"
+)
+
+// fakeServer accepts connections on a loopback port and passes each, in
+// its own goroutine, to handle along with its number, counting from 0.
+type fakeServer struct {
+	ln     net.Listener
+	handle func(n int, conn net.Conn, r *bufio.Reader)
+
+	mu    sync.Mutex
+	conns int
+	wg    sync.WaitGroup
+}
+
+func newFakeServer(t testing.TB, handle func(n int, conn net.Conn, r *bufio.Reader)) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, handle: handle}
+	go s.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		n := s.conns
+		s.conns++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(n, conn, bufio.NewReader(conn))
+		}()
+	}
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// readRequest reads one text request line, reporting false if the client
+// hung up.
+func readRequest(r *bufio.Reader) (string, bool) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// serveHello answers the client's HELLO with capabilities and, if they
+// include proto, switches the connection to the protobuf wire mode when
+// the client asks to. It returns the first request that follows, or false
+// if the client hung up.
+func serveHello(r *bufio.Reader, conn net.Conn, capabilities ...string) (string, bool) {
+	if line, ok := readRequest(r); !ok || !strings.HasPrefix(line, "HELLO ") {
+		return "", false
+	}
+	conn.Write([]byte("OK tcp-file-server/1 " + strings.Join(capabilities, " ") + "\n"))
+	line, ok := readRequest(r)
+	if ok && line == "PROTO 1" {
+		conn.Write([]byte("OK\n"))
+		protodelim.MarshalTo(conn, &wirepb.Hello{Version: "tcp-file-server/1", Capabilities: capabilities})
+		return "", true
+	}
+	return line, ok
+}
+
+// newTestOptions returns options with the flags' defaults, then args
+// applied, logging to the test.
+func newTestOptions(t testing.TB, args ...string) *options {
+	t.Helper()
+	var o options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.registerFlags(fs)
+	defaults := []string{"-history-db", "", "-log-file", "", "-keychain=false", "-netrc=false"}
+	if err := fs.Parse(append(defaults, args...)); err != nil {
+		t.Fatal(err)
+	}
+	o.log = &leveledLogger{out: log.New(testLogWriter{t}, "", 0), level: levelDebug}
+	o.totalLimiter = newRateLimiter(int64(o.limitRateTotal))
+	return &o
+}
+
+type testLogWriter struct {
+	t testing.TB
+}
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func runService(opts *options, globals, args []string, logger *leveledLogger) error {
+	return errors.New("services are only available on Windows; use daemon with systemd or another supervisor")
+}
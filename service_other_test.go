@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "testing"
+
+func TestServiceOnlyOnWindows(t *testing.T) {
+	opts := newTestOptions(t)
+	for _, command := range []string{"install", "uninstall", "run"} {
+		if err := runService(opts, nil, []string{command}, opts.log); err == nil {
+			t.Errorf("service %s succeeded", command)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const DefaultServiceName = "tcp-file-client"
+
+// stopCheckpoint is how often the service tells the service manager it is
+// still stopping while running jobs finish, so it isn't killed.
+const stopCheckpoint = 5 * time.Second
+
+// runService implements the service subcommand:
+//
+//	service install [-name name] [-- daemon flags]
+//	service uninstall [-name name]
+//	service run [-name name] [-- daemon flags]
+//
+// install registers the daemon as an automatically started Windows service
+// that runs with the global flags given before "service" and the daemon
+// flags given after "--", in the current directory; run is what the
+// service manager starts.
+func runService(opts *options, globals, args []string, logger *leveledLogger) error {
+	if len(args) == 0 {
+		return errors.New("usage: service install|uninstall|run [-name name] [-- daemon flags]")
+	}
+	var name, dir string
+	fs := newCommandFlags("service")
+	fs.StringVar(&name, "name", DefaultServiceName, "service `name`")
+	fs.StringVar(&dir, "dir", "", "working `directory` of the service; install sets it to the current directory")
+	fs.Parse(args[1:])
+	daemonArgs := fs.Args()
+
+	switch args[0] {
+	case "install":
+		return installService(name, globals, daemonArgs)
+	case "uninstall":
+		return uninstallService(name)
+	case "run":
+		isService, err := svc.IsWindowsService()
+		if err != nil {
+			return fmt.Errorf("error checking for the service manager: %w", err)
+		}
+		if !isService {
+			return errors.New("service run is started by the service manager; use daemon to run in the foreground")
+		}
+		if dir != "" {
+			if err := os.Chdir(dir); err != nil {
+				return fmt.Errorf("error changing to service directory: %w", err)
+			}
+		}
+		return svc.Run(name, &windowsService{opts: opts, args: daemonArgs, logger: logger})
+	}
+	return fmt.Errorf("unknown service command %q", args[0])
+}
+
+func installService(name string, globals, daemonArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding executable: %w", err)
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return fmt.Errorf("error finding executable: %w", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("error finding current directory: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	args := append(append([]string{}, globals...), "service", "run", "-name", name, "-dir", dir, "--")
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "TCP File Client",
+		Description: "Runs downloads submitted over the tcp-file-client control API.",
+		StartType:   mgr.StartAutomatic,
+	}, append(args, daemonArgs...)...)
+	if err != nil {
+		return fmt.Errorf("error creating service: %w", err)
+	}
+	defer s.Close()
+	// Restart after a crash, as systemd's Restart=on-failure would.
+	restart := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("error setting service recovery actions: %w", err)
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("error opening service %s: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("error deleting service: %w", err)
+	}
+	return nil
+}
+
+// windowsService runs the daemon under the service manager, which asks it
+// to stop on Stop and at system shutdown. As with SIGTERM, queued jobs are
+// dropped and the running ones are finished first.
+type windowsService struct {
+	opts   *options
+	args   []string
+	logger *leveledLogger
+}
+
+func (w *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serveDaemon(w.opts, w.args, w.logger, stop, func() {
+			status <- svc.Status{State: svc.Running, Accepts: accepts}
+		})
+	}()
+
+	var checkpoint <-chan time.Time
+	stopping := svc.Status{State: svc.StopPending, WaitHint: uint32((2 * stopCheckpoint).Milliseconds())}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				w.logger.Errorf("error running daemon: %v", err)
+				return false, 1
+			}
+			return false, 0
+		case <-checkpoint:
+			stopping.CheckPoint++
+			status <- stopping
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if checkpoint == nil {
+					status <- stopping
+					stop <- syscall.SIGTERM
+					ticker := time.NewTicker(stopCheckpoint)
+					defer ticker.Stop()
+					checkpoint = ticker.C
+				}
+			}
+		}
+	}
+}
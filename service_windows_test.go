@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestServiceRunsAndStopsDaemon(t *testing.T) {
+	opts := newTestOptions(t)
+	dir := t.TempDir()
+	w := &windowsService{opts: opts, logger: opts.log, args: []string{"-listen", "127.0.0.1:0", "-token-file", filepath.Join(dir, "token"), "-root", dir}}
+	requests := make(chan svc.ChangeRequest)
+	status := make(chan svc.Status, 16)
+	exited := make(chan uint32, 1)
+	go func() {
+		_, code := w.Execute(nil, requests, status)
+		exited <- code
+	}()
+
+	next := func() svc.State {
+		select {
+		case s := <-status:
+			return s.State
+		case <-time.After(10 * time.Second):
+			t.Fatal("no status from the service")
+		}
+		return 0
+	}
+	if s := next(); s != svc.StartPending {
+		t.Fatalf("first state %d, want start pending", s)
+	}
+	if s := next(); s != svc.Running {
+		t.Fatalf("second state %d, want running", s)
+	}
+	requests <- svc.ChangeRequest{Cmd: svc.Stop}
+	if s := next(); s != svc.StopPending {
+		t.Errorf("state %d after stop, want stop pending", s)
+	}
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("service exited with %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("service didn't stop")
+	}
+}
+
+func TestServiceRunOutsideServiceManager(t *testing.T) {
+	opts := newTestOptions(t)
+	if err := runService(opts, nil, []string{"run"}, opts.log); err == nil {
+		t.Error("service run succeeded outside the service manager")
+	}
+	if err := runService(opts, nil, nil, opts.log); err == nil {
+		t.Error("service without a command succeeded")
+	}
+}
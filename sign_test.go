@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkSignature does what a server does with a signed request line:
+// checks the HMAC and the timestamp, refuses a nonce it has seen, and
+// returns the request without the three fields.
+func checkSignature(token, line string, seen map[string]bool) (string, error) {
+	signed, sig, ok := strings.Cut(line, " sig=")
+	if !ok {
+		return "", errors.New("no signature")
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(signed))
+	if want := hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", errors.New("bad signature")
+	}
+	rest, nonce, ok := strings.Cut(signed, " nonce=")
+	request, ts, ok2 := strings.Cut(rest, " ts=")
+	if !ok || !ok2 || len(nonce) != 16 {
+		return "", fmt.Errorf("malformed signed fields in %q", signed)
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)).Abs() > time.Minute {
+		return "", fmt.Errorf("timestamp %s outside the window", ts)
+	}
+	if seen[nonce] {
+		return "", fmt.Errorf("nonce %s replayed", nonce)
+	}
+	seen[nonce] = true
+	return request, nil
+}
+
+func TestSignedRequests(t *testing.T) {
+	server := newTokenServer(t, "s3cret")
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-token", "s3cret", "-sign-requests")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + server.addr() + "/b.txt"}, nil, opts.log)
+	if err != nil || statuses(results) != "downloaded downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	if err := runRemove(opts, []string{"tcp://" + server.addr() + "/c.txt"}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.list(server.addr(), &listFilter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	var requests []string
+	for _, line := range server.served() {
+		request, err := checkSignature("s3cret", strings.TrimPrefix(line, "s3cret "), seen)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		requests = append(requests, request)
+	}
+	sort.Strings(requests)
+	if got, want := strings.Join(requests, ", "), "GET a.txt, GET b.txt, LIST, RM c.txt"; got != want {
+		t.Errorf("signed requests %s, want %s", got, want)
+	}
+
+	// A request sent again is caught by its nonce.
+	line := strings.TrimPrefix(server.served()[0], "s3cret ")
+	if _, err := checkSignature("s3cret", line, seen); err == nil {
+		t.Error("a replayed request passed")
+	}
+	if _, err := checkSignature("wrong", line, map[string]bool{}); err == nil {
+		t.Error("a request signed with another token passed")
+	}
+}
+
+func TestSignRequestsNeedsToken(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-sign-requests", "-retry-on", "none")
+
+	results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if statuses(results) != "failed" || !strings.Contains(results[0].Error, errSignNoToken.Error()) {
+		t.Errorf("unsigned batch %s: %s", statuses(results), results[0].Error)
+	}
+	if log.String() != "" {
+		t.Errorf("server got %s unsigned", log.String())
+	}
+	if request, err := opts.signRequest(server.addr(), "GET a.txt"); !errors.Is(err, errSignNoToken) {
+		t.Errorf("signed %q, %v", request, err)
+	}
+
+	opts = newTestOptions(t, "-token", "s3cret")
+	if request, err := opts.signRequest(server.addr(), "GET a.txt"); err != nil || request != "GET a.txt" {
+		t.Errorf("without -sign-requests, sent %q, %v", request, err)
+	}
+}
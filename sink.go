@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const partialSuffix = ".part"
+
+// A sink is where a download is written. Nothing appears at the destination
+// until commit succeeds, and abort throws away what an attempt wrote.
+type sink interface {
+	io.Writer
+	commit() error
+	abort() error
+}
+
+var sinks = map[string]func(*options, *url.URL) (sink, error){
+	"s3":     newS3Sink,
+	"gs":     newGCSSink,
+	"azblob": newAzureSink,
+}
+
+// openSink opens the destination of a download. When resuming, it also
+// reports how many bytes of an earlier attempt the sink already holds.
+func (o *options) openSink(destination string) (sink, int64, error) {
+	open := o.openDestination
+	if o.split > 0 {
+		open = o.openSplitSink
+	}
+	out, offset, err := open(destination)
+	if err != nil || !o.encryptTo.enabled() {
+		return out, offset, err
+	}
+	out, err = o.encryptSink(out)
+	return out, 0, err
+}
+
+func (o *options) openDestination(destination string) (sink, int64, error) {
+	if !strings.Contains(destination, "://") {
+		return o.openFileSink(destination, true)
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid destination %s: %w", destination, err)
+	}
+	newSink, ok := sinks[u.Scheme]
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported destination scheme %q", u.Scheme)
+	}
+	s, err := newSink(o, u)
+	return s, 0, err
+}
+
+// fileSink writes to path.part and renames it into place on commit. Partial
+// files are only kept after a failure when -partial allows it and the data
+// is fit to be resumed.
+//
+// With -quarantine-first the partial file lives in the quarantine directory
+// instead, so nothing reaches the destination before every check has passed,
+// and files that fail are kept there for inspection.
+type fileSink struct {
+	*os.File
+	path          string
+	keepPartial   bool
+	quarantineDir string
+	backup        backupMode
+	// fsync makes commit flush the file and its directory, and nocache
+	// keeps the download out of the page cache; see Write.
+	fsync     bool
+	nocache   bool
+	unflushed int64
+}
+
+// openFileSink opens path.part, picking up where it ends with -continue.
+// Data that must not be resumed, such as a rejected mirror's, is opened with
+// resumable false and never kept.
+func (o *options) openFileSink(path string, resumable bool) (sink, int64, error) {
+	if info, err := os.Stat(path); err == nil && isSpecialFile(info.Mode()) {
+		return openSpecialSink(path)
+	}
+
+	path = longPath(path)
+	partial := longPath(path + partialSuffix)
+	quarantineDir := ""
+	if o.quarantineFirst {
+		quarantineDir = o.quarantine
+		if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+			return nil, 0, fmt.Errorf("error creating quarantine directory: %w", err)
+		}
+		partial = filepath.Join(quarantineDir, filepath.Base(path)+partialSuffix)
+	}
+
+	var offset int64
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resumable && o.resume {
+		if info, err := os.Stat(partial); err == nil && info.Mode().IsRegular() {
+			offset = info.Size()
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+	}
+
+	file, err := os.OpenFile(partial, flags, 0666)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating file: %w", err)
+	}
+	if err := o.setPermissions(file); err != nil {
+		file.Close()
+		if offset == 0 {
+			os.Remove(partial)
+		}
+		return nil, 0, err
+	}
+	return &fileSink{
+		File:          file,
+		path:          path,
+		keepPartial:   resumable && o.keepPartial(),
+		quarantineDir: quarantineDir,
+		backup:        o.backup,
+		fsync:         o.fsync,
+		nocache:       o.nocache,
+	}, offset, nil
+}
+
+func (s *fileSink) commit() error {
+	return s.commitVerified("")
+}
+
+// commitVerified commits the file, first reading it back from disk when
+// digest is set and failing with errChecksumMismatch if it doesn't hash to
+// digest. The partial file is flushed and dropped from the page cache
+// before it is read, so the check sees what the storage returns rather
+// than what was just written to memory.
+func (s *fileSink) commitVerified(digest string) error {
+	if s.fsync || s.nocache || digest != "" {
+		if err := s.flush(digest != ""); err != nil {
+			s.File.Close()
+			return err
+		}
+	}
+	if err := s.File.Close(); err != nil {
+		return fmt.Errorf("error closing file: %w", err)
+	}
+	if digest != "" {
+		sum, err := fileSHA256(s.File.Name())
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, digest) {
+			os.Remove(s.File.Name())
+			return fmt.Errorf("read back %s: %w", s.File.Name(), errChecksumMismatch)
+		}
+	}
+	if err := s.backup.backup(s.path); err != nil {
+		return err
+	}
+	err := os.Rename(s.File.Name(), s.path)
+	if err != nil && s.quarantineDir != "" {
+		// The quarantine directory may be on another filesystem.
+		err = moveFile(s.File.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	if s.fsync || digest != "" {
+		return syncDir(filepath.Dir(s.path))
+	}
+	return nil
+}
+
+func (s *fileSink) flush(dropCache bool) error {
+	var err error
+	if s.nocache || dropCache {
+		err = dropPageCache(s.File)
+	} else {
+		err = s.File.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSink) abort() error {
+	s.File.Close()
+	if s.keepPartial {
+		return nil
+	}
+	if s.quarantineDir != "" {
+		return s.quarantine(s.quarantineDir)
+	}
+	return os.Remove(s.File.Name())
+}
+
+// moveFile copies src next to dst and renames it into place, so dst only
+// ever appears complete, then removes src.
+func moveFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + partialSuffix
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// freeName returns path, or if a regular file is already there, the first
+// of "name (1).ext", "name (2).ext" and so on that is free, for -auto-rename.
+func freeName(path string) string {
+	if info, err := os.Lstat(path); err != nil || isSpecialFile(info.Mode()) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// isSpecialFile reports whether a destination is a named pipe or device,
+// which must be written in place rather than through a partial file.
+func isSpecialFile(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// specialSink streams into an existing FIFO or device node. Such files can't
+// be truncated, renamed or resumed, so commit and abort only close them.
+type specialSink struct {
+	*os.File
+}
+
+func openSpecialSink(path string) (*specialSink, int64, error) {
+	// Opening a FIFO blocks until a reader is waiting on the other end.
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening file: %w", err)
+	}
+	return &specialSink{File: file}, 0, nil
+}
+
+func (s *specialSink) commit() error {
+	if err := s.File.Close(); err != nil {
+		return fmt.Errorf("error closing file: %w", err)
+	}
+	return nil
+}
+
+func (s *specialSink) abort() error {
+	return s.File.Close()
+}
+
+const (
+	uploadAttempts     = 4
+	uploadInitialDelay = time.Second
+)
+
+// partUploader is implemented by object stores that take an upload in
+// parts. putPart receives part n (counted from 1) starting at offset; finish
+// receives whatever is left after the last full part and completes the object.
+type partUploader interface {
+	putPart(n int, offset int64, data []byte) error
+	finish(parts int, offset int64, rest []byte) error
+	abort() error
+}
+
+// partSink buffers a download into fixed-size parts for a partUploader, so
+// at most one part is held in memory and nothing is staged on local disk.
+type partSink struct {
+	uploader partUploader
+	partSize int
+
+	buffer bytes.Buffer
+	parts  int
+	offset int64
+}
+
+func newPartSink(uploader partUploader, partSize int) *partSink {
+	return &partSink{uploader: uploader, partSize: partSize}
+}
+
+func (s *partSink) Write(p []byte) (int, error) {
+	s.buffer.Write(p)
+	for s.buffer.Len() >= s.partSize {
+		part := s.buffer.Next(s.partSize)
+		if err := s.uploader.putPart(s.parts+1, s.offset, part); err != nil {
+			return 0, err
+		}
+		s.parts++
+		s.offset += int64(len(part))
+	}
+	return len(p), nil
+}
+
+func (s *partSink) commit() error {
+	return s.uploader.finish(s.parts, s.offset, s.buffer.Bytes())
+}
+
+func (s *partSink) abort() error {
+	return s.uploader.abort()
+}
+
+// transientError marks a failure that is worth retrying, such as a network
+// error or a 5xx or 429 reply from an object store.
+type transientError struct {
+	error
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+func checkUploadStatus(service string, response *http.Response, body []byte) error {
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	err := fmt.Errorf("%s returned %s: %s", service, response.Status, strings.TrimSpace(string(body)))
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		return transientError{err}
+	}
+	return err
+}
+
+// withRetries runs an upload step until it succeeds, fails permanently, or
+// runs out of attempts, backing off exponentially between tries.
+func withRetries(step func() error) error {
+	delay := uploadInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := step()
+		var transient transientError
+		if err == nil || attempt == uploadAttempts || !errors.As(err, &transient) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
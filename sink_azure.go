@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azurePartSize   = 8 << 20
+	azureAPIVersion = "2021-08-06"
+)
+
+// azureUploader streams a download into a block blob with Put Block and
+// commits it with Put Block List. The account comes from
+// AZURE_STORAGE_ACCOUNT and is authorised with AZURE_STORAGE_SAS_TOKEN or a
+// Shared Key in AZURE_STORAGE_KEY; AZURE_STORAGE_BLOB_ENDPOINT overrides the
+// service URL, for Azurite and sovereign clouds.
+type azureUploader struct {
+	client  *http.Client
+	blobURL *url.URL
+	account string
+	sas     url.Values
+	key     []byte
+
+	blocks []string
+}
+
+func newAzureSink(opts *options, u *url.URL) (sink, error) {
+	container, blob := u.Host, strings.TrimPrefix(u.Path, "/")
+	if container == "" || blob == "" {
+		return nil, fmt.Errorf("azure destination must look like azblob://container/blob")
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT must be set for azblob destinations")
+	}
+
+	a := &azureUploader{client: &http.Client{Timeout: 5 * time.Minute}, account: account}
+
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %w", err)
+		}
+		a.sas = values
+	} else if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %w", err)
+		}
+		a.key = decoded
+	} else {
+		return nil, errors.New("AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY must be set for azblob destinations")
+	}
+
+	endpoint := os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid azure blob endpoint %q", endpoint)
+	}
+	a.blobURL = base.JoinPath(container, blob)
+
+	return newPartSink(a, azurePartSize), nil
+}
+
+func (a *azureUploader) putPart(n int, offset int64, data []byte) error {
+	// Block IDs must all have the same length before encoding.
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", n)))
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	if err := a.do(http.MethodPut, query, nil, data); err != nil {
+		return fmt.Errorf("error uploading part %d: %w", n, err)
+	}
+	a.blocks = append(a.blocks, id)
+	return nil
+}
+
+func (a *azureUploader) finish(parts int, offset int64, rest []byte) error {
+	if len(rest) > 0 {
+		if err := a.putPart(parts+1, offset, rest); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: a.blocks})
+	if err != nil {
+		return fmt.Errorf("error encoding block list: %w", err)
+	}
+	return a.do(http.MethodPut, url.Values{"comp": {"blocklist"}}, http.Header{"Content-Type": {"application/xml"}}, body)
+}
+
+// abort has nothing to clean up: uncommitted blocks are discarded by the
+// service after a week.
+func (a *azureUploader) abort() error {
+	return nil
+}
+
+// do sends a request with retries. Put Block and Put Block List are both
+// idempotent, so every request may be retried.
+func (a *azureUploader) do(method string, query url.Values, header http.Header, body []byte) error {
+	return withRetries(func() error {
+		target := *a.blobURL
+		values := url.Values{}
+		for name, v := range query {
+			values[name] = v
+		}
+		for name, v := range a.sas {
+			values[name] = v
+		}
+		target.RawQuery = values.Encode()
+
+		request, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error creating azure request: %w", err)
+		}
+		for name, v := range header {
+			request.Header[name] = v
+		}
+		request.Header.Set("x-ms-version", azureAPIVersion)
+		request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		if a.key != nil {
+			request.Header.Set("Authorization", "SharedKey "+a.account+":"+a.sign(request, query, len(body)))
+		}
+
+		response, err := a.client.Do(request)
+		if err != nil {
+			return transientError{fmt.Errorf("error sending azure request: %w", err)}
+		}
+		defer response.Body.Close()
+
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return transientError{fmt.Errorf("error reading azure response: %w", err)}
+		}
+		return checkUploadStatus("azure", response, data)
+	})
+}
+
+// sign computes a Shared Key signature for the Blob service.
+func (a *azureUploader) sign(request *http.Request, query url.Values, length int) string {
+	contentLength := ""
+	if length > 0 {
+		contentLength = strconv.Itoa(length)
+	}
+
+	var headers []string
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			headers = append(headers, lower+":"+strings.TrimSpace(request.Header.Get(name)))
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + a.account + request.URL.EscapedPath()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		request.Method,
+		request.Header.Get("Content-Encoding"),
+		request.Header.Get("Content-Language"),
+		contentLength,
+		request.Header.Get("Content-MD5"),
+		request.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		request.Header.Get("If-Modified-Since"),
+		request.Header.Get("If-Match"),
+		request.Header.Get("If-None-Match"),
+		request.Header.Get("If-Unmodified-Since"),
+		request.Header.Get("Range"),
+		strings.Join(headers, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type azureRequest struct {
+	method, path, comp, blockID, sig, authorization string
+	body                                            []byte
+}
+
+func newAzureServer(t *testing.T) func() []azureRequest {
+	var mu sync.Mutex
+	var requests []azureRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := r.URL.Query()
+		mu.Lock()
+		requests = append(requests, azureRequest{r.Method, r.URL.Path, query.Get("comp"), query.Get("blockid"), query.Get("sig"), r.Header.Get("Authorization"), body})
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "account")
+	t.Setenv("AZURE_STORAGE_BLOB_ENDPOINT", server.URL)
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "")
+	t.Setenv("AZURE_STORAGE_KEY", "")
+	return func() []azureRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]azureRequest(nil), requests...)
+	}
+}
+
+func TestAzureSinkPutsBlocksAndBlockList(t *testing.T) {
+	requests := newAzureServer(t)
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2021&sig=abc")
+	out, _, err := newTestOptions(t).openDestination("azblob://container/dir/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), azurePartSize+10)
+	out.Write(data)
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("%d requests, want 2 blocks and a block list", len(got))
+	}
+	var uploaded []byte
+	var ids []string
+	for _, r := range got {
+		if r.method != http.MethodPut || r.path != "/container/dir/big.bin" || r.sig != "abc" {
+			t.Errorf("request %s %s sig=%q, want PUT /container/dir/big.bin sig=abc", r.method, r.path, r.sig)
+		}
+		if r.comp == "block" {
+			uploaded = append(uploaded, r.body...)
+			ids = append(ids, r.blockID)
+		}
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("uploaded %d bytes, want %d", len(uploaded), len(data))
+	}
+
+	var list struct {
+		Latest []string `xml:"Latest"`
+	}
+	if last := got[2]; last.comp != "blocklist" || xml.Unmarshal(last.body, &list) != nil {
+		t.Fatalf("last request comp=%s %s, want the block list", last.comp, last.body)
+	}
+	if strings.Join(list.Latest, " ") != strings.Join(ids, " ") {
+		t.Errorf("block list %v, want %v", list.Latest, ids)
+	}
+	if first, _ := base64.StdEncoding.DecodeString(ids[0]); string(first) != "block-000001" {
+		t.Errorf("first block id %q, want block-000001", first)
+	}
+}
+
+func TestAzureSinkSharedKey(t *testing.T) {
+	requests := newAzureServer(t)
+	t.Setenv("AZURE_STORAGE_KEY", base64.StdEncoding.EncodeToString([]byte("key")))
+	out, _, err := newTestOptions(t).openDestination("azblob://container/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(out, "hello")
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range requests() {
+		if !strings.HasPrefix(r.authorization, "SharedKey account:") {
+			t.Errorf("authorization %q, want a SharedKey for account", r.authorization)
+		}
+	}
+}
+
+func TestAzureSinkNeedsCredentials(t *testing.T) {
+	newAzureServer(t)
+	if _, _, err := newTestOptions(t).openDestination("azblob://container/file.txt"); err == nil {
+		t.Error("opened an azblob destination without credentials")
+	}
+}
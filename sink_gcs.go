@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable upload chunks must be a multiple of 256 KiB except for the last.
+const gcsChunkSize = 32 * 256 << 10
+
+const gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcsUploader streams a download into a Cloud Storage resumable upload. The
+// access token comes from GOOGLE_OAUTH_ACCESS_TOKEN or, on Google Cloud, the
+// metadata server; STORAGE_EMULATOR_HOST points the sink at an emulator.
+type gcsUploader struct {
+	client *http.Client
+	base   string
+	bucket string
+	object string
+	token  string
+
+	session string
+}
+
+func newGCSSink(opts *options, u *url.URL) (sink, error) {
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("gcs destination must look like gs://bucket/object")
+	}
+
+	g := &gcsUploader{
+		client: &http.Client{Timeout: 5 * time.Minute},
+		base:   "https://storage.googleapis.com",
+		bucket: bucket,
+		object: object,
+		token:  os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+	}
+
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		g.base = strings.TrimSuffix(emulator, "/")
+	} else if g.token == "" {
+		token, err := gcsMetadataToken(g.client)
+		if err != nil {
+			return nil, err
+		}
+		g.token = token
+	}
+	return newPartSink(g, gcsChunkSize), nil
+}
+
+func gcsMetadataToken(client *http.Client) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, gcsMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("GOOGLE_OAUTH_ACCESS_TOKEN is not set and the metadata server is unavailable: %w", err)
+	}
+	defer response.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("error reading access token from the metadata server: %s", response.Status)
+	}
+	return token.AccessToken, nil
+}
+
+func (g *gcsUploader) putPart(n int, offset int64, data []byte) error {
+	if err := g.sendChunk(offset, data, false); err != nil {
+		return fmt.Errorf("error uploading part %d: %w", n, err)
+	}
+	return nil
+}
+
+func (g *gcsUploader) finish(parts int, offset int64, rest []byte) error {
+	return g.sendChunk(offset, rest, true)
+}
+
+// abort cancels the upload session so nothing is left behind.
+func (g *gcsUploader) abort() error {
+	if g.session == "" {
+		return nil
+	}
+	response, err := g.do(http.MethodDelete, g.session, nil, nil)
+	if err != nil {
+		return err
+	}
+	// A cancelled session answers 499; there is nothing else to check.
+	response.Body.Close()
+	return nil
+}
+
+func (g *gcsUploader) start() error {
+	query := url.Values{"uploadType": {"resumable"}, "name": {g.object}}
+	target := g.base + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + query.Encode()
+
+	return withRetries(func() error {
+		response, err := g.do(http.MethodPost, target, nil, nil)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err := checkUploadStatus("gcs", response, body); err != nil {
+			return err
+		}
+
+		g.session = response.Header.Get("Location")
+		if g.session == "" {
+			return errors.New("error starting gcs upload: no session URI returned")
+		}
+		return nil
+	})
+}
+
+// sendChunk uploads data at offset. After a failure it asks the session how
+// much was persisted and resends only the remainder, as the resumable upload
+// protocol requires.
+func (g *gcsUploader) sendChunk(offset int64, data []byte, last bool) error {
+	if g.session == "" {
+		if err := g.start(); err != nil {
+			return err
+		}
+	}
+
+	total := "*"
+	if last {
+		total = strconv.FormatInt(offset+int64(len(data)), 10)
+	}
+
+	retrying := false
+	return withRetries(func() error {
+		sent := int64(0)
+		if retrying {
+			persisted, done, err := g.persisted(total)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+			if sent = persisted - offset; sent < 0 || sent > int64(len(data)) {
+				return fmt.Errorf("gcs session persisted %d bytes, outside the chunk at %d", persisted, offset)
+			}
+		}
+		retrying = true
+
+		remaining := data[sent:]
+		contentRange := "bytes */" + total
+		if len(remaining) > 0 {
+			start := offset + sent
+			contentRange = fmt.Sprintf("bytes %d-%d/%s", start, start+int64(len(remaining))-1, total)
+		}
+
+		response, err := g.do(http.MethodPut, g.session, http.Header{"Content-Range": {contentRange}}, remaining)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusPermanentRedirect && !last {
+			return nil
+		}
+		return checkUploadStatus("gcs", response, body)
+	})
+}
+
+// persisted queries the session for the number of bytes it has stored, and
+// whether the object is already complete.
+func (g *gcsUploader) persisted(total string) (int64, bool, error) {
+	response, err := g.do(http.MethodPut, g.session, http.Header{"Content-Range": {"bytes */" + total}}, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusPermanentRedirect {
+		return 0, true, checkUploadStatus("gcs", response, body)
+	}
+
+	// Range looks like "bytes=0-N" and is missing when nothing is stored.
+	stored := response.Header.Get("Range")
+	if stored == "" {
+		return 0, false, nil
+	}
+	_, end, _ := strings.Cut(stored, "-")
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid gcs range %q", stored)
+	}
+	return last + 1, false, nil
+}
+
+func (g *gcsUploader) do(method, target string, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcs request: %w", err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if g.token != "" {
+		request.Header.Set("Authorization", "Bearer "+g.token)
+	}
+
+	response, err := g.client.Do(request)
+	if err != nil {
+		return nil, transientError{fmt.Errorf("error sending gcs request: %w", err)}
+	}
+	return response, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gcsEmulator implements enough of the resumable upload protocol to accept
+// one object. With failFirst set it persists only half of the first chunk
+// and answers 503, as a dropped connection would.
+type gcsEmulator struct {
+	mu        sync.Mutex
+	failFirst bool
+	name      string
+	stored    []byte
+	ranges    []string
+	cancelled bool
+}
+
+func newGCSEmulator(t *testing.T, failFirst bool) *gcsEmulator {
+	g := &gcsEmulator{failFirst: failFirst}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+	return g
+}
+
+func (g *gcsEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		g.name = r.URL.Query().Get("name")
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+	case r.Method == http.MethodDelete && r.URL.Path == "/session":
+		g.cancelled = true
+		w.WriteHeader(499)
+	case r.Method == http.MethodPut && r.URL.Path == "/session":
+		contentRange := r.Header.Get("Content-Range")
+		g.ranges = append(g.ranges, contentRange)
+		span, total, _ := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "/")
+		if span != "*" {
+			start, _, _ := strings.Cut(span, "-")
+			if offset, _ := strconv.Atoi(start); offset != len(g.stored) {
+				http.Error(w, "wrong offset", http.StatusBadRequest)
+				return
+			}
+			if g.failFirst {
+				g.failFirst = false
+				g.stored = append(g.stored, body[:len(body)/2]...)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			g.stored = append(g.stored, body...)
+		}
+		if total != "*" && total == strconv.Itoa(len(g.stored)) {
+			return
+		}
+		if len(g.stored) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(g.stored)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGCSSinkSmallUpload(t *testing.T) {
+	g := newGCSEmulator(t, false)
+	out, _, err := newTestOptions(t).openDestination("gs://bucket/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(out, "hello")
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.name != "dir/file.txt" || string(g.stored) != "hello" {
+		t.Errorf("stored %q as %s, want \"hello\" as dir/file.txt", g.stored, g.name)
+	}
+	if got, want := strings.Join(g.ranges, ", "), "bytes 0-4/5"; got != want {
+		t.Errorf("ranges %s, want %s", got, want)
+	}
+}
+
+func TestGCSSinkResendsOnlyUnpersistedBytes(t *testing.T) {
+	g := newGCSEmulator(t, true)
+	out, _, err := newTestOptions(t).openDestination("gs://bucket/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, gcsChunkSize+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	out.Write(data)
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(g.stored, data) {
+		t.Errorf("stored %d bytes, want %d", len(g.stored), len(data))
+	}
+	half := gcsChunkSize / 2
+	want := []string{
+		fmt.Sprintf("bytes 0-%d/*", gcsChunkSize-1),
+		"bytes */*",
+		fmt.Sprintf("bytes %d-%d/*", half, gcsChunkSize-1),
+		fmt.Sprintf("bytes %d-%d/%d", gcsChunkSize, len(data)-1, len(data)),
+	}
+	if got := strings.Join(g.ranges, ", "); got != strings.Join(want, ", ") {
+		t.Errorf("ranges %s, want %s", got, strings.Join(want, ", "))
+	}
+}
+
+func TestGCSSinkAbortCancelsSession(t *testing.T) {
+	g := newGCSEmulator(t, false)
+	out, _, err := newTestOptions(t).openDestination("gs://bucket/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(make([]byte, gcsChunkSize))
+	if err := out.abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !g.cancelled {
+		t.Error("upload session was not cancelled")
+	}
+}
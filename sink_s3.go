@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parts must be at least 5 MiB except for the last one; 8 MiB keeps memory
+// use small while allowing objects of up to ~78 GiB in 10,000 parts.
+const s3PartSize = 8 << 20
+
+// s3Uploader streams a download into an S3 multipart upload. Downloads
+// smaller than a part are sent with a single PUT. Credentials and region come
+// from the usual AWS_* environment variables; AWS_ENDPOINT_URL selects an
+// S3-compatible service and path-style requests.
+type s3Uploader struct {
+	client *http.Client
+	signer awsSigner
+
+	scheme    string
+	host      string
+	bucket    string
+	key       string
+	pathStyle bool
+
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func newS3Sink(opts *options, u *url.URL) (sink, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3 destination must look like s3://bucket/key")
+	}
+
+	signer := awsSigner{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       getenvAny("AWS_REGION", "AWS_DEFAULT_REGION"),
+		service:      "s3",
+	}
+	if signer.accessKey == "" || signer.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 destinations")
+	}
+	if signer.region == "" {
+		signer.region = "us-east-1"
+	}
+
+	s := &s3Uploader{
+		client: &http.Client{Timeout: 5 * time.Minute},
+		signer: signer,
+		scheme: "https",
+		host:   "s3." + signer.region + ".amazonaws.com",
+		bucket: bucket,
+		key:    key,
+		// Virtual-hosted addressing breaks TLS for bucket names with dots.
+		pathStyle: strings.Contains(bucket, "."),
+	}
+
+	if endpoint := getenvAny("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+		}
+		s.scheme, s.host, s.pathStyle = e.Scheme, e.Host, true
+	}
+	return newPartSink(s, s3PartSize), nil
+}
+
+func (s *s3Uploader) putPart(n int, offset int64, data []byte) error {
+	if s.uploadID == "" {
+		response, err := s.do(http.MethodPost, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var created struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(response.body, &created); err != nil || created.UploadID == "" {
+			return fmt.Errorf("error starting s3 multipart upload: unexpected response")
+		}
+		s.uploadID = created.UploadID
+	}
+
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {s.uploadID}}
+	response, err := s.do(http.MethodPut, query, data)
+	if err != nil {
+		return fmt.Errorf("error uploading part %d: %w", n, err)
+	}
+
+	s.parts = append(s.parts, s3Part{PartNumber: n, ETag: response.header.Get("ETag")})
+	return nil
+}
+
+func (s *s3Uploader) finish(parts int, offset int64, rest []byte) error {
+	if s.uploadID == "" {
+		_, err := s.do(http.MethodPut, nil, rest)
+		return err
+	}
+
+	if len(rest) > 0 {
+		if err := s.putPart(parts+1, offset, rest); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: s.parts})
+	if err != nil {
+		return fmt.Errorf("error encoding upload parts: %w", err)
+	}
+
+	_, err = s.do(http.MethodPost, url.Values{"uploadId": {s.uploadID}}, body)
+	return err
+}
+
+func (s *s3Uploader) abort() error {
+	if s.uploadID == "" {
+		return nil
+	}
+	_, err := s.do(http.MethodDelete, url.Values{"uploadId": {s.uploadID}}, nil)
+	return err
+}
+
+type s3Response struct {
+	header http.Header
+	body   []byte
+}
+
+// do sends a request, retrying transient failures of the idempotent PUT and
+// DELETE requests. Creating and completing uploads is not retried.
+func (s *s3Uploader) do(method string, query url.Values, body []byte) (*s3Response, error) {
+	if method != http.MethodPut && method != http.MethodDelete {
+		return s.send(method, query, body)
+	}
+	var response *s3Response
+	err := withRetries(func() (err error) {
+		response, err = s.send(method, query, body)
+		return err
+	})
+	return response, err
+}
+
+func (s *s3Uploader) send(method string, query url.Values, body []byte) (*s3Response, error) {
+	host, path := s.bucket+"."+s.host, "/"+s.key
+	if s.pathStyle {
+		host, path = s.host, "/"+s.bucket+"/"+s.key
+	}
+
+	canonicalPath := awsEscape(path, false)
+	canonicalQuery := awsCanonicalQuery(query)
+	target := s.scheme + "://" + host + canonicalPath
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating s3 request: %w", err)
+	}
+	s.signer.sign(request, canonicalPath, canonicalQuery, body, time.Now())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, transientError{fmt.Errorf("error sending s3 request: %w", err)}
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, transientError{fmt.Errorf("error reading s3 response: %w", err)}
+	}
+
+	// CompleteMultipartUpload can fail with a 200 status and an error body.
+	if response.StatusCode/100 != 2 || bytes.Contains(data, []byte("<Error>")) {
+		var failure struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.Unmarshal(data, &failure)
+		err := fmt.Errorf("s3 returned %s: %s %s", response.Status, failure.Code, failure.Message)
+		if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+			return nil, transientError{err}
+		}
+		return nil, err
+	}
+
+	return &s3Response{header: response.Header, body: data}, nil
+}
+
+// awsSigner implements AWS Signature Version 4 for requests whose body is
+// fully in memory.
+type awsSigner struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	service      string
+}
+
+func (a awsSigner) sign(request *http.Request, canonicalPath, canonicalQuery string, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+
+	request.Header.Set("X-Amz-Date", timestamp)
+	request.Header.Set("X-Amz-Content-Sha256", payload)
+	if a.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(request.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method, canonicalPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, payload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + a.region + "/" + a.service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, keeping
+// slashes unless encodeSlash is set, as SigV4 canonicalization requires.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
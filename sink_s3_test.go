@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type s3Request struct {
+	method, path, query, authorization string
+	body                               []byte
+}
+
+func newS3Server(t *testing.T) (*httptest.Server, func() []s3Request) {
+	var mu sync.Mutex
+	var requests []s3Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, s3Request{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), body})
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Has("uploads"):
+			w.Write([]byte("<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>"))
+		case r.Method == http.MethodPut && r.URL.Query().Has("partNumber"):
+			w.Header().Set("ETag", `"etag-`+r.URL.Query().Get("partNumber")+`"`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	return server, func() []s3Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]s3Request(nil), requests...)
+	}
+}
+
+func openS3Sink(t *testing.T, destination string) sink {
+	opts := newTestOptions(t)
+	out, _, err := opts.openDestination(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestS3SinkSmallUploadIsOnePut(t *testing.T) {
+	_, requests := newS3Server(t)
+	out := openS3Sink(t, "s3://bucket/dir/file.txt")
+	io.WriteString(out, "hello")
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("%d requests, want 1", len(got))
+	}
+	r := got[0]
+	if r.method != http.MethodPut || r.path != "/bucket/dir/file.txt" || string(r.body) != "hello" {
+		t.Errorf("got %s %s %q, want PUT /bucket/dir/file.txt \"hello\"", r.method, r.path, r.body)
+	}
+	if !strings.HasPrefix(r.authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(r.authorization, "/us-east-1/s3/aws4_request") {
+		t.Errorf("authorization %q", r.authorization)
+	}
+}
+
+func TestS3SinkMultipartUpload(t *testing.T) {
+	_, requests := newS3Server(t)
+	out := openS3Sink(t, "s3://bucket/big.bin")
+	data := bytes.Repeat([]byte("x"), s3PartSize+10)
+	out.Write(data)
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	var uploaded []byte
+	got := requests()
+	for _, r := range got {
+		methods = append(methods, r.method)
+		if r.method == http.MethodPut {
+			uploaded = append(uploaded, r.body...)
+		}
+	}
+	if got, want := strings.Join(methods, " "), "POST PUT PUT POST"; got != want {
+		t.Fatalf("requests %s, want %s", got, want)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("uploaded %d bytes, want %d", len(uploaded), len(data))
+	}
+	complete := got[len(got)-1]
+	if query, _ := url.ParseQuery(complete.query); query.Get("uploadId") != "upload-1" {
+		t.Errorf("completed %q, want uploadId upload-1", complete.query)
+	}
+	if !bytes.Contains(complete.body, []byte(`<PartNumber>2</PartNumber><ETag>&#34;etag-2&#34;</ETag>`)) {
+		t.Errorf("complete body %s lacks part 2", complete.body)
+	}
+}
+
+func TestS3SinkAbortDeletesUpload(t *testing.T) {
+	_, requests := newS3Server(t)
+	out := openS3Sink(t, "s3://bucket/big.bin")
+	out.Write(make([]byte, s3PartSize))
+	if err := out.abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	last := got[len(got)-1]
+	if last.method != http.MethodDelete || last.query != "uploadId=upload-1" {
+		t.Errorf("last request %s ?%s, want DELETE ?uploadId=upload-1", last.method, last.query)
+	}
+}
+
+func TestS3SinkNeedsCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	opts := newTestOptions(t)
+	if _, _, err := opts.openDestination("s3://bucket/key"); err == nil || !strings.Contains(err.Error(), "AWS_ACCESS_KEY_ID") {
+		t.Errorf("error %v, want missing credentials", err)
+	}
+}
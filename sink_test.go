@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineFirstStagesDownloads(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	quarantine := filepath.Join(dir, "quarantine")
+	opts := newTestOptions(t, "-quarantine", quarantine, "-quarantine-first")
+
+	out, _, err := opts.openFileSink("a.txt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := out.(*fileSink).File.Name()
+	if filepath.Dir(staged) != quarantine {
+		t.Errorf("staged in %s, want %s", staged, quarantine)
+	}
+	out.Write([]byte("hello"))
+	if _, err := os.Stat("a.txt" + partialSuffix); err == nil {
+		t.Error("a partial file appeared next to the destination")
+	}
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile("a.txt"); string(data) != "hello" {
+		t.Errorf("destination holds %q, want %q", data, "hello")
+	}
+	if _, err := os.Stat(staged); err == nil {
+		t.Error("the staged file is still in quarantine")
+	}
+}
+
+func TestQuarantineFirstKeepsRejectedFiles(t *testing.T) {
+	server := newFileServer(t)
+	clamd := newFakeClamd(t)
+	dir := t.TempDir()
+	chdir(t, dir)
+	quarantine := filepath.Join(dir, "quarantine")
+	opts := newTestOptions(t, "-quarantine", quarantine, "-quarantine-first", "-clamd", clamd, "-retry-on", "none")
+
+	results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/clean.txt", "tcp://" + server.addr() + "/EICAR.txt"}, nil, opts.log)
+	if got, want := statuses(results), "downloaded failed"; got != want {
+		t.Fatalf("statuses %q, want %q", got, want)
+	}
+	if _, err := os.Stat("EICAR.txt"); err == nil {
+		t.Error("the infected file reached its destination")
+	}
+	kept, _ := filepath.Glob(filepath.Join(quarantine, "*"))
+	if len(kept) != 1 || !strings.HasPrefix(filepath.Base(kept[0]), "EICAR.txt.") {
+		t.Fatalf("quarantine holds %v, want only the infected file", kept)
+	}
+	if data, _ := os.ReadFile(kept[0]); string(data) != "contents of EICAR.txt" {
+		t.Errorf("quarantined %q", data)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "hello" {
+		t.Errorf("moved %q, want %q", data, "hello")
+	}
+	for _, gone := range []string{src, dst + partialSuffix} {
+		if _, err := os.Stat(gone); err == nil {
+			t.Errorf("%s left behind", gone)
+		}
+	}
+}
+
+func TestAutoRename(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	for _, name := range []string{"a.txt", "a (1).txt", "README"} {
+		if err := os.WriteFile(name, []byte("mine"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := newTestOptions(t, "-auto-rename")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt", "tcp://" + server.addr() + "/README", "tcp://" + server.addr() + "/b.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"a (2).txt", "README (1)", "b.txt"} {
+		if results[i].Destination != want {
+			t.Errorf("saved to %s, want %s", results[i].Destination, want)
+		}
+		if data, _ := os.ReadFile(want); !strings.HasPrefix(string(data), "contents of ") {
+			t.Errorf("%s has %q", want, data)
+		}
+	}
+	for _, name := range []string{"a.txt", "a (1).txt", "README"} {
+		if data, _ := os.ReadFile(name); string(data) != "mine" {
+			t.Errorf("%s was replaced with %q", name, data)
+		}
+	}
+}
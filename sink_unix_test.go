@@ -0,0 +1,71 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDownloadIntoFIFO(t *testing.T) {
+	server := newFileServer(t)
+	dir := t.TempDir()
+	chdir(t, dir)
+	if err := syscall.Mkfifo("a.txt", 0600); err != nil {
+		t.Skip("can't create a FIFO:", err)
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		fifo, err := os.Open("a.txt")
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer fifo.Close()
+		data, _ := io.ReadAll(fifo)
+		received <- string(data)
+	}()
+
+	opts := newTestOptions(t)
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(results), "downloaded"; got != want {
+		t.Errorf("statuses %q, want %q", got, want)
+	}
+	if got, want := <-received, "contents of a.txt"; got != want {
+		t.Errorf("FIFO reader got %q, want %q", got, want)
+	}
+
+	info, err := os.Lstat("a.txt")
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("destination replaced: %v %v", info.Mode(), err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix)); len(leftovers) != 0 {
+		t.Errorf("partial files created: %v", leftovers)
+	}
+}
+
+func TestOpenSinkWritesDevicesInPlace(t *testing.T) {
+	out, offset, err := newTestOptions(t, "-continue").openFileSink(os.DevNull, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out.(*specialSink); !ok || offset != 0 {
+		t.Fatalf("opened %T at %d, want a specialSink at 0", out, offset)
+	}
+	if _, err := io.WriteString(out, "discarded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(os.DevNull + partialSuffix); err == nil {
+		t.Errorf("%s%s was created", os.DevNull, partialSuffix)
+	}
+}
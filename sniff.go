@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// sniffLength covers every signature below; tar's is the furthest in.
+const sniffLength = 512
+
+var errContentRejected = errors.New("content rejected")
+
+var contentSignatures = []struct {
+	kind   string
+	offset int
+	magic  []byte
+}{
+	{"gzip", 0, []byte{0x1f, 0x8b}},
+	{"bzip2", 0, []byte("BZh")},
+	{"xz", 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", 0, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"zip", 0, []byte("PK\x03\x04")},
+	{"zip", 0, []byte("PK\x05\x06")},
+	{"tar", 257, []byte("ustar")},
+	{"parquet", 0, []byte("PAR1")},
+	{"pdf", 0, []byte("%PDF-")},
+	{"png", 0, []byte("\x89PNG\r\n\x1a\n")},
+	{"jpeg", 0, []byte{0xff, 0xd8, 0xff}},
+	{"gif", 0, []byte("GIF8")},
+	{"executable", 0, []byte("\x7fELF")},
+	{"executable", 0, []byte("MZ")},
+	{"executable", 0, []byte{0xfe, 0xed, 0xfa, 0xce}},
+	{"executable", 0, []byte{0xfe, 0xed, 0xfa, 0xcf}},
+	{"executable", 0, []byte{0xce, 0xfa, 0xed, 0xfe}},
+	{"executable", 0, []byte{0xcf, 0xfa, 0xed, 0xfe}},
+	{"executable", 0, []byte{0xca, 0xfe, 0xba, 0xbe}},
+	{"executable", 0, []byte("#!")},
+}
+
+// contentKinds classifies the first bytes of a file. A file can have several
+// kinds: a CSV file is also text, and a shell script is text and executable.
+func contentKinds(head []byte) []string {
+	var kinds []string
+	for _, sig := range contentSignatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			kinds = append(kinds, sig.kind)
+		}
+	}
+
+	if len(head) > 0 && isText(head) {
+		kinds = append(kinds, "text")
+		trimmed := bytes.TrimLeft(head, " \t\r\n")
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			kinds = append(kinds, "json")
+		}
+		firstLine, _, _ := bytes.Cut(head, []byte("\n"))
+		if bytes.ContainsAny(firstLine, ",;\t") {
+			kinds = append(kinds, "csv")
+		}
+	}
+	if len(head) == 0 {
+		kinds = append(kinds, "empty")
+	}
+	return kinds
+}
+
+// isText accepts UTF-8 without NUL bytes, allowing for a multi-byte rune cut
+// off at the end of the sniffed window.
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size <= 1 {
+			return len(head) < utf8.UTFMax && !utf8.FullRune(head)
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// contentPolicy holds the -accept-types and -reject-types lists.
+type contentPolicy struct {
+	accept []string
+	reject []string
+}
+
+func (p *contentPolicy) enabled() bool {
+	return len(p.accept) > 0 || len(p.reject) > 0
+}
+
+// knownKinds lists every kind contentKinds can return.
+func knownKinds() []string {
+	var kinds []string
+	for _, sig := range contentSignatures {
+		if !containsString(kinds, sig.kind) {
+			kinds = append(kinds, sig.kind)
+		}
+	}
+	return append(kinds, "text", "json", "csv", "empty")
+}
+
+// typeListAdder rejects kinds contentKinds never returns, which would
+// otherwise be accepted and match nothing.
+func typeListAdder(list *[]string) func(string) error {
+	return func(value string) error {
+		known := knownKinds()
+		for _, kind := range strings.Split(value, ",") {
+			kind = strings.TrimSpace(strings.ToLower(kind))
+			if kind == "" {
+				continue
+			}
+			if !containsString(known, kind) {
+				return fmt.Errorf("unknown file type %q: use %s", kind, strings.Join(known, ", "))
+			}
+			*list = append(*list, kind)
+		}
+		return nil
+	}
+}
+
+func (p *contentPolicy) check(head []byte) error {
+	kinds := contentKinds(head)
+	for _, kind := range kinds {
+		if containsString(p.reject, kind) {
+			return fmt.Errorf("%s file: %w", kind, errContentRejected)
+		}
+	}
+	if len(p.accept) == 0 {
+		return nil
+	}
+	for _, kind := range kinds {
+		if containsString(p.accept, kind) {
+			return nil
+		}
+	}
+	if len(kinds) == 0 {
+		return fmt.Errorf("unrecognised file type: %w", errContentRejected)
+	}
+	return fmt.Errorf("%s file: %w", strings.Join(kinds, "/"), errContentRejected)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// contentSniffer collects the start of a transfer and applies the content
+// policy as soon as enough of it has arrived.
+type contentSniffer struct {
+	policy *contentPolicy
+	head   []byte
+	done   bool
+}
+
+func (s *contentSniffer) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+	if room := sniffLength - len(s.head); len(p) > room {
+		s.head = append(s.head, p[:room]...)
+	} else {
+		s.head = append(s.head, p...)
+	}
+	if len(s.head) == sniffLength {
+		return len(p), s.finish()
+	}
+	return len(p), nil
+}
+
+// finish checks files shorter than the sniffing window.
+func (s *contentSniffer) finish() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	return s.policy.check(s.head)
+}
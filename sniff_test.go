@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTypeListRejectsUnknownKinds(t *testing.T) {
+	var list []string
+	add := typeListAdder(&list)
+	if err := add("Executable, gzip"); err != nil {
+		t.Fatal(err)
+	}
+	err := add("exe")
+	if err == nil || !strings.Contains(err.Error(), "executable") {
+		t.Errorf("adding exe returned %v, want an error listing the kinds", err)
+	}
+	if got, want := strings.Join(list, ","), "executable,gzip"; got != want {
+		t.Errorf("list %q, want %q", got, want)
+	}
+}
+
+func TestKnownKindsCoverContentKinds(t *testing.T) {
+	known := knownKinds()
+	for _, head := range []string{"", "plain text", "a,b\n1,2\n", "{}", "#!/bin/sh\n", "\x1f\x8b", "%PDF-1.7"} {
+		for _, kind := range contentKinds([]byte(head)) {
+			if !containsString(known, kind) {
+				t.Errorf("%q sniffs as %s, which isn't a known kind", head, kind)
+			}
+		}
+	}
+}
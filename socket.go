@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketOptions tune the TCP connections the client opens: to the server, or
+// to the proxy or SSH host in front of it.
+type socketOptions struct {
+	noDelay    bool
+	recvBuffer byteSize
+	sendBuffer byteSize
+	dscp       int
+}
+
+// dscpNames are the standard DSCP code points (RFC 2474, 2597, 3246, 8622).
+var dscpNames = map[string]int{
+	"le": 1, "ef": 46,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+}
+
+func parseDSCP(value string) (int, error) {
+	if n, ok := dscpNames[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("invalid DSCP value %q: use 0-63 or a name such as cs1, af21 or ef", value)
+	}
+	return n, nil
+}
+
+func (s *socketOptions) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&s.noDelay, "tcp-nodelay", true, "send small writes immediately instead of coalescing them (disables Nagle's algorithm)")
+	fs.Var(&s.recvBuffer, "rcvbuf", "socket receive buffer `size` (SO_RCVBUF), such as 4M for links with a high bandwidth-delay product; defaults to the OS setting")
+	fs.Var(&s.sendBuffer, "sndbuf", "socket send buffer `size` (SO_SNDBUF); defaults to the OS setting")
+
+	s.dscp = -1
+	fs.Func("dscp", "mark outgoing packets with this DSCP `class`, 0-63 or a name such as cs1 or le for low-priority bulk traffic, or ef", func(value string) error {
+		n, err := parseDSCP(value)
+		s.dscp = n
+		return err
+	})
+}
+
+// control sets the buffer sizes and traffic class before the socket
+// connects, so the receive buffer is taken into account when the TCP window
+// scale is negotiated and even the SYN carries the DSCP mark.
+func (s *socketOptions) control(network, address string, c syscall.RawConn) error {
+	if s.recvBuffer == 0 && s.sendBuffer == 0 && s.dscp < 0 {
+		return nil
+	}
+
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if s.recvBuffer > 0 {
+			if err = setSocketInt(fd, sockRecvBuffer, int(s.recvBuffer)); err != nil {
+				err = fmt.Errorf("error setting receive buffer: %w", err)
+				return
+			}
+		}
+		if s.sendBuffer > 0 {
+			if err = setSocketInt(fd, sockSendBuffer, int(s.sendBuffer)); err != nil {
+				err = fmt.Errorf("error setting send buffer: %w", err)
+				return
+			}
+		}
+		if s.dscp >= 0 {
+			// DSCP is the upper six bits of the IPv4 TOS or IPv6 traffic
+			// class byte; the rest belongs to ECN.
+			if err = setTrafficClass(fd, strings.HasSuffix(network, "6"), s.dscp<<2); err != nil {
+				err = fmt.Errorf("error setting DSCP: %w", err)
+			}
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// apply sets the options that only take effect once connected. Go enables
+// TCP_NODELAY itself after connecting, so it can't be changed in control.
+func (s *socketOptions) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(s.noDelay); err != nil {
+		return fmt.Errorf("error setting TCP_NODELAY: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+const (
+	sockRecvBuffer = iota
+	sockSendBuffer
+)
+
+func setSocketInt(fd uintptr, opt, value int) error {
+	return errors.New("socket options are not supported on this platform")
+}
+
+func setTrafficClass(fd uintptr, ipv6 bool, class int) error {
+	return errors.New("DSCP marking is not supported on this platform")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for value, want := range map[string]int{"cs0": 0, "CS1": 8, "le": 1, "af41": 34, "ef": 46, "cs7": 56, "0": 0, "63": 63} {
+		if got, err := parseDSCP(value); err != nil || got != want {
+			t.Errorf("parseDSCP(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "64", "-1", "af5", "best"} {
+		if _, err := parseDSCP(value); err == nil {
+			t.Errorf("parseDSCP(%q) succeeded", value)
+		}
+	}
+
+	var s socketOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	s.registerFlags(fs)
+	if s.dscp != -1 {
+		t.Errorf("dscp %d without -dscp, want -1 for unmarked", s.dscp)
+	}
+	if err := fs.Parse([]string{"-dscp", "af99"}); err == nil {
+		t.Error("-dscp af99 was accepted")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+const (
+	sockRecvBuffer = syscall.SO_RCVBUF
+	sockSendBuffer = syscall.SO_SNDBUF
+)
+
+// setSocketInt sets a SOL_SOCKET option.
+func setSocketInt(fd uintptr, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, value)
+}
+
+func setTrafficClass(fd uintptr, ipv6 bool, class int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, class)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, class)
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockopt reads a socket option of a dialed connection.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var getErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, getErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	return value
+}
+
+func dialTestServer(t *testing.T, args ...string) net.Conn {
+	t.Helper()
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) { readRequest(r) })
+	conn, err := newTestOptions(t, args...).dial(server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSocketOptionsApplied(t *testing.T) {
+	conn := dialTestServer(t, "-tcp-nodelay=false", "-rcvbuf", "256K", "-sndbuf", "128K")
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != 0 {
+		t.Errorf("TCP_NODELAY %d, want it off", got)
+	}
+	// Linux reports twice the size asked for, to account for bookkeeping.
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < 256<<10 {
+		t.Errorf("SO_RCVBUF %d, want at least %d", got, 256<<10)
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < 128<<10 {
+		t.Errorf("SO_SNDBUF %d, want at least %d", got, 128<<10)
+	}
+
+	conn = dialTestServer(t)
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got == 0 {
+		t.Error("TCP_NODELAY is off by default")
+	}
+}
+
+func TestDSCPMarksConnections(t *testing.T) {
+	for value, want := range map[string]int{"af21": 18, "ef": 46, "8": 8} {
+		conn := dialTestServer(t, "-dscp", value)
+		if got := sockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS); got != want<<2 {
+			t.Errorf("-dscp %s: IP_TOS %#x, want %#x", value, got, want<<2)
+		}
+	}
+	if got := sockopt(t, dialTestServer(t), syscall.IPPROTO_IP, syscall.IP_TOS); got != 0 {
+		t.Errorf("IP_TOS %#x without -dscp, want 0", got)
+	}
+}
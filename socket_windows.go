@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	sockRecvBuffer = syscall.SO_RCVBUF
+	sockSendBuffer = syscall.SO_SNDBUF
+)
+
+// setSocketInt sets a SOL_SOCKET option.
+func setSocketInt(fd uintptr, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, value)
+}
+
+// setTrafficClass fails on Windows, which ignores IP_TOS from applications
+// and only marks traffic through its QoS policies.
+func setTrafficClass(fd uintptr, ipv6 bool, class int) error {
+	return errors.New("DSCP marking is not supported on Windows; use a QoS policy instead")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+)
+
+const manifestSuffix = ".manifest.json"
+
+// splitManifest describes a file stored as numbered parts. It is written
+// next to the parts by -split and read back by -join.
+type splitManifest struct {
+	Name   string      `json:"name"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+	Parts  []splitPart `json:"parts"`
+}
+
+type splitPart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func splitPartName(destination string, n int) string {
+	return fmt.Sprintf("%s.part%03d", destination, n)
+}
+
+// splitSink writes a download as destination.part001, .part002, … of at
+// most partSize bytes each, plus a manifest with per-part hashes. Parts are
+// held uncommitted until the whole download succeeds, so a failed transfer
+// leaves nothing behind.
+type splitSink struct {
+	opts        *options
+	destination string
+	partSize    int64
+
+	parts    []sink
+	manifest splitManifest
+	current  int64
+	partHash hash.Hash
+	fileHash hash.Hash
+}
+
+func (o *options) openSplitSink(destination string) (sink, int64, error) {
+	if o.resume {
+		return nil, 0, errors.New("-continue cannot be combined with -split")
+	}
+	return &splitSink{
+		opts:        o,
+		destination: destination,
+		partSize:    int64(o.split),
+		manifest:    splitManifest{Name: path.Base(destination)},
+		fileHash:    sha256.New(),
+	}, 0, nil
+}
+
+func (s *splitSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.parts) == 0 || s.current == s.partSize {
+			if err := s.nextPart(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p
+		if room := s.partSize - s.current; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := s.parts[len(s.parts)-1].Write(chunk)
+		s.partHash.Write(chunk[:n])
+		s.fileHash.Write(chunk[:n])
+		s.current += int64(n)
+		s.manifest.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *splitSink) nextPart() error {
+	s.finishPart()
+
+	name := splitPartName(s.destination, len(s.parts)+1)
+	part, _, err := s.opts.openDestination(name)
+	if err != nil {
+		return err
+	}
+	s.parts = append(s.parts, part)
+	s.manifest.Parts = append(s.manifest.Parts, splitPart{Name: path.Base(name)})
+	s.current = 0
+	s.partHash = sha256.New()
+	return nil
+}
+
+// finishPart records the size and hash of the part being written.
+func (s *splitSink) finishPart() {
+	if len(s.parts) == 0 {
+		return
+	}
+	last := &s.manifest.Parts[len(s.manifest.Parts)-1]
+	last.Size = s.current
+	last.SHA256 = hex.EncodeToString(s.partHash.Sum(nil))
+}
+
+func (s *splitSink) commit() error {
+	// An empty download still produces one (empty) part.
+	if len(s.parts) == 0 {
+		if err := s.nextPart(); err != nil {
+			return err
+		}
+	}
+	s.finishPart()
+	s.manifest.SHA256 = hex.EncodeToString(s.fileHash.Sum(nil))
+
+	data, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	for i, part := range s.parts {
+		if err := part.commit(); err != nil {
+			for _, rest := range s.parts[i+1:] {
+				rest.abort()
+			}
+			return err
+		}
+	}
+
+	out, _, err := s.opts.openDestination(s.destination + manifestSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		out.abort()
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return out.commit()
+}
+
+func (s *splitSink) abort() error {
+	var first error
+	for _, part := range s.parts {
+		if err := part.abort(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// maxManifestSize bounds how much of a remote manifest is read.
+const maxManifestSize = 1 << 20
+
+// fetchJoined fetches a file the server stores pre-split: it reads
+// source's manifest, downloads the parts it lists in order into a single
+// destination, and checks each part and the whole file against the manifest.
+func fetchJoined(opts *options, source *url.URL, destination string, bufferSize int, result *transferResult) (sink, error) {
+	if opts.resume {
+		return nil, errors.New("-continue cannot be combined with -join")
+	}
+
+	ctx := opts.transferContext(result)
+	manifest, err := opts.fetchManifest(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkDeclaredSize(manifest.Size); err != nil {
+		return nil, err
+	}
+
+	out, _, err := opts.openSink(destination)
+	if err != nil {
+		return nil, err
+	}
+	if out, err = opts.checkSink(out, 0, result); err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = out
+	if progress := opts.newProgress(result.ID, destination, 0, manifest.Size); progress != nil {
+		defer progress.finish()
+		w = io.MultiWriter(out, progress)
+	}
+
+	fileHash := sha256.New()
+	fetch := fetchParts
+	if opts.connections > 1 && len(manifest.Parts) > 1 {
+		fetch = fetchPartsParallel
+	}
+	if err := fetch(ctx, opts, source, manifest.Parts, io.MultiWriter(w, fileHash), bufferSize); err != nil {
+		out.abort()
+		return nil, err
+	}
+	result.Bytes = manifest.Size
+
+	if hex.EncodeToString(fileHash.Sum(nil)) != manifest.SHA256 {
+		out.abort()
+		return nil, fmt.Errorf("file hash: %w", errChecksumMismatch)
+	}
+	return out, nil
+}
+
+func (o *options) fetchManifest(ctx context.Context, source *url.URL) (*splitManifest, error) {
+	u := *source
+	u.Path += manifestSuffix
+
+	reader, _, err := o.openSource(ctx, &u, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxManifestSize))
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var manifest splitManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	if len(manifest.Parts) == 0 || manifest.SHA256 == "" {
+		return nil, errors.New("manifest lists no parts or no file hash")
+	}
+
+	var total int64
+	for _, part := range manifest.Parts {
+		// Parts live next to the manifest; anything else is refused.
+		if part.Name != path.Base(part.Name) || part.Name == ".." {
+			return nil, fmt.Errorf("invalid part name %q in manifest", part.Name)
+		}
+		total += part.Size
+	}
+	if total != manifest.Size {
+		return nil, fmt.Errorf("manifest part sizes add up to %d, not %d", total, manifest.Size)
+	}
+	return &manifest, nil
+}
+
+func fetchParts(ctx context.Context, opts *options, source *url.URL, parts []splitPart, w io.Writer, bufferSize int) error {
+	for _, part := range parts {
+		if err := fetchPart(ctx, opts, source, part, w, bufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchPartsParallel fetches up to -connections parts at once. Only the next
+// part in order can go to w, so the others are spooled to temporary files
+// and copied over when their turn comes.
+func fetchPartsParallel(ctx context.Context, opts *options, source *url.URL, parts []splitPart, w io.Writer, bufferSize int) error {
+	type spooled struct {
+		file *os.File
+		err  error
+	}
+	ready := make([]chan spooled, len(parts))
+	for i := range ready {
+		ready[i] = make(chan spooled, 1)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	launched := make(chan struct{})
+	slots := make(chan struct{}, opts.connections)
+	go func() {
+		defer close(launched)
+		for i, part := range parts {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int, part splitPart) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				file, err := os.CreateTemp("", "tcp-part-*")
+				if err != nil {
+					ready[i] <- spooled{err: fmt.Errorf("error creating spool file: %w", err)}
+					return
+				}
+				if err := fetchPart(ctx, opts, source, part, file, bufferSize); err != nil {
+					removeSpool(file)
+					ready[i] <- spooled{err: err}
+					return
+				}
+				ready[i] <- spooled{file: file}
+			}(i, part)
+		}
+	}()
+
+	for i := range parts {
+		s := <-ready[i]
+		err := s.err
+		if err == nil {
+			if _, err = s.file.Seek(0, io.SeekStart); err == nil {
+				_, err = io.Copy(w, s.file)
+			}
+			removeSpool(s.file)
+		}
+		if err != nil {
+			// Stop launching parts, cancel the ones in flight and clean up
+			// after them once the last has finished.
+			close(stop)
+			cancel()
+			go func() {
+				<-launched
+				wg.Wait()
+				for _, c := range ready[i+1:] {
+					select {
+					case s := <-c:
+						if s.file != nil {
+							removeSpool(s.file)
+						}
+					default:
+					}
+				}
+			}()
+			return err
+		}
+	}
+	close(stop)
+	return nil
+}
+
+func removeSpool(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func fetchPart(ctx context.Context, opts *options, source *url.URL, part splitPart, w io.Writer, bufferSize int) error {
+	u := *source
+	u.Path = path.Join(path.Dir(source.Path), part.Name)
+
+	reader, _, err := opts.openSource(ctx, &u, 0)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", part.Name, err)
+	}
+
+	partHash := sha256.New()
+	n, err := opts.transfer(ctx, io.MultiWriter(w, partHash), reader, bufferSize)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", part.Name, err)
+	}
+
+	if n != part.Size {
+		return fmt.Errorf("%s: got %d bytes, manifest lists %d", part.Name, n, part.Size)
+	}
+	if hex.EncodeToString(partHash.Sum(nil)) != part.SHA256 {
+		return fmt.Errorf("%s: %w", part.Name, errChecksumMismatch)
+	}
+	return nil
+}
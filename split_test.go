@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchPartsParallelCleansUpAfterFailure(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		if !ok {
+			return
+		}
+		if strings.HasSuffix(line, ".part001") {
+			conn.Write([]byte("short"))
+			return
+		}
+		conn.Write([]byte("part contents"))
+	})
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	sum := sha256.Sum256([]byte("part contents"))
+	var parts []splitPart
+	for _, name := range []string{"f.part001", "f.part002", "f.part003", "f.part004"} {
+		parts = append(parts, splitPart{Name: name, Size: 13, SHA256: hex.EncodeToString(sum[:])})
+	}
+	source, err := url.Parse("tcp://" + server.addr() + "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions(t, "-connections", "2")
+
+	var out bytes.Buffer
+	err = fetchPartsParallel(context.Background(), opts, source, parts, &out, 1024)
+	if err == nil || !strings.Contains(err.Error(), "f.part001") {
+		t.Fatalf("fetch returned %v, want the failure of f.part001", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %d bytes after the first part failed", out.Len())
+	}
+	// The parts still in flight remove their spool files once they finish.
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		files, _ := filepath.Glob(filepath.Join(spool, "tcp-part-*"))
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool files left behind: %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, _ := os.ReadDir(spool)
+	if len(entries) != 0 {
+		t.Errorf("%d files left in the spool directory", len(entries))
+	}
+}
+
+func TestSplitWritesPartsAndManifest(t *testing.T) {
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-split", "10")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(results), "downloaded"; got != want {
+		t.Fatalf("statuses %q, want %q", got, want)
+	}
+
+	content := "contents of a.txt"
+	first, _ := os.ReadFile("a.txt.part001")
+	second, _ := os.ReadFile("a.txt.part002")
+	if string(first) != content[:10] || string(second) != content[10:] {
+		t.Errorf("parts %q and %q, want %q split after 10 bytes", first, second, content)
+	}
+	if _, err := os.Stat("a.txt"); err == nil {
+		t.Error("the whole file was written too")
+	}
+
+	data, err := os.ReadFile("a.txt" + manifestSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest splitManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	want := splitManifest{Name: "a.txt", Size: int64(len(content)), SHA256: hash(content), Parts: []splitPart{
+		{Name: "a.txt.part001", Size: 10, SHA256: hash(content[:10])},
+		{Name: "a.txt.part002", Size: int64(len(content) - 10), SHA256: hash(content[10:])},
+	}}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("manifest %+v, want %+v", manifest, want)
+	}
+}
+
+func TestSplitAbortLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	opts := newTestOptions(t, "-split", "4")
+
+	out, _, err := opts.openSink("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("more than one part"))
+	if err := out.abort(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("left behind %v", files)
+	}
+}
+
+// newSplitServer serves content as parts of partSize bytes with a manifest,
+// as -split would have written them.
+func newSplitServer(t *testing.T, content string, partSize int, edit func(*splitManifest)) *fakeServer {
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	files := map[string]string{}
+	manifest := splitManifest{Name: "f", Size: int64(len(content)), SHA256: hash(content)}
+	for n := 1; len(content) > 0; n++ {
+		part := content
+		if len(part) > partSize {
+			part = part[:partSize]
+		}
+		content = content[len(part):]
+		name := splitPartName("f", n)
+		files[name] = part
+		manifest.Parts = append(manifest.Parts, splitPart{Name: name, Size: int64(len(part)), SHA256: hash(part)})
+	}
+	if edit != nil {
+		edit(&manifest)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["f"+manifestSuffix] = string(data)
+
+	return newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok {
+			conn.Write([]byte(files[strings.TrimPrefix(line, "GET ")]))
+		}
+	})
+}
+
+func TestJoinReassemblesParts(t *testing.T) {
+	content := "the whole file, three parts"
+	server := newSplitServer(t, content, 10, nil)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-join")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/f"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile("f"); string(got) != content {
+		t.Errorf("joined %q, want %q", got, content)
+	}
+	if results[0].Bytes != int64(len(content)) {
+		t.Errorf("reported %d bytes, want %d", results[0].Bytes, len(content))
+	}
+}
+
+func TestJoinRejectsBadManifests(t *testing.T) {
+	for name, edit := range map[string]func(*splitManifest){
+		"file hash":    func(m *splitManifest) { m.SHA256 = strings.Repeat("0", 64) },
+		"part hash":    func(m *splitManifest) { m.Parts[1].SHA256 = strings.Repeat("0", 64) },
+		"part outside": func(m *splitManifest) { m.Parts[0].Name = "../f.part001" },
+		"sizes":        func(m *splitManifest) { m.Size++ },
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := newSplitServer(t, "the whole file, three parts", 10, edit)
+			chdir(t, t.TempDir())
+			opts := newTestOptions(t, "-join", "-retry-on", "none")
+
+			results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/f"}, nil, opts.log)
+			if err == nil || statuses(results) != statusFailed {
+				t.Fatalf("join returned %v with %s, want a failure", err, statuses(results))
+			}
+			if _, err := os.Stat("f"); err == nil {
+				t.Error("a file was written anyway")
+			}
+		})
+	}
+}
+
+func TestFetchPartsParallelUsesConnections(t *testing.T) {
+	var c concurrency
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if line, ok := readRequest(r); ok {
+			c.enter()
+			time.Sleep(50 * time.Millisecond)
+			c.leave()
+			conn.Write([]byte(strings.TrimPrefix(line, "GET ")))
+		}
+	})
+	var parts []splitPart
+	var want string
+	for n := 1; n <= 6; n++ {
+		name := splitPartName("f", n)
+		sum := sha256.Sum256([]byte(name))
+		parts = append(parts, splitPart{Name: name, Size: int64(len(name)), SHA256: hex.EncodeToString(sum[:])})
+		want += name
+	}
+	source, err := url.Parse("tcp://" + server.addr() + "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+
+	var out bytes.Buffer
+	if err := fetchPartsParallel(context.Background(), newTestOptions(t, "-connections", "3"), source, parts, &out, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("joined %q, want the parts in order", out.String())
+	}
+	if c.peak() != 3 {
+		t.Errorf("fetched %d parts at once, want 3", c.peak())
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+type sshOptions struct {
+	target     string
+	keyFile    string
+	knownHosts string
+
+	mu     sync.Mutex
+	client *ssh.Client
+
+	// agent is the ssh-agent connection every SSH connection of the run
+	// authenticates with; see agentClient.
+	agentMu   sync.Mutex
+	agent     agent.ExtendedAgent
+	agentConn net.Conn
+}
+
+func (s *sshOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.target, "ssh", "", "dial the server through an SSH connection to `user@host[:port]`")
+	fs.StringVar(&s.keyFile, "ssh-key", "", "private key `file` for -ssh; defaults to the agent and ~/.ssh/id_*")
+	fs.StringVar(&s.knownHosts, "ssh-known-hosts", "", "known_hosts `file` used to verify the SSH host; defaults to ~/.ssh/known_hosts")
+}
+
+func (s *sshOptions) enabled() bool {
+	return s.target != ""
+}
+
+// dial opens a direct-tcpip channel to address through the SSH host. The SSH
+// connection itself is made once and shared by every dial in the run, and
+// made again if it drops.
+func (s *sshOptions) dial(forward proxy.Dialer, address string) (net.Conn, error) {
+	client, err := s.connect(forward)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("tcp", address)
+	var refused *ssh.OpenChannelError
+	if err != nil && !errors.As(err, &refused) {
+		// The SSH host didn't answer at all, so the connection is likely
+		// dead even if it hasn't noticed yet.
+		s.forget(client)
+		client.Close()
+		if client, err = s.connect(forward); err != nil {
+			return nil, err
+		}
+		conn, err = client.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s through ssh: %w", address, err)
+	}
+	return &sshChannelConn{Conn: conn}, nil
+}
+
+func (s *sshOptions) connect(forward proxy.Dialer) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	username, address, err := parseSSHTarget(s.target)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := s.clientConfig(username)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := forward.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh host: %w", err)
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error establishing ssh connection: %w", err)
+	}
+
+	client := ssh.NewClient(sshConn, channels, requests)
+	s.client = client
+	go func() {
+		client.Wait()
+		s.forget(client)
+	}()
+	return client, nil
+}
+
+// forget drops client, once it has closed, for the next dial to replace.
+func (s *sshOptions) forget(client *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.client = nil
+	}
+}
+
+func (s *sshOptions) clientConfig(username string) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+
+	knownHostsFile := s.knownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading known hosts: %w", err)
+	}
+
+	auth, err := s.authMethods(home)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         ConnectionTimeout,
+	}, nil
+}
+
+// agentClient returns the client of the ssh-agent listening on socket,
+// connecting once for the run rather than for every SSH connection, which
+// redialing would otherwise leak.
+func (s *sshOptions) agentClient(socket string) (agent.ExtendedAgent, error) {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	if s.agent == nil {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		s.agent, s.agentConn = agent.NewClient(conn), conn
+	}
+	return s.agent, nil
+}
+
+func (s *sshOptions) forgetAgent(client agent.ExtendedAgent) {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	if s.agent == client {
+		s.agentConn.Close()
+		s.agent, s.agentConn = nil, nil
+	}
+}
+
+func (s *sshOptions) authMethods(home string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && s.keyFile == "" {
+		if client, err := s.agentClient(socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				signers, err := client.Signers()
+				if err != nil {
+					// The agent went away; the next connection dials it again.
+					s.forgetAgent(client)
+				}
+				return signers, err
+			}))
+		}
+	}
+
+	keyFiles := []string{s.keyFile}
+	if s.keyFile == "" {
+		keyFiles = nil
+		for _, name := range defaultSSHKeys {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			if s.keyFile == "" && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading ssh key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			var missing *ssh.PassphraseMissingError
+			if s.keyFile == "" && errors.As(err, &missing) {
+				continue
+			}
+			return nil, fmt.Errorf("error parsing ssh key %s: %w", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no ssh agent or usable private key found")
+	}
+	return methods, nil
+}
+
+func parseSSHTarget(target string) (string, string, error) {
+	username, host := "", target
+	if at := strings.LastIndex(target, "@"); at >= 0 {
+		username, host = target[:at], target[at+1:]
+	}
+
+	if username == "" {
+		var err error
+		if username, err = defaultSSHUser(); err != nil {
+			return "", "", err
+		}
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("invalid ssh target %q", target)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return username, host, nil
+}
+
+func defaultSSHUser() (string, error) {
+	current, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("error determining ssh user: %w", err)
+	}
+	return current.Username, nil
+}
+
+// sshChannelConn emulates deadlines on a direct-tcpip channel, which does not
+// support them, by closing the channel when a deadline passes mid-operation.
+type sshChannelConn struct {
+	net.Conn
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *sshChannelConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return c.withDeadline(deadline, func() (int, error) { return c.Conn.Read(p) })
+}
+
+func (c *sshChannelConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return c.withDeadline(deadline, func() (int, error) { return c.Conn.Write(p) })
+}
+
+func (c *sshChannelConn) withDeadline(deadline time.Time, op func() (int, error)) (int, error) {
+	if deadline.IsZero() {
+		return op()
+	}
+	if !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	var expired atomic.Bool
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		expired.Store(true)
+		c.Conn.Close()
+	})
+	n, err := op()
+	if !timer.Stop() && expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *sshChannelConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return nil
+}
+
+func (c *sshChannelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *sshChannelConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
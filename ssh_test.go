@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// sshServer forwards direct-tcpip channels for any client key, and can drop
+// every connection it has open.
+type sshServer struct {
+	ln     net.Listener
+	config *ssh.ServerConfig
+	// sftpRoot, if set, serves sftp sessions from this directory.
+	sftpRoot string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newSSHServer(t *testing.T) (*sshServer, ssh.PublicKey) {
+	t.Helper()
+	return newSFTPServer(t, "")
+}
+
+// newSFTPServer is newSSHServer also serving sftp sessions from root.
+func newSFTPServer(t *testing.T, root string) (*sshServer, ssh.PublicKey) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{ln: ln, config: config, sftpRoot: root}
+	go s.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		s.drop()
+	})
+	return s, signer.PublicKey()
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *sshServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() == "session" && s.sftpRoot != "" {
+			go s.serveSFTP(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		backend, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			backend.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			io.Copy(channel, backend)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(backend, channel)
+			backend.Close()
+		}()
+	}
+}
+
+// serveSFTP runs the sftp subsystem, relative to sftpRoot, on a session.
+func (s *sshServer) serveSFTP(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		var subsystem struct{ Name string }
+		ok := request.Type == "subsystem" && ssh.Unmarshal(request.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+		request.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.sftpRoot))
+		if err != nil {
+			return
+		}
+		server.Serve()
+		return
+	}
+}
+
+// drop cuts every SSH connection, as a network outage or sshd restart
+// would.
+func (s *sshServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// writeSSHClientFiles writes a new client key and a known_hosts file that
+// trusts server, and keeps the agent out of the way.
+func writeSSHClientFiles(t *testing.T, server *sshServer, hostKey ssh.PublicKey) (keyFile, knownHosts string) {
+	t.Helper()
+	dir := t.TempDir()
+	knownHosts = filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{server.ln.Addr().String()}, hostKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return keyFile, knownHosts
+}
+
+func TestSSHTunnelRedialsAfterDrop(t *testing.T) {
+	target := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		conn.Write([]byte("hello"))
+	})
+	server, hostKey := newSSHServer(t)
+	keyFile, knownHosts := writeSSHClientFiles(t, server, hostKey)
+
+	s := &sshOptions{target: "tester@" + server.ln.Addr().String(), keyFile: keyFile, knownHosts: knownHosts}
+	for i := 0; i < 3; i++ {
+		conn, err := s.dial(proxy.Direct, target.addr())
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(data) != "hello" {
+			t.Errorf("dial %d read %q, %v", i, data, err)
+		}
+		server.drop()
+	}
+}
+
+func TestSSHRedialReusesAgent(t *testing.T) {
+	target := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		conn.Write([]byte("hello"))
+	})
+	server, hostKey := newSSHServer(t)
+	dir := t.TempDir()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{server.ln.Addr().String()}, hostKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// An agent holding the only key, on a path short enough for a socket.
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: clientKey}); err != nil {
+		t.Fatal(err)
+	}
+	socketDir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(socketDir)
+	socket := filepath.Join(socketDir, "sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var agentConns atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			agentConns.Add(1)
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	t.Setenv("HOME", dir)
+
+	s := &sshOptions{target: "tester@" + server.ln.Addr().String(), knownHosts: knownHosts}
+	for i := 0; i < 3; i++ {
+		conn, err := s.dial(proxy.Direct, target.addr())
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		io.ReadAll(conn)
+		conn.Close()
+		server.drop()
+	}
+	if n := agentConns.Load(); n != 1 {
+		t.Errorf("connected to the agent %d times, want once", n)
+	}
+}
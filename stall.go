@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// stallReader fails a transfer whose speed stays under -min-speed for all
+// of -min-speed-time, like curl's --speed-limit and --speed-time. A
+// half-dead connection that still trickles a few bytes never trips the
+// read deadline; this catches it, and the failure counts as a network
+// error so -reconnect picks the transfer up again on a fresh connection.
+type stallReader struct {
+	io.ReadCloser
+	minSpeed int64
+	window   time.Duration
+
+	start time.Time
+	bytes int64
+}
+
+func newStallReader(r io.ReadCloser, minSpeed int64, window time.Duration) *stallReader {
+	return &stallReader{ReadCloser: r, minSpeed: minSpeed, window: window, start: time.Now()}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	// The check comes before the read so that the error isn't returned
+	// alongside data, which a reconnectingReader would pass over.
+	if elapsed := time.Since(s.start); elapsed >= s.window {
+		if float64(s.bytes) < float64(s.minSpeed)*elapsed.Seconds() {
+			return 0, &classifiedError{classNetwork, fmt.Errorf("transfer stayed below %s/s for %s", formatBytes(s.minSpeed), s.window)}
+		}
+		s.start, s.bytes = time.Now(), 0
+	}
+	n, err := s.ReadCloser.Read(p)
+	s.bytes += int64(n)
+	return n, err
+}
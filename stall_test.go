@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMinSpeedFailsTricklingTransfer(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		if _, ok := readRequest(r); !ok {
+			return
+		}
+		// A byte every 20ms, until the client gives up.
+		for i := 0; i < 500; i++ {
+			if _, err := conn.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-min-speed", "1K", "-min-speed-time", "200ms", "-reconnect", "0", "-retry-on", "none")
+
+	start := time.Now()
+	results, _ := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if results[0].Status != statusFailed || results[0].ErrorClass != string(classNetwork) || !strings.Contains(results[0].Error, "stayed below 1.0 KiB/s for 200ms") {
+		t.Errorf("trickling transfer %s with %q (%s)", results[0].Status, results[0].Error, results[0].ErrorClass)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stall noticed after %s, want about 200ms", elapsed)
+	}
+}
+
+func TestMinSpeedPassesSteadyTransfer(t *testing.T) {
+	// 100 bytes every 10ms is about 10K/s, well over 1K/s.
+	r := newStallReader(io.NopCloser(&pacedReader{chunk: 100, every: 10 * time.Millisecond, left: 50}), 1024, 50*time.Millisecond)
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != 5000 {
+		t.Errorf("steady transfer read %d bytes, %v", n, err)
+	}
+}
+
+// pacedReader returns chunk bytes per read, left times, sleeping every
+// before each.
+type pacedReader struct {
+	chunk int
+	every time.Duration
+	left  int
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if p.left == 0 {
+		return 0, io.EOF
+	}
+	p.left--
+	time.Sleep(p.every)
+	if len(b) > p.chunk {
+		b = b[:p.chunk]
+	}
+	for i := range b {
+		b[i] = 'x'
+	}
+	return len(b), nil
+}
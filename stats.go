@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// historyStats summarizes the transfers in the history database.
+// Throughput percentiles are in bytes per second over successful transfers
+// that moved data; skipped files are never recorded, so they don't count.
+type historyStats struct {
+	Transfers     int           `json:"transfers"`
+	Failed        int           `json:"failed"`
+	SuccessRate   float64       `json:"success_rate"`
+	Bytes         int64         `json:"bytes"`
+	ThroughputP50 float64       `json:"throughput_p50"`
+	ThroughputP95 float64       `json:"throughput_p95"`
+	Daily         []dailyStats  `json:"daily"`
+	TopFailing    []failingFile `json:"top_failing"`
+}
+
+type dailyStats struct {
+	Day       string `json:"day"`
+	Server    string `json:"server"`
+	Transfers int    `json:"transfers"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type failingFile struct {
+	File      string    `json:"file"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	LastTime  time.Time `json:"last_time"`
+}
+
+// runStats implements the stats subcommand: stats [flags].
+func runStats(opts *options, args []string) error {
+	var q historyQuery
+	var top int
+	fs := newCommandFlags("stats")
+	fs.StringVar(&q.since, "since", "", "only count transfers after this `time`: a duration such as 168h, a date or an RFC 3339 time")
+	fs.StringVar(&q.server, "server", "", "only count transfers from this `host:port`")
+	fs.IntVar(&top, "top", 10, "list this `many` of the most often failing files")
+	fs.BoolVar(&q.json, "json", false, "print the statistics as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: stats [flags]")
+	}
+	if opts.history == nil {
+		return errors.New("the history database is disabled")
+	}
+
+	entries, err := opts.history.query(&q)
+	if err != nil {
+		return err
+	}
+	stats := summarize(entries, top)
+
+	if q.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	return stats.print(os.Stdout)
+}
+
+// summarize aggregates entries, which are sorted newest first.
+func summarize(entries []historyEntry, top int) *historyStats {
+	stats := &historyStats{Daily: []dailyStats{}, TopFailing: []failingFile{}}
+	daily := map[[2]string]*dailyStats{}
+	failing := map[string]*failingFile{}
+	var throughputs []float64
+
+	for _, e := range entries {
+		stats.Transfers++
+		stats.Bytes += e.Bytes
+
+		key := [2]string{e.Time.Local().Format("2006-01-02"), e.Server}
+		day, ok := daily[key]
+		if !ok {
+			day = &dailyStats{Day: key[0], Server: key[1]}
+			daily[key] = day
+		}
+		day.Transfers++
+		day.Bytes += e.Bytes
+
+		if e.Status == statusFailed {
+			stats.Failed++
+			f, ok := failing[e.File]
+			if !ok {
+				f = &failingFile{File: e.File, LastError: e.Error, LastTime: e.Time}
+				failing[e.File] = f
+			}
+			f.Failures++
+			continue
+		}
+		if e.Bytes > 0 && e.Duration > 0 {
+			throughputs = append(throughputs, float64(e.Bytes)/(float64(e.Duration)/1000))
+		}
+	}
+
+	if stats.Transfers > 0 {
+		stats.SuccessRate = float64(stats.Transfers-stats.Failed) / float64(stats.Transfers)
+	}
+	sort.Float64s(throughputs)
+	stats.ThroughputP50 = percentile(throughputs, 0.50)
+	stats.ThroughputP95 = percentile(throughputs, 0.95)
+
+	for _, day := range daily {
+		stats.Daily = append(stats.Daily, *day)
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		if stats.Daily[i].Day != stats.Daily[j].Day {
+			return stats.Daily[i].Day < stats.Daily[j].Day
+		}
+		return stats.Daily[i].Server < stats.Daily[j].Server
+	})
+
+	for _, f := range failing {
+		stats.TopFailing = append(stats.TopFailing, *f)
+	}
+	sort.Slice(stats.TopFailing, func(i, j int) bool {
+		a, b := stats.TopFailing[i], stats.TopFailing[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		return a.File < b.File
+	})
+	if top >= 0 && len(stats.TopFailing) > top {
+		stats.TopFailing = stats.TopFailing[:top]
+	}
+	return stats
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted)) + 0.999999)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (s *historyStats) print(w io.Writer) error {
+	fmt.Fprintf(w, "transfers:     %d (%d failed, %.1f%% succeeded)\n", s.Transfers, s.Failed, s.SuccessRate*100)
+	fmt.Fprintf(w, "bytes:         %s\n", formatBytes(s.Bytes))
+	fmt.Fprintf(w, "throughput:    p50 %s/s, p95 %s/s\n", formatBytes(int64(s.ThroughputP50)), formatBytes(int64(s.ThroughputP95)))
+
+	if len(s.Daily) > 0 {
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DAY\tSERVER\tTRANSFERS\tBYTES")
+		for _, d := range s.Daily {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", d.Day, d.Server, d.Transfers, formatBytes(d.Bytes))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.TopFailing) > 0 {
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FAILURES\tFILE\tLAST ERROR")
+		for _, f := range s.TopFailing {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", f.Failures, f.File, f.LastError)
+		}
+		return tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeHistory(t *testing.T) {
+	day1 := time.Date(2026, 5, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	// Newest first, as query returns them.
+	entries := []historyEntry{
+		{Time: day2.Add(time.Hour), File: "b.txt", Server: "a:8000", Status: statusFailed, Error: "timeout"},
+		{Time: day2, File: "c.txt", Server: "b:8000", Status: statusDownloaded, Bytes: 4000, Duration: 1000},
+		{Time: day1.Add(2 * time.Hour), File: "b.txt", Server: "a:8000", Status: statusFailed, Error: "refused"},
+		{Time: day1.Add(time.Hour), File: "a.txt", Server: "a:8000", Status: statusFailed, Error: "refused"},
+		{Time: day1, File: "d.txt", Server: "a:8000", Status: statusDownloaded, Bytes: 1000, Duration: 1000},
+		{Time: day1, File: "e.txt", Server: "a:8000", Status: statusDownloaded, Bytes: 0, Duration: 0},
+	}
+
+	stats := summarize(entries, 1)
+	if stats.Transfers != 6 || stats.Failed != 3 || stats.SuccessRate != 0.5 || stats.Bytes != 5000 {
+		t.Errorf("totals %d transfers, %d failed, %v success, %d bytes", stats.Transfers, stats.Failed, stats.SuccessRate, stats.Bytes)
+	}
+	if stats.ThroughputP50 != 1000 || stats.ThroughputP95 != 4000 {
+		t.Errorf("throughput p50 %v, p95 %v, want 1000 and 4000", stats.ThroughputP50, stats.ThroughputP95)
+	}
+	wantDaily := []dailyStats{
+		{Day: "2026-05-01", Server: "a:8000", Transfers: 4, Bytes: 1000},
+		{Day: "2026-05-02", Server: "a:8000", Transfers: 1},
+		{Day: "2026-05-02", Server: "b:8000", Transfers: 1, Bytes: 4000},
+	}
+	if !reflect.DeepEqual(stats.Daily, wantDaily) {
+		t.Errorf("daily %+v, want %+v", stats.Daily, wantDaily)
+	}
+	wantFailing := []failingFile{{File: "b.txt", Failures: 2, LastError: "timeout", LastTime: day2.Add(time.Hour)}}
+	if !reflect.DeepEqual(stats.TopFailing, wantFailing) {
+		t.Errorf("top failing %+v, want %+v", stats.TopFailing, wantFailing)
+	}
+
+	if empty := summarize(nil, 10); empty.SuccessRate != 0 || empty.ThroughputP50 != 0 || empty.Daily == nil || empty.TopFailing == nil {
+		t.Errorf("empty history summarized as %+v", empty)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[float64]float64{0: 1, 0.5: 5, 0.95: 10, 1: 10} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestStatsPrint(t *testing.T) {
+	stats := &historyStats{
+		Transfers: 4, Failed: 1, SuccessRate: 0.75, Bytes: 3 << 20, ThroughputP50: 1 << 20, ThroughputP95: 2 << 20,
+		Daily:      []dailyStats{{Day: "2026-05-01", Server: "a:8000", Transfers: 4, Bytes: 3 << 20}},
+		TopFailing: []failingFile{{File: "b.txt", Failures: 1, LastError: "refused"}},
+	}
+	var out bytes.Buffer
+	if err := stats.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"transfers:     4 (1 failed, 75.0% succeeded)\n", "2026-05-01  a:8000", "1         b.txt  refused\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
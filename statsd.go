@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// statsdOptions send metrics about every transfer that completes to a
+// StatsD server over UDP, for sites that don't scrape Prometheus:
+//
+//	transfers:1|c     each transfer, skipped and failed ones included
+//	bytes:N|c         the bytes it moved
+//	duration:N|ms     how long it took
+//	failures:1|c      failed transfers, tagged with their error class too
+//
+// all under -statsd-prefix and tagged with the server and the result's
+// status. The dogstatsd format sends the tags as DogStatsD and Telegraf
+// understand them; plain StatsD has no tags, so with the statsd format
+// they become part of the name instead: prefix.transfers.server.status.
+type statsdOptions struct {
+	address string
+	prefix  string
+	format  string
+	tags    []string
+}
+
+func (s *statsdOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.address, "statsd", "", "send transfer metrics to the StatsD server at this UDP `host:port`")
+	fs.StringVar(&s.prefix, "statsd-prefix", "tcp_file_client.", "`prefix` for the names of StatsD metrics")
+	fs.StringVar(&s.format, "statsd-format", "dogstatsd", "how StatsD metrics carry their tags: `format` dogstatsd, or statsd to put them in the name")
+	fs.Func("statsd-tag", "add this `key:value` tag to every StatsD metric, with -statsd-format dogstatsd; may be repeated", func(tag string) error {
+		if !strings.Contains(tag, ":") {
+			return fmt.Errorf("invalid tag %q: want key:value", tag)
+		}
+		s.tags = append(s.tags, tag)
+		return nil
+	})
+}
+
+type statsdClient struct {
+	opts statsdOptions
+	conn net.Conn
+}
+
+func newStatsdClient(opts statsdOptions) (*statsdClient, error) {
+	if opts.format != "dogstatsd" && opts.format != "statsd" {
+		return nil, fmt.Errorf("invalid -statsd-format %q: want dogstatsd or statsd", opts.format)
+	}
+	conn, err := net.Dial("udp", opts.address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd: %w", err)
+	}
+	return &statsdClient{opts: opts, conn: conn}, nil
+}
+
+// record sends a transfer's metrics in one datagram. Like StatsD itself,
+// it doesn't wait to hear whether they arrived.
+func (c *statsdClient) record(r *transferResult) error {
+	tags := [][2]string{{"server", sourceHost(r.Source)}, {"status", r.Status}}
+	var lines []string
+	lines = append(lines, c.metric("transfers", "1|c", tags))
+	if r.Bytes > 0 {
+		lines = append(lines, c.metric("bytes", fmt.Sprintf("%d|c", r.Bytes), tags))
+	}
+	if d := r.duration(); d > 0 {
+		lines = append(lines, c.metric("duration", fmt.Sprintf("%d|ms", d.Milliseconds()), tags))
+	}
+	if r.Status == statusFailed {
+		lines = append(lines, c.metric("failures", "1|c", append(tags, [2]string{"error_class", r.ErrorClass})))
+	}
+	if _, err := c.conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		return fmt.Errorf("error sending metrics to statsd: %w", err)
+	}
+	return nil
+}
+
+func (c *statsdClient) metric(name, value string, tags [][2]string) string {
+	if c.opts.format == "statsd" {
+		parts := []string{c.opts.prefix + name}
+		for _, tag := range tags {
+			parts = append(parts, statsdName(tag[1]))
+		}
+		return strings.Join(parts, ".") + ":" + value
+	}
+	var pairs []string
+	for _, tag := range tags {
+		pairs = append(pairs, tag[0]+":"+statsdTag(tag[1]))
+	}
+	pairs = append(pairs, c.opts.tags...)
+	return c.opts.prefix + name + ":" + value + "|#" + strings.Join(pairs, ",")
+}
+
+// statsdName makes a tag value safe as a component of a dotted name.
+func statsdName(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", " ", "_", "\n", "_").Replace(value)
+}
+
+// statsdTag makes a tag value safe in a DogStatsD tag list.
+func statsdTag(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_", "\n", "_").Replace(value)
+}
+
+func (c *statsdClient) Close() error {
+	return c.conn.Close()
+}
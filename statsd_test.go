@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStatsdListener returns a UDP socket for a test StatsD client to send
+// to, and a function reading the next datagram off it.
+func newStatsdListener(t *testing.T) (string, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String(), func() string {
+		t.Helper()
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	address, read := newStatsdListener(t)
+	started := time.Now()
+	failed := &transferResult{Source: "tcp://files:8000/a.txt", Status: statusFailed, ErrorClass: "network", Bytes: 512, started: started, finished: started.Add(1500 * time.Millisecond)}
+
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-statsd-tag", "env:prod"}, strings.Join([]string{
+			"tcp_file_client.transfers:1|c|#server:files:8000,status:failed,env:prod",
+			"tcp_file_client.bytes:512|c|#server:files:8000,status:failed,env:prod",
+			"tcp_file_client.duration:1500|ms|#server:files:8000,status:failed,env:prod",
+			"tcp_file_client.failures:1|c|#server:files:8000,status:failed,error_class:network,env:prod",
+		}, "\n")},
+		{[]string{"-statsd-format", "statsd", "-statsd-prefix", "files."}, strings.Join([]string{
+			"files.transfers.files_8000.failed:1|c",
+			"files.bytes.files_8000.failed:512|c",
+			"files.duration.files_8000.failed:1500|ms",
+			"files.failures.files_8000.failed.network:1|c",
+		}, "\n")},
+	} {
+		opts := newTestOptions(t, append([]string{"-statsd", address}, test.args...)...)
+		client, err := newStatsdClient(opts.statsd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.record(failed); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		if got := read(); got != test.want {
+			t.Errorf("%v sent\n%s\nwant\n%s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestStatsdRecordsBatch(t *testing.T) {
+	address, read := newStatsdListener(t)
+	server := newFileServer(t)
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-statsd", address)
+	var err error
+	if opts.statsdClient, err = newStatsdClient(opts.statsd); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { opts.statsdClient.Close() })
+
+	if results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil || statuses(results) != "downloaded" {
+		t.Fatalf("batch returned %v with %s", err, statuses(results))
+	}
+	tags := "|#server:" + server.addr() + ",status:downloaded"
+	lines := strings.Split(read(), "\n")
+	if len(lines) != 3 || lines[0] != "tcp_file_client.transfers:1|c"+tags || lines[1] != "tcp_file_client.bytes:17|c"+tags || !strings.HasSuffix(lines[2], "|ms"+tags) {
+		t.Errorf("sent %q", lines)
+	}
+}
+
+func TestStatsdNames(t *testing.T) {
+	if got, want := statsdName("files.example.com:8000"), "files_example_com_8000"; got != want {
+		t.Errorf("name %q, want %q", got, want)
+	}
+	if got, want := statsdName(""), "none"; got != want {
+		t.Errorf("empty name %q, want %q", got, want)
+	}
+	if got, want := statsdTag("a b,c|d#e"), "a_b_c_d_e"; got != want {
+		t.Errorf("tag %q, want %q", got, want)
+	}
+
+	if _, err := newStatsdClient(statsdOptions{address: "127.0.0.1:8125", format: "graphite"}); err == nil || !strings.Contains(err.Error(), "invalid -statsd-format") {
+		t.Errorf("graphite format: %v", err)
+	}
+	var s statsdOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	s.registerFlags(fs)
+	if err := fs.Parse([]string{"-statsd-tag", "prod"}); err == nil {
+		t.Error("a tag without a value was accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for symlinks found in a sync directory.
+const (
+	symlinkSkip   = "skip"
+	symlinkFollow = "follow"
+)
+
+// scanLinks finds the symlinks in a sync directory and decides what each
+// stands for: under -symlinks follow, the regular file it resolves to, and
+// otherwise nothing, meaning sync leaves the name alone on both sides rather
+// than replacing the link with a download. Links are never followed out of
+// the directory, and dangling or looping links are skipped as well.
+//
+// The server's listings carry no link targets, so links can't be recreated
+// from the server; its files always arrive as regular files.
+func (s *syncOptions) scanLinks(dir string, logger *leveledLogger) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync directory: %w", err)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync directory: %w", err)
+	}
+
+	links := map[string]string{}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		name := entry.Name()
+		links[name] = ""
+		if s.symlinks != symlinkFollow {
+			logger.Debugf("skipping symlink %s", name)
+			continue
+		}
+		target, err := resolveLink(root, filepath.Join(dir, name))
+		if err != nil {
+			logger.Warnf("skipping symlink %s: %v", name, err)
+			continue
+		}
+		links[name] = target
+	}
+	return links, nil
+}
+
+// resolveLink follows path to the regular file it finally names, which must
+// lie within root.
+func resolveLink(root, path string) (string, error) {
+	// EvalSymlinks gives up on loops after a fixed number of links.
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("it points outside the sync directory")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", target)
+	}
+	return target, nil
+}
+
+// localPath is where sync reads and writes name: the file a followed link
+// points to, or the name in dir.
+func (s *syncOptions) localPath(dir, name string) string {
+	if target := s.links[name]; target != "" {
+		return longPath(target)
+	}
+	return longPath(filepath.Join(dir, localName(name)))
+}
+
+// skippedLink reports whether name is a symlink sync leaves alone.
+func (s *syncOptions) skippedLink(name string) bool {
+	target, ok := s.links[name]
+	return ok && target == ""
+}
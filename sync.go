@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type syncOptions struct {
+	checksum      bool
+	sizeOnly      bool
+	dryRun        bool
+	bidirectional bool
+	conflict      string
+	symlinks      string
+	hardlink      bool
+
+	// links maps the symlinks in the sync directory to the files they are
+	// followed to, or to "" for links left alone.
+	links map[string]string
+}
+
+// Policies for files changed on both sides of a bidirectional sync.
+const (
+	conflictFail     = "fail"
+	conflictNewest   = "newest"
+	conflictLocal    = "local"
+	conflictRemote   = "remote"
+	conflictKeepBoth = "keep-both"
+)
+
+func (s *syncOptions) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&s.checksum, "checksum", false, "compare files by sha256 instead of size and modification time, like rsync -c")
+	fs.BoolVar(&s.sizeOnly, "size-only", false, "compare files by size alone")
+	fs.BoolVar(&s.dryRun, "n", false, "only report what would be transferred")
+	fs.BoolVar(&s.bidirectional, "bidirectional", false, "also push local changes and deletions to the server, using the last-sync snapshot to tell which side changed")
+	fs.StringVar(&s.symlinks, "symlinks", symlinkSkip, "what to do with symlinks in the sync directory: `policy` skip leaves them alone, follow syncs the file they point to if it is inside the directory")
+	fs.BoolVar(&s.hardlink, "hardlink", false, "hard-link files with identical content to one copy instead of storing each; the links share one modification time, so pair it with -checksum")
+	fs.StringVar(&s.conflict, "conflict", conflictFail, "how -bidirectional handles files changed on both sides: `policy` fail reports them, newest, local or remote picks the winner, keep-both renames the local copy")
+}
+
+// runSync implements the sync subcommand: sync [flags] [tcp://host:port/] dir.
+// It pulls every file in the server's listing that is missing or differs
+// locally, then stamps it with the remote modification time so the next
+// quick comparison sees it as unchanged. With -bidirectional, changes made
+// locally are pushed as well; see twoWay.
+func runSync(opts *options, args []string, logger *leveledLogger) error {
+	var s syncOptions
+	fs := newCommandFlags("sync")
+	s.registerFlags(fs)
+	fs.Parse(args)
+
+	server := &url.URL{Scheme: "tcp", Host: ServerAddress}
+	var dir string
+	switch fs.NArg() {
+	case 1:
+		dir = fs.Arg(0)
+	case 2:
+		u, err := parseTCPURL(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		server, dir = u, fs.Arg(1)
+	default:
+		return errors.New("usage: sync [flags] [tcp://host:port/] dir")
+	}
+	if s.checksum && s.sizeOnly {
+		return errors.New("-checksum and -size-only are mutually exclusive")
+	}
+	switch s.conflict {
+	case conflictFail, conflictNewest, conflictLocal, conflictRemote, conflictKeepBoth:
+	default:
+		return fmt.Errorf("unknown conflict policy %q", s.conflict)
+	}
+	if s.symlinks != symlinkSkip && s.symlinks != symlinkFollow {
+		return fmt.Errorf("unknown symlink policy %q", s.symlinks)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating sync directory: %w", err)
+	}
+	links, err := s.scanLinks(dir, logger)
+	if err != nil {
+		return err
+	}
+	s.links = links
+
+	s.estimate(opts, server.Host, logger)
+	entries, err := opts.list(server.Host, &listFilter{xattrs: opts.preserve.enabled()})
+	if err != nil {
+		return err
+	}
+	defer opts.runReport.write(&opts.budget, logger)
+	defer opts.budget.report(logger)
+	if s.bidirectional {
+		return s.twoWay(opts, server.Host, dir, entries, logger)
+	}
+
+	var index linkIndex
+	failure := &batchFailure{total: len(entries)}
+	for i, entry := range entries {
+		source := &url.URL{Scheme: "tcp", Host: server.Host, Path: "/" + entry.Name}
+		if s.skippedLink(entry.Name) {
+			logger.Infof("skipped symlink %s", entry.Name)
+			continue
+		}
+		result := newTransferResult(source.String(), s.localPath(dir, entry.Name))
+
+		err := validateFilename(entry.Name)
+		if err == nil {
+			var same bool
+			if same, err = s.unchanged(opts, server.Host, entry, result.Destination); err == nil && same {
+				if s.checksum {
+					index.add(entry.SHA256, result.Destination)
+				}
+				continue
+			}
+		}
+		if err == nil && s.dryRun {
+			if !opts.budget.admit(source.String(), entry.Size) {
+				continue
+			}
+			logger.Infof("would download file %s", entry.Name)
+			opts.budget.spend(entry.Size)
+			continue
+		}
+		if err == nil && s.hardlink {
+			// The listing's hash saves fetching a copy at all.
+			var existing string
+			if existing, err = index.link(opts, entry.SHA256, result.Destination, entry.Size); err == nil && existing != "" {
+				logger.Infof("linked file %s to %s", result.Destination, existing)
+				continue
+			}
+		}
+		if err == nil && !opts.budget.admit(source.String(), entry.Size) {
+			continue
+		}
+		if err == nil {
+			err = opts.window.wait(context.Background(), logger, "download "+entry.Name)
+		}
+		if err == nil {
+			err = pullFile(opts, source, entry, result)
+		}
+
+		opts.report(logger, result, err)
+		if result.Status == statusFailed {
+			if failure.failed++; opts.failFast {
+				failure.aborted, failure.skipped = true, len(entries)-i-1
+				break
+			}
+		}
+		if err == nil && s.hardlink {
+			// Without a hash in the listing, duplicates are only found once
+			// they have been downloaded.
+			if existing, err := index.link(opts, result.SHA256, result.Destination, result.Bytes); err != nil {
+				logger.Errorf("%v", err)
+			} else if existing != "" {
+				logger.Infof("linked file %s to %s", result.Destination, existing)
+			}
+			index.add(result.SHA256, result.Destination)
+		}
+	}
+
+	if index.linked > 0 {
+		logger.Infof("hard-linked %d files, saving %s", index.linked, formatBytes(index.saved))
+	}
+	if failure.failed > 0 {
+		return failure
+	}
+	return nil
+}
+
+func pullFile(opts *options, source *url.URL, entry listEntry, result *transferResult) error {
+	result.expectSHA256 = entry.SHA256
+	if err := downloadFile(opts, source, result.Destination, DefaultBufferSize, result); err != nil {
+		return err
+	}
+	if err := os.Chtimes(result.Destination, time.Now(), entry.ModTime); err != nil {
+		return fmt.Errorf("error setting modification time: %w", err)
+	}
+	return opts.applyMetadata(result.Destination, &entry)
+}
+
+// unchanged compares a remote entry with the local file using the selected
+// strategy: size and modification time by default, size alone, or sha256.
+func (s *syncOptions) unchanged(opts *options, address string, entry listEntry, local string) (bool, error) {
+	info, err := os.Stat(local)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking local file: %w", err)
+	}
+	if info.Size() != entry.Size {
+		return false, nil
+	}
+
+	switch {
+	case s.sizeOnly:
+		return true, nil
+	case s.checksum:
+		remote := entry.SHA256
+		if remote == "" {
+			if remote, err = opts.remoteChecksum(address, entry.Name); err != nil {
+				return false, err
+			}
+		}
+		sum, err := fileSHA256(local)
+		if err != nil {
+			return false, err
+		}
+		return strings.EqualFold(sum, remote), nil
+	default:
+		return info.ModTime().Unix() == entry.ModTime.Unix(), nil
+	}
+}
+
+// remoteChecksum asks the server for a file's sha256 with "SUM name"; the
+// reply is the hex digest on one line, or "ERR message".
+func (o *options) remoteChecksum(address, name string) (string, error) {
+	line, err := o.exchange(address, "SUM "+name, nil, true)
+	if err != nil {
+		return "", err
+	}
+	if digest, err := hex.DecodeString(line); err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("invalid checksum reply %q", line)
+	}
+	return line, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading local file: %w", err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("error reading local file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
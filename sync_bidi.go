@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const syncSnapshotName = ".tcp-sync.json"
+
+var errConflict = errors.New("changed on both sides")
+
+// syncState is what sync knows about one side of a file.
+type syncState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// syncSnapshot records the files as they were on both sides at the end of
+// the last bidirectional sync. Comparing each side with it tells a change
+// or deletion on one side from a change on the other, so neither is undone.
+type syncSnapshot struct {
+	Server string               `json:"server"`
+	Files  map[string]syncState `json:"files"`
+}
+
+func loadSyncSnapshot(dir, server string) (*syncSnapshot, error) {
+	snapshot := &syncSnapshot{Server: server, Files: map[string]syncState{}}
+	data, err := os.ReadFile(filepath.Join(dir, syncSnapshotName))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("error parsing sync snapshot: %w", err)
+	}
+	if snapshot.Server != server {
+		return nil, fmt.Errorf("%s was synced with %s; remove %s to sync it with %s", dir, snapshot.Server, syncSnapshotName, server)
+	}
+	if snapshot.Files == nil {
+		snapshot.Files = map[string]syncState{}
+	}
+	return snapshot, nil
+}
+
+func (s *syncSnapshot) save(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sync snapshot: %w", err)
+	}
+	tmp := filepath.Join(dir, syncSnapshotName+partialSuffix)
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing sync snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, syncSnapshotName)); err != nil {
+		return fmt.Errorf("error writing sync snapshot: %w", err)
+	}
+	return nil
+}
+
+// scanLocal lists the regular files a bidirectional sync manages in dir,
+// including those that followed symlinks point to.
+func (s *syncOptions) scanLocal(opts *options, dir string) (map[string]syncState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync directory: %w", err)
+	}
+
+	files := map[string]syncState{}
+	for _, entry := range entries {
+		name := entry.Name()
+		followed := s.links[name] != ""
+		if !entry.Type().IsRegular() && !followed || strings.HasPrefix(name, syncSnapshotName) || strings.HasSuffix(name, partialSuffix) {
+			continue
+		}
+		if validateFilename(name) != nil || !opts.filters.allows(name) {
+			continue
+		}
+		info, err := os.Stat(s.localPath(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading sync directory: %w", err)
+		}
+		files[name] = syncState{Size: info.Size(), ModTime: info.ModTime().UTC().Truncate(time.Second)}
+	}
+	return files, nil
+}
+
+// same compares two states of a file, either of which may be missing, with
+// the selected strategy. Without both hashes, checksum mode falls back to
+// the modification time.
+func (s *syncOptions) same(a, b *syncState) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a.Size != b.Size {
+		return false
+	}
+	switch {
+	case s.sizeOnly:
+		return true
+	case s.checksum && a.SHA256 != "" && b.SHA256 != "":
+		return strings.EqualFold(a.SHA256, b.SHA256)
+	default:
+		return a.ModTime.Unix() == b.ModTime.Unix()
+	}
+}
+
+// twoWay reconciles dir with the server in one pass. A file changed on one
+// side only is copied to the other, and one deleted on one side only is
+// deleted on the other. Files changed differently on both sides are
+// reported as conflicts and left alone.
+func (s *syncOptions) twoWay(opts *options, address, dir string, entries []listEntry, logger *leveledLogger) error {
+	snapshot, err := loadSyncSnapshot(dir, address)
+	if err != nil {
+		return err
+	}
+	local, err := s.scanLocal(opts, dir)
+	if err != nil {
+		return err
+	}
+	remote := map[string]syncState{}
+	for _, entry := range entries {
+		if validateFilename(entry.Name) == nil && !s.skippedLink(entry.Name) {
+			remote[entry.Name] = syncState{Size: entry.Size, ModTime: entry.ModTime, SHA256: entry.SHA256}
+		}
+	}
+	if s.checksum {
+		if err := s.fillHashes(opts, address, dir, local, remote); err != nil {
+			return err
+		}
+	}
+
+	next := &syncSnapshot{Server: address, Files: map[string]syncState{}}
+	names := map[string]bool{}
+	for _, files := range []map[string]syncState{local, remote, snapshot.Files} {
+		for name := range files {
+			if s.skippedLink(name) {
+				// Left alone, so what was last known about it still holds.
+				if last, ok := snapshot.Files[name]; ok {
+					next.Files[name] = last
+				}
+				continue
+			}
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	failure := &batchFailure{total: len(sorted)}
+	for i, name := range sorted {
+		l, r, last := lookupState(local, name), lookupState(remote, name), lookupState(snapshot.Files, name)
+		if !s.syncFile(opts, address, dir, name, l, r, last, next, logger) {
+			if failure.failed++; opts.failFast {
+				// The files not looked at keep their old state, so the
+				// next sync still sees what changed.
+				for _, name := range sorted[i+1:] {
+					if state, ok := snapshot.Files[name]; ok {
+						next.Files[name] = state
+					}
+				}
+				failure.aborted, failure.skipped = true, len(sorted)-i-1
+				break
+			}
+		}
+	}
+
+	if !s.dryRun {
+		if err := next.save(dir); err != nil {
+			return err
+		}
+	}
+	if failure.failed > 0 {
+		return failure
+	}
+	return nil
+}
+
+func lookupState(files map[string]syncState, name string) *syncState {
+	if state, ok := files[name]; ok {
+		return &state
+	}
+	return nil
+}
+
+// syncFile reconciles one file and records its new state in next. It
+// reports false when the file failed or was left in conflict.
+func (s *syncOptions) syncFile(opts *options, address, dir, name string, l, r, last *syncState, next *syncSnapshot, logger *leveledLogger) bool {
+	localChanged, remoteChanged := !s.same(l, last), !s.same(r, last)
+	keep := func(state *syncState) {
+		if state != nil {
+			next.Files[name] = *state
+		}
+	}
+
+	source := &url.URL{Scheme: "tcp", Host: address, Path: "/" + name}
+	result := newTransferResult(source.String(), s.localPath(dir, name))
+
+	var push, keepBoth bool
+	switch {
+	case !localChanged && !remoteChanged, s.same(l, r):
+		// Unchanged, or both sides made the same change.
+		keep(mergeStates(l, r))
+		return true
+	case localChanged && !remoteChanged:
+		push = true
+	case remoteChanged && !localChanged:
+		push = false
+	default:
+		var ok bool
+		if push, ok = s.resolve(l, r); !ok {
+			keep(last)
+			opts.report(logger, result, errConflict)
+			return false
+		}
+		result.Conflict = s.conflict
+		keepBoth = s.conflict == conflictKeepBoth && l != nil && r != nil
+	}
+
+	var action func() error
+	switch {
+	case keepBoth:
+		copyName := conflictCopyName(name, time.Now())
+		action = func() error {
+			if err := opts.keepConflictCopy(address, dir, name, copyName); err != nil {
+				return err
+			}
+			next.Files[copyName] = *l
+			logger.Infof("kept local copy of %s as %s", name, copyName)
+			return pullFile(opts, source, r.entry(name), result)
+		}
+	case push && l == nil:
+		result.Action = actionDeleteRemote
+		action = func() error { return opts.removeFile(address, name) }
+	case push:
+		result.Action = actionUpload
+		action = func() error {
+			result.Bytes = l.Size
+			return opts.putFile(address, name, result.Destination)
+		}
+	case r == nil:
+		result.Action = actionDeleteLocal
+		action = func() error { return os.Remove(result.Destination) }
+	default:
+		action = func() error { return pullFile(opts, source, r.entry(name), result) }
+	}
+
+	if result.Action == "" && !opts.budget.admit(source.String(), r.Size) {
+		// Left as it was, so that the next sync still pulls it.
+		keep(last)
+		return true
+	}
+	if s.dryRun {
+		if result.Action == "" {
+			opts.budget.spend(r.Size)
+		}
+		if result.Conflict != "" {
+			logger.Infof("would resolve conflict on file %s (%s)", name, result.Conflict)
+		}
+		logger.Infof("would %s file %s", result.verb(), name)
+		return true
+	}
+	err := opts.window.wait(context.Background(), logger, result.verb()+" "+name)
+	if err == nil {
+		err = action()
+	}
+	if err != nil {
+		keep(last)
+		opts.report(logger, result, err)
+		return result.Status != statusFailed
+	}
+
+	if result.Conflict != "" {
+		logger.Infof("resolved conflict on file %s (%s)", name, result.Conflict)
+	}
+	switch result.Action {
+	case actionUpload:
+		keep(l)
+	case "":
+		keep(r)
+	}
+	opts.report(logger, result, nil)
+	return true
+}
+
+func (st *syncState) entry(name string) listEntry {
+	return listEntry{Name: name, Size: st.Size, ModTime: st.ModTime, SHA256: st.SHA256}
+}
+
+// resolve applies the -conflict policy to a file changed on both sides and
+// reports whether the local side wins. A side that deleted the file loses
+// to one that changed it under newest and keep-both, so no data is lost.
+func (s *syncOptions) resolve(l, r *syncState) (push, ok bool) {
+	switch s.conflict {
+	case conflictLocal:
+		return true, true
+	case conflictRemote:
+		return false, true
+	case conflictNewest:
+		if l == nil || r == nil {
+			return r == nil, true
+		}
+		return l.ModTime.After(r.ModTime), true
+	case conflictKeepBoth:
+		return r == nil, true
+	}
+	return false, false
+}
+
+// conflictCopyName names the renamed local copy kept by -conflict keep-both,
+// inserting a timestamp before the extension: report.conflict-20060102T150405.txt.
+func conflictCopyName(name string, now time.Time) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + ".conflict-" + now.UTC().Format("20060102T150405") + ext
+}
+
+// keepConflictCopy moves the local version of name aside as copyName and
+// uploads it, so both versions end up on both sides.
+func (o *options) keepConflictCopy(address, dir, name, copyName string) error {
+	copyPath := filepath.Join(dir, copyName)
+	if err := os.Rename(filepath.Join(dir, name), copyPath); err != nil {
+		return fmt.Errorf("error keeping conflicting copy: %w", err)
+	}
+	return o.putFile(address, copyName, copyPath)
+}
+
+// mergeStates combines the two sides of an unchanged file, keeping whichever
+// hash is known.
+func mergeStates(l, r *syncState) *syncState {
+	if l == nil || r == nil {
+		return nil
+	}
+	merged := *l
+	if merged.SHA256 == "" {
+		merged.SHA256 = r.SHA256
+	}
+	return &merged
+}
+
+// fillHashes computes the digests checksum mode compares: local files are
+// hashed and remote files the listing lacks a hash for are asked with SUM.
+func (s *syncOptions) fillHashes(opts *options, address, dir string, local, remote map[string]syncState) error {
+	for name, state := range local {
+		sum, err := fileSHA256(s.localPath(dir, name))
+		if err != nil {
+			return err
+		}
+		state.SHA256 = sum
+		local[name] = state
+	}
+	for name, state := range remote {
+		if state.SHA256 != "" {
+			continue
+		}
+		sum, err := opts.remoteChecksum(address, name)
+		if err != nil {
+			return err
+		}
+		state.SHA256 = sum
+		remote[name] = state
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type treeFile struct {
+	data  string
+	mtime int64
+}
+
+// fakeTree is a server holding files in memory. It answers LIST, GET, SUM,
+// PUT and RM and records every request.
+type fakeTree struct {
+	*fakeServer
+	mu       sync.Mutex
+	files    map[string]treeFile
+	requests []string
+}
+
+func newFakeTree(t *testing.T, files map[string]treeFile) *fakeTree {
+	tree := &fakeTree{files: files}
+	tree.fakeServer = newFakeServer(t, tree.serve)
+	return tree
+}
+
+func (tree *fakeTree) serve(n int, conn net.Conn, r *bufio.Reader) {
+	line, ok := readRequest(r)
+	if !ok {
+		return
+	}
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	tree.requests = append(tree.requests, line)
+
+	command, name, _ := strings.Cut(line, " ")
+	switch command {
+	case "LIST":
+		var names []string
+		for name := range tree.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := tree.files[name]
+			fmt.Fprintf(conn, "%s\t%d\t%d\t-\n", name, len(f.data), f.mtime)
+		}
+	case "GET":
+		if f, ok := tree.files[name]; ok {
+			conn.Write([]byte(f.data))
+		} else {
+			conn.Write([]byte("ERR no such file\n"))
+		}
+	case "SUM":
+		sum := sha256.Sum256([]byte(tree.files[name].data))
+		conn.Write([]byte(hex.EncodeToString(sum[:]) + "\n"))
+	case "PUT":
+		fields := strings.Fields(name)
+		size, _ := strconv.Atoi(fields[1])
+		mtime, _ := strconv.ParseInt(fields[2], 10, 64)
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		tree.files[fields[0]] = treeFile{string(data), mtime}
+		conn.Write([]byte("OK\n"))
+	case "RM":
+		delete(tree.files, name)
+		conn.Write([]byte("OK\n"))
+	}
+}
+
+// gets returns the names fetched with GET since the last call.
+func (tree *fakeTree) gets() string {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	var names []string
+	for _, request := range tree.requests {
+		if name := strings.TrimPrefix(request, "GET "); name != request {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	tree.requests = nil
+	return strings.Join(names, " ")
+}
+
+func writeLocal(t *testing.T, dir, name, data string, mtime int64) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Unix(mtime, 0), time.Unix(mtime, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncPullsMissingAndChangedFiles(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{
+		"new.txt":     {"new", 1700000000},
+		"same.txt":    {"same", 1700000000},
+		"touched.txt": {"abcd", 1700000500},
+		"grown.txt":   {"grown", 1700000000},
+	})
+	dir := t.TempDir()
+	writeLocal(t, dir, "same.txt", "SAME", 1700000000)
+	writeLocal(t, dir, "touched.txt", "abcd", 1700000000)
+	writeLocal(t, dir, "grown.txt", "grow", 1700000000)
+	opts := newTestOptions(t)
+
+	if err := runSync(opts, []string{"tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree.gets(), "grown.txt new.txt touched.txt"; got != want {
+		t.Errorf("fetched %s, want %s", got, want)
+	}
+	info, err := os.Stat(filepath.Join(dir, "new.txt"))
+	if err != nil || info.ModTime().Unix() != 1700000000 {
+		t.Errorf("new.txt not stamped with the remote time: %v %v", info, err)
+	}
+
+	// The pulled files now compare as unchanged.
+	if err := runSync(opts, []string{"tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.gets(); got != "" {
+		t.Errorf("second sync fetched %s", got)
+	}
+}
+
+func TestSyncComparisonModes(t *testing.T) {
+	for _, test := range []struct {
+		flag string
+		want string
+	}{
+		// Same size, different content and times.
+		{"-size-only", ""},
+		{"-checksum", "a.txt"},
+	} {
+		tree := newFakeTree(t, map[string]treeFile{"a.txt": {"remote", 1700000000}, "b.txt": {"stable", 1700000000}})
+		dir := t.TempDir()
+		writeLocal(t, dir, "a.txt", "local!", 1600000000)
+		writeLocal(t, dir, "b.txt", "stable", 1600000000)
+		opts := newTestOptions(t)
+
+		if err := runSync(opts, []string{test.flag, "tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		if got := tree.gets(); got != test.want {
+			t.Errorf("%s fetched %q, want %q", test.flag, got, test.want)
+		}
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{"a.txt": {"a", 1700000000}})
+	dir := t.TempDir()
+	opts := newTestOptions(t)
+
+	if err := runSync(opts, []string{"-n", "tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.gets(); got != "" {
+		t.Errorf("dry run fetched %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+		t.Error("dry run wrote a.txt")
+	}
+}
+
+func (tree *fakeTree) file(name string) (treeFile, bool) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	f, ok := tree.files[name]
+	return f, ok
+}
+
+// commands returns the requests that transfer or delete files since the
+// last call.
+func (tree *fakeTree) commands() string {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	var commands []string
+	for _, request := range tree.requests {
+		if request != "LIST" && !strings.HasPrefix(request, "DU ") {
+			commands = append(commands, strings.Join(strings.Fields(request)[:2], " "))
+		}
+	}
+	sort.Strings(commands)
+	tree.requests = nil
+	return strings.Join(commands, ", ")
+}
+
+func TestBidirectionalSyncPropagatesBothWays(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{
+		"a.txt": {"a", 1700000000},
+		"b.txt": {"b", 1700000000},
+		"c.txt": {"c", 1700000000},
+	})
+	dir := t.TempDir()
+	opts := newTestOptions(t)
+	sync := func() {
+		t.Helper()
+		if err := runSync(opts, []string{"-bidirectional", "tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sync()
+	if got, want := tree.commands(), "GET a.txt, GET b.txt, GET c.txt"; got != want {
+		t.Fatalf("first sync sent %s, want %s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, syncSnapshotName)); err != nil {
+		t.Fatal(err)
+	}
+
+	writeLocal(t, dir, "a.txt", "edited", 1700000900)
+	os.Remove(filepath.Join(dir, "b.txt"))
+	tree.mu.Lock()
+	delete(tree.files, "c.txt")
+	tree.files["d.txt"] = treeFile{"d", 1700000000}
+	tree.mu.Unlock()
+
+	sync()
+	if got, want := tree.commands(), "GET d.txt, PUT a.txt, RM b.txt"; got != want {
+		t.Errorf("second sync sent %s, want %s", got, want)
+	}
+	if f, _ := tree.file("a.txt"); f.data != "edited" || f.mtime != 1700000900 {
+		t.Errorf("server has a.txt %+v, want the local edit", f)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.txt")); err == nil {
+		t.Error("c.txt deleted on the server is still here")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "d.txt")); string(data) != "d" {
+		t.Errorf("d.txt holds %q", data)
+	}
+
+	sync()
+	if got := tree.commands(); got != "" {
+		t.Errorf("third sync sent %s", got)
+	}
+}
+
+func TestBidirectionalSyncRefusesOtherServersSnapshot(t *testing.T) {
+	tree := newFakeTree(t, map[string]treeFile{})
+	dir := t.TempDir()
+	snapshot := &syncSnapshot{Server: "elsewhere:1234", Files: map[string]syncState{}}
+	if err := snapshot.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions(t)
+	err := runSync(opts, []string{"-bidirectional", "tcp://" + tree.addr() + "/", dir}, opts.log)
+	if err == nil || !strings.Contains(err.Error(), "elsewhere:1234") {
+		t.Errorf("sync returned %v, want the snapshot's server refused", err)
+	}
+}
+
+func TestBidirectionalSyncConflictPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy        string
+		local, remote string
+	}{
+		{conflictFail, "local", "remote!"},
+		{conflictLocal, "local", "local"},
+		{conflictRemote, "remote!", "remote!"},
+		{conflictNewest, "remote!", "remote!"},
+		{conflictKeepBoth, "remote!", "remote!"},
+	} {
+		tree := newFakeTree(t, map[string]treeFile{"a.txt": {"base", 1700000000}})
+		dir := t.TempDir()
+		opts := newTestOptions(t)
+		args := []string{"-bidirectional", "-conflict", test.policy, "tcp://" + tree.addr() + "/", dir}
+		if err := runSync(opts, args, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		writeLocal(t, dir, "a.txt", "local", 1700000300)
+		tree.mu.Lock()
+		tree.files["a.txt"] = treeFile{"remote!", 1700000600}
+		tree.mu.Unlock()
+
+		err := runSync(opts, args, opts.log)
+		if failed := err != nil; failed != (test.policy == conflictFail) {
+			t.Errorf("-conflict %s: sync returned %v", test.policy, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != test.local {
+			t.Errorf("-conflict %s: local a.txt holds %q, want %q", test.policy, data, test.local)
+		}
+		if f, _ := tree.file("a.txt"); f.data != test.remote {
+			t.Errorf("-conflict %s: remote a.txt holds %q, want %q", test.policy, f.data, test.remote)
+		}
+
+		copies, _ := filepath.Glob(filepath.Join(dir, "a.conflict-*.txt"))
+		if test.policy != conflictKeepBoth {
+			if len(copies) != 0 {
+				t.Errorf("-conflict %s: kept copies %v", test.policy, copies)
+			}
+			continue
+		}
+		if len(copies) != 1 {
+			t.Fatalf("-conflict keep-both: local copies %v, want one", copies)
+		}
+		if data, _ := os.ReadFile(copies[0]); string(data) != "local" {
+			t.Errorf("-conflict keep-both: the copy holds %q, want the local version", data)
+		}
+		if f, ok := tree.file(filepath.Base(copies[0])); !ok || f.data != "local" {
+			t.Errorf("-conflict keep-both: the copy wasn't uploaded: %+v", f)
+		}
+	}
+}
+
+func TestConflictCopyName(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	for name, want := range map[string]string{
+		"report.txt":     "report.conflict-20240301T123045.txt",
+		"archive.tar.gz": "archive.tar.conflict-20240301T123045.gz",
+		"Makefile":       "Makefile.conflict-20240301T123045",
+	} {
+		if got := conflictCopyName(name, now); got != want {
+			t.Errorf("conflictCopyName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSyncSymlinkPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy, gets, real string
+	}{
+		{"skip", "", "old"},
+		{"follow", "link.txt", "newer"},
+	} {
+		tree := newFakeTree(t, map[string]treeFile{
+			"link.txt":    {"newer", 1700000500},
+			"outside.txt": {"outside", 1700000500},
+		})
+		dir := t.TempDir()
+		writeLocal(t, dir, "real.txt", "old", 1700000000)
+		elsewhere := t.TempDir()
+		writeLocal(t, elsewhere, "secret.txt", "secret", 1700000000)
+		if err := os.Symlink("real.txt", filepath.Join(dir, "link.txt")); err != nil {
+			t.Skipf("cannot create symlinks: %v", err)
+		}
+		if err := os.Symlink(filepath.Join(elsewhere, "secret.txt"), filepath.Join(dir, "outside.txt")); err != nil {
+			t.Fatal(err)
+		}
+		opts := newTestOptions(t)
+
+		if err := runSync(opts, []string{"-symlinks", test.policy, "tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		if got := tree.gets(); got != test.gets {
+			t.Errorf("-symlinks %s fetched %q, want %q", test.policy, got, test.gets)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "real.txt")); string(data) != test.real {
+			t.Errorf("-symlinks %s left real.txt with %q, want %q", test.policy, data, test.real)
+		}
+		if data, _ := os.ReadFile(filepath.Join(elsewhere, "secret.txt")); string(data) != "secret" {
+			t.Errorf("-symlinks %s wrote %q outside the sync directory", test.policy, data)
+		}
+		for _, name := range []string{"link.txt", "outside.txt"} {
+			if info, err := os.Lstat(filepath.Join(dir, name)); err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("-symlinks %s replaced the symlink %s", test.policy, name)
+			}
+		}
+	}
+
+	opts := newTestOptions(t)
+	if err := runSync(opts, []string{"-symlinks", "copy", "tcp://127.0.0.1:1/", t.TempDir()}, opts.log); err == nil {
+		t.Error("-symlinks copy accepted")
+	}
+}
+
+func TestSyncHardlinksIdenticalFiles(t *testing.T) {
+	for _, hardlink := range []bool{false, true} {
+		tree := newFakeTree(t, map[string]treeFile{
+			"a.txt": {"same", 1700000000},
+			"b.txt": {"same", 1700000000},
+			"c.txt": {"different", 1700000000},
+		})
+		dir := t.TempDir()
+		opts := newTestOptions(t)
+
+		if err := runSync(opts, []string{"-hardlink=" + strconv.FormatBool(hardlink), "tcp://" + tree.addr() + "/", dir}, opts.log); err != nil {
+			t.Fatal(err)
+		}
+		stat := func(name string) os.FileInfo {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return info
+		}
+		if linked := os.SameFile(stat("a.txt"), stat("b.txt")); linked != hardlink {
+			t.Errorf("-hardlink=%t: a.txt and b.txt linked %t", hardlink, linked)
+		}
+		if os.SameFile(stat("a.txt"), stat("c.txt")) {
+			t.Errorf("-hardlink=%t: linked files with different content", hardlink)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "b.txt")); string(data) != "same" {
+			t.Errorf("-hardlink=%t: b.txt has %q", hardlink, data)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "b.txt"+partialSuffix)); err == nil {
+			t.Errorf("-hardlink=%t: left a partial file behind", hardlink)
+		}
+	}
+}
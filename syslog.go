@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[logLevel]int{
+	levelDebug: 7,
+	levelInfo:  6,
+	levelWarn:  4,
+	levelError: 3,
+}
+
+type syslogOptions struct {
+	address  string
+	facility string
+	tag      string
+}
+
+func (s *syslogOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.address, "syslog", "", "also send the log to syslog at this `address`: local, udp://host:port or tcp://host:port")
+	fs.StringVar(&s.facility, "syslog-facility", "user", "syslog `facility`, such as daemon or local0")
+	fs.StringVar(&s.tag, "syslog-tag", "tcp-file-client", "syslog app name `tag`")
+}
+
+func (s *syslogOptions) attach(logger *leveledLogger) error {
+	if s.address == "" {
+		return nil
+	}
+	sink, err := newSyslogSink(s.address, s.facility, s.tag)
+	if err != nil {
+		return err
+	}
+	logger.sinks = append(logger.sinks, sink)
+	return nil
+}
+
+// syslogSink sends log messages to a syslog server as RFC 5424 messages.
+// The address is "local" for the machine's own syslog socket, or a
+// udp://host:port or tcp://host:port URL; over TCP, messages are framed
+// with octet counting (RFC 6587).
+type syslogSink struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(address, facility, tag string) (*syslogSink, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	s := &syslogSink{facility: code, tag: tag, hostname: "-"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		s.hostname = hostname
+	}
+
+	if address == "local" {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				s.network, s.address = "unixgram", path
+				break
+			}
+		}
+		if s.network == "" {
+			return nil, fmt.Errorf("no local syslog socket found")
+		}
+	} else {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: use local, udp://host:port or tcp://host:port", address)
+		}
+		s.network, s.address = u.Scheme, hostWithDefaultPort(u, 514)
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, ConnectionTimeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to syslog: %w", err)
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *syslogSink) write(level logLevel, message string, fields map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := s.format(level, message, time.Now())
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		// The server may have restarted; try a fresh connection once.
+		s.conn.Close()
+		s.conn = nil
+		if err := s.connect(); err != nil {
+			return err
+		}
+		_, err = s.conn.Write([]byte(msg))
+		return err
+	}
+	return nil
+}
+
+// format builds an RFC 5424 message without structured data.
+func (s *syslogSink) format(level logLevel, message string, now time.Time) string {
+	priority := s.facility*8 + syslogSeverities[level]
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, now.UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, s.tag, os.Getpid(), message)
+}
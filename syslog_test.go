@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	s := &syslogSink{facility: syslogFacilities["local3"], tag: "tfc", hostname: "host"}
+	now := time.Date(2026, 3, 4, 5, 6, 7, 890000000, time.FixedZone("", 3600))
+	got := s.format(levelWarn, "disk almost full", now)
+	want := fmt.Sprintf("<156>1 2026-03-04T04:06:07.890000Z host tfc %d - - disk almost full", os.Getpid())
+	if got != want {
+		t.Errorf("formatted %q, want %q", got, want)
+	}
+}
+
+func TestSyslogOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	opts := newTestOptions(t, "-syslog", "udp://"+conn.LocalAddr().String(), "-syslog-facility", "daemon")
+	logger := &leveledLogger{out: log.New(io.Discard, "", 0), level: levelInfo}
+	if err := opts.syslog.attach(logger); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debugf("not sent")
+	logger.Errorf("transfer of %s failed", "a.txt")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<27>1 ") || !strings.HasSuffix(msg, " tcp-file-client "+fmt.Sprint(os.Getpid())+" - - transfer of a.txt failed") {
+		t.Errorf("syslog got %q", msg)
+	}
+}
+
+func TestSyslogOverTCPFramesMessages(t *testing.T) {
+	lines := make(chan string, 2)
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		for i := 0; i < 2; i++ {
+			var size int
+			if _, err := fmt.Fscanf(r, "%d ", &size); err != nil {
+				return
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			lines <- string(msg)
+		}
+	})
+	sink, err := newSyslogSink("tcp://"+server.addr(), "user", "tfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.conn.Close()
+	for _, message := range []string{"one", "two and more"} {
+		if err := sink.write(levelInfo, message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"one", "two and more"} {
+		if msg := <-lines; !strings.HasPrefix(msg, "<14>1 ") || !strings.HasSuffix(msg, " - - "+want) {
+			t.Errorf("syslog got %q, want message %q", msg, want)
+		}
+	}
+}
+
+func TestSyslogRejectsBadOptions(t *testing.T) {
+	for _, test := range []struct{ address, facility string }{
+		{"udp://127.0.0.1:514", "printer"},
+		{"http://127.0.0.1:514", "user"},
+		{"tcp://", "user"},
+	} {
+		if _, err := newSyslogSink(test.address, test.facility, "tfc"); err == nil {
+			t.Errorf("accepted -syslog %s -syslog-facility %s", test.address, test.facility)
+		}
+	}
+}
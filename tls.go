@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const pinPrefix = "sha256//"
+
+var errPinMismatch = errors.New("server certificate does not match any pinned key")
+
+type tlsOptions struct {
+	forced     bool
+	caCert     string
+	caPath     string
+	serverName string
+	pins       [][]byte
+
+	sessionCacheSize int
+
+	once         sync.Once
+	sessionCache tls.ClientSessionCache
+	roots        *x509.CertPool
+	rootsErr     error
+}
+
+func (t *tlsOptions) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&t.forced, "tls", false, "connect to the server over TLS")
+	fs.StringVar(&t.caCert, "cacert", "", "verify the server against the CA certificates in this PEM `file` (implies -tls)")
+	fs.StringVar(&t.caPath, "capath", "", "verify the server against the CA certificates in this `directory` (implies -tls)")
+	fs.StringVar(&t.serverName, "tls-server-name", "", "verify the server certificate against this `name` instead of the dialed host (implies -tls)")
+	fs.Func("pin", "pin the server's public key or certificate as sha256//`base64`; separate several with ';' (implies -tls, and skips CA verification unless -cacert or -capath is set)", t.addPins)
+	fs.IntVar(&t.sessionCacheSize, "tls-session-cache", 64, "number of TLS sessions kept for resumption across connections in one run; 0 disables resumption")
+}
+
+func (t *tlsOptions) addPins(value string) error {
+	for _, pin := range strings.Split(value, ";") {
+		pin = strings.TrimSpace(pin)
+		if !strings.HasPrefix(pin, pinPrefix) {
+			return fmt.Errorf("pin %q must start with %s", pin, pinPrefix)
+		}
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("pin %q is not a base64 sha256 digest", pin)
+		}
+		t.pins = append(t.pins, digest)
+	}
+	return nil
+}
+
+func (t *tlsOptions) enabled() bool {
+	return t.forced || t.caCert != "" || t.caPath != "" || t.serverName != "" || len(t.pins) > 0
+}
+
+// setup loads the CA pool and creates the session cache once per run, so the
+// many short connections of a batch share both instead of paying for them
+// on every dial.
+func (t *tlsOptions) setup() error {
+	t.once.Do(func() {
+		if t.sessionCacheSize > 0 {
+			t.sessionCache = tls.NewLRUClientSessionCache(t.sessionCacheSize)
+		}
+		if t.caCert != "" || t.caPath != "" {
+			t.roots, t.rootsErr = t.rootCAs()
+		}
+	})
+	return t.rootsErr
+}
+
+func (t *tlsOptions) config(address string) (*tls.Config, error) {
+	if err := t.setup(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            t.roots,
+		ClientSessionCache: t.sessionCache,
+	}
+
+	config.ServerName = t.serverName
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server address: %w", err)
+		}
+		config.ServerName = host
+	}
+
+	if len(t.pins) > 0 {
+		// With only pins configured the pin is the trust anchor, which lets
+		// devices with self-signed certificates be reached safely.
+		config.InsecureSkipVerify = config.RootCAs == nil
+		config.VerifyConnection = t.verifyPin
+	}
+
+	return config, nil
+}
+
+// client runs the TLS handshake for address over an established connection,
+// closing it if the handshake fails.
+func (t *tlsOptions) client(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	config, err := t.config(address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error during tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// verifyPin accepts the connection when the leaf certificate's public key
+// (SubjectPublicKeyInfo) or the whole certificate hashes to a pinned value.
+func (t *tlsOptions) verifyPin(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errPinMismatch
+	}
+	leaf := state.PeerCertificates[0]
+
+	keyDigest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	certDigest := sha256.Sum256(leaf.Raw)
+	for _, pin := range t.pins {
+		if subtle.ConstantTimeCompare(pin, keyDigest[:]) == 1 || subtle.ConstantTimeCompare(pin, certDigest[:]) == 1 {
+			return nil
+		}
+	}
+	return errPinMismatch
+}
+
+// rootCAs loads the CA bundle and every PEM file in the CA directory. Like
+// curl, supplying either replaces the system roots rather than adding to them.
+func (t *tlsOptions) rootCAs() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	if t.caCert != "" {
+		data, err := os.ReadFile(t.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca certificate: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", t.caCert)
+		}
+	}
+
+	if t.caPath != "" {
+		entries, err := os.ReadDir(t.caPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca directory: %w", err)
+		}
+
+		found := false
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(t.caPath, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("error reading ca certificate: %w", err)
+			}
+			if pool.AppendCertsFromPEM(data) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no certificates found in %s", t.caPath)
+		}
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA and a certificate it issued for files.test.
+type testPKI struct {
+	caPEM []byte
+	cert  tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "files.test"},
+		DNSNames:     []string{"files.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPKI{
+		caPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		cert:  tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: key},
+	}
+}
+
+// newTLSServer answers every connection with "hello" over TLS.
+func newTLSServer(t *testing.T, pki *testPKI) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pki.cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialTLS connects to address with opts' TLS settings and reads the greeting.
+func dialTLS(t *testing.T, opts *options, address string) (tls.ConnectionState, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := opts.tls.client(context.Background(), conn, address)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer tlsConn.Close()
+	if data, err := io.ReadAll(tlsConn); err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	return tlsConn.(*tls.Conn).ConnectionState(), nil
+}
+
+func TestTLSCACertAndServerName(t *testing.T) {
+	pki := newTestPKI(t)
+	address := newTLSServer(t, pki)
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(bundle, pki.caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	caDir := filepath.Join(dir, "certs")
+	if err := os.Mkdir(caDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(caDir, "test.pem"), pki.caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-cacert", bundle, "-tls-server-name", "files.test"}, true},
+		{[]string{"-capath", caDir, "-tls-server-name", "files.test"}, true},
+		// The certificate isn't for 127.0.0.1, the dialed host.
+		{[]string{"-cacert", bundle}, false},
+		{[]string{"-cacert", bundle, "-tls-server-name", "other.test"}, false},
+		// Nor is the test CA among the system roots.
+		{[]string{"-tls", "-tls-server-name", "files.test"}, false},
+	} {
+		opts := newTestOptions(t, test.args...)
+		if !opts.tls.enabled() {
+			t.Errorf("%v doesn't enable TLS", test.args)
+		}
+		if _, err := dialTLS(t, opts, address); (err == nil) != test.ok {
+			t.Errorf("%v: %v, want success %v", test.args, err, test.ok)
+		}
+	}
+}
+
+func TestTLSPinning(t *testing.T) {
+	pki := newTestPKI(t)
+	address := newTLSServer(t, pki)
+	leaf, err := x509.ParseCertificate(pki.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	certPin := sha256.Sum256(leaf.Raw)
+	other := sha256.Sum256([]byte("another key"))
+	pin := func(digest [sha256.Size]byte) string {
+		return pinPrefix + base64.StdEncoding.EncodeToString(digest[:])
+	}
+
+	for _, test := range []struct {
+		pins string
+		ok   bool
+	}{
+		// A pin alone stands in for the CA the self-signed chain lacks.
+		{pin(keyPin), true},
+		{pin(certPin), true},
+		{pin(other) + ";" + pin(keyPin), true},
+		{pin(other), false},
+	} {
+		if _, err := dialTLS(t, newTestOptions(t, "-pin", test.pins), address); (err == nil) != test.ok {
+			t.Errorf("-pin %s: %v, want success %v", test.pins, err, test.ok)
+		} else if err != nil && !errors.Is(err, errPinMismatch) {
+			t.Errorf("-pin %s: %v, want %v", test.pins, err, errPinMismatch)
+		}
+	}
+
+	var tlsOpts tlsOptions
+	for _, bad := range []string{"sha1//" + base64.StdEncoding.EncodeToString(keyPin[:]), pinPrefix + "not base64!", pinPrefix + base64.StdEncoding.EncodeToString(keyPin[:8])} {
+		if err := tlsOpts.addPins(bad); err == nil {
+			t.Errorf("accepted the pin %q", bad)
+		}
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	pki := newTestPKI(t)
+	address := newTLSServer(t, pki)
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(bundle, pki.caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		cacheSize string
+		resumed   bool
+	}{
+		{"64", true},
+		{"0", false},
+	} {
+		opts := newTestOptions(t, "-cacert", bundle, "-tls-server-name", "files.test", "-tls-session-cache", test.cacheSize)
+		for i := 0; i < 3; i++ {
+			state, err := dialTLS(t, opts, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := i > 0 && test.resumed; state.DidResume != want {
+				t.Errorf("cache of %s, connection %d: resumed %v, want %v", test.cacheSize, i, state.DidResume, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var (
+	umaskOnce sync.Once
+	umask     os.FileMode
+)
+
+// processUmask reads the umask, which can only be done by setting it, once
+// and before any transfer could create a file while it is changed.
+func processUmask() os.FileMode {
+	umaskOnce.Do(func() {
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		umask = os.FileMode(mask)
+	})
+	return umask
+}
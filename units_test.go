@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"512":   512,
+		"4k":    4 << 10,
+		"1.5M":  3 << 19,
+		"1G":    1 << 30,
+		"2GiB":  2 << 30,
+		"1TB":   1 << 40,
+		" 10 K": 10 << 10,
+	} {
+		if got, err := parseByteSize(value); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "-1", "lots", "1X"} {
+		if _, err := parseByteSize(value); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// timeWindows are the -window flag, or a daemon job's window: the times of
+// day, in local time, when transfers may run, such as 01:00-05:00 for a
+// link billed heavily for daytime traffic. Several are separated by
+// commas, and one that ends before it starts, like 22:00-06:00, runs past
+// midnight. Outside them no transfer starts, and transfers under way pause
+// until the next window opens; a server that drops the paused connection
+// meanwhile is reconnected to as usual, if -reconnect allows.
+type timeWindows []timeWindow
+
+// timeWindow runs from start up to end, in minutes after midnight.
+type timeWindow struct {
+	start, end int
+}
+
+func parseTimeWindows(s string) (timeWindows, error) {
+	var windows timeWindows
+	for _, spec := range strings.Split(s, ",") {
+		window, err := parseTimeWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	spec = strings.TrimSpace(strings.ReplaceAll(spec, "–", "-"))
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: want a range such as 01:00-05:00", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %w", spec, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %w", spec, err)
+	}
+	if start == end {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: it is empty", spec)
+	}
+	return timeWindow{start, end}, nil
+}
+
+func (w timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// parseClock parses a time of day, HH:MM, as minutes after midnight; 24:00
+// is allowed as the end of the day.
+func parseClock(s string) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &hour, &minute); err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time of day %q: want HH:MM", s)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w *timeWindows) String() string {
+	if w == nil {
+		return ""
+	}
+	specs := make([]string, len(*w))
+	for i, window := range *w {
+		specs[i] = window.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (w *timeWindows) Set(s string) error {
+	windows, err := parseTimeWindows(s)
+	if err != nil {
+		return err
+	}
+	*w = windows
+	return nil
+}
+
+// open reports whether t falls in one of the windows; with none, every time
+// does.
+func (w timeWindows) open(t time.Time) bool {
+	if len(w) == 0 {
+		return true
+	}
+	for _, window := range w {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return now >= w.start && now < w.end
+	}
+	return now >= w.start || now < w.end
+}
+
+// opens returns when the next window opens after t, or t itself if one is
+// open.
+func (w timeWindows) opens(t time.Time) time.Time {
+	if w.open(t) {
+		return t
+	}
+	var next time.Time
+	for _, window := range w {
+		at := time.Date(t.Year(), t.Month(), t.Day(), window.start/60, window.start%60, 0, 0, t.Location())
+		if !at.After(t) {
+			at = at.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// wait blocks until a window is open, or ctx is done, logging that it waits
+// to do what.
+func (w timeWindows) wait(ctx context.Context, logger *leveledLogger, what string) error {
+	for {
+		now := time.Now()
+		next := w.opens(now)
+		if !next.After(now) {
+			return nil
+		}
+		logger.Infof("outside the transfer window; waiting until %s to %s", next.Format("Mon 15:04"), what)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// windowReader pauses a transfer while its windows are closed.
+type windowReader struct {
+	ctx     context.Context
+	r       io.Reader
+	windows timeWindows
+	log     *leveledLogger
+}
+
+func (w *windowReader) Read(p []byte) (int, error) {
+	if !w.windows.open(time.Now()) {
+		if err := w.windows.wait(w.ctx, w.log, "resume the transfer"); err != nil {
+			return 0, err
+		}
+		w.log.Infof("resuming the transfer")
+	}
+	return w.r.Read(p)
+}
+
+// transferWindows returns the windows a transfer keeps to: its own, for a
+// daemon job that set one, or -window.
+func (o *options) transferWindows(ctx context.Context) timeWindows {
+	if state, ok := ctx.Value(transferKey{}).(*transferState); ok && state.windows != nil {
+		return state.windows
+	}
+	return o.window
+}
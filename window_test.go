@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindows(t *testing.T) {
+	for spec, want := range map[string]string{
+		"01:00-05:00":                "01:00-05:00",
+		"22:00-06:00, 12:30–13:00":   "22:00-06:00,12:30-13:00",
+		"0:00-24:00":                 "00:00-24:00",
+		" 9:05 - 17:45 ,18:00-19:00": "09:05-17:45,18:00-19:00",
+	} {
+		windows, err := parseTimeWindows(spec)
+		if err != nil || windows.String() != want {
+			t.Errorf("%q: %s, %v; want %s", spec, windows.String(), err, want)
+		}
+	}
+	for spec, want := range map[string]string{
+		"01:00":             "want a range",
+		"01:00-":            "want HH:MM",
+		"25:00-01:00":       "invalid time of day",
+		"24:30-01:00":       "invalid time of day",
+		"01:60-02:00":       "invalid time of day",
+		"03:00-03:00":       "it is empty",
+		"01:00-02:00,later": "want a range",
+	} {
+		if _, err := parseTimeWindows(spec); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: %v, want %s", spec, err, want)
+		}
+	}
+}
+
+func TestTimeWindowsOpen(t *testing.T) {
+	windows, err := parseTimeWindows("22:00-06:00,12:00-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d, hour, minute int) time.Time { return time.Date(2026, 5, d, hour, minute, 0, 0, time.Local) }
+	for _, test := range []struct {
+		now, opens time.Time
+	}{
+		{day(4, 23, 30), day(4, 23, 30)},
+		{day(4, 5, 59), day(4, 5, 59)},
+		{day(4, 6, 0), day(4, 12, 0)},
+		{day(4, 13, 0), day(4, 22, 0)},
+		{day(4, 22, 0), day(4, 22, 0)},
+	} {
+		if got := windows.opens(test.now); !got.Equal(test.opens) || windows.open(test.now) != test.now.Equal(test.opens) {
+			t.Errorf("at %s: opens %s, want %s", test.now.Format("15:04"), got.Format("Jan 2 15:04"), test.opens.Format("Jan 2 15:04"))
+		}
+	}
+	morning := timeWindows{{60, 120}}
+	if got, want := morning.opens(day(4, 3, 0)), day(5, 1, 0); !got.Equal(want) {
+		t.Errorf("a window passed for the day opens %s, want %s", got, want)
+	}
+	if now := time.Now(); !timeWindows(nil).open(now) || !timeWindows(nil).opens(now).Equal(now) {
+		t.Error("no windows is not always open")
+	}
+}
+
+// windowFrom returns a window from minutes after now to minutes after that
+// again, wrapping past midnight as needed.
+func windowFrom(from, length int) timeWindows {
+	now := time.Now()
+	start := (now.Hour()*60 + now.Minute() + from + 24*60) % (24 * 60)
+	return timeWindows{{start, (start + length) % (24 * 60)}}
+}
+
+func TestWindowReaderWaitsForWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &windowReader{ctx: ctx, r: strings.NewReader("data"), windows: windowFrom(60, 60), log: newTestOptions(t).log}
+	if n, err := r.Read(make([]byte, 4)); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("read %d bytes, %v, with the window closed", n, err)
+	}
+	r.windows = windowFrom(-60, 120)
+	if n, err := r.Read(make([]byte, 4)); n != 4 || err != nil {
+		t.Errorf("read %d bytes, %v, with the window open", n, err)
+	}
+}
+
+func TestDaemonDefersJobsOutsideWindow(t *testing.T) {
+	var log eventLog
+	server := newLoggingFileServer(t, &log, "server")
+	d := newTestDaemon(t, 0)
+	d.opts.window = windowFrom(-60, 120)
+	startWorker(t, d)
+
+	later := windowFrom(60, 60)
+	closed, err := d.submit("tcp://"+server.addr()+"/later.txt", filepath.Join(d.root, "later.txt"), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed.Window != later.String() {
+		t.Errorf("job window %q", closed.Window)
+	}
+	// A job without a window of its own keeps to -window.
+	if _, err := d.submit("tcp://"+server.addr()+"/now.txt", filepath.Join(d.root, "now.txt"), nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the open job to finish", func() bool { return strings.Join(jobStates(d), " ") == "queued done" })
+	time.Sleep(50 * time.Millisecond)
+	if got, want := log.String(), "server GET now.txt"; got != want {
+		t.Errorf("server saw %s, want %s", got, want)
+	}
+	if _, err := d.cancel(closed.ID); err != nil {
+		t.Errorf("cancelling the deferred job: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxShortPath is the longest path Windows APIs accept without the \\?\
+// prefix once the directory part needs room for an 8.3 file name.
+const maxShortPath = 248
+
+// reservedNames are the DOS device names Windows won't create a file as,
+// with or without an extension, in any case.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isReservedName reports whether Windows treats name as a device. Trailing
+// dots and spaces are ignored there, so "nul. " is one too.
+func isReservedName(name string) bool {
+	base, _, _ := strings.Cut(strings.TrimRight(name, ". "), ".")
+	return reservedNames[strings.ToUpper(base)]
+}
+
+// windowsLocalName saves a file the server calls CON.txt or nul as
+// _CON.txt or _nul instead of writing to the device.
+func windowsLocalName(name string) string {
+	if isReservedName(name) {
+		return "_" + name
+	}
+	return name
+}
+
+// windowsLongPath returns path in the \\?\ form Windows needs for paths of
+// maxShortPath characters or more, which is always absolute and rooted at a
+// drive or, as \\?\UNC\, a share.
+func windowsLongPath(path string) string {
+	if len(path) < maxShortPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+// localName is the name a remote file is saved under in a directory. Only
+// Windows has names that can't be used.
+func localName(name string) string {
+	return name
+}
+
+// longPath prepares a destination path for the file APIs, which only
+// Windows limits in length.
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWindowsLocalName(t *testing.T) {
+	for name, want := range map[string]string{
+		"CON":         "_CON",
+		"con.txt":     "_con.txt",
+		"Nul. ":       "_Nul. ",
+		"com1.tar.gz": "_com1.tar.gz",
+		"LPT9":        "_LPT9",
+		"console.txt": "console.txt",
+		"COM10":       "COM10",
+		"a.nul":       "a.nul",
+		"report.txt":  "report.txt",
+	} {
+		if got := windowsLocalName(name); got != want {
+			t.Errorf("windowsLocalName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestWindowsLongPathLeavesShortPaths(t *testing.T) {
+	for _, path := range []string{`C:\data\a.txt`, `\\?\` + strings.Repeat("a", 300)} {
+		if got := windowsLongPath(path); got != path {
+			t.Errorf("windowsLongPath(%q) = %q", path, got)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+// localName is the name a remote file is saved under in a directory.
+func localName(name string) string {
+	return windowsLocalName(name)
+}
+
+// longPath prepares a destination path for the file APIs.
+func longPath(path string) string {
+	return windowsLongPath(path)
+}
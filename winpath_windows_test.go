@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWindowsLongPath(t *testing.T) {
+	for path, want := range map[string]string{
+		`C:\` + strings.Repeat("a", 300):             `\\?\C:\` + strings.Repeat("a", 300),
+		`\\server\share\` + strings.Repeat("a", 300): `\\?\UNC\server\share\` + strings.Repeat("a", 300),
+	} {
+		if got := windowsLongPath(path); got != want {
+			t.Errorf("windowsLongPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestLongDestinationPaths(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), strings.Repeat("d", 100), strings.Repeat("e", 100))
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	server := newFileServer(t)
+	opts := newTestOptions(t, "-o", filepath.Join(dir, strings.Repeat("f", 100)+".txt"))
+	if _, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(longPath(opts.output)); err != nil || string(data) != "contents of a.txt" {
+		t.Errorf("long path has %q, %v", data, err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	"tcpFileClient/wirepb"
+)
+
+// wireMode is the -wire flag: how control messages are encoded once the
+// handshake is done. Text is the line protocol every server speaks;
+// protobuf is the binary mode described in wirepb/wire.proto, which servers
+// offer with the "proto" capability; auto uses protobuf wherever it is
+// offered.
+//
+// Only connections that handshake can switch: pipelines, ping and, with
+// -wire protobuf, which makes every GET handshake first, single downloads.
+type wireMode string
+
+const (
+	wireAuto     wireMode = "auto"
+	wireText     wireMode = "text"
+	wireProtobuf wireMode = "protobuf"
+)
+
+func (m *wireMode) String() string {
+	if *m == "" {
+		return string(wireAuto)
+	}
+	return string(*m)
+}
+
+func (m *wireMode) Set(s string) error {
+	switch mode := wireMode(s); mode {
+	case wireAuto, wireText, wireProtobuf:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("invalid wire mode %q: want text, protobuf or auto", s)
+}
+
+var errNoProtobuf = errors.New("server does not offer the protobuf wire mode")
+
+// upgradeWire switches a connection that has just been greeted to the
+// protobuf wire mode if the server offers it and -wire allows, updating
+// hello with the server's binary Hello. It fails only with -wire protobuf,
+// or when the switch itself goes wrong.
+func (o *options) upgradeWire(conn net.Conn, r *bufio.Reader, hello *serverHello) error {
+	if o.wire == wireText {
+		return nil
+	}
+	if !hello.supports("proto") {
+		if o.wire == wireProtobuf {
+			return errNoProtobuf
+		}
+		return nil
+	}
+	if _, err := io.WriteString(deadlineWriter{conn}, "PROTO 1\n"); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	if _, err := readReply(r); err != nil {
+		return fmt.Errorf("error switching to the protobuf wire mode: %w", err)
+	}
+	var h wirepb.Hello
+	if err := readWire(r, &h); err != nil {
+		return err
+	}
+	if len(h.Capabilities) > maxCapabilities {
+		return &protocolError{fmt.Sprintf("more than %d capabilities", maxCapabilities), ""}
+	}
+	hello.Version, hello.Capabilities, hello.Wire = h.Version, h.Capabilities, string(wireProtobuf)
+	o.log.Debugf("server %s switched to the protobuf wire mode", conn.RemoteAddr())
+	return nil
+}
+
+func writeWire(w io.Writer, m proto.Message) error {
+	if _, err := protodelim.MarshalTo(w, m); err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	return nil
+}
+
+// readWire reads one length-delimited message of at most maxReplyLength
+// bytes. As with text replies, a connection that drops is a network error
+// and anything malformed a protocol error.
+func readWire(r *bufio.Reader, m proto.Message) error {
+	err := protodelim.UnmarshalOptions{MaxSize: maxReplyLength}.UnmarshalFrom(r, m)
+	if err == nil {
+		return nil
+	}
+	var tooLarge *protodelim.SizeTooLargeError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &tooLarge):
+		return &protocolError{fmt.Sprintf("message of %d bytes, over the %d byte limit", tooLarge.Size, maxReplyLength), ""}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &netErr):
+		return &classifiedError{classNetwork, fmt.Errorf("error reading reply: %w", err)}
+	}
+	return &protocolError{"invalid protobuf message: " + err.Error(), ""}
+}
+
+// readWireReply reads a Reply, returning an Error as a serverError.
+func readWireReply(r *bufio.Reader) (*wirepb.Reply, error) {
+	var reply wirepb.Reply
+	if err := readWire(r, &reply); err != nil {
+		return nil, err
+	}
+	if e := reply.GetError(); e != nil {
+		message := e.Message
+		if message == "" {
+			message = strings.ToLower(strings.ReplaceAll(e.Code.String(), "_", " "))
+		}
+		if e.Code == wirepb.Error_TOKEN_EXPIRED && !strings.HasPrefix(message, "token expired") {
+			// So that tokenExpired recognises it as it does the text reply.
+			message = "token expired: " + message
+		}
+		return nil, &serverError{message}
+	}
+	if reply.Kind == nil {
+		return nil, &protocolError{"empty reply", ""}
+	}
+	return &reply, nil
+}
+
+// requestWireFile is requestFile for a connection in the protobuf wire
+// mode.
+func (o *options) requestWireFile(conn net.Conn, address, filename, id string) error {
+	request := &wirepb.Request{Kind: &wirepb.Request_Get{Get: &wirepb.Get{Name: filename, TransferId: id}}}
+	if o.signRequests {
+		text := "GET " + filename
+		if id != "" {
+			text += " id=" + id
+		}
+		s, err := o.sign(address, text)
+		if err != nil {
+			return err
+		}
+		request.Signature = &wirepb.Signature{Timestamp: s.timestamp, Nonce: s.nonce, Hmac: s.hmac}
+	}
+	return writeWire(deadlineWriter{conn}, request)
+}
+
+// readWireFile reads the FileHeader answering a Get and returns the size
+// of the file that follows it and its digest, if the server sent one.
+func readWireFile(r *bufio.Reader) (int64, []byte, error) {
+	reply, err := readWireReply(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	header := reply.GetFile()
+	if header == nil {
+		return 0, nil, &protocolError{"expected a file header", ""}
+	}
+	if header.Size < 0 {
+		return 0, nil, &protocolError{fmt.Sprintf("invalid size %d", header.Size), ""}
+	}
+	if len(header.Sha256) != 0 && len(header.Sha256) != sha256.Size {
+		return 0, nil, &protocolError{"invalid sha256", ""}
+	}
+	return header.Size, header.Sha256, nil
+}
+
+// openWire fetches a file over its own connection in the protobuf wire
+// mode, for -wire protobuf without a pipeline.
+func (b *tcpBackend) openWire(ctx context.Context, host, filename, id string) (io.ReadCloser, int64, error) {
+	conn, err := b.opts.dialContext(ctx, host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error connecting to server: %w", err)
+	}
+	r := bufio.NewReader(deadlineReader{conn})
+	if _, err := b.opts.handshake(host, conn, r, true); err != nil {
+		conn.Close()
+		if errors.Is(err, errNoHandshake) {
+			err = errNoProtobuf
+		}
+		return nil, 0, err
+	}
+	if err := b.opts.requestWireFile(conn, host, filename, id); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	b.opts.transferLog(ctx).Debugf("sent GET %s to %s", filename, host)
+	size, digest, err := readWireFile(r)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return &connBody{Reader: newDigestReader(r, size, digest), Closer: conn}, size, nil
+}
+
+// connBody is a response read through a buffered reader over the
+// connection it closes.
+type connBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	"tcpFileClient/wirepb"
+)
+
+func delimited(messages ...proto.Message) []byte {
+	var b bytes.Buffer
+	for _, m := range messages {
+		protodelim.MarshalTo(&b, m)
+	}
+	return b.Bytes()
+}
+
+// FuzzReadWireFile reads the reply to a protobuf Get from whatever a
+// server might send.
+func FuzzReadWireFile(f *testing.F) {
+	digest := sha256.Sum256([]byte("abc"))
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_File{File: &wirepb.FileHeader{Size: 3, Sha256: digest[:]}}}))
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_File{File: &wirepb.FileHeader{Size: -1}}}))
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_File{File: &wirepb.FileHeader{Size: 1, Sha256: []byte{1}}}}))
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_Error{Error: &wirepb.Error{Code: wirepb.Error_TOKEN_EXPIRED}}}))
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_Ok{Ok: &wirepb.Ok{}}}))
+	f.Add(delimited(&wirepb.Reply{}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Add([]byte{0x05, 0x0a})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		size, digest, err := readWireFile(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		if size < 0 {
+			t.Errorf("accepted the size %d", size)
+		}
+		if digest != nil && len(digest) != sha256.Size {
+			t.Errorf("accepted a %d byte digest", len(digest))
+		}
+	})
+}
+
+func FuzzReadWireReply(f *testing.F) {
+	f.Add(delimited(&wirepb.Reply{Kind: &wirepb.Reply_Ok{Ok: &wirepb.Ok{}}}, &wirepb.Reply{Kind: &wirepb.Reply_Error{Error: &wirepb.Error{Message: "no such file"}}}))
+	f.Add(delimited(&wirepb.Hello{Version: "tcp-file-server/1", Capabilities: []string{"proto"}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for i := 0; i <= len(data); i++ {
+			reply, err := readWireReply(r)
+			if err != nil {
+				if _, ok := err.(*serverError); ok {
+					continue
+				}
+				return
+			}
+			if reply.Kind == nil {
+				t.Error("returned an empty reply")
+			}
+		}
+		t.Fatal("readWireReply returned more replies than there were bytes")
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// xattrPrefix marks the optional listing fields that carry a file's
+// extended attributes: after the four usual fields, a server that was asked
+// with "xattrs=1" may add one "xattr.NAME=BASE64" field per attribute. POSIX
+// ACLs travel the same way, as system.posix_acl_access and
+// system.posix_acl_default. Servers that don't know the option ignore it.
+const xattrPrefix = "xattr."
+
+// preserveOptions is the -preserve flag: the comma-separated kinds of
+// metadata copied from the server's listing onto downloaded files.
+type preserveOptions struct {
+	xattrs bool
+	acls   bool
+}
+
+func (p *preserveOptions) String() string {
+	var kinds []string
+	if p.xattrs {
+		kinds = append(kinds, "xattrs")
+	}
+	if p.acls {
+		kinds = append(kinds, "acls")
+	}
+	return strings.Join(kinds, ",")
+}
+
+func (p *preserveOptions) Set(value string) error {
+	*p = preserveOptions{}
+	for _, kind := range strings.Split(value, ",") {
+		switch strings.TrimSpace(kind) {
+		case "xattrs", "xattr":
+			p.xattrs = true
+		case "acls", "acl":
+			p.acls = true
+		case "all":
+			p.xattrs, p.acls = true, true
+		default:
+			return fmt.Errorf("unknown metadata %q: use xattrs, acls or all", kind)
+		}
+	}
+	return nil
+}
+
+func (p *preserveOptions) enabled() bool {
+	return p.xattrs || p.acls
+}
+
+// wants reports whether the attribute name is one -preserve copies.
+func (p *preserveOptions) wants(name string) bool {
+	if strings.HasPrefix(name, "system.posix_acl_") {
+		return p.acls
+	}
+	return p.xattrs
+}
+
+// parseXattrField adds an "xattr.NAME=BASE64" listing field to xattrs and
+// ignores any other field.
+func parseXattrField(field string, xattrs map[string][]byte) error {
+	if !strings.HasPrefix(field, xattrPrefix) {
+		return nil
+	}
+	name, value, ok := strings.Cut(strings.TrimPrefix(field, xattrPrefix), "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid attribute %q", field)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("invalid attribute %q: %w", field, err)
+	}
+	xattrs[name] = data
+	return nil
+}
+
+// applyMetadata copies the attributes -preserve asks for from entry onto the
+// downloaded file at path. Filesystems without extended attributes, and
+// remote destinations, are passed over.
+func (o *options) applyMetadata(path string, entry *listEntry) error {
+	if entry == nil || !o.preserve.enabled() || strings.Contains(path, "://") {
+		return nil
+	}
+	names := make([]string, 0, len(entry.Xattrs))
+	for name := range entry.Xattrs {
+		if o.preserve.wants(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := setXattr(path, name, entry.Xattrs[name])
+		if isXattrUnsupported(err) {
+			o.log.Debugf("not preserving attributes of %s: %v", path, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error setting attribute %s: %w", name, err)
+		}
+	}
+	return nil
+}
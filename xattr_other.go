@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNoXattrs = errors.New("extended attributes are not supported on this platform")
+
+func setXattr(path, name string, value []byte) error {
+	return errNoXattrs
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, errNoXattrs)
+}
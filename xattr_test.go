@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseListEntryXattrs(t *testing.T) {
+	entry, err := parseListEntry("a.txt\t5\t1700000000\t-\txattr.user.comment=aGVsbG8=\txattr.system.posix_acl_access=AgAAAA==\tfuture=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Xattrs["user.comment"]) != "hello" || string(entry.Xattrs["system.posix_acl_access"]) != "\x02\x00\x00\x00" || len(entry.Xattrs) != 2 {
+		t.Errorf("attributes %q", entry.Xattrs)
+	}
+	for _, bad := range []string{"a.txt\t5\t1700000000\t-\txattr.=aGk=", "a.txt\t5\t1700000000\t-\txattr.user.x=not base64", "a.txt\t5\t1700000000\t-\txattr.user.x"} {
+		if _, err := parseListEntry(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestPreserveKinds(t *testing.T) {
+	for value, want := range map[string]preserveOptions{
+		"xattrs":      {xattrs: true},
+		"acl":         {acls: true},
+		"xattrs,acls": {xattrs: true, acls: true},
+		"all":         {xattrs: true, acls: true},
+	} {
+		var p preserveOptions
+		if err := p.Set(value); err != nil || p != want {
+			t.Errorf("-preserve %s gives %+v, %v", value, p, err)
+		}
+	}
+	var p preserveOptions
+	if err := p.Set("owner"); err == nil {
+		t.Error("-preserve owner accepted")
+	}
+
+	p = preserveOptions{xattrs: true}
+	if !p.wants("user.comment") || p.wants("system.posix_acl_access") || p.wants("system.posix_acl_default") {
+		t.Error("-preserve xattrs should copy attributes but not ACLs")
+	}
+	p = preserveOptions{acls: true}
+	if p.wants("user.comment") || !p.wants("system.posix_acl_default") {
+		t.Error("-preserve acls should copy ACLs but not other attributes")
+	}
+}
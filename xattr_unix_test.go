@@ -0,0 +1,46 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPreserveSetsXattrs(t *testing.T) {
+	server := newFakeServer(t, func(n int, conn net.Conn, r *bufio.Reader) {
+		line, ok := readRequest(r)
+		switch {
+		case !ok:
+		case strings.HasPrefix(line, "LIST"):
+			fields := ""
+			if strings.Contains(line, "xattrs=1") {
+				// An ACL that isn't valid, which would fail to apply.
+				fields = "\txattr.user.comment=aGVsbG8=\txattr.system.posix_acl_access=AA=="
+			}
+			fmt.Fprintf(conn, "a.txt\t17\t1700000000\t-%s\n", fields)
+		case strings.HasPrefix(line, "GET "):
+			conn.Write([]byte("contents of a.txt"))
+		}
+	})
+	chdir(t, t.TempDir())
+	opts := newTestOptions(t, "-preserve", "xattrs")
+
+	results, err := runBatch(opts, []string{"tcp://" + server.addr() + "/a.txt"}, nil, opts.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 64)
+	n, err := unix.Getxattr("a.txt", "user.comment", value)
+	if isXattrUnsupported(err) {
+		t.Skipf("no extended attributes here: %v", err)
+	}
+	if err != nil || string(value[:n]) != "hello" {
+		t.Errorf("user.comment is %q, %v; want hello (%s)", value[:n], err, results[0].Error)
+	}
+}